@@ -0,0 +1,183 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const exportPageSize = 500
+
+func exportCommands() cli.Command {
+	c := cli.Command{
+		Name:     "export",
+		Usage:    "export data of the relay",
+		Category: "export commands:",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "fills",
+				Usage:  "export fills joined with orders as csv",
+				Action: exportFills,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config,c",
+						Usage: "config file",
+					},
+					cli.StringFlag{
+						Name:  "owner",
+						Usage: "export fills of the owner, export all fills if it is empty",
+					},
+					cli.StringFlag{
+						Name:  "market",
+						Usage: "export fills of the market, such as LRC-WETH",
+					},
+					cli.StringFlag{
+						Name:  "from",
+						Usage: "start time(inclusive), unix timestamp or 2006-01-02",
+					},
+					cli.StringFlag{
+						Name:  "to",
+						Usage: "end time(inclusive), unix timestamp or 2006-01-02",
+					},
+					cli.StringFlag{
+						Name:  "output,o",
+						Usage: "the csv file, write to stdout if it is empty",
+					},
+				},
+			},
+		},
+	}
+	return c
+}
+
+func exportFills(ctx *cli.Context) {
+	owner := ctx.String("owner")
+	if "" != owner && !common.IsHexAddress(owner) {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("owner must be an address"))
+	}
+	from, err := parseTimeFlag(ctx.String("from"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	to, err := parseEndTimeFlag(ctx.String("to"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+
+	globalConfig := utils.SetGlobalConfig(ctx)
+	logger := log.Initialize(globalConfig.Log)
+	defer logger.Sync()
+
+	util.Initialize(globalConfig.Market, globalConfig.Common.ProtocolImpl.Address)
+	rds := dao.NewRdsService(globalConfig.Mysql)
+
+	var writer io.Writer = os.Stdout
+	if output := ctx.String("output"); "" != output {
+		file, err := os.Create(output)
+		if nil != err {
+			utils.ExitWithErr(ctx.App.Writer, err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	query := ordermanager.TradeHistoryQuery{Owner: owner, Market: ctx.String("market"), Start: from, End: to}
+	count, err := writeTradesCsv(writer, rds, query, globalConfig.MarketCap.Currency)
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d fills\n", count)
+}
+
+var tradeCsvHeader = []string{
+	"create_time", "block_number", "tx_hash", "ring_hash", "ring_index", "order_hash", "owner",
+	"market", "side", "token_s", "amount_s", "token_b", "amount_b", "price", "order_price",
+	"fee_token", "fee", "lrc_fee", "split_s", "split_b", "lrc_reward", "legal_value", "currency",
+}
+
+func writeTradesCsv(writer io.Writer, rds dao.RdsService, query ordermanager.TradeHistoryQuery, currency string) (int, error) {
+	w := csv.NewWriter(writer)
+	if err := w.Write(tradeCsvHeader); nil != err {
+		return 0, err
+	}
+
+	count := 0
+	err := ordermanager.ExportTradeHistory(rds, query, exportPageSize, func(trades []ordermanager.Trade) error {
+		for _, t := range trades {
+			record := []string{
+				time.Unix(t.CreateTime, 0).UTC().Format(time.RFC3339), strconv.FormatInt(t.BlockNumber, 10), t.TxHash, t.RingHash, strconv.FormatInt(t.RingIndex, 10), t.OrderHash, t.Owner,
+				t.Market, t.Side, t.TokenS, t.AmountS, t.TokenB, t.AmountB, t.Price, t.OrderPrice,
+				t.FeeToken, t.Fee, t.LrcFee, t.SplitS, t.SplitB, t.LrcReward, t.LegalValue, currency,
+			}
+			if err := w.Write(record); nil != err {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if nil != err {
+		return count, err
+	}
+
+	w.Flush()
+	return count, w.Error()
+}
+
+func parseTimeFlag(s string) (int64, error) {
+	t, _, err := parseTimeOrDate(s)
+	return t, err
+}
+
+// parseEndTimeFlag 结束时间包含在范围内，只指定日期时为当天的最后一秒
+func parseEndTimeFlag(s string) (int64, error) {
+	t, isDate, err := parseTimeOrDate(s)
+	if nil != err || !isDate {
+		return t, err
+	}
+	return t + 24*3600 - 1, nil
+}
+
+func parseTimeOrDate(s string) (t int64, isDate bool, err error) {
+	if "" == s {
+		return 0, false, nil
+	}
+	if t, err := strconv.ParseInt(s, 10, 64); nil == err {
+		return t, false, nil
+	}
+	date, err := time.Parse("2006-01-02", s)
+	if nil != err {
+		return 0, false, fmt.Errorf("invalid time %s, it should be unix timestamp or 2006-01-02", s)
+	}
+	return date.Unix(), true, nil
+}
@@ -41,6 +41,8 @@ func main() {
 
 	app.Commands = []cli.Command{
 		accountCommands(),
+		exportCommands(),
+		trendCommands(),
 	}
 
 	sort.Sort(cli.CommandsByName(app.Commands))
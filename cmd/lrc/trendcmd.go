@@ -0,0 +1,110 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/market/util"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func trendCommands() cli.Command {
+	c := cli.Command{
+		Name:     "trends",
+		Usage:    "manage trends and candles of markets",
+		Category: "trend commands:",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "rebuild",
+				Usage:  "recompute trends and candles from fills, existing records in the range are overwritten. Stop the relay before running it, the relay writes the same records without a lock shared with this command",
+				Action: rebuildTrends,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config,c",
+						Usage: "config file",
+					},
+					cli.StringFlag{
+						Name:  "market",
+						Usage: "the market to rebuild, such as LRC-WETH, rebuild all markets if it is empty",
+					},
+					cli.StringFlag{
+						Name:  "from",
+						Usage: "start time(inclusive), unix timestamp or 2006-01-02",
+					},
+					cli.StringFlag{
+						Name:  "to",
+						Usage: "end time(inclusive), unix timestamp or 2006-01-02, default is now",
+					},
+				},
+			},
+		},
+	}
+	return c
+}
+
+func rebuildTrends(ctx *cli.Context) {
+	from, err := parseTimeFlag(ctx.String("from"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	if from <= 0 {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from must be specified"))
+	}
+	to, err := parseEndTimeFlag(ctx.String("to"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	if now := time.Now().Unix(); to <= 0 || to > now {
+		to = now
+	}
+	if from > to {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from must be earlier than to"))
+	}
+
+	globalConfig := utils.SetGlobalConfig(ctx)
+	logger := log.Initialize(globalConfig.Log)
+	defer logger.Sync()
+
+	util.Initialize(globalConfig.Market, globalConfig.Common.ProtocolImpl.Address)
+	rds := dao.NewRdsService(globalConfig.Mysql)
+
+	markets := util.AllMarkets
+	if mkt := strings.ToUpper(ctx.String("market")); "" != mkt {
+		if !util.IsSupportedMarket(mkt) {
+			utils.ExitWithErr(ctx.App.Writer, fmt.Errorf("unsupported market %s", mkt))
+		}
+		markets = []string{mkt}
+	}
+
+	for _, mkt := range markets {
+		if err := market.RebuildTrends(rds, mkt, from, to); nil != err {
+			utils.ExitWithErr(ctx.App.Writer, fmt.Errorf("rebuild trends of %s error:%s", mkt, err.Error()))
+		}
+		fmt.Fprintf(os.Stderr, "rebuilt trends of %s\n", mkt)
+	}
+}
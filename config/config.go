@@ -85,7 +85,38 @@ type GlobalConfig struct {
 }
 
 type JsonrpcOptions struct {
-	Port int
+	BindAddress  string
+	Port         int
+	WsPort       int
+	CorsDomain   []string
+	Vhosts       []string
+	TlsCertFile  string
+	TlsKeyFile   string
+	ReadTimeout  int // seconds
+	WriteTimeout int // seconds
+	RateLimit    RateLimitOptions
+	Depth        DepthOptions
+}
+
+// rate为每秒生成的令牌数，为0时不限制，burst为令牌桶的容量
+type RateLimitOptions struct {
+	Enable          bool
+	IpReadRate      float64
+	IpReadBurst     int
+	IpWriteRate     float64
+	IpWriteBurst    int
+	OwnerWriteRate  float64 // owner只在订单签名校验通过之后计算，只限制提交订单
+	OwnerWriteBurst int
+	OwnerReadRate   float64 // 按照查询参数中的owner限制读请求
+	OwnerReadBurst  int
+}
+
+// 深度按照tick size聚合价格，tick_sizes中未配置的market使用default_tick_size
+type DepthOptions struct {
+	DefaultTickSize string
+	TickSizes       map[string]string
+	MaxOrders       int  // 计算一侧深度时最多读取的订单数量
+	CheckBalance    bool // 按照owner的余额以及授权计算订单可成交的数量
 }
 
 func (c *GlobalConfig) defaultConfig() {
@@ -96,6 +127,8 @@ type OrderManagerOptions struct {
 	CutoffCacheExpireTime int64
 	CutoffCacheCleanTime  int64
 	DustOrderValue        int64
+	ExpireSweepInterval   int64 // 秒，将过期订单的状态更新为ORDER_EXPIRED的时间间隔
+	BookCheckInterval     int64 // 秒，内存中的orderbook与数据库比较的时间间隔
 }
 
 type IpfsOptions struct {
@@ -114,7 +147,9 @@ func (opts IpfsOptions) Url() string {
 }
 
 type AccessorOptions struct {
-	RawUrl string `required:"true"`
+	RawUrl        string  `required:"true"`
+	GasMultiplier float64 //the gas limit of a tx will be gas*GasMultiplier, it will be 1 if it is not set.
+	GasLimitCap   int64   //the max gas limit of a tx, there is no limit if it is 0.
 }
 
 type KeyStoreOptions struct {
@@ -153,10 +188,18 @@ type TimingMatcher struct {
 	MaxCacheRoundsLength int
 }
 
+type GasPriceOptions struct {
+	Strategy   string //node, fixed or percentile, default is node. percent miners use it too, capped by FeePercent.
+	FixedPrice int64  //the gas price used by fixed strategy
+	Blocks     int    //the count of recent blocks used by percentile strategy, default is 20
+	Percentile int    //the percentile of gas prices of txs in recent blocks, must be in (0, 100] when strategy is percentile
+}
+
 type PercentMinerAddress struct {
-	Address    string
-	FeePercent float64 //the gasprice will be calculated by (FeePercent/100)*(legalFee/eth-price)/gaslimit
-	StartFee   float64 //If received reaches StartReceived, it will use feepercent to ensure eth confirm this tx quickly.
+	Address       string
+	FeePercent    float64 //the gasprice is the price of the gas price strategy, but at most (FeePercent/100)*(legalFee/eth-price)/gaslimit
+	StartFee      float64 //If received reaches StartReceived, it will use feepercent to ensure eth confirm this tx quickly.
+	GasPriceLimit int64   //the max gas price
 }
 
 type NormalMinerAddress struct {
@@ -174,10 +217,15 @@ type MinerOptions struct {
 	IfRegistryRingHash    bool
 	NormalMiners          []NormalMinerAddress  //
 	PercentMiners         []PercentMinerAddress //
+	Matcher               string                //timing, event or batch_auction, default is timing
 	TimingMatcher         *TimingMatcher
+	GasPrice              *GasPriceOptions
 	RateRatioCVSThreshold int64
 	MinGasLimit           int64
 	MaxGasLimit           int64
+	MinProfit             float64 //the min legal currency received of a ring after the gas cost, rings that can't reach it will not be submitted.
+	MinProfitRatio        float64 //the min ratio of received to the legal cost of a ring.
+	GasPriceBumpPercent   int64   //the gas price of a pending tx will be raised by this percent when it is sent again, at least 10.
 }
 
 type MarketOptions struct {
@@ -191,10 +239,33 @@ type MarketCapOptions struct {
 }
 
 type GatewayFiltersOptions struct {
+	Filters    []string // 按照顺序执行的filter，未配置时使用base、sign、token、cutoff，base和sign必须配置并且始终最先执行
 	BaseFilter struct {
 		MinLrcFee int64
 		MaxPrice  int64
 	}
+	TokenFilter struct {
+		AllowTokens  []string // token的地址或者symbol，为空时允许所有支持的token
+		DeniedTokens []string
+	}
+	OwnerFilter struct {
+		AllowOwners  []string // 为空时允许所有的地址
+		DeniedOwners []string
+	}
+	MinValueFilter struct {
+		MinValue float64 // tokenS的法币价值，币种与market_cap中的currency一致
+	}
+	TtlFilter struct {
+		MaxTtl          int64 // 秒，0表示不限制
+		MinRemainingTtl int64
+	}
+	OpenOrderFilter struct {
+		MaxOpenOrders int
+	}
+	MarginSplitFilter struct {
+		MinPercentage int
+		MaxPercentage int
+	}
 }
 
 type GateWayOptions struct {
@@ -30,6 +30,8 @@ type PageResult struct {
 	PageIndex int           `json:"pageIndex"`
 	PageSize  int           `json:"pageSize"`
 	Total     int           `json:"total"`
+	// 按照cursor分页时下一页的cursor，为空表示没有更多数据
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 type RdsServiceImpl struct {
@@ -83,8 +85,21 @@ func (s *RdsServiceImpl) Prepare() {
 		}
 	}
 
+	// 唯一索引创建之前需要删除重复的趋势，否则AutoMigrate创建索引失败
+	if err := s.dedupTrends(); err != nil {
+		log.Fatalf("remove duplicate trends error:%s", err.Error())
+	}
+
 	// auto migrate to keep schema update to date
 	// AutoMigrate will ONLY create tables, missing columns and missing indexes,
 	// and WON'T change existing column's type or delete unused columns to protect your data
 	s.db.AutoMigrate(tables...)
+
+	if err := s.checkTrendIndex(); err != nil {
+		log.Fatalf("create trend unique index error:%s", err.Error())
+	}
+
+	if err := s.migrateTrendColumns(); err != nil {
+		log.Errorf("migrate trend columns error:%s", err.Error())
+	}
 }
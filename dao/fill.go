@@ -46,6 +46,7 @@ type FillEvent struct {
 	SplitS        string `gorm:"column:split_s;type:varchar(30)" json:"splitS"`
 	SplitB        string `gorm:"column:split_b;type:varchar(30)" json:"splitB"`
 	Market        string `gorm:"column:market;type:varchar(42)" json:"market"`
+	LegalValue    string `gorm:"column:legal_value;type:varchar(40)" json:"legalValue"` // 成交时amountS的法币价值
 }
 
 // convert chainclient/orderFilledEvent to dao/fill
@@ -102,6 +103,62 @@ func (s *RdsServiceImpl) FillsPageQuery(query map[string]interface{}, pageIndex,
 	return
 }
 
+// FillsPageQueryByTime 与FillsPageQuery相同，增加了create_time的范围，start以及end为0时不限制
+func (s *RdsServiceImpl) FillsPageQueryByTime(query map[string]interface{}, start, end int64, pageIndex, pageSize int) (res PageResult, err error) {
+	fills := make([]FillEvent, 0)
+	res = PageResult{PageIndex: pageIndex, PageSize: pageSize, Data: make([]interface{}, 0)}
+
+	db := s.db.Model(&FillEvent{}).Where(query)
+	if timeQuery := buildTimeQueryString(start, end); timeQuery != "" {
+		db = db.Where(timeQuery)
+	}
+
+	if err = db.Count(&res.Total).Error; err != nil {
+		return res, err
+	}
+	err = db.Order("create_time desc").Order("id desc").Offset((pageIndex - 1) * pageSize).Limit(pageSize).Find(&fills).Error
+	if err != nil {
+		return res, err
+	}
+
+	for _, fill := range fills {
+		res.Data = append(res.Data, fill)
+	}
+	return
+}
+
+// MaxFillID 当前最大的fill id，没有fill时为0
+func (s *RdsServiceImpl) MaxFillID() (int, error) {
+	var ids []int
+	if err := s.db.Model(&FillEvent{}).Order("id desc").Limit(1).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return ids[0], nil
+}
+
+// FillsAfterID 按照id升序返回(afterID, maxID]之间的fill，用于导出时按照id分页，不受新增fill的影响
+func (s *RdsServiceImpl) FillsAfterID(query map[string]interface{}, start, end int64, afterID, maxID, limit int) (fills []FillEvent, err error) {
+	db := s.db.Model(&FillEvent{}).Where(query)
+	if timeQuery := buildTimeQueryString(start, end); timeQuery != "" {
+		db = db.Where(timeQuery)
+	}
+	err = db.Where("id > ? and id <= ?", afterID, maxID).Order("id asc").Limit(limit).Find(&fills).Error
+	return fills, err
+}
+
+// GetFillsByTime market在[start, end]之间的所有fill，按照成交的先后排序
+func (s *RdsServiceImpl) GetFillsByTime(market string, start, end int64) (fills []FillEvent, err error) {
+	err = s.db.Where("market = ?", market).
+		Where("create_time >= ? and create_time <= ?", start, end).
+		Order("create_time asc").
+		Order("id asc").
+		Find(&fills).Error
+	return
+}
+
 func (s *RdsServiceImpl) QueryRecentFills(market, owner string, start int64, end int64) (fills []FillEvent, err error) {
 
 	query := make(map[string]interface{})
@@ -47,15 +47,18 @@ type RdsService interface {
 	GetOrdersForMiner(protocol, tokenS, tokenB string, length int, filterStatus []types.OrderStatus, startBlockNumber, endBlockNumber int64) ([]*Order, error)
 	GetOrdersWithBlockNumberRange(from, to int64) ([]Order, error)
 	GetCutoffOrders(cutoffTime int64) ([]Order, error)
-	SetCutOff(owner common.Address, cutoffTime *big.Int) error
+	SetCutOff(owner common.Address, cutoffTime *big.Int) ([]common.Hash, error)
+	SetExpired(now int64) (int64, error)
 	CheckOrderCutoff(orderhash string, cutoff int64) bool
-	GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]Order, error)
-	OrderPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error)
+	GetOrderBook(protocol, tokenS, tokenB common.Address, offset, length int) ([]Order, error)
+	GetOpenOrders(now int64) ([]Order, error)
+	OrderPageQuery(query map[string]interface{}, options *OrderQueryOptions, pageIndex, pageSize int) (PageResult, error)
 	UpdateBroadcastTimeByHash(hash string, bt int) error
 	UpdateOrderWhileFill(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, splitAmountS, splitAmountB, blockNumber *big.Int) error
 	UpdateOrderWhileCancel(hash common.Hash, status types.OrderStatus, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error
 	GetFrozenAmount(owner common.Address, token common.Address, statusSet []types.OrderStatus) ([]Order, error)
 	GetFrozenLrcFee(owner common.Address, statusSet []types.OrderStatus) ([]Order, error)
+	CountOrdersByOwner(owner common.Address, statusSet []types.OrderStatus) (int, error)
 
 	// block table
 	FindBlockByHash(blockhash common.Hash) (*Block, error)
@@ -69,6 +72,10 @@ type RdsService interface {
 	QueryRecentFills(mkt, owner string, start int64, end int64) (fills []FillEvent, err error)
 	RollBackFill(from, to int64) error
 	FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error)
+	FillsPageQueryByTime(query map[string]interface{}, start, end int64, pageIndex, pageSize int) (res PageResult, err error)
+	MaxFillID() (int, error)
+	FillsAfterID(query map[string]interface{}, start, end int64, afterID, maxID, limit int) (fills []FillEvent, err error)
+	GetFillsByTime(market string, start, end int64) (fills []FillEvent, err error)
 
 	// cancel event table
 	FindCancelEvent(orderhash, txhash common.Hash) (*CancelEvent, error)
@@ -83,6 +90,9 @@ type RdsService interface {
 	// trend table
 	TrendPageQuery(query Trend, pageIndex, pageSize int) (pageResult PageResult, err error)
 	TrendQueryByTime(intervals, market string, start, end int64) (trends []Trend, err error)
+	TrendsByRange(intervals, market string, start, end int64) (trends []Trend, err error)
+	SaveTrend(trend *Trend) error
+	DelTrend(intervals, market string, start int64) error
 
 	// white list
 	GetWhiteList() ([]WhiteList, error)
@@ -96,6 +106,13 @@ type RdsService interface {
 	UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error
 	GetRingForSubmitByHash(ringhash common.Hash) (RingSubmitInfo, error)
 	GetRingHashesByTxHash(txHash common.Hash) ([]common.Hash, error)
+	GetOrderHashesByRingHash(ringhash common.Hash) ([]common.Hash, error)
+	UpdateRingSubmitInfoRegistered(ringhash common.Hash) error
+	UpdateRingSubmitInfoMined(ringhash common.Hash, blockNumber int64) error
+	RollBackRingSubmitInfoMined(from, to int64) error
+	RingSubmitInfoPageQuery(query map[string]interface{}, statusSet []types.RingSubmitStatus, start, end int64, pageIndex, pageSize int) (res PageResult, err error)
+	RingSubmitInfosWithUsedGas(protocol string, start, end int64) ([]RingSubmitInfo, error)
+	GetUnminedRingSubmitInfos(miners []string) ([]RingSubmitInfo, error)
 	RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error)
 
 	// token
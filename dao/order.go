@@ -19,6 +19,8 @@
 package dao
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Loopring/relay/types"
@@ -246,13 +248,52 @@ func (s *RdsServiceImpl) CheckOrderCutoff(orderhash string, cutoff int64) bool {
 	return true
 }
 
-func (s *RdsServiceImpl) SetCutOff(owner common.Address, cutoffTime *big.Int) error {
+// SetCutOff 将owner在cutoff之前的未完成订单更新为ORDER_CUTOFF，返回被更新的订单hash
+func (s *RdsServiceImpl) SetCutOff(owner common.Address, cutoffTime *big.Int) ([]common.Hash, error) {
+	var hashes []string
 	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
-	err := s.db.Model(&Order{}).Where("valid_time < ? and owner = ? and status in (?)", cutoffTime.Int64(), owner.Hex(), filterStatus).Update("status", types.ORDER_CUTOFF).Error
-	return err
+	if err := s.db.Model(&Order{}).Where("valid_time < ? and owner = ? and status in (?)", cutoffTime.Int64(), owner.Hex(), filterStatus).Pluck("order_hash", &hashes).Error; err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	if err := s.db.Model(&Order{}).Where("order_hash in (?) and status in (?)", hashes, filterStatus).Update("status", types.ORDER_CUTOFF).Error; err != nil {
+		return nil, err
+	}
+
+	list := make([]common.Hash, len(hashes))
+	for i, hash := range hashes {
+		list[i] = common.HexToHash(hash)
+	}
+	return list, nil
+}
+
+// SetExpired 将已经过期但未完全成交的订单更新为ORDER_EXPIRED，返回更新的订单数量
+func (s *RdsServiceImpl) SetExpired(now int64) (int64, error) {
+	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
+	db := s.db.Model(&Order{}).Where("valid_time + ttl <= ? and status in (?)", now, filterStatus).Update("status", types.ORDER_EXPIRED)
+	return db.RowsAffected, db.Error
+}
+
+// GetOpenOrders 所有未过期并且未完成的订单，用于初始化内存中的orderbook
+func (s *RdsServiceImpl) GetOpenOrders(now int64) ([]Order, error) {
+	var (
+		list []Order
+		err  error
+	)
+
+	filterStatus := []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL}
+	err = s.db.Where("status in (?)", filterStatus).
+		Where("valid_time + ttl > ? ", now).
+		Order("id asc").
+		Find(&list).Error
+
+	return list, err
 }
 
-func (s *RdsServiceImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]Order, error) {
+// GetOrderBook 按照价格从优到差分页读取可以撮合的订单，offset为已经读取的订单数量
+func (s *RdsServiceImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, offset, length int) ([]Order, error) {
 	var (
 		list []Order
 		err  error
@@ -265,14 +306,83 @@ func (s *RdsServiceImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, l
 		Where("status in (?)", filterStatus).
 		Where("valid_time < ?", nowtime).
 		Where("valid_time + ttl > ? ", nowtime).
-		Order("price desc").
+		Order("price desc, id asc").
+		Offset(offset).
 		Limit(length).
 		Find(&list).Error
 
 	return list, err
 }
 
-func (s *RdsServiceImpl) OrderPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error) {
+// 订单查询支持排序的字段
+const (
+	OrderSortByCreateTime = "create_time"
+	OrderSortByValidTime  = "valid_time"
+	OrderSortByPrice      = "price"
+)
+
+var ErrInvalidOrderCursor = errors.New("dao,invalid order cursor")
+
+// OrderQueryOptions 无法用等值条件表示的查询条件，时间为0表示不限制
+type OrderQueryOptions struct {
+	Statuses       []types.OrderStatus
+	CreateTimeFrom int64
+	CreateTimeTo   int64
+	ValidTimeFrom  int64
+	ValidTimeTo    int64
+	SortBy         string
+	SortAsc        bool
+	// 不为空时按照cursor分页，忽略pageIndex
+	Cursor string
+}
+
+// orderCursor 上一页最后一个订单的排序字段以及id，编码后返回给客户端，
+// 排序字段的值相同时按照id排序，保证分页的结果稳定
+type orderCursor struct {
+	SortBy  string `json:"s"`
+	SortAsc bool   `json:"a"`
+	Value   string `json:"v"`
+	ID      int    `json:"i"`
+}
+
+func (c *orderCursor) encode() string {
+	bs, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func decodeOrderCursor(str string) (*orderCursor, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, ErrInvalidOrderCursor
+	}
+	c := &orderCursor{}
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, ErrInvalidOrderCursor
+	}
+	return c, nil
+}
+
+// orderSortValue cursor中排序字段的值，price是decimal(28,16)，转换为float64会丢失精度，
+// 所以直接读取数据库中的decimal字符串
+func (s *RdsServiceImpl) orderSortValue(o *Order, sortBy string) (string, error) {
+	switch sortBy {
+	case OrderSortByValidTime:
+		return strconv.FormatInt(o.ValidTime, 10), nil
+	case OrderSortByPrice:
+		var prices []string
+		if err := s.db.Model(&Order{}).Where("id = ?", o.ID).Pluck("price", &prices).Error; err != nil {
+			return "", err
+		}
+		if len(prices) == 0 {
+			return "", fmt.Errorf("dao,order %d not found", o.ID)
+		}
+		return prices[0], nil
+	default:
+		return strconv.FormatInt(o.CreateTime, 10), nil
+	}
+}
+
+func (s *RdsServiceImpl) OrderPageQuery(query map[string]interface{}, options *OrderQueryOptions, pageIndex, pageSize int) (PageResult, error) {
 	var (
 		orders     []Order
 		err        error
@@ -288,7 +398,68 @@ func (s *RdsServiceImpl) OrderPageQuery(query map[string]interface{}, pageIndex,
 		pageSize = 20
 	}
 
-	if err = s.db.Where(query).Offset((pageIndex - 1) * pageSize).Order("create_time DESC").Limit(pageSize).Find(&orders).Error; err != nil {
+	if options == nil {
+		options = &OrderQueryOptions{}
+	}
+	sortBy := options.SortBy
+	switch sortBy {
+	case "":
+		sortBy = OrderSortByCreateTime
+	case OrderSortByCreateTime, OrderSortByValidTime, OrderSortByPrice:
+	default:
+		return pageResult, fmt.Errorf("dao,unsupported order sort field %s", sortBy)
+	}
+	direction := "DESC"
+	if options.SortAsc {
+		direction = "ASC"
+	}
+
+	db := s.db.Model(&Order{}).Where(query)
+	if len(options.Statuses) > 0 {
+		db = db.Where("status in (?)", options.Statuses)
+	}
+	if options.CreateTimeFrom > 0 {
+		db = db.Where("create_time >= ?", options.CreateTimeFrom)
+	}
+	if options.CreateTimeTo > 0 {
+		db = db.Where("create_time < ?", options.CreateTimeTo)
+	}
+	if options.ValidTimeFrom > 0 {
+		db = db.Where("valid_time >= ?", options.ValidTimeFrom)
+	}
+	if options.ValidTimeTo > 0 {
+		db = db.Where("valid_time < ?", options.ValidTimeTo)
+	}
+
+	// 只在第一页计算总数，按照cursor分页时total为-1
+	if options.Cursor == "" {
+		if err = db.Count(&pageResult.Total).Error; err != nil {
+			return pageResult, err
+		}
+	} else {
+		pageResult.Total = -1
+	}
+
+	// cursor分页使用上一页最后一条记录作为条件，避免offset过大时扫描大量数据
+	pageDb := db
+	if options.Cursor != "" {
+		cursor, err := decodeOrderCursor(options.Cursor)
+		if err != nil {
+			return pageResult, err
+		}
+		if cursor.SortBy != sortBy || cursor.SortAsc != options.SortAsc {
+			return pageResult, ErrInvalidOrderCursor
+		}
+		op := "<"
+		if options.SortAsc {
+			op = ">"
+		}
+		pageDb = pageDb.Where(fmt.Sprintf("%s %s ? or (%s = ? and id %s ?)", sortBy, op, sortBy, op), cursor.Value, cursor.Value, cursor.ID)
+	} else {
+		pageDb = pageDb.Offset((pageIndex - 1) * pageSize)
+	}
+
+	if err = pageDb.Order(sortBy + " " + direction).Order("id " + direction).Limit(pageSize).Find(&orders).Error; err != nil {
 		return pageResult, err
 	}
 
@@ -296,11 +467,17 @@ func (s *RdsServiceImpl) OrderPageQuery(query map[string]interface{}, pageIndex,
 		data = append(data, v)
 	}
 
-	pageResult = PageResult{data, pageIndex, pageSize, 0}
-
-	err = s.db.Model(&Order{}).Where(query).Count(&pageResult.Total).Error
-	if err != nil {
-		return pageResult, err
+	pageResult.Data = data
+	pageResult.PageIndex = pageIndex
+	pageResult.PageSize = pageSize
+	if len(orders) == pageSize {
+		last := orders[len(orders)-1]
+		value, err := s.orderSortValue(&last, sortBy)
+		if err != nil {
+			return pageResult, err
+		}
+		cursor := &orderCursor{SortBy: sortBy, SortAsc: options.SortAsc, Value: value, ID: last.ID}
+		pageResult.NextCursor = cursor.encode()
 	}
 
 	return pageResult, err
@@ -361,6 +538,21 @@ func (s *RdsServiceImpl) GetFrozenLrcFee(owner common.Address, statusSet []types
 	return list, err
 }
 
+// CountOrdersByOwner 统计owner未过期的订单数量
+func (s *RdsServiceImpl) CountOrdersByOwner(owner common.Address, statusSet []types.OrderStatus) (int, error) {
+	var (
+		count int
+		err   error
+	)
+
+	now := time.Now().Unix()
+	err = s.db.Model(&Order{}).
+		Where("owner = ? and status in "+buildStatusInSet(statusSet), owner.Hex()).
+		Where("valid_time + ttl > ? ", now).
+		Count(&count).Error
+	return count, err
+}
+
 func buildStatusInSet(statusSet []types.OrderStatus) string {
 	if len(statusSet) == 0 {
 		return ""
@@ -0,0 +1,57 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package dao
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestOrderCursorEncodeDecode(t *testing.T) {
+	cursors := []orderCursor{
+		{SortBy: OrderSortByCreateTime, SortAsc: false, Value: "1520000000", ID: 12},
+		{SortBy: OrderSortByValidTime, SortAsc: true, Value: "1520000001", ID: 1},
+		// decimal(28,16)的全部精度都要保留
+		{SortBy: OrderSortByPrice, SortAsc: false, Value: "123456789012.1234567890123456", ID: 99},
+	}
+
+	for _, c := range cursors {
+		decoded, err := decodeOrderCursor(c.encode())
+		if err != nil {
+			t.Fatalf("decode cursor %+v error:%s", c, err.Error())
+		}
+		if *decoded != c {
+			t.Errorf("cursor %+v decoded as %+v", c, *decoded)
+		}
+	}
+}
+
+func TestDecodeOrderCursorInvalid(t *testing.T) {
+	invalids := []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.StdEncoding.EncodeToString([]byte(`{"s":"price"}`)),
+	}
+
+	for _, str := range invalids {
+		if _, err := decodeOrderCursor(str); err != ErrInvalidOrderCursor {
+			t.Errorf("cursor %q should be invalid, err:%v", str, err)
+		}
+	}
+}
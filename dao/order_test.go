@@ -1,3 +1,6 @@
+//go:build integration
+// +build integration
+
 /*
 
   Copyright 2017 Loopring Project Ltd (Loopring Foundation).
@@ -102,3 +105,34 @@ func TestRdsServiceImpl_GetOrdersByHash(t *testing.T) {
 		t.Logf("order owner:%s", v.Owner)
 	}
 }
+
+func TestRdsServiceImpl_OrderPageQuery(t *testing.T) {
+	s := test.LoadConfigAndGenerateDaoService()
+
+	query := map[string]interface{}{"token_s": common.HexToAddress("0x8711ac984e6ce2169a2a6bd83ec15332c366ee4f").Hex()}
+	options := &dao.OrderQueryOptions{
+		Statuses: []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL},
+		SortBy:   dao.OrderSortByPrice,
+	}
+
+	seen := make(map[string]bool)
+	for {
+		res, err := s.OrderPageQuery(query, options, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range res.Data {
+			ord := v.(dao.Order)
+			if seen[ord.OrderHash] {
+				t.Fatalf("order %s returned twice", ord.OrderHash)
+			}
+			seen[ord.OrderHash] = true
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		options.Cursor = res.NextCursor
+	}
+
+	t.Logf("length of orders:%d", len(seen))
+}
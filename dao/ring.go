@@ -22,6 +22,7 @@ import (
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"time"
 )
 
 type Ring struct {
@@ -129,6 +130,25 @@ type RingSubmitInfo struct {
 
 	Miner string `gorm:"column:miner;type:varchar(42)"`
 	Err   string `gorm:"column:err;type:text"`
+
+	// 提交前估计的法币收益以及成本，与实际使用的gas比较
+	Received  string `gorm:"column:received;type:varchar(50)"`
+	LegalCost string `gorm:"column:legal_cost;type:varchar(50)"`
+
+	Status      uint8 `gorm:"column:status;type:tinyint(4)"`
+	BlockNumber int64 `gorm:"column:block_number;type:bigint"` // 环路被打包的区块
+	CreateTime  int64 `gorm:"column:create_time;type:bigint"`
+	UpdateTime  int64 `gorm:"column:update_time;type:bigint"`
+}
+
+// 法币金额保留的小数位数
+const legalPrecision = 8
+
+func getLegalString(v *big.Rat) string {
+	if nil == v {
+		return ""
+	}
+	return v.FloatString(legalPrecision)
 }
 
 func getBigIntString(v *big.Int) string {
@@ -152,6 +172,11 @@ func (info *RingSubmitInfo) ConvertDown(typesInfo *types.RingSubmitInfo) error {
 	info.RegistryUsedGas = getBigIntString(typesInfo.RegistryUsedGas)
 	info.RegistryGasPrice = getBigIntString(typesInfo.RegistryGasPrice)
 	info.Miner = typesInfo.Miner.Hex()
+	info.Received = getLegalString(typesInfo.Received)
+	info.LegalCost = getLegalString(typesInfo.LegalCost)
+	info.Status = uint8(types.RING_SUBMIT_PENDING)
+	info.CreateTime = time.Now().Unix()
+	info.UpdateTime = info.CreateTime
 	return nil
 }
 
@@ -176,6 +201,12 @@ func (info *RingSubmitInfo) ConvertUp(typesInfo *types.RingSubmitInfo) error {
 	typesInfo.SubmitTxHash = common.HexToHash(info.ProtocolTxHash)
 	typesInfo.RegistryTxHash = common.HexToHash(info.RegistryTxHash)
 	typesInfo.Miner = common.HexToAddress(info.Miner)
+	if received, ok := new(big.Rat).SetString(info.Received); ok {
+		typesInfo.Received = received
+	}
+	if legalCost, ok := new(big.Rat).SetString(info.LegalCost); ok {
+		typesInfo.LegalCost = legalCost
+	}
 	return nil
 }
 
@@ -185,7 +216,7 @@ func (s *RdsServiceImpl) UpdateRingSubmitInfoRegistryTxHash(ringhashs []common.H
 		hashes = append(hashes, h.Hex())
 	}
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("ringhash in (?)", hashes)
-	return dbForUpdate.Update("registry_tx_hash", txHash).Error
+	return dbForUpdate.Updates(map[string]interface{}{"registry_tx_hash": txHash, "update_time": time.Now().Unix()}).Error
 }
 
 func (s *RdsServiceImpl) UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error {
@@ -194,12 +225,84 @@ func (s *RdsServiceImpl) UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err
 		hashes = append(hashes, h.Hex())
 	}
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("ringhash in (?) ", hashes)
-	return dbForUpdate.Update("err", err).Error
+	return dbForUpdate.Updates(map[string]interface{}{"err": err, "status": uint8(types.RING_SUBMIT_FAILED), "update_time": time.Now().Unix()}).Error
 }
 
 func (s *RdsServiceImpl) UpdateRingSubmitInfoProtocolTxHash(ringhash common.Hash, txHash string) error {
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("ringhash = ?", ringhash.Hex())
-	return dbForUpdate.Update("protocol_tx_hash", txHash).Error
+	return dbForUpdate.Updates(map[string]interface{}{"protocol_tx_hash": txHash, "status": uint8(types.RING_SUBMIT_SUBMITTED), "update_time": time.Now().Unix()}).Error
+}
+
+// UpdateRingSubmitInfoRegistered 只更新还未提交的环路，避免覆盖之后的状态
+func (s *RdsServiceImpl) UpdateRingSubmitInfoRegistered(ringhash common.Hash) error {
+	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("ringhash = ? and status = ?", ringhash.Hex(), uint8(types.RING_SUBMIT_PENDING))
+	return dbForUpdate.Updates(map[string]interface{}{"status": uint8(types.RING_SUBMIT_REGISTERED), "update_time": time.Now().Unix()}).Error
+}
+
+func (s *RdsServiceImpl) UpdateRingSubmitInfoMined(ringhash common.Hash, blockNumber int64) error {
+	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("ringhash = ?", ringhash.Hex())
+	return dbForUpdate.Updates(map[string]interface{}{"status": uint8(types.RING_SUBMIT_MINED), "block_number": blockNumber, "update_time": time.Now().Unix()}).Error
+}
+
+// RollBackRingSubmitInfoMined 分叉区块中被打包的环路恢复为已提交
+func (s *RdsServiceImpl) RollBackRingSubmitInfoMined(from, to int64) error {
+	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("status = ? and block_number > ? and block_number <= ?", uint8(types.RING_SUBMIT_MINED), from, to)
+	return dbForUpdate.Updates(map[string]interface{}{"status": uint8(types.RING_SUBMIT_SUBMITTED), "block_number": 0, "update_time": time.Now().Unix()}).Error
+}
+
+// RingSubmitInfoPageQuery statusSet为空时不限制状态，start以及end为0时不限制创建时间
+func (s *RdsServiceImpl) RingSubmitInfoPageQuery(query map[string]interface{}, statusSet []types.RingSubmitStatus, start, end int64, pageIndex, pageSize int) (res PageResult, err error) {
+	infos := make([]RingSubmitInfo, 0)
+	res = PageResult{PageIndex: pageIndex, PageSize: pageSize, Data: make([]interface{}, 0)}
+
+	db := s.db.Model(&RingSubmitInfo{}).Where(query)
+	if len(statusSet) > 0 {
+		statuses := make([]uint8, 0, len(statusSet))
+		for _, status := range statusSet {
+			statuses = append(statuses, uint8(status))
+		}
+		db = db.Where("status in (?)", statuses)
+	}
+	if timeQuery := buildTimeQueryString(start, end); timeQuery != "" {
+		db = db.Where(timeQuery)
+	}
+
+	if err = db.Count(&res.Total).Error; err != nil {
+		return res, err
+	}
+	err = db.Order("create_time desc").Order("id desc").Offset((pageIndex - 1) * pageSize).Limit(pageSize).Find(&infos).Error
+	if err != nil {
+		return res, err
+	}
+
+	for _, info := range infos {
+		res.Data = append(res.Data, info)
+	}
+	return
+}
+
+// RingSubmitInfosWithUsedGas 已经获取到submitRing交易实际使用gas的环路，protocol为空时不限制合约
+func (s *RdsServiceImpl) RingSubmitInfosWithUsedGas(protocol string, start, end int64) ([]RingSubmitInfo, error) {
+	infos := make([]RingSubmitInfo, 0)
+	db := s.db.Model(&RingSubmitInfo{}).Where("protocol_used_gas <> '' and protocol_used_gas <> '0'")
+	if protocol != "" {
+		db = db.Where("protocol_address = ?", protocol)
+	}
+	if timeQuery := buildTimeQueryString(start, end); timeQuery != "" {
+		db = db.Where(timeQuery)
+	}
+	err := db.Select("orders_count, protocol_gas, protocol_used_gas").Find(&infos).Error
+	return infos, err
+}
+
+// GetUnminedRingSubmitInfos 已经发送registry或者submitRing交易但还没有被打包的环路，
+// 未注册的环路registry_tx_hash不为空，已提交的环路protocol_tx_hash不为空
+func (s *RdsServiceImpl) GetUnminedRingSubmitInfos(miners []string) ([]RingSubmitInfo, error) {
+	infos := make([]RingSubmitInfo, 0)
+	err := s.db.Model(&RingSubmitInfo{}).Where("miner in (?)", miners).
+		Where("(status = ? and registry_tx_hash <> '') or (status = ? and protocol_tx_hash <> '')", uint8(types.RING_SUBMIT_PENDING), uint8(types.RING_SUBMIT_SUBMITTED)).
+		Order("id").Find(&infos).Error
+	return infos, err
 }
 
 func (s *RdsServiceImpl) GetRingForSubmitByHash(ringhash common.Hash) (ringForSubmit RingSubmitInfo, err error) {
@@ -221,6 +324,20 @@ func (s *RdsServiceImpl) GetRingHashesByTxHash(txHash common.Hash) ([]common.Has
 	return hashes, err
 }
 
+func (s *RdsServiceImpl) GetOrderHashesByRingHash(ringhash common.Hash) ([]common.Hash, error) {
+	var (
+		err       error
+		hashes    []common.Hash
+		hashesStr []string
+	)
+
+	err = s.db.Model(&FilledOrder{}).Where("ringhash = ?", ringhash.Hex()).Pluck("orderhash", &hashesStr).Error
+	for _, h := range hashesStr {
+		hashes = append(hashes, common.HexToHash(h))
+	}
+	return hashes, err
+}
+
 func (s *RdsServiceImpl) UpdateRingSubmitInfoRegistryUsedGas(txHash string, usedGas *big.Int) error {
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("registry_tx_hash = ?", txHash)
 	return dbForUpdate.Update("registry_used_gas", getBigIntString(usedGas)).Error
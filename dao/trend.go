@@ -18,20 +18,67 @@
 
 package dao
 
-// order amountS 上限1e30
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// 价格以及数量为按照token decimals换算后的十进制字符串，避免float损失精度
 type Trend struct {
-	ID         int     `gorm:"column:id;primary_key;"`
-	Market     string  `gorm:"column:market;type:varchar(42);unique_index:market_intervals_start"`
-	Intervals  string  `gorm:"column:intervals;type:varchar(42);unique_index:market_intervals_start"`
-	Vol        float64 `gorm:"column:vol;type:float"`
-	Amount     float64 `gorm:"column:amount;type:float"`
-	CreateTime int64   `gorm:"column:create_time;type:bigint"`
-	Open       float64 `gorm:"column:open;type:float"`
-	Close      float64 `gorm:"column:close;type:float"`
-	High       float64 `gorm:"column:high;type:float"`
-	Low        float64 `gorm:"column:low;type:float"`
-	Start      int64   `gorm:"column:start;type:bigint;unique_index:market_intervals_start"`
-	End        int64   `gorm:"column:end;type:bigint"`
+	ID         int    `gorm:"column:id;primary_key;"`
+	Market     string `gorm:"column:market;type:varchar(42);unique_index:market_intervals_start"`
+	Intervals  string `gorm:"column:intervals;type:varchar(42);unique_index:market_intervals_start"`
+	Vol        string `gorm:"column:vol;type:varchar(64)"`
+	Amount     string `gorm:"column:amount;type:varchar(64)"`
+	CreateTime int64  `gorm:"column:create_time;type:bigint"`
+	Open       string `gorm:"column:open;type:varchar(64)"`
+	Close      string `gorm:"column:close;type:varchar(64)"`
+	High       string `gorm:"column:high;type:varchar(64)"`
+	Low        string `gorm:"column:low;type:varchar(64)"`
+	Start      int64  `gorm:"column:start;type:bigint;unique_index:market_intervals_start"`
+	End        int64  `gorm:"column:end;type:bigint"`
+}
+
+const trendUniqueIndex = "market_intervals_start"
+
+// dedupTrends 早期版本没有唯一索引，同一个market、intervals以及start可能有多条记录，只保留id最大的一条
+func (s *RdsServiceImpl) dedupTrends() error {
+	scope := s.db.NewScope(&Trend{})
+	tableName := scope.TableName()
+	if !scope.Dialect().HasTable(tableName) || scope.Dialect().HasIndex(tableName, trendUniqueIndex) {
+		return nil
+	}
+	return s.db.Exec("delete t1 from " + tableName + " t1 inner join " + tableName + " t2 on t1.market = t2.market and t1.intervals = t2.intervals and t1.start = t2.start and t1.id < t2.id").Error
+}
+
+// checkTrendIndex AutoMigrate创建索引失败时不会返回错误，这里再次创建以便返回失败原因
+func (s *RdsServiceImpl) checkTrendIndex() error {
+	scope := s.db.NewScope(&Trend{})
+	if scope.Dialect().HasIndex(scope.TableName(), trendUniqueIndex) {
+		return nil
+	}
+	return s.db.Model(&Trend{}).AddUniqueIndex(trendUniqueIndex, "market", "intervals", "start").Error
+}
+
+var trendDecimalColumns = []string{"vol", "amount", "open", "close", "high", "low"}
+
+// migrateTrendColumns 早期版本使用float保存价格以及数量，AutoMigrate不会修改已有列的类型，
+// 修改之后需要使用relay trends rebuild重新计算历史数据
+func (s *RdsServiceImpl) migrateTrendColumns() error {
+	tableName := s.db.NewScope(&Trend{}).TableName()
+	for _, column := range trendDecimalColumns {
+		var dataType string
+		row := s.db.Raw("select data_type from information_schema.columns where table_schema = ? and table_name = ? and column_name = ?", s.options.DbName, tableName, column).Row()
+		if err := row.Scan(&dataType); err != nil {
+			return err
+		}
+		if dataType == "varchar" {
+			continue
+		}
+		if err := s.db.Model(&Trend{}).ModifyColumn(column, "varchar(64)").Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *RdsServiceImpl) TrendPageQuery(query Trend, pageIndex, pageSize int) (pageResult PageResult, err error) {
@@ -66,3 +113,30 @@ func (s *RdsServiceImpl) TrendQueryByTime(intervals, market string, start, end i
 	err = s.db.Where("intervals = ? and market = ? and start = ? and end = ?", intervals, market, start, end).Order("start desc").Find(&trends).Error
 	return
 }
+
+// TrendsByRange 周期的开始时间在[start, end]之间的记录，按照开始时间排序
+func (s *RdsServiceImpl) TrendsByRange(intervals, market string, start, end int64) (trends []Trend, err error) {
+	err = s.db.Where("intervals = ? and market = ?", intervals, market).
+		Where("start >= ? and start <= ?", start, end).
+		Order("start asc").
+		Find(&trends).Error
+	return
+}
+
+// SaveTrend 按照market、intervals以及start更新已经存在的记录，不存在时插入
+func (s *RdsServiceImpl) SaveTrend(trend *Trend) error {
+	var existed Trend
+	err := s.db.Where("intervals = ? and market = ? and start = ?", trend.Intervals, trend.Market, trend.Start).First(&existed).Error
+	if err == nil {
+		trend.ID = existed.ID
+		return s.db.Save(trend).Error
+	}
+	if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	return s.db.Create(trend).Error
+}
+
+func (s *RdsServiceImpl) DelTrend(intervals, market string, start int64) error {
+	return s.db.Where("intervals = ? and market = ? and start = ?", intervals, market, start).Delete(&Trend{}).Error
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rpc"
+	"math/big"
 )
 
 type EthNodeAccessor struct {
@@ -34,6 +35,8 @@ type EthNodeAccessor struct {
 	WethAbi             *abi.ABI
 	WethAddress         common.Address
 	ProtocolAddresses   map[common.Address]*ProtocolAddress
+	gasMultiplier       *big.Rat
+	gasLimitCap         *big.Int
 	*rpc.Client
 }
 
@@ -54,6 +57,12 @@ func NewAccessor(accessorOptions config.AccessorOptions, commonOptions config.Co
 	}
 	accessor.WethAddress = wethAddress
 
+	accessor.gasMultiplier = big.NewRat(1, 1)
+	if accessorOptions.GasMultiplier > 0 {
+		accessor.gasMultiplier.SetFloat64(accessorOptions.GasMultiplier)
+	}
+	accessor.gasLimitCap = big.NewInt(accessorOptions.GasLimitCap)
+
 	accessor.ProtocolAddresses = make(map[common.Address]*ProtocolAddress)
 
 	if protocolImplAbi, err := NewAbi(commonOptions.ProtocolImpl.ImplAbi); nil != err {
@@ -271,26 +271,32 @@ func (ethAccessor *EthNodeAccessor) SignAndSendTransaction(result interface{}, s
 }
 
 func (accessor *EthNodeAccessor) ContractSendTransactionByData(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte) (string, error) {
+	var nonce types.Big
+	if err := accessor.RetryCall(2, &nonce, "eth_getTransactionCount", sender.Address.Hex(), "pending"); nil != err {
+		return "", err
+	}
+	return accessor.ContractSendTransactionWithNonce(sender, to, gas, gasPrice, value, nonce.BigInt(), callData)
+}
+
+//nonce相同的交易会替换还没有被打包的交易
+func (accessor *EthNodeAccessor) ContractSendTransactionWithNonce(sender accounts.Account, to common.Address, gas, gasPrice, value, nonce *big.Int, callData []byte) (string, error) {
 	if nil == gasPrice || gasPrice.Cmp(big.NewInt(0)) <= 0 {
 		return "", errors.New("gasPrice must be setted.")
 	}
 	if nil == gas || gas.Cmp(big.NewInt(0)) <= 0 {
 		return "", errors.New("gas must be setted.")
 	}
-	var txHash string
-	var nonce types.Big
-	if err := accessor.RetryCall(2, &nonce, "eth_getTransactionCount", sender.Address.Hex(), "pending"); nil != err {
-		return "", err
+	if nil == nonce || nonce.Sign() < 0 {
+		return "", errors.New("nonce must be setted.")
 	}
+	var txHash string
 	if value == nil {
 		value = big.NewInt(0)
 	}
-	// todo: modify gas
-	gas.SetString("1000000", 0)
 	transaction := ethTypes.NewTransaction(nonce.Uint64(),
 		common.HexToAddress(to.Hex()),
 		value,
-		gas,
+		accessor.gasLimit(gas),
 		gasPrice,
 		callData)
 	if err := accessor.SignAndSendTransaction(&txHash, sender, transaction); nil != err {
@@ -300,6 +306,19 @@ func (accessor *EthNodeAccessor) ContractSendTransactionByData(sender accounts.A
 	}
 }
 
+//gasLimit 估计的gas乘以GasMultiplier，不超过GasLimitCap，不修改传入的gas
+func (accessor *EthNodeAccessor) gasLimit(gas *big.Int) *big.Int {
+	limit := new(big.Rat).Mul(new(big.Rat).SetInt(gas), accessor.gasMultiplier)
+	res := new(big.Int).Quo(limit.Num(), limit.Denom())
+	if res.Cmp(gas) < 0 {
+		res.Set(gas)
+	}
+	if nil != accessor.gasLimitCap && accessor.gasLimitCap.Sign() > 0 && res.Cmp(accessor.gasLimitCap) > 0 {
+		res.Set(accessor.gasLimitCap)
+	}
+	return res
+}
+
 //gas, gasPrice can be set to nil
 func (accessor *EthNodeAccessor) ContractSendTransactionMethod(a *abi.ABI, contractAddress common.Address) func(sender accounts.Account, methodName string, gas, gasPrice, value *big.Int, args ...interface{}) (string, error) {
 	return func(sender accounts.Account, methodName string, gas, gasPrice, value *big.Int, args ...interface{}) (string, error) {
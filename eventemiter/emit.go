@@ -47,11 +47,12 @@ const (
 	OrderManagerExtractorFill      = "OrderManagerExtractorFill"
 	OrderManagerExtractorCancel    = "OrderManagerExtractorCancel"
 	OrderManagerExtractorCutoff    = "OrderManagerExtractorCutoff"
-	MinedOrderState                = "MinedOrderState" //orderbook send orderstate to miner
+	MinedOrderState                = "MinedOrderState"          //orderbook send orderstate to miner
+	OrderManagerOrdersCutoff       = "OrderManagerOrdersCutoff" //orders updated to cutoff by a cutoff event
 
 	//Miner
 	Miner_DeleteOrderState           = "Miner_DeleteOrderState"
-	Miner_NewOrderState              = "Miner_NewOrderState"
+	Miner_NewOrderState              = "Miner_NewOrderState" //order from gateway saved by ordermanager
 	Miner_NewRing                    = "Miner_NewRing"
 	Miner_RingMined                  = "Miner_RingMined"
 	Miner_RingSubmitFailed           = "Miner_RingSubmitFailed"
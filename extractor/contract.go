@@ -78,6 +78,7 @@ type MethodData struct {
 	LogAmount       int
 	Gas             *big.Int
 	GasPrice        *big.Int
+	GasUsed         *big.Int // 交易receipt中实际使用的gas
 }
 
 func newMethodData(method *abi.Method, cabi *abi.ABI) MethodData {
@@ -90,7 +91,7 @@ func newMethodData(method *abi.Method, cabi *abi.ABI) MethodData {
 	return c
 }
 
-func (method *MethodData) FullFilled(tx *ethaccessor.Transaction, blockTime *big.Int, logAmount int) {
+func (method *MethodData) FullFilled(tx *ethaccessor.Transaction, receipt *ethaccessor.TransactionReceipt, blockTime *big.Int, logAmount int) {
 	method.BlockNumber = tx.BlockNumber.BigInt()
 	method.Time = blockTime
 	method.ContractAddress = tx.To
@@ -102,6 +103,7 @@ func (method *MethodData) FullFilled(tx *ethaccessor.Transaction, blockTime *big
 	method.Input = tx.Input
 	method.Gas = tx.Gas.BigInt()
 	method.GasPrice = tx.GasPrice.BigInt()
+	method.GasUsed = receipt.GasUsed.BigInt()
 	method.LogAmount = logAmount
 }
 
@@ -430,7 +432,7 @@ func (processor *AbiProcessor) handleSubmitRingMethod(input eventemitter.EventDa
 	// emit to miner
 	var evt types.SubmitRingMethodEvent
 	evt.TxHash = common.HexToHash(contract.TxHash)
-	evt.UsedGas = contract.Gas
+	evt.UsedGas = contract.GasUsed
 	evt.UsedGasPrice = contract.GasPrice
 	evt.Err = contract.IsValid()
 
@@ -478,7 +480,7 @@ func (processor *AbiProcessor) handleSubmitRingHashMethod(input eventemitter.Eve
 	}
 
 	evt.TxHash = common.HexToHash(contract.TxHash)
-	evt.UsedGas = contract.Gas
+	evt.UsedGas = contract.GasUsed
 	evt.UsedGasPrice = contract.GasPrice
 	evt.Err = contract.IsValid()
 
@@ -505,7 +507,7 @@ func (processor *AbiProcessor) handleBatchSubmitRingHashMethod(input eventemitte
 	}
 
 	evt.TxHash = common.HexToHash(contract.TxHash)
-	evt.UsedGas = contract.Gas
+	evt.UsedGas = contract.GasUsed
 	evt.UsedGasPrice = contract.GasPrice
 	evt.Err = contract.IsValid()
 
@@ -210,13 +210,13 @@ func (l *ExtractorServiceImpl) processBlock() {
 		}
 
 		// 解析method，获得ring内等orders并发送到orderbook保存
-		if err := l.processMethod(transaction, block.Timestamp.BigInt(), block.Number.BigInt(), logAmount); err != nil {
+		if err := l.processMethod(transaction, recipient, block.Timestamp.BigInt(), block.Number.BigInt(), logAmount); err != nil {
 			log.Errorf(err.Error())
 		}
 	}
 }
 
-func (l *ExtractorServiceImpl) processMethod(tx ethaccessor.Transaction, time, blockNumber *big.Int, logAmount int) error {
+func (l *ExtractorServiceImpl) processMethod(tx ethaccessor.Transaction, receipt ethaccessor.TransactionReceipt, time, blockNumber *big.Int, logAmount int) error {
 	txhash := tx.Hash
 
 	if !l.processor.HasContract(common.HexToAddress(tx.To)) {
@@ -242,7 +242,7 @@ func (l *ExtractorServiceImpl) processMethod(tx ethaccessor.Transaction, time, b
 		return nil
 	}
 
-	method.FullFilled(&tx, time, logAmount)
+	method.FullFilled(&tx, &receipt, time, logAmount)
 
 	eventemitter.Emit(method.Id, method)
 	return nil
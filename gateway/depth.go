@@ -0,0 +1,252 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"sort"
+)
+
+const (
+	// 每次从orderbook中读取的订单数量
+	depthPageSize = 100
+
+	defaultDepthMaxOrders = 2000
+	defaultDepthTickSize  = "0.0000000001"
+
+	// tick size最多支持的小数位数
+	maxTickSizeDigits = 18
+)
+
+type depthLevel struct {
+	price  *big.Rat
+	amount *big.Rat // market中第一个token的数量
+	size   *big.Rat // market中第二个token的数量
+}
+
+// depthSide 聚合一侧的深度，订单需要按照价格从优到差的顺序加入，
+// 价格按照tickSize取整，卖单向上取整，买单向下取整
+type depthSide struct {
+	isAsk         bool
+	tickSize      *big.Rat
+	baseDecimals  *big.Rat
+	quoteDecimals *big.Rat
+	levels        map[string]*depthLevel
+
+	// 返回owner可用的tokenS数量，为nil时不检查余额
+	spendableFn func(owner common.Address) *big.Rat
+	spendable   map[common.Address]*big.Rat
+}
+
+func newDepthSide(isAsk bool, tickSize *big.Rat, baseDecimals, quoteDecimals *big.Int, spendableFn func(owner common.Address) *big.Rat) *depthSide {
+	d := &depthSide{}
+	d.isAsk = isAsk
+	d.tickSize = tickSize
+	d.baseDecimals = new(big.Rat).SetInt(baseDecimals)
+	d.quoteDecimals = new(big.Rat).SetInt(quoteDecimals)
+	d.levels = make(map[string]*depthLevel)
+	d.spendableFn = spendableFn
+	d.spendable = make(map[common.Address]*big.Rat)
+	return d
+}
+
+func (d *depthSide) add(state *types.OrderState) {
+	order := state.RawOrder
+	if order.AmountS == nil || order.AmountB == nil || order.AmountS.Sign() <= 0 || order.AmountB.Sign() <= 0 {
+		return
+	}
+
+	remainS, remainB := state.RemainedAmount()
+	if remainS.Sign() <= 0 || remainB.Sign() <= 0 {
+		return
+	}
+
+	// 同一个owner的订单共享余额以及授权，价格优的订单先占用
+	if nil != d.spendableFn {
+		spendable, exists := d.spendable[order.Owner]
+		if !exists {
+			spendable = d.spendableFn(order.Owner)
+			d.spendable[order.Owner] = spendable
+		}
+		if nil != spendable {
+			if spendable.Sign() <= 0 {
+				return
+			}
+			if spendable.Cmp(remainS) < 0 {
+				remainB.Mul(remainB, new(big.Rat).Quo(spendable, remainS))
+				remainS.Set(spendable)
+			}
+			spendable.Sub(spendable, remainS)
+		}
+	}
+
+	var base, quote, price *big.Rat
+	if d.isAsk {
+		base = remainS.Quo(remainS, d.baseDecimals)
+		quote = remainB.Quo(remainB, d.quoteDecimals)
+		price = new(big.Rat).SetFrac(order.AmountB, order.AmountS)
+	} else {
+		base = remainB.Quo(remainB, d.baseDecimals)
+		quote = remainS.Quo(remainS, d.quoteDecimals)
+		price = new(big.Rat).SetFrac(order.AmountS, order.AmountB)
+	}
+	price.Mul(price, d.baseDecimals)
+	price.Quo(price, d.quoteDecimals)
+	price = roundToTick(price, d.tickSize, d.isAsk)
+
+	key := price.RatString()
+	if level, exists := d.levels[key]; exists {
+		level.amount.Add(level.amount, base)
+		level.size.Add(level.size, quote)
+	} else {
+		d.levels[key] = &depthLevel{price: price, amount: base, size: quote}
+	}
+}
+
+// full 订单按照价格排序，出现第length+1档时前length档已经聚合完成
+func (d *depthSide) full(length int) bool {
+	return len(d.levels) > length
+}
+
+// result 每一档为[价格, 数量, 金额, 累计数量, 累计金额]
+func (d *depthSide) result(length, priceDigits, baseDigits, quoteDigits int) [][]string {
+	levels := make([]*depthLevel, 0, len(d.levels))
+	for _, level := range d.levels {
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if d.isAsk {
+			return levels[i].price.Cmp(levels[j].price) < 0
+		}
+		return levels[i].price.Cmp(levels[j].price) > 0
+	})
+	if length < len(levels) {
+		levels = levels[:length]
+	}
+
+	depth := make([][]string, 0, len(levels))
+	totalAmount := new(big.Rat)
+	totalSize := new(big.Rat)
+	for _, level := range levels {
+		totalAmount.Add(totalAmount, level.amount)
+		totalSize.Add(totalSize, level.size)
+		depth = append(depth, []string{
+			level.price.FloatString(priceDigits),
+			level.amount.FloatString(baseDigits),
+			level.size.FloatString(quoteDigits),
+			totalAmount.FloatString(baseDigits),
+			totalSize.FloatString(quoteDigits),
+		})
+	}
+	return depth
+}
+
+// fillDepthSide 按页读取orderbook，直到聚合出length档或者读完所有订单
+func (j *JsonrpcServiceImpl) fillDepthSide(side *depthSide, protocol, tokenS, tokenB common.Address, length int) error {
+	maxOrders := j.options.Depth.MaxOrders
+	if maxOrders <= 0 {
+		maxOrders = defaultDepthMaxOrders
+	}
+
+	for offset := 0; offset < maxOrders && !side.full(length); offset += depthPageSize {
+		states, err := j.orderManager.GetOrderBook(protocol, tokenS, tokenB, offset, depthPageSize)
+		if err != nil {
+			return err
+		}
+		for i := range states {
+			side.add(&states[i])
+		}
+		if len(states) < depthPageSize {
+			break
+		}
+	}
+	return nil
+}
+
+// spendableFn owner的余额与授权中较小的值，无法获取时不限制订单的数量。
+// 深度由ticker以及订阅共用，每次最多读取数千个订单，所以只使用accountManager中缓存的余额，不访问以太坊节点
+func (j *JsonrpcServiceImpl) spendableFn(token common.Address) func(owner common.Address) *big.Rat {
+	if !j.options.Depth.CheckBalance {
+		return nil
+	}
+	return func(owner common.Address) *big.Rat {
+		balance, allowance, exists := j.accountManager.GetCachedBalanceByTokenAddress(owner, token)
+		if !exists || balance == nil || allowance == nil {
+			log.Debugf("gateway,depth balance of owner:%s token:%s isn't cached", owner.Hex(), token.Hex())
+			return nil
+		}
+		if allowance.Cmp(balance) < 0 {
+			return new(big.Rat).SetInt(allowance)
+		}
+		return new(big.Rat).SetInt(balance)
+	}
+}
+
+// depthTickSize 请求的精度不能小于market配置的tick size
+func (j *JsonrpcServiceImpl) depthTickSize(market string, precision *int) (*big.Rat, error) {
+	tickSizeStr := j.options.Depth.TickSizes[market]
+	if tickSizeStr == "" {
+		tickSizeStr = j.options.Depth.DefaultTickSize
+	}
+	if tickSizeStr == "" {
+		tickSizeStr = defaultDepthTickSize
+	}
+	tickSize, ok := new(big.Rat).SetString(tickSizeStr)
+	if !ok || tickSize.Sign() <= 0 {
+		return nil, errors.New("invalid tick size " + tickSizeStr + " of market " + market)
+	}
+
+	if nil == precision {
+		return tickSize, nil
+	}
+	if *precision < 0 || *precision > maxTickSizeDigits {
+		return nil, invalidParamsError("precision", fmt.Sprintf("precision must be in [0,%d]", maxTickSizeDigits))
+	}
+	requested := new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(*precision)), nil))
+	if requested.Cmp(tickSize) < 0 {
+		return tickSize, nil
+	}
+	return requested, nil
+}
+
+func roundToTick(price, tickSize *big.Rat, up bool) *big.Rat {
+	q := new(big.Rat).Quo(price, tickSize)
+	ticks := new(big.Int).Quo(q.Num(), q.Denom())
+	if up && !q.IsInt() {
+		ticks.Add(ticks, big.NewInt(1))
+	}
+	return new(big.Rat).Mul(new(big.Rat).SetInt(ticks), tickSize)
+}
+
+// decimalDigits 完整表示该值需要的小数位数，超过maxTickSizeDigits时截断
+func decimalDigits(value *big.Rat) int {
+	v := new(big.Rat).Set(value)
+	ten := big.NewRat(10, 1)
+	digits := 0
+	for !v.IsInt() && digits < maxTickSizeDigits {
+		v.Mul(v, ten)
+		digits++
+	}
+	return digits
+}
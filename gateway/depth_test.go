@@ -0,0 +1,168 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func rat(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		panic("invalid rat " + s)
+	}
+	return r
+}
+
+// ether 按照18位decimals转换为最小单位
+func ether(s string) *big.Int {
+	r := rat(s)
+	r.Mul(r, new(big.Rat).SetInt(big.NewInt(1e18)))
+	if !r.IsInt() {
+		panic("too many decimals " + s)
+	}
+	return new(big.Int).Set(r.Num())
+}
+
+func depthOrder(owner common.Address, amountS, amountB, dealtAmountS string) *types.OrderState {
+	state := &types.OrderState{}
+	state.RawOrder.Owner = owner
+	state.RawOrder.AmountS = ether(amountS)
+	state.RawOrder.AmountB = ether(amountB)
+	state.DealtAmountS = ether(dealtAmountS)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	return state
+}
+
+func TestRoundToTick(t *testing.T) {
+	tests := []struct {
+		price, tick string
+		up          bool
+		expect      string
+	}{
+		{"1.234", "0.01", true, "1.24"},
+		{"1.234", "0.01", false, "1.23"},
+		{"1.23", "0.01", true, "1.23"},
+		{"1.23", "0.01", false, "1.23"},
+		{"12", "5", true, "15"},
+		{"12", "5", false, "10"},
+		{"0.004", "0.01", false, "0"},
+		{"0.004", "0.01", true, "0.01"},
+		{"1/3", "0.0001", true, "0.3334"},
+	}
+
+	for _, test := range tests {
+		res := roundToTick(rat(test.price), rat(test.tick), test.up)
+		if res.Cmp(rat(test.expect)) != 0 {
+			t.Errorf("round %s to tick %s up:%t got %s, expect %s", test.price, test.tick, test.up, res.FloatString(8), test.expect)
+		}
+	}
+}
+
+func TestDecimalDigits(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect int
+	}{
+		{"1", 0},
+		{"10", 0},
+		{"0.5", 1},
+		{"0.01", 2},
+		{"0.000000000000000001", 18},
+		{"1/3", maxTickSizeDigits},
+		{"0.0000000000000000001", maxTickSizeDigits},
+	}
+
+	for _, test := range tests {
+		if digits := decimalDigits(rat(test.value)); digits != test.expect {
+			t.Errorf("digits of %s is %d, expect %d", test.value, digits, test.expect)
+		}
+	}
+}
+
+func TestDepthSideAsk(t *testing.T) {
+	ownerA := common.HexToAddress("0x8888f1f195afa192cfee860698584c030f4c9db1")
+	ownerB := common.HexToAddress("0x750ad4351bb728cec7d639a9511f9d6488f1e259")
+	decimals := big.NewInt(1e18)
+
+	spendable := map[common.Address]*big.Int{ownerA: ether("15")}
+	lookups := 0
+	side := newDepthSide(true, rat("0.01"), decimals, decimals, func(owner common.Address) *big.Rat {
+		lookups++
+		if balance, exists := spendable[owner]; exists {
+			return new(big.Rat).SetInt(balance)
+		}
+		return nil
+	})
+
+	// 卖单按照价格从低到高加入
+	side.add(depthOrder(ownerA, "10", "20", "0"))
+	side.add(depthOrder(ownerB, "5", "10.001", "0"))
+	side.add(depthOrder(ownerB, "4", "8.02", "2"))
+	side.add(depthOrder(ownerA, "10", "25", "0"))
+	side.add(depthOrder(ownerA, "1", "3", "0"))
+
+	if lookups != 2 {
+		t.Errorf("balance of each owner should be looked up once, got %d lookups", lookups)
+	}
+	if !side.full(2) || side.full(3) {
+		t.Errorf("side should have 3 levels, got %d", len(side.levels))
+	}
+
+	// ownerA的余额只够第一个订单以及第二个订单的一半，第三个订单被忽略
+	expect := [][]string{
+		{"2.00", "10.0000", "20.0000", "10.0000", "20.0000"},
+		{"2.01", "7.0000", "14.0110", "17.0000", "34.0110"},
+		{"2.50", "5.0000", "12.5000", "22.0000", "46.5110"},
+	}
+	if res := side.result(3, 2, 4, 4); !reflect.DeepEqual(res, expect) {
+		t.Errorf("ask depth %v, expect %v", res, expect)
+	}
+	if res := side.result(1, 2, 4, 4); !reflect.DeepEqual(res, expect[:1]) {
+		t.Errorf("ask depth of length 1 %v, expect %v", res, expect[:1])
+	}
+}
+
+func TestDepthSideBid(t *testing.T) {
+	owner := common.HexToAddress("0x8888f1f195afa192cfee860698584c030f4c9db1")
+	side := newDepthSide(false, rat("0.1"), big.NewInt(1e18), big.NewInt(1e18), nil)
+
+	// 买单卖出quote token，价格为amountS/amountB，向下取整，按照价格从高到低加入
+	side.add(depthOrder(owner, "25.5", "10", "0"))
+	side.add(depthOrder(owner, "25", "10", "0"))
+	side.add(depthOrder(owner, "20", "10", "10"))
+	side.add(depthOrder(owner, "10", "10", "5"))
+
+	expect := [][]string{
+		{"2.5", "20", "50.5", "20", "50.5"},
+		{"2.0", "5", "10.0", "25", "60.5"},
+		{"1.0", "5", "5.0", "30", "65.5"},
+	}
+	if res := side.result(5, 1, 0, 1); !reflect.DeepEqual(res, expect) {
+		t.Errorf("bid depth %v, expect %v", res, expect)
+	}
+}
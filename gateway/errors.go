@@ -0,0 +1,178 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/Loopring/relay/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"strings"
+)
+
+// jsonrpc返回的错误码，已经发布的错误码不能修改
+const (
+	ErrCodeServerError   = -32000
+	ErrCodeRateLimited   = -32005 // 与EIP-1474中的limit exceeded保持一致
+	ErrCodeInvalidParams = -32602
+
+	ErrCodeOrderInvalid      = 10001
+	ErrCodeOrderSignInvalid  = 10002
+	ErrCodeTokenUnsupported  = 10003
+	ErrCodeOrderCutoff       = 10004
+	ErrCodeMarketUnsupported = 10005
+	ErrCodeOrderNotFound     = 10006
+
+	ErrCodeInsufficientBalance   = 10007
+	ErrCodeInsufficientAllowance = 10008
+	ErrCodeOrderFinished         = 10009
+	ErrCodeOwnerDenied           = 10010
+	ErrCodeTooManyOpenOrders     = 10011
+	ErrCodeOrderExpired          = 10012
+	ErrCodeOrderNotYetValid      = 10013
+	ErrCodeRingSimulateFailed    = 10014
+
+	ErrCodeDBUnavailable        = 20001
+	ErrCodeChainNodeUnavailable = 20002
+	ErrCodeMinerUnavailable     = 20003
+	ErrCodeMarketCapUnavailable = 20004
+)
+
+var errMessages = map[int]string{
+	ErrCodeServerError:           "server error",
+	ErrCodeRateLimited:           "rate limit exceeded",
+	ErrCodeInvalidParams:         "invalid params",
+	ErrCodeOrderInvalid:          "order invalid",
+	ErrCodeOrderSignInvalid:      "order signature invalid",
+	ErrCodeTokenUnsupported:      "token unsupported",
+	ErrCodeOrderCutoff:           "order cutoff",
+	ErrCodeMarketUnsupported:     "market unsupported",
+	ErrCodeOrderNotFound:         "order not found",
+	ErrCodeInsufficientBalance:   "insufficient balance",
+	ErrCodeInsufficientAllowance: "insufficient allowance",
+	ErrCodeOrderFinished:         "order cancelled or filled",
+	ErrCodeOwnerDenied:           "owner denied",
+	ErrCodeTooManyOpenOrders:     "too many open orders",
+	ErrCodeOrderExpired:          "order expired",
+	ErrCodeOrderNotYetValid:      "order not yet valid",
+	ErrCodeRingSimulateFailed:    "ring simulation failed",
+	ErrCodeDBUnavailable:         "database unavailable",
+	ErrCodeChainNodeUnavailable:  "chain node unavailable",
+	ErrCodeMinerUnavailable:      "miner unavailable",
+	ErrCodeMarketCapUnavailable:  "market cap unavailable",
+}
+
+type ErrorData struct {
+	OrderHash string `json:"orderHash,omitempty"`
+	Field     string `json:"field,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// RpcError 带有错误码以及data的错误，filter以及loopring_*方法都应该返回该错误
+type RpcError struct {
+	Code    int       `json:"code"`
+	Message string    `json:"message"`
+	Data    ErrorData `json:"data"`
+}
+
+func NewRpcError(code int, data ErrorData) *RpcError {
+	return &RpcError{Code: code, Message: errMessages[code], Data: data}
+}
+
+func (e *RpcError) ErrorCode() int { return e.Code }
+
+// go-ethereum的rpc server只把方法返回错误的message交给codec，错误码统一为-32000，
+// 所以Error返回带有前缀的json，errorCodec从message中解析出错误码以及data
+const rpcErrorPrefix = "loopring error:"
+
+func (e *RpcError) Error() string {
+	data, _ := json.Marshal(e)
+	return rpcErrorPrefix + string(data)
+}
+
+// parseRpcError 从RpcError.Error()的结果中解析出RpcError，错误码未定义时返回false
+func parseRpcError(message string) (*RpcError, bool) {
+	if !strings.HasPrefix(message, rpcErrorPrefix) {
+		return nil, false
+	}
+	e := &RpcError{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(message, rpcErrorPrefix)), e); err != nil {
+		return nil, false
+	}
+	if _, exists := errMessages[e.Code]; !exists {
+		return nil, false
+	}
+	return e, true
+}
+
+// toRpcError 将任意错误转换为RpcError，未在错误码中定义的错误都按照server error处理
+func toRpcError(err error) *RpcError {
+	if rpcErr, ok := err.(*RpcError); ok {
+		return rpcErr
+	}
+	return NewRpcError(ErrCodeServerError, ErrorData{Reason: err.Error()})
+}
+
+func invalidParamsError(field, reason string) error {
+	return NewRpcError(ErrCodeInvalidParams, ErrorData{Field: field, Reason: reason})
+}
+
+// dbUnavailableError 数据库以及驱动的错误信息只记录在日志中，不返回给客户端
+func dbUnavailableError(err error) error {
+	log.Errorf("gateway,database error:%s", err.Error())
+	return NewRpcError(ErrCodeDBUnavailable, ErrorData{Reason: "database query failed"})
+}
+
+func marketCapUnavailableError(err error) error {
+	log.Errorf("gateway,market cap error:%s", err.Error())
+	return NewRpcError(ErrCodeMarketCapUnavailable, ErrorData{Reason: "market cap of token not found"})
+}
+
+func chainNodeUnavailableError(err error) error {
+	log.Errorf("gateway,chain node error:%s", err.Error())
+	return NewRpcError(ErrCodeChainNodeUnavailable, ErrorData{Reason: "chain node request failed"})
+}
+
+func isRecordNotFound(err error) bool {
+	return err != nil && err.Error() == "record not found"
+}
+
+// responseError 返回给客户端的message只包含错误码对应的message，详细信息在data中
+type responseError struct {
+	code    int
+	message string
+}
+
+func (e *responseError) ErrorCode() int { return e.code }
+
+func (e *responseError) Error() string { return e.message }
+
+type errorCodec struct {
+	rpc.ServerCodec
+}
+
+func newErrorCodec(codec rpc.ServerCodec) rpc.ServerCodec {
+	return &errorCodec{ServerCodec: codec}
+}
+
+func (c *errorCodec) CreateErrorResponse(id interface{}, err rpc.Error) interface{} {
+	if rpcErr, ok := parseRpcError(err.Error()); ok {
+		return c.ServerCodec.CreateErrorResponseWithInfo(id, &responseError{code: rpcErr.Code, message: rpcErr.Message}, rpcErr.Data)
+	}
+	return c.ServerCodec.CreateErrorResponse(id, err)
+}
@@ -0,0 +1,100 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/rpc"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type ErrorTestService struct{}
+
+func (s *ErrorTestService) Fail(code int) (string, error) {
+	if code == 0 {
+		return "", errors.New("plain error")
+	}
+	return "", NewRpcError(code, ErrorData{OrderHash: "0x01", Field: "amountS", Reason: "test reason"})
+}
+
+type errorTestResponse struct {
+	Error struct {
+		Code    int       `json:"code"`
+		Message string    `json:"message"`
+		Data    ErrorData `json:"data"`
+	} `json:"error"`
+}
+
+// callFail 通过rpc server以及errorCodec调用loopring_fail，与jsonrpc的http接口相同
+func callFail(t *testing.T, code int) errorTestResponse {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("loopring", &ErrorTestService{}); err != nil {
+		t.Fatalf("register service error:%s", err.Error())
+	}
+	req := strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"loopring_fail","params":[` + strconv.Itoa(code) + `]}`)
+	out := &bytes.Buffer{}
+	srv.ServeSingleRequest(newErrorCodec(rpc.NewJSONCodec(&httpReadWriteNopCloser{req, out})), rpc.OptionMethodInvocation)
+
+	res := errorTestResponse{}
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("unmarshal response %s error:%s", out.String(), err.Error())
+	}
+	return res
+}
+
+func TestErrorCodecRpcError(t *testing.T) {
+	for _, code := range []int{ErrCodeOrderInvalid, ErrCodeDBUnavailable, ErrCodeMarketCapUnavailable} {
+		res := callFail(t, code)
+		if res.Error.Code != code || res.Error.Message != errMessages[code] {
+			t.Errorf("code %d got error %d %s", code, res.Error.Code, res.Error.Message)
+		}
+		if res.Error.Data.OrderHash != "0x01" || res.Error.Data.Field != "amountS" || res.Error.Data.Reason != "test reason" {
+			t.Errorf("code %d got data %+v", code, res.Error.Data)
+		}
+	}
+}
+
+func TestErrorCodecPlainError(t *testing.T) {
+	res := callFail(t, 0)
+	if res.Error.Code != ErrCodeServerError || res.Error.Message != "plain error" {
+		t.Errorf("got error %d %s", res.Error.Code, res.Error.Message)
+	}
+}
+
+func TestParseRpcError(t *testing.T) {
+	rpcErr := NewRpcError(ErrCodeOrderCutoff, ErrorData{OrderHash: "0x02", Reason: "cutoff"})
+	parsed, ok := parseRpcError(rpcErr.Error())
+	if !ok || *parsed != *rpcErr {
+		t.Errorf("parse %s got %+v", rpcErr.Error(), parsed)
+	}
+
+	for _, message := range []string{
+		"plain error",
+		rpcErrorPrefix + "not json",
+		rpcErrorPrefix + `{"code":12345,"message":"unknown","data":{"reason":"x"}}`,
+	} {
+		if _, ok := parseRpcError(message); ok {
+			t.Errorf("message %s should not be parsed", message)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// requiredFilters 校验订单格式以及签名，始终最先执行，配置中不能去掉
+var requiredFilters = []string{"base", "sign"}
+
+// 未配置gateway_filters.filters时使用的filter，与之前的行为保持一致
+var defaultFilters = []string{"base", "sign", "token", "cutoff"}
+
+// filterNames 按照执行顺序返回filter的名称，requiredFilters在最前面，其余的filter按照配置的顺序执行
+func filterNames(configured []string) ([]string, error) {
+	if len(configured) == 0 {
+		return defaultFilters, nil
+	}
+
+	required := make(map[string]bool)
+	for _, name := range requiredFilters {
+		required[name] = true
+	}
+
+	names := append([]string{}, requiredFilters...)
+	seen := make(map[string]bool)
+	for _, name := range configured {
+		if seen[name] {
+			return nil, fmt.Errorf("filter %s is configured more than once", name)
+		}
+		seen[name] = true
+		if !required[name] {
+			names = append(names, name)
+		}
+	}
+	for _, name := range requiredFilters {
+		if !seen[name] {
+			return nil, fmt.Errorf("filter %s is required and can't be removed", name)
+		}
+	}
+	return names, nil
+}
+
+type filterFactory func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error)
+
+var filterFactories = make(map[string]filterFactory)
+
+// registerFilter 注册filter，名称即gateway_filters.filters中配置的名称
+func registerFilter(name string, factory filterFactory) {
+	if _, exists := filterFactories[name]; exists {
+		panic("gateway,filter " + name + " already registered")
+	}
+	filterFactories[name] = factory
+}
+
+func newFilter(name string, options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+	factory, exists := filterFactories[name]
+	if !exists {
+		return nil, errors.New("unknown filter " + name)
+	}
+	return factory(options, om, mc)
+}
+
+func init() {
+	registerFilter("base", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		if options.BaseFilter.MaxPrice <= 0 {
+			return nil, errors.New("max_price must be positive")
+		}
+		return &BaseFilter{MinLrcFee: big.NewInt(options.BaseFilter.MinLrcFee), MaxPrice: big.NewInt(options.BaseFilter.MaxPrice)}, nil
+	})
+	registerFilter("sign", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		return &SignFilter{}, nil
+	})
+	registerFilter("token", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		f := &TokenFilter{}
+		var err error
+		if f.AllowTokens, err = tokenSet(options.TokenFilter.AllowTokens); err != nil {
+			return nil, err
+		}
+		if f.DeniedTokens, err = tokenSet(options.TokenFilter.DeniedTokens); err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	registerFilter("cutoff", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		return &CutoffFilter{om: om}, nil
+	})
+	registerFilter("owner", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		f := &OwnerFilter{}
+		var err error
+		if f.AllowOwners, err = addressSet(options.OwnerFilter.AllowOwners); err != nil {
+			return nil, err
+		}
+		if f.DeniedOwners, err = addressSet(options.OwnerFilter.DeniedOwners); err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	registerFilter("min_value", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		minValue := new(big.Rat)
+		if nil == minValue.SetFloat64(options.MinValueFilter.MinValue) || minValue.Sign() < 0 {
+			return nil, fmt.Errorf("invalid min_value %f", options.MinValueFilter.MinValue)
+		}
+		return &MinValueFilter{MinValue: minValue, mc: mc}, nil
+	})
+	registerFilter("ttl", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		if options.TtlFilter.MaxTtl < 0 || options.TtlFilter.MinRemainingTtl < 0 {
+			return nil, errors.New("max_ttl and min_remaining_ttl can't be negative")
+		}
+		return &TtlFilter{MaxTtl: options.TtlFilter.MaxTtl, MinRemainingTtl: options.TtlFilter.MinRemainingTtl}, nil
+	})
+	registerFilter("open_order", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		if options.OpenOrderFilter.MaxOpenOrders <= 0 {
+			return nil, errors.New("max_open_orders must be positive")
+		}
+		return &OpenOrderFilter{MaxOpenOrders: options.OpenOrderFilter.MaxOpenOrders, om: om}, nil
+	})
+	registerFilter("margin_split", func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) (Filter, error) {
+		min, max := options.MarginSplitFilter.MinPercentage, options.MarginSplitFilter.MaxPercentage
+		if min < 0 || max > 100 || min > max {
+			return nil, fmt.Errorf("invalid margin split percentage range [%d,%d]", min, max)
+		}
+		return &MarginSplitFilter{MinPercentage: uint8(min), MaxPercentage: uint8(max)}, nil
+	})
+}
+
+// parseToken token可以是地址或者symbol
+func parseToken(token string) (common.Address, error) {
+	if common.IsHexAddress(token) {
+		return common.HexToAddress(token), nil
+	}
+	address := util.AliasToAddress(strings.ToUpper(token))
+	if types.IsZeroAddress(address) {
+		return address, errors.New("unsupported token " + token)
+	}
+	return address, nil
+}
+
+func tokenSet(tokens []string) (map[common.Address]bool, error) {
+	set := make(map[common.Address]bool)
+	for _, token := range tokens {
+		address, err := parseToken(token)
+		if err != nil {
+			return nil, err
+		}
+		set[address] = true
+	}
+	return set, nil
+}
+
+func addressSet(addresses []string) (map[common.Address]bool, error) {
+	set := make(map[common.Address]bool)
+	for _, address := range addresses {
+		if !common.IsHexAddress(address) {
+			return nil, errors.New("invalid address " + address)
+		}
+		set[common.HexToAddress(address)] = true
+	}
+	return set, nil
+}
+
+func tokenField(o *types.Order, token common.Address) string {
+	if token == o.TokenS {
+		return "tokenS"
+	}
+	return "tokenB"
+}
+
+type OwnerFilter struct {
+	AllowOwners  map[common.Address]bool
+	DeniedOwners map[common.Address]bool
+}
+
+func (f *OwnerFilter) filter(o *types.Order) (bool, error) {
+	if len(f.AllowOwners) > 0 && !f.AllowOwners[o.Owner] {
+		return false, NewRpcError(ErrCodeOwnerDenied, ErrorData{OrderHash: o.Hash.Hex(), Field: "owner", Reason: fmt.Sprintf("owner %s is not allowed", o.Owner.Hex())})
+	}
+	if f.DeniedOwners[o.Owner] {
+		return false, NewRpcError(ErrCodeOwnerDenied, ErrorData{OrderHash: o.Hash.Hex(), Field: "owner", Reason: fmt.Sprintf("owner %s is denied", o.Owner.Hex())})
+	}
+	return true, nil
+}
+
+// MinValueFilter 过滤法币价值过小的订单，这些订单撮合后的收益无法覆盖gas
+type MinValueFilter struct {
+	MinValue *big.Rat
+	mc       marketcap.MarketCapProvider
+}
+
+func (f *MinValueFilter) filter(o *types.Order) (bool, error) {
+	value, err := f.mc.LegalCurrencyValue(o.TokenS, new(big.Rat).SetInt(o.AmountS))
+	if err != nil {
+		return false, NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: o.Hash.Hex(), Field: "tokenS", Reason: err.Error()})
+	}
+	if value.Cmp(f.MinValue) < 0 {
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "amountS", Reason: fmt.Sprintf("value of amountS %s is less than %s", value.FloatString(2), f.MinValue.FloatString(2))})
+	}
+	return true, nil
+}
+
+// TtlFilter 限制订单的最大有效期以及提交时剩余的有效期，值为0时不检查
+type TtlFilter struct {
+	MaxTtl          int64
+	MinRemainingTtl int64
+}
+
+func (f *TtlFilter) filter(o *types.Order) (bool, error) {
+	if o.Ttl == nil || o.Timestamp == nil {
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "ttl", Reason: "timestamp and ttl are required"})
+	}
+	if f.MaxTtl > 0 && o.Ttl.Cmp(big.NewInt(f.MaxTtl)) > 0 {
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "ttl", Reason: fmt.Sprintf("ttl %s is greater than %d", o.Ttl.String(), f.MaxTtl)})
+	}
+	if f.MinRemainingTtl > 0 {
+		remaining := new(big.Int).Add(o.Timestamp, o.Ttl)
+		remaining.Sub(remaining, big.NewInt(time.Now().Unix()))
+		if remaining.Cmp(big.NewInt(f.MinRemainingTtl)) < 0 {
+			return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "ttl", Reason: fmt.Sprintf("remaining ttl %s is less than %d", remaining.String(), f.MinRemainingTtl)})
+		}
+	}
+	return true, nil
+}
+
+// OpenOrderFilter 限制每个owner未过期并且未完全成交的订单数量
+type OpenOrderFilter struct {
+	MaxOpenOrders int
+	om            ordermanager.OrderManager
+}
+
+func (f *OpenOrderFilter) filter(o *types.Order) (bool, error) {
+	count, err := f.om.GetOpenOrderCount(o.Owner)
+	if err != nil {
+		return false, dbUnavailableError(err)
+	}
+	if count >= f.MaxOpenOrders {
+		return false, NewRpcError(ErrCodeTooManyOpenOrders, ErrorData{OrderHash: o.Hash.Hex(), Field: "owner", Reason: fmt.Sprintf("owner %s already has %d open orders", o.Owner.Hex(), count)})
+	}
+	return true, nil
+}
+
+type MarginSplitFilter struct {
+	MinPercentage uint8
+	MaxPercentage uint8
+}
+
+func (f *MarginSplitFilter) filter(o *types.Order) (bool, error) {
+	if o.MarginSplitPercentage < f.MinPercentage || o.MarginSplitPercentage > f.MaxPercentage {
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "marginSplitPercentage", Reason: fmt.Sprintf("marginSplitPercentage %d out of range [%d,%d]", o.MarginSplitPercentage, f.MinPercentage, f.MaxPercentage)})
+	}
+	return true, nil
+}
@@ -24,14 +24,16 @@ import (
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"time"
 )
 
 type Gateway struct {
-	filters          []Filter
+	filters          []namedFilter
 	om               ordermanager.OrderManager
 	isBroadcast      bool
 	maxBroadcastTime int
@@ -44,54 +46,72 @@ type Filter interface {
 	filter(o *types.Order) (bool, error)
 }
 
-func Initialize(filterOptions *config.GatewayFiltersOptions, options *config.GateWayOptions, ipfsOptions *config.IpfsOptions, om ordermanager.OrderManager) {
+// namedFilter 记录filter的名称，loopring_validateOrder按照该名称返回每一项检查的结果
+type namedFilter struct {
+	name string
+	Filter
+}
+
+func Initialize(filterOptions *config.GatewayFiltersOptions, options *config.GateWayOptions, ipfsOptions *config.IpfsOptions, om ordermanager.OrderManager, mc marketcap.MarketCapProvider) {
 	// add gateway watcher
 	gatewayWatcher := &eventemitter.Watcher{Concurrent: false, Handle: HandleOrder}
 	eventemitter.On(eventemitter.Gateway, gatewayWatcher)
 
-	gateway = Gateway{filters: make([]Filter, 0), om: om, isBroadcast: options.IsBroadcast, maxBroadcastTime: options.MaxBroadcastTime}
+	gateway = Gateway{filters: make([]namedFilter, 0), om: om, isBroadcast: options.IsBroadcast, maxBroadcastTime: options.MaxBroadcastTime}
 	gateway.ipfsPubService = NewIPFSPubService(ipfsOptions)
 
-	// new base filter
-	baseFilter := &BaseFilter{MinLrcFee: big.NewInt(filterOptions.BaseFilter.MinLrcFee), MaxPrice: big.NewInt(filterOptions.BaseFilter.MaxPrice)}
-
-	// new token filter
-	tokenFilter := &TokenFilter{}
-
-	// new sign filter
-	signFilter := &SignFilter{}
-
-	// new cutoff filter
-	cutoffFilter := &CutoffFilter{om: om}
-
-	gateway.filters = append(gateway.filters, baseFilter)
-	gateway.filters = append(gateway.filters, signFilter)
-	gateway.filters = append(gateway.filters, tokenFilter)
-	gateway.filters = append(gateway.filters, cutoffFilter)
+	names, err := filterNames(filterOptions.Filters)
+	if err != nil {
+		log.Fatalf("gateway,init filters error:%s", err.Error())
+	}
+	for _, name := range names {
+		f, err := newFilter(name, filterOptions, om, mc)
+		if err != nil {
+			log.Fatalf("gateway,init filter %s error:%s", name, err.Error())
+		}
+		gateway.filters = append(gateway.filters, namedFilter{name, f})
+	}
+	log.Infof("gateway,filters:%v", names)
 }
 
 func HandleOrder(input eventemitter.EventData) error {
-	var (
-		state *types.OrderState
-		err   error
-	)
+	_, err := handleOrder(input.(*types.Order), nil)
+	return err
+}
+
+// handleOrder 校验并保存新订单，订单已经存在时known为true，
+// admit不为nil时在所有filter(包括签名校验)通过之后、保存订单之前调用，返回错误时拒绝该订单
+func handleOrder(order *types.Order, admit func(order *types.Order) error) (known bool, err error) {
+	var state *types.OrderState
 
-	order := input.(*types.Order)
 	order.Hash = order.GenerateHash()
 
 	var broadcastTime int
 
-	//TODO(xiaolu) 这里需要测试一下，超时error和查询数据为空的error，处理方式不应该一样
-	if state, err = gateway.om.GetOrderByHash(order.Hash); err != nil && err.Error() == "record not found" {
+	state, err = gateway.om.GetOrderByHash(order.Hash)
+	if err != nil && !isRecordNotFound(err) {
+		return false, dbUnavailableError(err)
+	}
+
+	if err != nil {
 		if err = generatePrice(order); err != nil {
-			return err
+			return false, err
+		}
+
+		if err = checkOrderTime(order, time.Now().Unix()); err != nil {
+			return false, err
 		}
 
 		for _, v := range gateway.filters {
 			valid, err := v.filter(order)
 			if !valid {
 				log.Errorf(err.Error())
-				return err
+				return false, err
+			}
+		}
+		if admit != nil {
+			if err = admit(order); err != nil {
+				return false, err
 			}
 		}
 		state = &types.OrderState{}
@@ -99,6 +119,7 @@ func HandleOrder(input eventemitter.EventData) error {
 		broadcastTime = 0
 		eventemitter.Emit(eventemitter.OrderManagerGatewayNewOrder, state)
 	} else {
+		known = true
 		broadcastTime = state.BroadcastTime
 		log.Infof("gateway,order %s exist,will not insert again", order.Hash.Hex())
 	}
@@ -111,36 +132,38 @@ func HandleOrder(input eventemitter.EventData) error {
 			log.Errorf("gateway,publish order %s failed", state.RawOrder.Hash.String())
 		} else {
 			if err = gateway.om.UpdateBroadcastTimeByHash(state.RawOrder.Hash, state.BroadcastTime+1); nil != err {
-				return err
+				return known, dbUnavailableError(err)
 			}
 		}
 	}
-	return nil
+	return known, nil
 }
 
 func generatePrice(order *types.Order) error {
+	orderHash := order.Hash.Hex()
+
 	tokenS, err := util.AddressToToken(order.TokenS)
 	if err != nil {
-		return err
+		return NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: orderHash, Field: "tokenS", Reason: err.Error()})
 	}
 	if tokenS.Decimals == nil || tokenS.Decimals.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's tokenS decimals invalid")
+		return NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: orderHash, Field: "tokenS", Reason: "tokenS decimals invalid"})
 	}
 
 	tokenB, err := util.AddressToToken(order.TokenB)
 	if err != nil {
-		return err
+		return NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: orderHash, Field: "tokenB", Reason: err.Error()})
 	}
 	if tokenB.Decimals == nil || tokenB.Decimals.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's tokenS decimals invalid")
+		return NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: orderHash, Field: "tokenB", Reason: "tokenB decimals invalid"})
 	}
 
 	if order.AmountS == nil || order.AmountS.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's amountS invalid")
+		return NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "amountS", Reason: "amountS must be positive"})
 	}
 
 	if order.AmountB == nil || order.AmountB.Cmp(big.NewInt(0)) < 1 {
-		return fmt.Errorf("order's amountB invalid")
+		return NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "amountB", Reason: "amountB must be positive"})
 	}
 
 	order.Price = new(big.Rat).Mul(
@@ -151,6 +174,25 @@ func generatePrice(order *types.Order) error {
 	return nil
 }
 
+// 允许客户端与relay之间存在的时间误差，单位秒
+const orderTimeTolerance = 60
+
+// checkOrderTime 拒绝已经过期以及timestamp距离当前时间过远的订单，
+// 与其他filter不同，该检查不能通过配置关闭
+func checkOrderTime(order *types.Order, now int64) error {
+	orderHash := order.Hash.Hex()
+	if order.Timestamp == nil || order.Ttl == nil || order.Ttl.Sign() <= 0 {
+		return NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "ttl", Reason: "ttl must be positive"})
+	}
+	if order.IsExpired(now) {
+		return NewRpcError(ErrCodeOrderExpired, ErrorData{OrderHash: orderHash, Field: "ttl", Reason: fmt.Sprintf("order expired at %d", new(big.Int).Add(order.Timestamp, order.Ttl).Int64())})
+	}
+	if order.Timestamp.Cmp(big.NewInt(now+orderTimeTolerance)) > 0 {
+		return NewRpcError(ErrCodeOrderNotYetValid, ErrorData{OrderHash: orderHash, Field: "timestamp", Reason: fmt.Sprintf("timestamp %s is later than current time %d", order.Timestamp.String(), now)})
+	}
+	return nil
+}
+
 type BaseFilter struct {
 	MinLrcFee *big.Int
 	MaxPrice  *big.Int
@@ -162,26 +204,27 @@ func (f *BaseFilter) filter(o *types.Order) (bool, error) {
 		hashLength = 32
 	)
 
+	orderHash := o.Hash.Hex()
 	if len(o.Hash) != hashLength {
-		return false, fmt.Errorf("gateway,base filter,order %s length error", o.Hash.Hex())
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "hash", Reason: "hash length error"})
 	}
 	if len(o.TokenB) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenB %s address length error", o.Hash.Hex(), o.TokenB.Hex())
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "tokenB", Reason: fmt.Sprintf("tokenB %s address length error", o.TokenB.Hex())})
 	}
 	if len(o.TokenS) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenS %s address length error", o.Hash.Hex(), o.TokenS.Hex())
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "tokenS", Reason: fmt.Sprintf("tokenS %s address length error", o.TokenS.Hex())})
 	}
 	if o.TokenB == o.TokenS {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenB == tokenS", o.Hash.Hex())
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "tokenB", Reason: "tokenB == tokenS"})
 	}
 	if len(o.Owner) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s owner %s address length error", o.Hash.Hex(), o.Owner.Hex())
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "owner", Reason: fmt.Sprintf("owner %s address length error", o.Owner.Hex())})
 	}
 	if len(o.Protocol) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s protocol %s address length error", o.Hash.Hex(), o.Owner.Hex())
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "protocol", Reason: fmt.Sprintf("protocol %s address length error", o.Protocol.Hex())})
 	}
 	if o.Price.Cmp(new(big.Rat).SetFrac(f.MaxPrice, big.NewInt(1))) > 0 || o.Price.Cmp(new(big.Rat).SetFrac(big.NewInt(1), f.MaxPrice)) < 0 {
-		return false, fmt.Errorf("dao order convert down,price out of range")
+		return false, NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: orderHash, Field: "price", Reason: "price out of range"})
 	}
 	return true, nil
 }
@@ -193,9 +236,9 @@ func (f *SignFilter) filter(o *types.Order) (bool, error) {
 	o.Hash = o.GenerateHash()
 
 	if addr, err := o.SignerAddress(); nil != err {
-		return false, err
+		return false, NewRpcError(ErrCodeOrderSignInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "v", Reason: err.Error()})
 	} else if addr != o.Owner {
-		return false, fmt.Errorf("gateway,sign filter,o.Owner %s and signeraddress %s are not match", o.Owner.Hex(), addr.Hex())
+		return false, NewRpcError(ErrCodeOrderSignInvalid, ErrorData{OrderHash: o.Hash.Hex(), Field: "owner", Reason: fmt.Sprintf("owner %s and signer address %s are not match", o.Owner.Hex(), addr.Hex())})
 	}
 
 	return true, nil
@@ -207,6 +250,15 @@ type TokenFilter struct {
 }
 
 func (f *TokenFilter) filter(o *types.Order) (bool, error) {
+	for _, token := range []common.Address{o.TokenS, o.TokenB} {
+		if len(f.AllowTokens) > 0 && !f.AllowTokens[token] {
+			return false, NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: o.Hash.Hex(), Field: tokenField(o, token), Reason: fmt.Sprintf("token %s is not allowed", token.Hex())})
+		}
+		if f.DeniedTokens[token] {
+			return false, NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: o.Hash.Hex(), Field: tokenField(o, token), Reason: fmt.Sprintf("token %s is denied", token.Hex())})
+		}
+	}
+
 	supportTokenS := false
 	supportTokenB := false
 	for _, v := range util.AllTokens {
@@ -219,10 +271,10 @@ func (f *TokenFilter) filter(o *types.Order) (bool, error) {
 	}
 
 	if !supportTokenS {
-		return false, fmt.Errorf("gateway,token filter,tokenS:%s do not supported", o.TokenS.Hex())
+		return false, NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: o.Hash.Hex(), Field: "tokenS", Reason: fmt.Sprintf("tokenS %s do not supported", o.TokenS.Hex())})
 	}
 	if !supportTokenB {
-		return false, fmt.Errorf("gateway,token filter,tokenB:%s do not supported", o.TokenB.Hex())
+		return false, NewRpcError(ErrCodeTokenUnsupported, ErrorData{OrderHash: o.Hash.Hex(), Field: "tokenB", Reason: fmt.Sprintf("tokenB %s do not supported", o.TokenB.Hex())})
 	}
 
 	return true, nil
@@ -235,7 +287,7 @@ type CutoffFilter struct {
 // 如果订单接收在cutoff(cancel)事件之后，则该订单直接过滤
 func (f *CutoffFilter) filter(o *types.Order) (bool, error) {
 	if f.om.IsOrderCutoff(o.Protocol, o.Owner, o.Timestamp) {
-		return false, fmt.Errorf("gateway,cutoff filter order:%s should be cutoff", o.Owner.Hex())
+		return false, NewRpcError(ErrCodeOrderCutoff, ErrorData{OrderHash: o.Hash.Hex(), Field: "timestamp", Reason: fmt.Sprintf("order of owner %s is earlier than cutoff", o.Owner.Hex())})
 	}
 
 	return true, nil
@@ -0,0 +1,156 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/rs/cors"
+	"golang.org/x/net/websocket"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type httpReadWriteNopCloser struct {
+	io.Reader
+	io.Writer
+}
+
+func (t *httpReadWriteNopCloser) Close() error {
+	return nil
+}
+
+// rpcHandler 与rpc.Server.ServeHTTP相同，只是使用errorCodec返回带有错误码的错误
+type rpcHandler struct {
+	srv *rpc.Server
+}
+
+func newRpcHandler(srv *rpc.Server) http.Handler {
+	return &rpcHandler{srv: srv}
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > maxRequestContentLength {
+		http.Error(w,
+			fmt.Sprintf("content length too large (%d>%d)", r.ContentLength, maxRequestContentLength),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil || mt != "application/json" {
+		http.Error(w,
+			"invalid content type, only application/json is supported",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+
+	codec := newErrorCodec(rpc.NewJSONCodec(&httpReadWriteNopCloser{r.Body, w}))
+	defer codec.Close()
+	h.srv.ServeSingleRequest(codec, rpc.OptionMethodInvocation)
+}
+
+// newWebsocketHandler 与rpc.Server.WebsocketHandler相同，只是使用errorCodec返回带有错误码的错误，
+// 配置了限流时每条消息都经过limiter
+func newWebsocketHandler(srv *rpc.Server, allowedOrigins []string, limiter *requestLimiter) http.Handler {
+	origins := make(map[string]bool)
+	for _, origin := range allowedOrDefault(allowedOrigins) {
+		origins[strings.ToLower(origin)] = true
+	}
+
+	return websocket.Server{
+		Handshake: func(cfg *websocket.Config, req *http.Request) error {
+			origin := strings.ToLower(req.Header.Get("Origin"))
+			if origins["*"] || origins[origin] {
+				return nil
+			}
+			return fmt.Errorf("origin %s not allowed", origin)
+		},
+		Handler: func(conn *websocket.Conn) {
+			var rwc io.ReadWriteCloser = conn
+			if nil != limiter {
+				rwc = newRateLimitConn(conn, limiter)
+			}
+			srv.ServeCodec(newErrorCodec(rpc.NewJSONCodec(rwc)), rpc.OptionMethodInvocation|rpc.OptionSubscriptions)
+		},
+	}
+}
+
+// 未配置时与之前的行为保持一致，允许所有的origin
+func allowedOrDefault(allowed []string) []string {
+	if len(allowed) == 0 {
+		return []string{"*"}
+	}
+	return allowed
+}
+
+func newCorsHandler(allowedOrigins []string, next http.Handler) http.Handler {
+	c := cors.New(cors.Options{
+		AllowedOrigins: allowedOrDefault(allowedOrigins),
+		AllowedMethods: []string{"POST", "GET"},
+		MaxAge:         600,
+		AllowedHeaders: []string{"*"},
+	})
+	return c.Handler(next)
+}
+
+// vhostHandler 校验请求的Host header，防止DNS rebinding攻击
+type vhostHandler struct {
+	vhosts map[string]struct{}
+	next   http.Handler
+}
+
+func newVHostHandler(vhosts []string, next http.Handler) http.Handler {
+	h := &vhostHandler{vhosts: make(map[string]struct{}), next: next}
+	for _, vhost := range allowedOrDefault(vhosts) {
+		h.vhosts[strings.ToLower(vhost)] = struct{}{}
+	}
+	return h
+}
+
+func (h *vhostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 没有Host header的请求不是来自浏览器，不会受到DNS rebinding的影响
+	if r.Host == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// Host header中不包含端口
+		host = r.Host
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if _, exist := h.vhosts["*"]; exist {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if _, exist := h.vhosts[strings.ToLower(host)]; exist {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "invalid host specified", http.StatusForbidden)
+}
@@ -19,22 +19,25 @@
 package gateway
 
 import (
-	"errors"
 	"fmt"
+	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/market"
 	"github.com/Loopring/relay/market/util"
 	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/miner"
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rpc"
 	"math/big"
 	"net"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (*JsonrpcServiceImpl) Ping(val string, val2 int) (res string, err error) {
@@ -43,15 +46,17 @@ func (*JsonrpcServiceImpl) Ping(val string, val2 int) (res string, err error) {
 }
 
 type PageResult struct {
-	Data      []interface{} `json:"data"`
-	PageIndex int           `json:"pageIndex"`
-	PageSize  int           `json:"pageSize"`
-	Total     int           `json:"total"`
+	Data       []interface{} `json:"data"`
+	PageIndex  int           `json:"pageIndex"`
+	PageSize   int           `json:"pageSize"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"nextCursor,omitempty"`
 }
 
 type Depth struct {
 	ContractVersion string `json:"contractVersion"`
 	Market          string `json:"market"`
+	TickSize        string `json:"tickSize"`
 	Depth           AskBid `json:"depth"`
 }
 
@@ -60,31 +65,37 @@ type AskBid struct {
 	Sell [][]string `json:"sell"`
 }
 
-type DepthElement struct {
-	Price  string
-	Size   *big.Rat
-	Amount *big.Rat
-}
-
 type CommonTokenRequest struct {
 	ContractVersion string `json:"contractVersion"`
 	Owner           string `json:"owner"`
 }
 
 type OrderQuery struct {
-	Status          string `json:"status"`
-	PageIndex       int    `json:"pageIndex"`
-	PageSize        int    `json:"pageSize"`
-	ContractVersion string `json:"contractVersion"`
-	Owner           string `json:"owner"`
-	Market          string `json:"market"`
-	OrderHash       string `json:"orderHash"`
+	Status          string   `json:"status"`
+	Statuses        []string `json:"statuses"`
+	PageIndex       int      `json:"pageIndex"`
+	PageSize        int      `json:"pageSize"`
+	ContractVersion string   `json:"contractVersion"`
+	Owner           string   `json:"owner"`
+	Market          string   `json:"market"`
+	Side            string   `json:"side"` // buy或sell，相对于market中的第一个token
+	TokenS          string   `json:"tokenS"`
+	TokenB          string   `json:"tokenB"`
+	OrderHash       string   `json:"orderHash"`
+	CreateTimeFrom  int64    `json:"createTimeFrom"`
+	CreateTimeTo    int64    `json:"createTimeTo"`
+	ValidTimeFrom   int64    `json:"validTimeFrom"`
+	ValidTimeTo     int64    `json:"validTimeTo"`
+	SortBy          string   `json:"sortBy"`    // createTime、validTime或price
+	SortOrder       string   `json:"sortOrder"` // asc或desc，默认desc
+	Cursor          string   `json:"cursor"`
 }
 
 type DepthQuery struct {
 	Length          int    `json:"length"`
 	ContractVersion string `json:"contractVersion"`
 	Market          string `json:"market"`
+	Precision       *int   `json:"precision"` // 价格保留的小数位数，为空时使用market的tick size
 }
 
 type FillQuery struct {
@@ -97,6 +108,28 @@ type FillQuery struct {
 	PageSize        int
 }
 
+type CandleQuery struct {
+	Market   string `json:"market"`
+	Interval string `json:"interval"` // 1m、5m、15m、1h、4h、1d或1w
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+}
+
+type TradesQuery struct {
+	Market string `json:"market"`
+	Limit  int    `json:"limit"` // 默认20，最多50
+	Since  int64  `json:"since"` // 只返回该时间之后的成交
+}
+
+type TradeHistoryQuery struct {
+	Owner     string `json:"owner"`
+	Market    string `json:"market"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime"`
+	PageIndex int    `json:"pageIndex"`
+	PageSize  int    `json:"pageSize"`
+}
+
 type RingMinedQuery struct {
 	ContractVersion string
 	RingHash        string
@@ -132,6 +165,27 @@ type OrderJsonResult struct {
 	Status           string             `json:"status"`
 }
 
+const (
+	SubmitStatusAccepted     = "ACCEPTED"
+	SubmitStatusRejected     = "REJECTED"
+	SubmitStatusAlreadyKnown = "ALREADY_KNOWN"
+
+	// 批量提交以及查询订单的最大数量
+	maxBatchOrderCount = 50
+)
+
+type SubmitOrderResult struct {
+	OrderHash string            `json:"orderHash"`
+	Status    string            `json:"status"`
+	Error     *SubmitOrderError `json:"error,omitempty"`
+}
+
+type SubmitOrderError struct {
+	Code    int       `json:"code"`
+	Message string    `json:"message"`
+	Data    ErrorData `json:"data"`
+}
+
 type PriceQuote struct {
 	Currency string       `json:"currency"`
 	Tokens   []TokenPrice `json:"tokens"`
@@ -145,69 +199,193 @@ type TokenPrice struct {
 var RemoteAddrContextKey = "RemoteAddr"
 
 type JsonrpcService interface {
-	Start(port string)
+	Start()
 	Stop()
 }
 
 type JsonrpcServiceImpl struct {
-	port           string
+	options        *config.JsonrpcOptions
 	trendManager   market.TrendManager
 	orderManager   ordermanager.OrderManager
 	accountManager market.AccountManager
 	ethForwarder   *EthForwarder
 	marketCap      marketcap.MarketCapProvider
+	miner          *miner.Miner // relay模式下没有miner
+	subscriptions  *subscriptionHub
+	requestLimiter *requestLimiter // 按照remote address以及查询的owner限流，未启用时为nil
+	ownerLimiter   *rateLimiter    // 按照owner限制提交订单的频率，只在订单签名校验通过之后计算
+
+	rpcServer  *rpc.Server
+	httpServer *http.Server
+	wsServer   *http.Server
 }
 
-func NewJsonrpcService(port string, trendManager market.TrendManager, orderManager ordermanager.OrderManager, accountManager market.AccountManager, ethForwarder *EthForwarder, capProvider marketcap.MarketCapProvider) *JsonrpcServiceImpl {
+func NewJsonrpcService(options *config.JsonrpcOptions, trendManager market.TrendManager, orderManager ordermanager.OrderManager, accountManager market.AccountManager, ethForwarder *EthForwarder, capProvider marketcap.MarketCapProvider) *JsonrpcServiceImpl {
 	l := &JsonrpcServiceImpl{}
-	l.port = port
+	l.options = options
 	l.trendManager = trendManager
 	l.orderManager = orderManager
 	l.accountManager = accountManager
 	l.ethForwarder = ethForwarder
 	l.marketCap = capProvider
+	l.subscriptions = newSubscriptionHub(l)
+	l.requestLimiter = newRequestLimiter(&options.RateLimit)
+	if options.RateLimit.Enable {
+		l.ownerLimiter = newRateLimiter(options.RateLimit.OwnerWriteRate, options.RateLimit.OwnerWriteBurst)
+	}
 	return l
 }
 
+func (j *JsonrpcServiceImpl) SetMiner(minerInstance *miner.Miner) {
+	j.miner = minerInstance
+}
+
 func (j *JsonrpcServiceImpl) Start() {
 	handler := rpc.NewServer()
 	if err := handler.RegisterName("loopring", j); err != nil {
-		fmt.Println(err)
+		log.Errorf("gateway,jsonrpc register loopring service error:%s", err.Error())
 		return
 	}
 	if err := handler.RegisterName("eth", j.ethForwarder); err != nil {
-		fmt.Println(err)
+		log.Errorf("gateway,jsonrpc register eth service error:%s", err.Error())
 		return
 	}
-	var (
-		listener net.Listener
-		err      error
-	)
-	if listener, err = net.Listen("tcp", ":8083"); err != nil {
+	j.rpcServer = handler
+
+	endpoint := net.JoinHostPort(j.options.BindAddress, strconv.Itoa(j.options.Port))
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		log.Errorf("gateway,jsonrpc listen on %s error:%s", endpoint, err.Error())
 		return
 	}
-	go rpc.NewHTTPServer([]string{"*"}, handler).Serve(listener)
-	log.Info(fmt.Sprintf("HTTP endpoint opened on 8083"))
+	j.httpServer = &http.Server{}
+	j.httpServer.Handler = newVHostHandler(j.options.Vhosts, newCorsHandler(j.options.CorsDomain, newRateLimitHandler(j.requestLimiter, newRpcHandler(handler))))
+	j.setTimeouts(j.httpServer)
+	go j.serve(j.httpServer, listener)
+	log.Infof("HTTP endpoint opened on %s", endpoint)
 
-	return
+	if j.options.WsPort > 0 {
+		wsEndpoint := net.JoinHostPort(j.options.BindAddress, strconv.Itoa(j.options.WsPort))
+		wsListener, err := net.Listen("tcp", wsEndpoint)
+		if err != nil {
+			log.Errorf("gateway,websocket listen on %s error:%s", wsEndpoint, err.Error())
+			return
+		}
+		j.subscriptions.Start()
+		j.wsServer = &http.Server{Handler: newRateLimitHandler(j.requestLimiter, newWebsocketHandler(handler, j.options.CorsDomain, j.requestLimiter))}
+		go j.serve(j.wsServer, wsListener)
+		log.Infof("WebSocket endpoint opened on %s", wsEndpoint)
+	}
+}
+
+func (j *JsonrpcServiceImpl) Stop() {
+	if nil != j.wsServer {
+		j.subscriptions.Stop()
+		if err := j.wsServer.Close(); nil != err {
+			log.Errorf("gateway,websocket close error:%s", err.Error())
+		}
+	}
+	if nil != j.httpServer {
+		if err := j.httpServer.Close(); nil != err {
+			log.Errorf("gateway,jsonrpc close error:%s", err.Error())
+		}
+	}
+	if nil != j.rpcServer {
+		j.rpcServer.Stop()
+	}
+}
+
+func (j *JsonrpcServiceImpl) serve(server *http.Server, listener net.Listener) {
+	var err error
+	if j.options.TlsCertFile != "" && j.options.TlsKeyFile != "" {
+		err = server.ServeTLS(listener, j.options.TlsCertFile, j.options.TlsKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if nil != err && err != http.ErrServerClosed {
+		log.Errorf("gateway,jsonrpc serve on %s error:%s", listener.Addr().String(), err.Error())
+	}
+}
+
+func (j *JsonrpcServiceImpl) setTimeouts(server *http.Server) {
+	if j.options.ReadTimeout > 0 {
+		server.ReadTimeout = time.Duration(j.options.ReadTimeout) * time.Second
+	}
+	if j.options.WriteTimeout > 0 {
+		server.WriteTimeout = time.Duration(j.options.WriteTimeout) * time.Second
+	}
 }
 
 func (j *JsonrpcServiceImpl) SubmitOrder(order *types.OrderJsonRequest) (res string, err error) {
-	err = HandleOrder(types.ToOrder(order))
-	if err != nil {
-		fmt.Println(err)
+	if _, err = handleOrder(types.ToOrder(order), j.admitOwner); err != nil {
+		return "", err
+	}
+	return "SUBMIT_SUCCESS", nil
+}
+
+// SubmitOrders 批量提交订单，每个订单单独校验，返回结果的顺序与请求一致
+func (j *JsonrpcServiceImpl) SubmitOrders(orders []*types.OrderJsonRequest) (res []SubmitOrderResult, err error) {
+	if len(orders) == 0 || len(orders) > maxBatchOrderCount {
+		return nil, invalidParamsError("orders", fmt.Sprintf("count of orders must be between 1 and %d", maxBatchOrderCount))
+	}
+
+	res = make([]SubmitOrderResult, 0, len(orders))
+	for _, o := range orders {
+		order := types.ToOrder(o)
+		known, handleErr := handleOrder(order, j.admitOwner)
+
+		result := SubmitOrderResult{OrderHash: order.Hash.Hex()}
+		if handleErr != nil {
+			rpcErr := toRpcError(handleErr)
+			result.Status = SubmitStatusRejected
+			result.Error = &SubmitOrderError{Code: rpcErr.Code, Message: rpcErr.Message, Data: rpcErr.Data}
+		} else if known {
+			result.Status = SubmitStatusAlreadyKnown
+		} else {
+			result.Status = SubmitStatusAccepted
+		}
+		res = append(res, result)
 	}
-	res = "SUBMIT_SUCCESS"
-	return res, err
+	return res, nil
 }
 
 func (j *JsonrpcServiceImpl) GetOrders(query *OrderQuery) (res PageResult, err error) {
-	orderQuery, pi, ps := convertFromQuery(query)
-	queryRst, err := j.orderManager.GetOrders(orderQuery, pi, ps)
+	orderQuery, options, pi, ps, err := convertFromQuery(query)
 	if err != nil {
-		fmt.Println(err)
+		return res, err
+	}
+	queryRst, err := j.orderManager.GetOrders(orderQuery, options, pi, ps)
+	if err == dao.ErrInvalidOrderCursor {
+		return res, invalidParamsError("cursor", err.Error())
+	} else if err != nil {
+		return res, dbUnavailableError(err)
 	}
-	return buildOrderResult(queryRst), err
+	return buildOrderResult(queryRst), nil
+}
+
+// GetOrdersByHashes 批量查询订单当前的状态，不存在的订单不会出现在结果中
+func (j *JsonrpcServiceImpl) GetOrdersByHashes(orderHashes []string) (res []OrderJsonResult, err error) {
+	if len(orderHashes) == 0 || len(orderHashes) > maxBatchOrderCount {
+		return nil, invalidParamsError("orderHashes", fmt.Sprintf("count of order hashes must be between 1 and %d", maxBatchOrderCount))
+	}
+
+	hashes := make([]common.Hash, 0, len(orderHashes))
+	for _, h := range orderHashes {
+		hashes = append(hashes, common.HexToHash(h))
+	}
+
+	states, err := j.orderManager.GetOrdersByHashes(hashes)
+	if err != nil {
+		return nil, dbUnavailableError(err)
+	}
+
+	res = make([]OrderJsonResult, 0, len(states))
+	for _, hash := range hashes {
+		if state, ok := states[hash]; ok {
+			res = append(res, orderStateToJson(*state))
+		}
+	}
+	return res, nil
 }
 
 func (j *JsonrpcServiceImpl) GetDepth(query DepthQuery) (res Depth, err error) {
@@ -216,8 +394,12 @@ func (j *JsonrpcServiceImpl) GetDepth(query DepthQuery) (res Depth, err error) {
 	protocol := query.ContractVersion
 	length := query.Length
 
-	if mkt == "" || protocol == "" || util.ContractVersionConfig[protocol] == "" {
-		err = errors.New("market and correct contract version must be applied")
+	if mkt == "" {
+		err = invalidParamsError("market", "market must be applied")
+		return
+	}
+	if protocol == "" || util.ContractVersionConfig[protocol] == "" {
+		err = invalidParamsError("contractVersion", "correct contract version must be applied")
 		return
 	}
 
@@ -229,51 +411,49 @@ func (j *JsonrpcServiceImpl) GetDepth(query DepthQuery) (res Depth, err error) {
 
 	_, err = util.WrapMarket(a, b)
 	if err != nil {
-		err = errors.New("unsupported market type")
+		err = NewRpcError(ErrCodeMarketUnsupported, ErrorData{Field: "market", Reason: err.Error()})
 		return
 	}
-
-	empty := make([][]string, 0)
-
-	for i := range empty {
-		empty[i] = make([]string, 0)
+	baseToken, quoteToken := util.AllTokens[a], util.AllTokens[b]
+	if baseToken.Decimals == nil || quoteToken.Decimals == nil {
+		err = NewRpcError(ErrCodeMarketUnsupported, ErrorData{Field: "market", Reason: "decimals of " + a + " or " + b + " is unknown"})
+		return
 	}
-	askBid := AskBid{Buy: empty, Sell: empty}
-	depth := Depth{ContractVersion: util.ContractVersionConfig[protocol], Market: mkt, Depth: askBid}
-
-	//(TODO) 考虑到需要聚合的情况，所以每次取2倍的数据，先聚合完了再cut, 不是完美方案，后续再优化
-	asks, askErr := j.orderManager.GetOrderBook(
-		common.HexToAddress(util.ContractVersionConfig[protocol]),
-		util.AllTokens[a].Protocol,
-		util.AllTokens[b].Protocol, length*2)
 
-	if askErr != nil {
-		err = errors.New("get depth error , please refresh again")
+	tickSize, err := j.depthTickSize(mkt, query.Precision)
+	if err != nil {
+		err = toRpcError(err)
 		return
 	}
+	priceDigits := decimalDigits(tickSize)
+	baseDigits := decimalDigits(new(big.Rat).SetFrac(big.NewInt(1), baseToken.Decimals))
+	quoteDigits := decimalDigits(new(big.Rat).SetFrac(big.NewInt(1), quoteToken.Decimals))
 
-	depth.Depth.Sell = calculateDepth(asks, length, true, util.AllTokens[a].Decimals, util.AllTokens[b].Decimals)
+	depth := Depth{ContractVersion: util.ContractVersionConfig[protocol], Market: mkt, TickSize: tickSize.FloatString(priceDigits)}
+	protocolAddress := common.HexToAddress(util.ContractVersionConfig[protocol])
 
-	bids, bidErr := j.orderManager.GetOrderBook(
-		common.HexToAddress(util.ContractVersionConfig[protocol]),
-		util.AllTokens[b].Protocol,
-		util.AllTokens[a].Protocol, length*2)
-
-	if bidErr != nil {
-		err = errors.New("get depth error , please refresh again")
+	asks := newDepthSide(true, tickSize, baseToken.Decimals, quoteToken.Decimals, j.spendableFn(baseToken.Protocol))
+	if askErr := j.fillDepthSide(asks, protocolAddress, baseToken.Protocol, quoteToken.Protocol, length); askErr != nil {
+		err = dbUnavailableError(askErr)
 		return
 	}
+	depth.Depth.Sell = asks.result(length, priceDigits, baseDigits, quoteDigits)
 
-	depth.Depth.Buy = calculateDepth(bids, length, false, util.AllTokens[b].Decimals, util.AllTokens[a].Decimals)
+	bids := newDepthSide(false, tickSize, baseToken.Decimals, quoteToken.Decimals, j.spendableFn(quoteToken.Protocol))
+	if bidErr := j.fillDepthSide(bids, protocolAddress, quoteToken.Protocol, baseToken.Protocol, length); bidErr != nil {
+		err = dbUnavailableError(bidErr)
+		return
+	}
+	depth.Depth.Buy = bids.result(length, priceDigits, baseDigits, quoteDigits)
 
-	return depth, err
+	return depth, nil
 }
 
 func (j *JsonrpcServiceImpl) GetFills(query FillQuery) (dao.PageResult, error) {
 	res, err := j.orderManager.FillsPageQuery(fillQueryToMap(query))
 
 	if err != nil {
-		return dao.PageResult{}, nil
+		return dao.PageResult{}, dbUnavailableError(err)
 	}
 
 	result := dao.PageResult{PageIndex: res.PageIndex, PageSize: res.PageSize, Total: res.Total, Data: make([]interface{}, 0)}
@@ -287,8 +467,30 @@ func (j *JsonrpcServiceImpl) GetFills(query FillQuery) (dao.PageResult, error) {
 	return result, nil
 }
 
+// GetTradeHistory owner的成交记录，包含成交价格、手续费以及成交时的法币价值
+func (j *JsonrpcServiceImpl) GetTradeHistory(query TradeHistoryQuery) (res dao.PageResult, err error) {
+	if !common.IsHexAddress(query.Owner) {
+		return res, invalidParamsError("owner", "owner must be an address")
+	}
+	if query.StartTime > 0 && query.EndTime > 0 && query.StartTime > query.EndTime {
+		return res, invalidParamsError("endTime", "endTime is earlier than startTime")
+	}
+	if query.PageSize > 50 {
+		query.PageSize = 50
+	}
+
+	q := ordermanager.TradeHistoryQuery{Owner: query.Owner, Market: query.Market, Start: query.StartTime, End: query.EndTime}
+	if res, err = j.orderManager.GetTradeHistory(q, query.PageIndex, query.PageSize); err != nil {
+		return res, dbUnavailableError(err)
+	}
+	return res, nil
+}
+
 func (j *JsonrpcServiceImpl) GetTicker(contractVersion string) (res []market.Ticker, err error) {
 	res, err = j.trendManager.GetTicker()
+	if err != nil {
+		return res, dbUnavailableError(err)
+	}
 
 	for i, t := range res {
 		j.fillBuyAndSell(&t, contractVersion)
@@ -299,19 +501,60 @@ func (j *JsonrpcServiceImpl) GetTicker(contractVersion string) (res []market.Tic
 
 func (j *JsonrpcServiceImpl) GetTrend(market string) (res []market.Trend, err error) {
 	res, err = j.trendManager.GetTrends(market)
+	if err != nil {
+		return res, dbUnavailableError(err)
+	}
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].Start < res[j].Start
 	})
 	return
 }
 
+func (j *JsonrpcServiceImpl) GetCandles(query CandleQuery) (res []market.Trend, err error) {
+	mkt := strings.ToUpper(query.Market)
+	if _, err = util.WrapMarket(util.UnWrap(mkt)); err != nil {
+		return res, NewRpcError(ErrCodeMarketUnsupported, ErrorData{Field: "market", Reason: err.Error()})
+	}
+
+	res, err = j.trendManager.GetCandles(mkt, query.Interval, query.Start, query.End)
+	switch err {
+	case nil:
+		return res, nil
+	case market.ErrUnsupportedInterval:
+		return res, invalidParamsError("interval", err.Error())
+	case market.ErrInvalidCandleRange:
+		return res, invalidParamsError("start", err.Error())
+	default:
+		return res, dbUnavailableError(err)
+	}
+}
+
+func (j *JsonrpcServiceImpl) GetTrades(query TradesQuery) (res []market.Trade, err error) {
+	mkt := strings.ToUpper(query.Market)
+	if _, err = util.WrapMarket(util.UnWrap(mkt)); err != nil {
+		return res, NewRpcError(ErrCodeMarketUnsupported, ErrorData{Field: "market", Reason: err.Error()})
+	}
+	if query.Limit < 0 {
+		return res, invalidParamsError("limit", "limit can't be negative")
+	}
+
+	if res, err = j.trendManager.GetTrades(mkt, query.Limit, query.Since); err != nil {
+		return res, dbUnavailableError(err)
+	}
+	return res, nil
+}
+
 func (j *JsonrpcServiceImpl) GetRingMined(query RingMinedQuery) (res dao.PageResult, err error) {
-	return j.orderManager.RingMinedPageQuery(ringMinedQueryToMap(query))
+	if res, err = j.orderManager.RingMinedPageQuery(ringMinedQueryToMap(query)); err != nil {
+		return res, dbUnavailableError(err)
+	}
+	return res, nil
 }
 
 func (j *JsonrpcServiceImpl) GetBalance(balanceQuery CommonTokenRequest) (res market.AccountJson, err error) {
 	account := j.accountManager.GetBalance(balanceQuery.ContractVersion, balanceQuery.Owner)
 	ethBalance := market.Balance{Token: "ETH", Balance: big.NewInt(0)}
+	// 以太坊节点出错时仍然返回token的余额，只是不包含ETH
 	b, bErr := j.ethForwarder.GetBalance(balanceQuery.Owner, "latest")
 	if bErr == nil {
 		ethBalance.Balance = types.HexToBigint(b)
@@ -321,6 +564,8 @@ func (j *JsonrpcServiceImpl) GetBalance(balanceQuery CommonTokenRequest) (res ma
 		}
 		newBalances["ETH"] = ethBalance
 		account.Balances = newBalances
+	} else {
+		log.Debugf("gateway,get eth balance of %s error:%s", balanceQuery.Owner, bErr.Error())
 	}
 	res = account.ToJsonObject(balanceQuery.ContractVersion)
 	return
@@ -329,16 +574,24 @@ func (j *JsonrpcServiceImpl) GetBalance(balanceQuery CommonTokenRequest) (res ma
 func (j *JsonrpcServiceImpl) GetCutoff(address, contractVersion, blockNumber string) (result string, err error) {
 	cutoff, err := j.ethForwarder.Accessor.GetCutoff(common.HexToAddress(util.ContractVersionConfig[contractVersion]), common.HexToAddress(address), blockNumber)
 	if err != nil {
-		return "", err
+		return "", chainNodeUnavailableError(err)
 	}
 	return cutoff.String(), nil
 }
 
 func (j *JsonrpcServiceImpl) GetPriceQuote(currency string) (result PriceQuote, err error) {
+	switch strings.ToUpper(currency) {
+	case "CNY", "USD", "BTC":
+	default:
+		return result, invalidParamsError("currency", "currency must be one of CNY, USD and BTC")
+	}
 
 	rst := PriceQuote{currency, make([]TokenPrice, 0)}
 	for k, v := range util.AllTokens {
-		price, _ := j.marketCap.GetMarketCapByCurrency(v.Protocol, currency)
+		price, err := j.marketCap.GetMarketCapByCurrency(v.Protocol, currency)
+		if err != nil {
+			return result, marketCapUnavailableError(err)
+		}
 		floatPrice, _ := price.Float64()
 		rst.Tokens = append(rst.Tokens, TokenPrice{k, floatPrice})
 	}
@@ -352,18 +605,18 @@ func (j *JsonrpcServiceImpl) GetEstimatedAllocatedAllowance(owner, token string)
 	statusSet = append(statusSet, types.ORDER_PARTIAL)
 
 	tokenAddress := util.AliasToAddress(token)
-	if tokenAddress.Hex() == "" {
-		return "", errors.New("unsupported token alias " + token)
+	if types.IsZeroAddress(tokenAddress) {
+		return "", NewRpcError(ErrCodeTokenUnsupported, ErrorData{Field: "token", Reason: "unsupported token alias " + token})
 	}
 	amount, err := j.orderManager.GetFrozenAmount(common.HexToAddress(owner), tokenAddress, statusSet)
 	if err != nil {
-		return "", err
+		return "", dbUnavailableError(err)
 	}
 
 	if token == "LRC" {
 		allLrcFee, err := j.orderManager.GetFrozenLRCFee(common.HexToAddress(owner), statusSet)
 		if err != nil {
-			return "", err
+			return "", dbUnavailableError(err)
 		}
 		amount.Add(amount, allLrcFee)
 	}
@@ -375,13 +628,28 @@ func (j *JsonrpcServiceImpl) GetSupportedMarket() (markets []string, err error)
 	return util.AllMarkets, err
 }
 
-func convertFromQuery(orderQuery *OrderQuery) (query map[string]interface{}, pageIndex int, pageSize int) {
+var orderSortFields = map[string]string{
+	"createTime": dao.OrderSortByCreateTime,
+	"validTime":  dao.OrderSortByValidTime,
+	"price":      dao.OrderSortByPrice,
+}
+
+func convertFromQuery(orderQuery *OrderQuery) (query map[string]interface{}, options *dao.OrderQueryOptions, pageIndex int, pageSize int, err error) {
 
 	query = make(map[string]interface{})
+	options = &dao.OrderQueryOptions{}
+
 	status := convertStatus(orderQuery.Status)
 	if uint8(status) != 0 {
 		query["status"] = uint8(status)
 	}
+	for _, s := range orderQuery.Statuses {
+		status := convertStatus(s)
+		if status == types.ORDER_UNKNOWN {
+			return nil, nil, 0, 0, invalidParamsError("statuses", "unknown status "+s)
+		}
+		options.Statuses = append(options.Statuses, status)
+	}
 	if orderQuery.Owner != "" {
 		query["owner"] = orderQuery.Owner
 	}
@@ -394,6 +662,68 @@ func convertFromQuery(orderQuery *OrderQuery) (query map[string]interface{}, pag
 	if orderQuery.OrderHash != "" {
 		query["order_hash"] = orderQuery.OrderHash
 	}
+
+	if orderQuery.TokenS != "" {
+		tokenS, err := parseToken(orderQuery.TokenS)
+		if err != nil {
+			return nil, nil, 0, 0, invalidParamsError("tokenS", err.Error())
+		}
+		query["token_s"] = tokenS.Hex()
+	}
+	if orderQuery.TokenB != "" {
+		tokenB, err := parseToken(orderQuery.TokenB)
+		if err != nil {
+			return nil, nil, 0, 0, invalidParamsError("tokenB", err.Error())
+		}
+		query["token_b"] = tokenB.Hex()
+	}
+
+	// 卖单卖出market中的第一个token，买单买入该token
+	if orderQuery.Side != "" {
+		token, _ := util.UnWrap(orderQuery.Market)
+		if token == "" {
+			return nil, nil, 0, 0, invalidParamsError("market", "market is required when side is specified")
+		}
+		tokenAddress, err := parseToken(token)
+		if err != nil {
+			return nil, nil, 0, 0, invalidParamsError("market", err.Error())
+		}
+		field, column := "", ""
+		switch strings.ToLower(orderQuery.Side) {
+		case "sell":
+			field, column = "tokenS", "token_s"
+		case "buy":
+			field, column = "tokenB", "token_b"
+		default:
+			return nil, nil, 0, 0, invalidParamsError("side", "side must be buy or sell")
+		}
+		if token, exists := query[column]; exists && token != tokenAddress.Hex() {
+			return nil, nil, 0, 0, invalidParamsError("side", fmt.Sprintf("side %s conflicts with %s", orderQuery.Side, field))
+		}
+		query[column] = tokenAddress.Hex()
+	}
+
+	options.CreateTimeFrom = orderQuery.CreateTimeFrom
+	options.CreateTimeTo = orderQuery.CreateTimeTo
+	options.ValidTimeFrom = orderQuery.ValidTimeFrom
+	options.ValidTimeTo = orderQuery.ValidTimeTo
+
+	if orderQuery.SortBy != "" {
+		sortBy, ok := orderSortFields[orderQuery.SortBy]
+		if !ok {
+			return nil, nil, 0, 0, invalidParamsError("sortBy", "sortBy must be createTime, validTime or price")
+		}
+		options.SortBy = sortBy
+	}
+	switch strings.ToLower(orderQuery.SortOrder) {
+	case "", "desc":
+	case "asc":
+		options.SortAsc = true
+	default:
+		return nil, nil, 0, 0, invalidParamsError("sortOrder", "sortOrder must be asc or desc")
+	}
+	options.Cursor = orderQuery.Cursor
+
 	pageIndex = orderQuery.PageIndex
 	pageSize = orderQuery.PageSize
 	return
@@ -412,6 +742,8 @@ func convertStatus(s string) types.OrderStatus {
 		return types.ORDER_CANCEL
 	case "ORDER_CUTOFF":
 		return types.ORDER_CUTOFF
+	case "ORDER_EXPIRED":
+		return types.ORDER_EXPIRED
 	}
 	return types.ORDER_UNKNOWN
 }
@@ -428,89 +760,12 @@ func getStringStatus(s types.OrderStatus) string {
 		return "ORDER_CANCELED"
 	case types.ORDER_CUTOFF:
 		return "ORDER_CUTOFF"
+	case types.ORDER_EXPIRED:
+		return "ORDER_EXPIRED"
 	}
 	return "ORDER_UNKNOWN"
 }
 
-func calculateDepth(states []types.OrderState, length int, isAsk bool, tokenSDecimal, tokenBDecimal *big.Int) [][]string {
-
-	if len(states) == 0 {
-		return [][]string{}
-	}
-
-	depth := make([][]string, 0)
-	for i := range depth {
-		depth[i] = make([]string, 0)
-	}
-
-	depthMap := make(map[string]DepthElement)
-
-	for _, s := range states {
-
-		price := *s.RawOrder.Price
-		amountS, amountB := s.RemainedAmount()
-		amountS = amountS.Quo(amountS, new(big.Rat).SetFrac(tokenSDecimal, big.NewInt(1)))
-		amountB = amountB.Quo(amountB, new(big.Rat).SetFrac(tokenBDecimal, big.NewInt(1)))
-
-		if amountS.Cmp(new(big.Rat).SetFloat64(0)) == 0 {
-			log.Debug("amount s is zero, skipped")
-			continue
-		}
-
-		if amountB.Cmp(new(big.Rat).SetFloat64(0)) == 0 {
-			log.Debug("amount b is zero, skipped")
-			continue
-		}
-
-		if isAsk {
-			price = *price.Inv(&price)
-			priceFloatStr := price.FloatString(10)
-			if v, ok := depthMap[priceFloatStr]; ok {
-				amount := v.Amount
-				size := v.Size
-				amount = amount.Add(amount, amountS)
-				size = size.Add(size, amountB)
-				depthMap[priceFloatStr] = DepthElement{Price: v.Price, Amount: amount, Size: size}
-			} else {
-				depthMap[priceFloatStr] = DepthElement{Price: priceFloatStr, Amount: amountS, Size: amountB}
-			}
-		} else {
-			priceFloatStr := price.FloatString(10)
-			if v, ok := depthMap[priceFloatStr]; ok {
-				amount := v.Amount
-				size := v.Size
-				amount = amount.Add(amount, amountB)
-				size = size.Add(size, amountS)
-				depthMap[priceFloatStr] = DepthElement{Price: v.Price, Amount: amount, Size: size}
-			} else {
-				depthMap[priceFloatStr] = DepthElement{Price: priceFloatStr, Amount: amountB, Size: amountS}
-			}
-		}
-	}
-
-	for k, v := range depthMap {
-		amount, _ := v.Amount.Float64()
-		size, _ := v.Size.Float64()
-		depth = append(depth, []string{k, strconv.FormatFloat(amount, 'f', 10, 64), strconv.FormatFloat(size, 'f', 10, 64)})
-	}
-
-	sort.Slice(depth, func(i, j int) bool {
-		cmpA, _ := strconv.ParseFloat(depth[i][0], 64)
-		cmpB, _ := strconv.ParseFloat(depth[j][0], 64)
-		if isAsk {
-			return cmpA < cmpB
-		} else {
-			return cmpA > cmpB
-		}
-
-	})
-
-	if length < len(depth) {
-		return depth[:length]
-	}
-	return depth
-}
-
 func fillQueryToMap(q FillQuery) (map[string]interface{}, int, int) {
 	rst := make(map[string]interface{})
 	var pi, ps int
@@ -568,7 +823,7 @@ func ringMinedQueryToMap(q RingMinedQuery) (map[string]interface{}, int, int) {
 
 func buildOrderResult(src dao.PageResult) PageResult {
 
-	rst := PageResult{Total: src.Total, PageIndex: src.PageIndex, PageSize: src.PageSize, Data: make([]interface{}, 0)}
+	rst := PageResult{Total: src.Total, PageIndex: src.PageIndex, PageSize: src.PageSize, NextCursor: src.NextCursor, Data: make([]interface{}, 0)}
 
 	for _, d := range src.Data {
 		o := d.(types.OrderState)
@@ -607,7 +862,7 @@ func orderStateToJson(src types.OrderState) OrderJsonResult {
 }
 
 func (j *JsonrpcServiceImpl) fillBuyAndSell(ticker *market.Ticker, contractVersion string) {
-	queryDepth := DepthQuery{1, contractVersion, ticker.Market}
+	queryDepth := DepthQuery{Length: 1, ContractVersion: contractVersion, Market: ticker.Market}
 
 	depth, err := j.GetDepth(queryDepth)
 	if err != nil {
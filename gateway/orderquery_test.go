@@ -0,0 +1,145 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"reflect"
+	"testing"
+)
+
+var (
+	testLrcAddress  = common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	testWethAddress = common.HexToAddress("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2")
+)
+
+func setTestTokens() {
+	util.AllTokens = map[string]types.Token{
+		"LRC":  {Protocol: testLrcAddress, Symbol: "LRC"},
+		"WETH": {Protocol: testWethAddress, Symbol: "WETH"},
+	}
+}
+
+func TestConvertFromQuery(t *testing.T) {
+	setTestTokens()
+
+	query, options, pageIndex, pageSize, err := convertFromQuery(&OrderQuery{
+		Owner:          "0x8888f1f195afa192cfee860698584c030f4c9db1",
+		Market:         "LRC-WETH",
+		Side:           "sell",
+		TokenB:         "WETH",
+		Statuses:       []string{"ORDER_NEW", "ORDER_PARTIAL"},
+		CreateTimeFrom: 100,
+		CreateTimeTo:   200,
+		SortBy:         "price",
+		SortOrder:      "asc",
+		Cursor:         "abc",
+		PageIndex:      2,
+		PageSize:       30,
+	})
+	if err != nil {
+		t.Fatalf("convert query error:%s", err.Error())
+	}
+
+	expectQuery := map[string]interface{}{
+		"owner":   "0x8888f1f195afa192cfee860698584c030f4c9db1",
+		"market":  "LRC-WETH",
+		"token_s": testLrcAddress.Hex(),
+		"token_b": testWethAddress.Hex(),
+	}
+	if !reflect.DeepEqual(query, expectQuery) {
+		t.Errorf("query %v, expect %v", query, expectQuery)
+	}
+	expectOptions := &dao.OrderQueryOptions{
+		Statuses:       []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL},
+		CreateTimeFrom: 100,
+		CreateTimeTo:   200,
+		SortBy:         dao.OrderSortByPrice,
+		SortAsc:        true,
+		Cursor:         "abc",
+	}
+	if !reflect.DeepEqual(options, expectOptions) {
+		t.Errorf("options %+v, expect %+v", options, expectOptions)
+	}
+	if pageIndex != 2 || pageSize != 30 {
+		t.Errorf("page %d/%d, expect 2/30", pageIndex, pageSize)
+	}
+}
+
+func TestConvertFromQuerySide(t *testing.T) {
+	setTestTokens()
+
+	tests := []struct {
+		query   OrderQuery
+		column  string
+		invalid string
+	}{
+		{query: OrderQuery{Market: "LRC-WETH", Side: "sell"}, column: "token_s"},
+		{query: OrderQuery{Market: "LRC-WETH", Side: "BUY"}, column: "token_b"},
+		{query: OrderQuery{Market: "LRC-WETH", Side: "buy", TokenB: "LRC"}, column: "token_b"},
+		{query: OrderQuery{Market: "LRC-WETH", Side: "sell", TokenS: "WETH"}, invalid: "side"},
+		{query: OrderQuery{Market: "LRC-WETH", Side: "buy", TokenB: testWethAddress.Hex()}, invalid: "side"},
+		{query: OrderQuery{Side: "sell"}, invalid: "market"},
+		{query: OrderQuery{Market: "LRC-WETH", Side: "both"}, invalid: "side"},
+	}
+
+	for _, test := range tests {
+		query, _, _, _, err := convertFromQuery(&test.query)
+		if test.invalid != "" {
+			rpcErr, ok := err.(*RpcError)
+			if !ok || rpcErr.Code != ErrCodeInvalidParams || rpcErr.Data.Field != test.invalid {
+				t.Errorf("query %+v should be rejected by field %s, err:%v", test.query, test.invalid, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("query %+v error:%s", test.query, err.Error())
+			continue
+		}
+		if query[test.column] != testLrcAddress.Hex() {
+			t.Errorf("query %+v, %s is %v", test.query, test.column, query[test.column])
+		}
+	}
+}
+
+func TestConvertFromQueryInvalid(t *testing.T) {
+	setTestTokens()
+
+	tests := []struct {
+		query OrderQuery
+		field string
+	}{
+		{query: OrderQuery{Statuses: []string{"ORDER_UNKNOWN"}}, field: "statuses"},
+		{query: OrderQuery{TokenS: "FOO"}, field: "tokenS"},
+		{query: OrderQuery{TokenB: "FOO"}, field: "tokenB"},
+		{query: OrderQuery{SortBy: "amountS"}, field: "sortBy"},
+		{query: OrderQuery{SortOrder: "up"}, field: "sortOrder"},
+	}
+
+	for _, test := range tests {
+		_, _, _, _, err := convertFromQuery(&test.query)
+		rpcErr, ok := err.(*RpcError)
+		if !ok || rpcErr.Code != ErrCodeInvalidParams || rpcErr.Data.Field != test.field {
+			t.Errorf("query %+v should be rejected by field %s, err:%v", test.query, test.field, err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/rcrowley/go-metrics"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxRequestContentLength = 1024 * 128
+
+	limitKindRead  = "read"
+	limitKindWrite = "write"
+)
+
+// 消耗写入配额的方法，其余方法都按照读请求计算
+var writeMethods = map[string]bool{
+	"loopring_submitOrder":  true,
+	"loopring_submitOrders": true,
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter 令牌桶限流，rate为每秒生成的令牌数，burst为桶的容量
+type rateLimiter struct {
+	mtx       sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	l := &rateLimiter{}
+	l.rate = rate
+	l.burst = float64(burst)
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.buckets = make(map[string]*tokenBucket)
+	l.lastSweep = time.Now()
+	return l
+}
+
+func (l *rateLimiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+func (l *rateLimiter) AllowN(key string, n int) bool {
+	// 未配置的限流器不做任何限制
+	if nil == l {
+		return true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < float64(n) {
+		return false
+	}
+	bucket.tokens -= float64(n)
+	return true
+}
+
+// sweep 删除已经填满的桶，避免内存随着地址的数量增长
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	fullAfter := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > fullAfter {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// requestLimiter 按照remote address以及查询的owner限流，http请求以及websocket中的每条消息都需要经过该限流器，
+// 提交订单时owner的限流需要先校验订单签名，见JsonrpcServiceImpl.admitOwner
+type requestLimiter struct {
+	ipLimiters       map[string]*rateLimiter
+	ownerReadLimiter *rateLimiter
+}
+
+func newRequestLimiter(options *config.RateLimitOptions) *requestLimiter {
+	if !options.Enable {
+		return nil
+	}
+
+	l := &requestLimiter{}
+	l.ipLimiters = map[string]*rateLimiter{
+		limitKindRead:  newRateLimiter(options.IpReadRate, options.IpReadBurst),
+		limitKindWrite: newRateLimiter(options.IpWriteRate, options.IpWriteBurst),
+	}
+	l.ownerReadLimiter = newRateLimiter(options.OwnerReadRate, options.OwnerReadBurst)
+	return l
+}
+
+// check 检查一条jsonrpc消息（单个请求或者批量请求）是否超过限制，超过时返回被拒绝请求的id以及原因
+// 格式错误的消息不做限制，交给rpc server返回parse error
+func (l *requestLimiter) check(remoteAddr string, body []byte) (json.RawMessage, *rateLimitErrorData) {
+	var reqs []rateLimitRequest
+	var err error
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &reqs)
+	} else {
+		req := rateLimitRequest{}
+		err = json.Unmarshal(trimmed, &req)
+		reqs = append(reqs, req)
+	}
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, req := range reqs {
+		kind := limitKindRead
+		if writeMethods[req.Method] {
+			kind = limitKindWrite
+		}
+		// 批量提交时每个订单消耗一个令牌
+		cost := 1
+		if kind == limitKindWrite {
+			cost = requestOrderCount(req.Params)
+		}
+		if !l.ipLimiters[kind].AllowN(remoteAddr, cost) {
+			return req.Id, &rateLimitErrorData{Limit: "ip", Kind: kind, Method: req.Method, Reason: "too many requests from " + remoteAddr}
+		}
+		if kind == limitKindRead {
+			if owner := requestOwner(req.Params); owner != "" && !l.ownerReadLimiter.Allow(owner) {
+				return req.Id, &rateLimitErrorData{Limit: "owner", Kind: kind, Method: req.Method, Reason: "too many requests of owner " + owner}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// rateLimitHandler 对http请求限流，websocket的握手按照一次读请求计算，之后的消息由rateLimitConn限流
+type rateLimitHandler struct {
+	limiter *requestLimiter
+	next    http.Handler
+}
+
+func newRateLimitHandler(limiter *requestLimiter, next http.Handler) http.Handler {
+	if nil == limiter {
+		return next
+	}
+	return &rateLimitHandler{limiter: limiter, next: next}
+}
+
+type rateLimitRequest struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rateLimitErrorData struct {
+	Limit  string `json:"limit"`
+	Kind   string `json:"kind"`
+	Method string `json:"method,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type rateLimitError struct {
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Data    rateLimitErrorData `json:"data"`
+}
+
+type rateLimitResponse struct {
+	Version string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Error   rateLimitError  `json:"error"`
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	r = r.WithContext(context.WithValue(r.Context(), RemoteAddrContextKey, remoteAddr))
+
+	if r.Method == http.MethodOptions {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	// websocket握手等非jsonrpc请求按照一次读请求计算
+	if r.Method != http.MethodPost {
+		if !h.limiter.ipLimiters[limitKindRead].Allow(remoteAddr) {
+			h.reject(w, nil, &rateLimitErrorData{Limit: "ip", Kind: limitKindRead, Reason: "too many requests from " + remoteAddr})
+			return
+		}
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestContentLength))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if id, data := h.limiter.check(remoteAddr, body); nil != data {
+		h.reject(w, id, data)
+		return
+	}
+
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *rateLimitHandler) reject(w http.ResponseWriter, id json.RawMessage, data *rateLimitErrorData) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(newRateLimitResponse(id, data))
+}
+
+func newRateLimitResponse(id json.RawMessage, data *rateLimitErrorData) rateLimitResponse {
+	metrics.GetOrRegisterCounter("gateway/ratelimit/"+data.Limit+"/"+data.Kind, nil).Inc(1)
+	log.Debugf("gateway,rate limit rejected %s request, limit:%s method:%s", data.Kind, data.Limit, data.Method)
+
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	res := rateLimitResponse{Version: "2.0", Id: id}
+	res.Error = rateLimitError{Code: ErrCodeRateLimited, Message: errMessages[ErrCodeRateLimited], Data: *data}
+	return res
+}
+
+// rateLimitConn 逐条读取websocket消息，超过限制的消息直接返回错误，不交给rpc server处理
+type rateLimitConn struct {
+	*websocket.Conn
+	limiter    *requestLimiter
+	remoteAddr string
+	pending    []byte
+}
+
+func newRateLimitConn(conn *websocket.Conn, limiter *requestLimiter) *rateLimitConn {
+	c := &rateLimitConn{Conn: conn, limiter: limiter}
+	c.remoteAddr, _ = conn.Request().Context().Value(RemoteAddrContextKey).(string)
+	conn.MaxPayloadBytes = maxRequestContentLength
+	return c
+}
+
+func (c *rateLimitConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+			return 0, err
+		}
+		if id, data := c.limiter.check(c.remoteAddr, msg); nil != data {
+			if err := websocket.JSON.Send(c.Conn, newRateLimitResponse(id, data)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// requestOwner 读请求中查询的owner，第一个参数是带有owner字段的对象或者地址时返回小写的地址
+func requestOwner(raw json.RawMessage) string {
+	var params []json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil || len(params) == 0 {
+		return ""
+	}
+	query := struct {
+		Owner string `json:"owner"`
+	}{}
+	if err := json.Unmarshal(params[0], &query); err == nil && common.IsHexAddress(query.Owner) {
+		return strings.ToLower(common.HexToAddress(query.Owner).Hex())
+	}
+	var address string
+	if err := json.Unmarshal(params[0], &address); err == nil && common.IsHexAddress(address) {
+		return strings.ToLower(common.HexToAddress(address).Hex())
+	}
+	return ""
+}
+
+// requestOrderCount 第一个参数中订单的数量，参数是订单数组时为数组的长度，否则为1
+func requestOrderCount(raw json.RawMessage) int {
+	var params []json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil || len(params) == 0 {
+		return 1
+	}
+	var orders []json.RawMessage
+	if err := json.Unmarshal(params[0], &orders); err != nil || len(orders) == 0 {
+		return 1
+	}
+	return len(orders)
+}
+
+// admitOwner 订单签名校验通过之后才按照owner消耗令牌，避免伪造的owner消耗其他用户的配额
+func (j *JsonrpcServiceImpl) admitOwner(order *types.Order) error {
+	if j.ownerLimiter.Allow(strings.ToLower(order.Owner.Hex())) {
+		return nil
+	}
+	metrics.GetOrRegisterCounter("gateway/ratelimit/owner/"+limitKindWrite, nil).Inc(1)
+	log.Debugf("gateway,rate limit rejected order %s of owner %s", order.Hash.Hex(), order.Owner.Hex())
+	return NewRpcError(ErrCodeRateLimited, ErrorData{OrderHash: order.Hash.Hex(), Field: "owner", Reason: "too many orders of owner " + order.Owner.Hex()})
+}
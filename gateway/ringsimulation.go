@@ -0,0 +1,167 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+)
+
+// SimulatedOrderJson 数量与合约中一样为整数，法币金额保留ringSubmissionLegalPrecision位小数
+type SimulatedOrderJson struct {
+	OrderHash        string `json:"orderHash"`
+	AvailableAmountS string `json:"availableAmountS"` // 余额、授权以及订单剩余数量中的最小值
+	RateAmountS      string `json:"rateAmountS"`
+	FillAmountS      string `json:"fillAmountS"`
+	FillAmountB      string `json:"fillAmountB"`
+	LrcFee           string `json:"lrcFee"`
+	Margin           string `json:"margin"`       // BuyNoMoreThanAmountB时为节省的tokenS，否则为多得到的tokenB
+	FeeSelection     uint8  `json:"feeSelection"` // 0为lrc费用，1为分润
+	LegalLrcFee      string `json:"legalLrcFee"`
+	LegalFeeS        string `json:"legalFeeS"` // 按照MarginSplitPercentage计算的分润
+	LegalFee         string `json:"legalFee"`  // 按照feeSelection选择的费用，选择分润时已经扣除支付给订单的lrc
+	LrcReward        string `json:"lrcReward"`
+}
+
+type SimulateRingResult struct {
+	RingHash         string               `json:"ringHash"`
+	Protocol         string               `json:"protocol"`
+	Miner            string               `json:"miner"`
+	Orders           []SimulatedOrderJson `json:"orders"`
+	LegalFee         string               `json:"legalFee"`
+	LegalCost        string               `json:"legalCost"`
+	Received         string               `json:"received"`
+	Profitable       bool                 `json:"profitable"` // 是否达到miner配置的最小收益，未达到时matcher不会提交
+	RegistryGas      string               `json:"registryGas,omitempty"`
+	ProtocolGas      string               `json:"protocolGas"`
+	ProtocolGasPrice string               `json:"protocolGasPrice"`
+	ProtocolData     string               `json:"protocolData"`
+	GasEstimated     bool                 `json:"gasEstimated"` // 为false时gas为配置的maxGasLimit
+	EstimateError    string               `json:"estimateError,omitempty"`
+	Called           bool                 `json:"called"`
+	CallError        string               `json:"callError,omitempty"`
+	WouldRevert      bool                 `json:"wouldRevert"`
+}
+
+// SimulateRing 按照orderHashes的顺序组成环路，计算成交数量、费用选择以及gas，但是不提交环路，
+// call为true时使用eth_call执行submitRing。只有启动了miner的节点才能使用
+func (j *JsonrpcServiceImpl) SimulateRing(orderHashes []string, call *bool) (res SimulateRingResult, err error) {
+	if nil == j.miner {
+		return res, NewRpcError(ErrCodeMinerUnavailable, ErrorData{Reason: "miner isn't started in this relay"})
+	}
+	if len(orderHashes) < 2 || len(orderHashes) > maxBatchOrderCount {
+		return res, invalidParamsError("orderHashes", fmt.Sprintf("count of order hashes must be between 2 and %d", maxBatchOrderCount))
+	}
+
+	hashes := make([]common.Hash, 0, len(orderHashes))
+	seen := make(map[common.Hash]bool)
+	for _, h := range orderHashes {
+		hash := common.HexToHash(h)
+		if seen[hash] {
+			return res, invalidParamsError("orderHashes", "duplicate order hash "+hash.Hex())
+		}
+		seen[hash] = true
+		hashes = append(hashes, hash)
+	}
+
+	states, err := j.orderManager.GetOrdersByHashes(hashes)
+	if err != nil {
+		return res, dbUnavailableError(err)
+	}
+	orders := make([]*types.OrderState, 0, len(hashes))
+	for _, hash := range hashes {
+		state, ok := states[hash]
+		if !ok {
+			return res, NewRpcError(ErrCodeOrderNotFound, ErrorData{OrderHash: hash.Hex(), Reason: "order not found"})
+		}
+		orders = append(orders, state)
+	}
+
+	simulation, err := j.miner.SimulateRing(orders, nil != call && *call)
+	if err != nil {
+		return res, NewRpcError(ErrCodeRingSimulateFailed, ErrorData{Reason: err.Error()})
+	}
+	return ringSimulationToJson(simulation), nil
+}
+
+func ringSimulationToJson(simulation *miner.RingSimulation) SimulateRingResult {
+	info := simulation.SubmitInfo
+	ringState := info.RawRing
+
+	rst := SimulateRingResult{}
+	rst.RingHash = info.Ringhash.Hex()
+	rst.Protocol = info.ProtocolAddress.Hex()
+	rst.Miner = info.Miner.Hex()
+	rst.LegalFee = ringState.LegalFee.FloatString(ringSubmissionLegalPrecision)
+	rst.LegalCost = info.LegalCost.FloatString(ringSubmissionLegalPrecision)
+	rst.Received = info.Received.FloatString(ringSubmissionLegalPrecision)
+	rst.Profitable = simulation.Profitable
+	if nil != info.RegistryGas {
+		rst.RegistryGas = info.RegistryGas.String()
+	}
+	rst.ProtocolGas = info.ProtocolGas.String()
+	rst.ProtocolGasPrice = info.ProtocolGasPrice.String()
+	rst.ProtocolData = common.ToHex(info.ProtocolData)
+	rst.GasEstimated = nil == simulation.EstimateErr
+	if nil != simulation.EstimateErr {
+		rst.EstimateError = simulation.EstimateErr.Error()
+	}
+	rst.Called = simulation.Called
+	if nil != simulation.CallErr {
+		rst.CallError = simulation.CallErr.Error()
+	}
+	rst.WouldRevert = simulation.WouldRevert()
+
+	rst.Orders = make([]SimulatedOrderJson, 0, len(ringState.Orders))
+	for _, filledOrder := range ringState.Orders {
+		o := SimulatedOrderJson{}
+		o.OrderHash = filledOrder.OrderState.RawOrder.Hash.Hex()
+		o.AvailableAmountS = ratAmountString(filledOrder.AvailableAmountS)
+		o.RateAmountS = ratAmountString(filledOrder.RateAmountS)
+		o.FillAmountS = ratAmountString(filledOrder.FillAmountS)
+		o.FillAmountB = ratAmountString(filledOrder.FillAmountB)
+		o.LrcFee = ratAmountString(filledOrder.LrcFee)
+		o.Margin = ratAmountString(filledOrder.FeeS)
+		o.FeeSelection = filledOrder.FeeSelection
+		o.LegalLrcFee = ratLegalString(filledOrder.LegalLrcFee)
+		o.LegalFeeS = ratLegalString(filledOrder.LegalFeeS)
+		o.LegalFee = ratLegalString(filledOrder.LegalFee)
+		o.LrcReward = ratLegalString(filledOrder.LrcReward)
+		rst.Orders = append(rst.Orders, o)
+	}
+	return rst
+}
+
+// ratAmountString 与GenerateSubmitArgs中的rateAmountS相同，四舍五入到整数
+func ratAmountString(r *big.Rat) string {
+	if nil == r {
+		return ""
+	}
+	return r.FloatString(0)
+}
+
+func ratLegalString(r *big.Rat) string {
+	if nil == r {
+		return ""
+	}
+	return r.FloatString(ringSubmissionLegalPrecision)
+}
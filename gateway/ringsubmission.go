@@ -0,0 +1,322 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	// 法币金额保留的小数位数
+	ringSubmissionLegalPrecision = 8
+
+	maxRingSubmissionPageSize = 50
+
+	// 没有指定时间范围时统计最近7天的环路
+	defaultRingGasStatsRange = 7 * 24 * 60 * 60
+)
+
+type RingSubmissionQuery struct {
+	Miner           string   `json:"miner"`
+	Statuses        []string `json:"statuses"` // pending、registered、submitted、mined或failed，为空时不限制
+	RingHash        string   `json:"ringHash"`
+	ContractVersion string   `json:"contractVersion"`
+	StartTime       int64    `json:"startTime"`
+	EndTime         int64    `json:"endTime"`
+	PageIndex       int      `json:"pageIndex"`
+	PageSize        int      `json:"pageSize"`
+}
+
+// RingSubmissionJson received以及legalCost为提交前的估计，actual开头的字段按照实际使用的gas以及当前的eth价格计算
+type RingSubmissionJson struct {
+	RingHash         string `json:"ringHash"`
+	Protocol         string `json:"protocol"`
+	Miner            string `json:"miner"`
+	Status           string `json:"status"`
+	OrdersCount      int64  `json:"ordersCount"`
+	RegistryTxHash   string `json:"registryTxHash"`
+	RegistryGas      string `json:"registryGas"`
+	RegistryGasPrice string `json:"registryGasPrice"`
+	RegistryUsedGas  string `json:"registryUsedGas"`
+	ProtocolTxHash   string `json:"protocolTxHash"`
+	ProtocolGas      string `json:"protocolGas"`
+	ProtocolGasPrice string `json:"protocolGasPrice"`
+	ProtocolUsedGas  string `json:"protocolUsedGas"`
+	LegalFee         string `json:"legalFee"`
+	LegalCost        string `json:"legalCost"`
+	Received         string `json:"received"`
+	ActualCost       string `json:"actualCost"` // 实际消耗的eth，单位为wei
+	ActualLegalCost  string `json:"actualLegalCost"`
+	ActualReceived   string `json:"actualReceived"`
+	BlockNumber      int64  `json:"blockNumber"`
+	Err              string `json:"err"`
+	CreateTime       int64  `json:"createTime"`
+	UpdateTime       int64  `json:"updateTime"`
+}
+
+type RingGasStatsQuery struct {
+	ContractVersion string `json:"contractVersion"`
+	StartTime       int64  `json:"startTime"`
+	EndTime         int64  `json:"endTime"`
+}
+
+// RingGasStat 相同订单数量的环路提交前估计的gas与submitRing实际使用的gas
+type RingGasStat struct {
+	OrdersCount     int64  `json:"ordersCount"`
+	Count           int64  `json:"count"`
+	AvgEstimatedGas string `json:"avgEstimatedGas"`
+	AvgUsedGas      string `json:"avgUsedGas"`
+	MaxUsedGas      string `json:"maxUsedGas"`
+	MaxUsedRatio    string `json:"maxUsedRatio"` // 实际使用的gas除以估计的gas的最大值
+}
+
+func (j *JsonrpcServiceImpl) GetRingSubmissions(query RingSubmissionQuery) (res PageResult, err error) {
+	q, statusSet, pi, ps, err := ringSubmissionQueryToMap(query)
+	if err != nil {
+		return res, err
+	}
+
+	queryRst, err := j.orderManager.RingSubmitInfoPageQuery(q, statusSet, query.StartTime, query.EndTime, pi, ps)
+	if err != nil {
+		return res, dbUnavailableError(err)
+	}
+
+	res = PageResult{PageIndex: queryRst.PageIndex, PageSize: queryRst.PageSize, Total: queryRst.Total, Data: make([]interface{}, 0)}
+	for _, v := range queryRst.Data {
+		info := v.(dao.RingSubmitInfo)
+		res.Data = append(res.Data, j.ringSubmissionToJson(&info))
+	}
+	return res, nil
+}
+
+func (j *JsonrpcServiceImpl) GetRingGasStats(query RingGasStatsQuery) ([]RingGasStat, error) {
+	protocol := ""
+	if query.ContractVersion != "" {
+		if protocol = util.ContractVersionConfig[query.ContractVersion]; protocol == "" {
+			return nil, invalidParamsError("contractVersion", "unsupported contract version "+query.ContractVersion)
+		}
+		protocol = common.HexToAddress(protocol).Hex()
+	}
+	end := query.EndTime
+	if end <= 0 {
+		end = time.Now().Unix()
+	}
+	start := query.StartTime
+	if start <= 0 {
+		start = end - defaultRingGasStatsRange
+	}
+	if start > end {
+		return nil, invalidParamsError("startTime", "startTime must be earlier than endTime")
+	}
+
+	infos, err := j.orderManager.RingSubmitInfosWithUsedGas(protocol, start, end)
+	if err != nil {
+		return nil, dbUnavailableError(err)
+	}
+	return ringGasStats(infos), nil
+}
+
+// ringGasStats 按照订单数量从小到大返回，估计的gas或者实际使用的gas无法解析的环路不统计
+func ringGasStats(infos []dao.RingSubmitInfo) []RingGasStat {
+	type gasSum struct {
+		count        int64
+		estimated    *big.Int
+		used         *big.Int
+		maxUsed      *big.Int
+		maxUsedRatio *big.Rat
+	}
+
+	sums := make(map[int64]*gasSum)
+	for _, info := range infos {
+		estimated, estimatedOk := new(big.Int).SetString(info.ProtocolGas, 0)
+		used, usedOk := new(big.Int).SetString(info.ProtocolUsedGas, 0)
+		if !estimatedOk || !usedOk || estimated.Sign() <= 0 || used.Sign() <= 0 {
+			continue
+		}
+		sum, exists := sums[info.OrdersCount]
+		if !exists {
+			sum = &gasSum{estimated: new(big.Int), used: new(big.Int), maxUsed: new(big.Int), maxUsedRatio: new(big.Rat)}
+			sums[info.OrdersCount] = sum
+		}
+		sum.count++
+		sum.estimated.Add(sum.estimated, estimated)
+		sum.used.Add(sum.used, used)
+		if used.Cmp(sum.maxUsed) > 0 {
+			sum.maxUsed.Set(used)
+		}
+		if ratio := new(big.Rat).SetFrac(used, estimated); ratio.Cmp(sum.maxUsedRatio) > 0 {
+			sum.maxUsedRatio = ratio
+		}
+	}
+
+	stats := make([]RingGasStat, 0, len(sums))
+	for ordersCount, sum := range sums {
+		count := big.NewInt(sum.count)
+		stat := RingGasStat{OrdersCount: ordersCount, Count: sum.count}
+		stat.AvgEstimatedGas = new(big.Int).Div(sum.estimated, count).String()
+		stat.AvgUsedGas = new(big.Int).Div(sum.used, count).String()
+		stat.MaxUsedGas = sum.maxUsed.String()
+		stat.MaxUsedRatio = sum.maxUsedRatio.FloatString(4)
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, k int) bool {
+		return stats[i].OrdersCount < stats[k].OrdersCount
+	})
+	return stats
+}
+
+func ringSubmissionQueryToMap(q RingSubmissionQuery) (map[string]interface{}, []types.RingSubmitStatus, int, int, error) {
+	rst := make(map[string]interface{})
+	var pi, ps int
+	if q.PageIndex <= 0 {
+		pi = 1
+	} else {
+		pi = q.PageIndex
+	}
+	if q.PageSize <= 0 || q.PageSize > maxRingSubmissionPageSize {
+		ps = maxRingSubmissionPageSize
+	} else {
+		ps = q.PageSize
+	}
+
+	if q.Miner != "" {
+		if !common.IsHexAddress(q.Miner) {
+			return nil, nil, 0, 0, invalidParamsError("miner", "miner must be an address")
+		}
+		rst["miner"] = common.HexToAddress(q.Miner).Hex()
+	}
+	if q.RingHash != "" {
+		rst["ringhash"] = common.HexToHash(q.RingHash).Hex()
+	}
+	if q.ContractVersion != "" {
+		protocol := util.ContractVersionConfig[q.ContractVersion]
+		if protocol == "" {
+			return nil, nil, 0, 0, invalidParamsError("contractVersion", "unsupported contract version "+q.ContractVersion)
+		}
+		rst["protocol_address"] = common.HexToAddress(protocol).Hex()
+	}
+
+	var statusSet []types.RingSubmitStatus
+	for _, s := range q.Statuses {
+		status := convertRingSubmitStatus(s)
+		if status == types.RING_SUBMIT_UNKNOWN {
+			return nil, nil, 0, 0, invalidParamsError("statuses", "unknown status "+s)
+		}
+		statusSet = append(statusSet, status)
+	}
+	return rst, statusSet, pi, ps, nil
+}
+
+func (j *JsonrpcServiceImpl) ringSubmissionToJson(info *dao.RingSubmitInfo) RingSubmissionJson {
+	rst := RingSubmissionJson{}
+	rst.RingHash = info.RingHash
+	rst.Protocol = info.ProtocolAddress
+	rst.Miner = info.Miner
+	rst.Status = getRingSubmitStatusString(types.RingSubmitStatus(info.Status))
+	rst.OrdersCount = info.OrdersCount
+	rst.RegistryTxHash = info.RegistryTxHash
+	rst.RegistryGas = info.RegistryGas
+	rst.RegistryGasPrice = info.RegistryGasPrice
+	rst.RegistryUsedGas = info.RegistryUsedGas
+	rst.ProtocolTxHash = info.ProtocolTxHash
+	rst.ProtocolGas = info.ProtocolGas
+	rst.ProtocolGasPrice = info.ProtocolGasPrice
+	rst.ProtocolUsedGas = info.ProtocolUsedGas
+	rst.LegalCost = info.LegalCost
+	rst.Received = info.Received
+	rst.BlockNumber = info.BlockNumber
+	rst.Err = info.Err
+	rst.CreateTime = info.CreateTime
+	rst.UpdateTime = info.UpdateTime
+
+	// 环路的法币收入为估计的收益加上估计的成本
+	received, receivedOk := new(big.Rat).SetString(info.Received)
+	legalCost, legalCostOk := new(big.Rat).SetString(info.LegalCost)
+	var legalFee *big.Rat
+	if receivedOk && legalCostOk {
+		legalFee = new(big.Rat).Add(received, legalCost)
+		rst.LegalFee = legalFee.FloatString(ringSubmissionLegalPrecision)
+	}
+
+	actualCost := new(big.Int)
+	usedGas := false
+	for _, pair := range [][2]string{{info.ProtocolUsedGas, info.ProtocolGasPrice}, {info.RegistryUsedGas, info.RegistryGasPrice}} {
+		gas, gasOk := new(big.Int).SetString(pair[0], 0)
+		gasPrice, gasPriceOk := new(big.Int).SetString(pair[1], 0)
+		if gasOk && gasPriceOk {
+			actualCost.Add(actualCost, new(big.Int).Mul(gas, gasPrice))
+			usedGas = true
+		}
+	}
+	if !usedGas {
+		return rst
+	}
+	rst.ActualCost = actualCost.String()
+
+	if nil == j.marketCap {
+		return rst
+	}
+	actualLegalCost, err := j.marketCap.LegalCurrencyValueOfEth(new(big.Rat).SetInt(actualCost))
+	if err != nil || nil == actualLegalCost {
+		return rst
+	}
+	rst.ActualLegalCost = actualLegalCost.FloatString(ringSubmissionLegalPrecision)
+	if nil != legalFee {
+		rst.ActualReceived = new(big.Rat).Sub(legalFee, actualLegalCost).FloatString(ringSubmissionLegalPrecision)
+	}
+	return rst
+}
+
+func convertRingSubmitStatus(s string) types.RingSubmitStatus {
+	switch s {
+	case "pending":
+		return types.RING_SUBMIT_PENDING
+	case "registered":
+		return types.RING_SUBMIT_REGISTERED
+	case "submitted":
+		return types.RING_SUBMIT_SUBMITTED
+	case "mined":
+		return types.RING_SUBMIT_MINED
+	case "failed":
+		return types.RING_SUBMIT_FAILED
+	}
+	return types.RING_SUBMIT_UNKNOWN
+}
+
+func getRingSubmitStatusString(s types.RingSubmitStatus) string {
+	switch s {
+	case types.RING_SUBMIT_PENDING:
+		return "pending"
+	case types.RING_SUBMIT_REGISTERED:
+		return "registered"
+	case types.RING_SUBMIT_SUBMITTED:
+		return "submitted"
+	case types.RING_SUBMIT_MINED:
+		return "mined"
+	case types.RING_SUBMIT_FAILED:
+		return "failed"
+	}
+	return "unknown"
+}
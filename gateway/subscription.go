@@ -0,0 +1,422 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"context"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// websocket订阅的topic，对应loopring_subscribe的第一个参数
+const (
+	SubscribeTopicDepth  = "depth"
+	SubscribeTopicTicker = "ticker"
+	SubscribeTopicFills  = "fills"
+	SubscribeTopicOrders = "orders"
+)
+
+// 每个订阅者待推送消息的上限，写socket跟不上的订阅者会被删除
+const subscriberQueueSize = 64
+
+type subscriber struct {
+	notifier *rpc.Notifier
+	id       rpc.ID
+	topic    string
+	depth    DepthQuery
+	fill     FillQuery
+	owner    common.Address
+	version  string
+
+	queue chan interface{}
+	done  chan struct{}
+}
+
+// subscriptionHub 监听eventemitter中订单以及成交相关的事件，并推送给websocket订阅者
+// 新成交和新订单实时推送，深度、ticker以及订单状态在收到新块时统一推送，
+// 此时上一个块中的事件已经被ordermanager写入数据库
+// 事件处理只修改状态以及把消息放入订阅者的队列，不会阻塞eventemitter.Emit，
+// 每个订阅者由各自的goroutine写socket，新块的推送在pushLoop中完成
+type subscriptionHub struct {
+	mtx         sync.Mutex
+	rpcService  *JsonrpcServiceImpl
+	subscribers map[string]map[rpc.ID]*subscriber
+
+	dirtyMarkets   map[string]bool
+	allMarketDirty bool
+	tickerDirty    bool
+	changedOrders  map[common.Hash]bool
+
+	newBlockChan chan struct{}
+	stopChan     chan struct{}
+
+	watchers map[string]*eventemitter.Watcher
+}
+
+func newSubscriptionHub(rpcService *JsonrpcServiceImpl) *subscriptionHub {
+	h := &subscriptionHub{}
+	h.rpcService = rpcService
+	h.subscribers = make(map[string]map[rpc.ID]*subscriber)
+	for _, topic := range []string{SubscribeTopicDepth, SubscribeTopicTicker, SubscribeTopicFills, SubscribeTopicOrders} {
+		h.subscribers[topic] = make(map[rpc.ID]*subscriber)
+	}
+	h.resetPending()
+	h.newBlockChan = make(chan struct{}, 1)
+
+	h.watchers = map[string]*eventemitter.Watcher{
+		eventemitter.OrderManagerGatewayNewOrder: {Concurrent: false, Handle: h.handleNewOrder},
+		eventemitter.OrderManagerExtractorFill:   {Concurrent: false, Handle: h.handleOrderFilled},
+		eventemitter.OrderManagerExtractorCancel: {Concurrent: false, Handle: h.handleOrderCancelled},
+		eventemitter.OrderManagerOrdersCutoff:    {Concurrent: false, Handle: h.handleOrdersCutoff},
+		eventemitter.ChainForkProcess:            {Concurrent: false, Handle: h.handleFork},
+		eventemitter.Block_New:                   {Concurrent: false, Handle: h.handleNewBlock},
+	}
+
+	return h
+}
+
+func (h *subscriptionHub) Start() {
+	h.stopChan = make(chan struct{})
+	go h.pushLoop(h.stopChan)
+	for topic, watcher := range h.watchers {
+		eventemitter.On(topic, watcher)
+	}
+}
+
+func (h *subscriptionHub) Stop() {
+	for topic, watcher := range h.watchers {
+		eventemitter.Un(topic, watcher)
+	}
+	close(h.stopChan)
+}
+
+// pushLoop 新块到达后计算并推送变化的订单、深度以及ticker，
+// 推送期间到达的多个新块只会触发一次推送
+func (h *subscriptionHub) pushLoop(stopChan chan struct{}) {
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-h.newBlockChan:
+			h.pushChanges()
+		}
+	}
+}
+
+func (h *subscriptionHub) resetPending() {
+	h.dirtyMarkets = make(map[string]bool)
+	h.allMarketDirty = false
+	h.tickerDirty = false
+	h.changedOrders = make(map[common.Hash]bool)
+}
+
+// subscribe 创建订阅，并在客户端取消订阅或者连接断开后删除
+func (h *subscriptionHub) subscribe(ctx context.Context, topic string, s *subscriber) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	sub := notifier.CreateSubscription()
+	s.notifier = notifier
+	s.id = sub.ID
+	s.topic = topic
+	s.queue = make(chan interface{}, subscriberQueueSize)
+	s.done = make(chan struct{})
+
+	h.mtx.Lock()
+	h.subscribers[topic][sub.ID] = s
+	h.mtx.Unlock()
+
+	go h.writeLoop(s)
+	go func() {
+		select {
+		case <-sub.Err():
+		case <-notifier.Closed():
+		case <-s.done:
+		}
+		h.remove(s)
+	}()
+
+	return sub, nil
+}
+
+// remove 删除订阅者并结束它的writeLoop，可以重复调用
+func (h *subscriptionHub) remove(s *subscriber) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if current, exists := h.subscribers[s.topic][s.id]; exists && current == s {
+		delete(h.subscribers[s.topic], s.id)
+		close(s.done)
+	}
+}
+
+func (h *subscriptionHub) writeLoop(s *subscriber) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case data := <-s.queue:
+			if err := s.notifier.Notify(s.id, data); err != nil {
+				log.Errorf("gateway,subscription %s notify error:%s", s.id, err.Error())
+			}
+		}
+	}
+}
+
+// notify 只把消息放入订阅者的队列，队列已满说明客户端读得太慢，直接删除该订阅
+func (h *subscriptionHub) notify(s *subscriber, data interface{}) {
+	select {
+	case s.queue <- data:
+	default:
+		log.Warnf("gateway,subscription %s of topic %s dropped, too many pending messages", s.id, s.topic)
+		h.remove(s)
+	}
+}
+
+func (h *subscriptionHub) topicSubscribers(topic string) []*subscriber {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	list := make([]*subscriber, 0, len(h.subscribers[topic]))
+	for _, s := range h.subscribers[topic] {
+		list = append(list, s)
+	}
+	return list
+}
+
+func (h *subscriptionHub) handleNewOrder(input eventemitter.EventData) error {
+	state := input.(*types.OrderState)
+
+	h.mtx.Lock()
+	h.markMarketDirty(state.RawOrder.TokenS, state.RawOrder.TokenB)
+	h.mtx.Unlock()
+
+	for _, s := range h.topicSubscribers(SubscribeTopicOrders) {
+		if s.owner == state.RawOrder.Owner {
+			h.notify(s, orderStateToJson(*state))
+		}
+	}
+	return nil
+}
+
+func (h *subscriptionHub) handleOrderFilled(input eventemitter.EventData) error {
+	event := input.(*types.OrderFilledEvent)
+
+	h.mtx.Lock()
+	h.dirtyMarkets[event.Market] = true
+	h.tickerDirty = true
+	h.changedOrders[event.OrderHash] = true
+	h.mtx.Unlock()
+
+	fill := dao.FillEvent{}
+	if err := fill.ConvertDown(event); err != nil {
+		return err
+	}
+	fill.TokenS = util.AddressToAlias(fill.TokenS)
+	fill.TokenB = util.AddressToAlias(fill.TokenB)
+
+	for _, s := range h.topicSubscribers(SubscribeTopicFills) {
+		if s.fill.Market != "" && !strings.EqualFold(s.fill.Market, event.Market) {
+			continue
+		}
+		if s.fill.Owner != "" && common.HexToAddress(s.fill.Owner) != event.Owner {
+			continue
+		}
+		if s.fill.ContractVersion != "" && common.HexToAddress(util.ContractVersionConfig[s.fill.ContractVersion]) != event.ContractAddress {
+			continue
+		}
+		h.notify(s, fill)
+	}
+	return nil
+}
+
+func (h *subscriptionHub) handleOrderCancelled(input eventemitter.EventData) error {
+	event := input.(*types.OrderCancelledEvent)
+
+	h.mtx.Lock()
+	h.changedOrders[event.OrderHash] = true
+	h.mtx.Unlock()
+	return nil
+}
+
+// handleOrdersCutoff 只推送本次cutoff更新的订单，ordermanager已经将这些订单更新为ORDER_CUTOFF
+func (h *subscriptionHub) handleOrdersCutoff(input eventemitter.EventData) error {
+	event := input.(*types.OrdersCutoffEvent)
+
+	h.mtx.Lock()
+	for _, orderHash := range event.OrderHashes {
+		h.changedOrders[orderHash] = true
+	}
+	h.mtx.Unlock()
+	return nil
+}
+
+func (h *subscriptionHub) handleFork(input eventemitter.EventData) error {
+	h.mtx.Lock()
+	h.allMarketDirty = true
+	h.tickerDirty = true
+	h.mtx.Unlock()
+	return nil
+}
+
+// 新块到达时，通知pushLoop推送上一个块中变化的订单状态、深度以及ticker
+func (h *subscriptionHub) handleNewBlock(input eventemitter.EventData) error {
+	select {
+	case h.newBlockChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (h *subscriptionHub) pushChanges() {
+	h.mtx.Lock()
+	changedOrders := h.changedOrders
+	tickerDirty := h.tickerDirty
+	h.changedOrders = make(map[common.Hash]bool)
+	h.tickerDirty = false
+	h.mtx.Unlock()
+
+	h.pushOrders(changedOrders)
+
+	h.mtx.Lock()
+	dirtyMarkets := h.dirtyMarkets
+	allMarketDirty := h.allMarketDirty
+	h.resetPending()
+	h.mtx.Unlock()
+
+	h.pushDepth(dirtyMarkets, allMarketDirty)
+	if tickerDirty {
+		h.pushTicker()
+	}
+}
+
+func (h *subscriptionHub) pushOrders(changedOrders map[common.Hash]bool) {
+	subscribers := h.topicSubscribers(SubscribeTopicOrders)
+
+	for orderHash := range changedOrders {
+		state, err := h.rpcService.orderManager.GetOrderByHash(orderHash)
+		if err != nil {
+			log.Debugf("gateway,subscription push order %s error:%s", orderHash.Hex(), err.Error())
+			continue
+		}
+
+		h.mtx.Lock()
+		h.markMarketDirty(state.RawOrder.TokenS, state.RawOrder.TokenB)
+		h.mtx.Unlock()
+
+		for _, s := range subscribers {
+			if s.owner == state.RawOrder.Owner {
+				h.notify(s, orderStateToJson(*state))
+			}
+		}
+	}
+}
+
+func (h *subscriptionHub) pushDepth(dirtyMarkets map[string]bool, allMarketDirty bool) {
+	// 订阅相同深度的客户端共用一次计算的结果
+	depths := make(map[string]Depth)
+	for _, s := range h.topicSubscribers(SubscribeTopicDepth) {
+		if !allMarketDirty && !dirtyMarkets[s.depth.Market] {
+			continue
+		}
+		key := depthQueryKey(s.depth)
+		depth, exists := depths[key]
+		if !exists {
+			var err error
+			if depth, err = h.rpcService.GetDepth(s.depth); err != nil {
+				log.Debugf("gateway,subscription push depth of %s error:%s", s.depth.Market, err.Error())
+				continue
+			}
+			depths[key] = depth
+		}
+		h.notify(s, depth)
+	}
+}
+
+func depthQueryKey(query DepthQuery) string {
+	precision := "-"
+	if nil != query.Precision {
+		precision = strconv.Itoa(*query.Precision)
+	}
+	return strings.Join([]string{strings.ToUpper(query.Market), query.ContractVersion, strconv.Itoa(query.Length), precision}, ",")
+}
+
+func (h *subscriptionHub) pushTicker() {
+	// 相同合约版本的订阅者共用一次计算的结果
+	tickers := make(map[string][]market.Ticker)
+	for _, s := range h.topicSubscribers(SubscribeTopicTicker) {
+		res, exists := tickers[s.version]
+		if !exists {
+			var err error
+			if res, err = h.rpcService.GetTicker(s.version); err != nil {
+				log.Debugf("gateway,subscription push ticker error:%s", err.Error())
+				continue
+			}
+			tickers[s.version] = res
+		}
+		h.notify(s, res)
+	}
+}
+
+func (h *subscriptionHub) markMarketDirty(tokenS, tokenB common.Address) {
+	if mkt, err := util.WrapMarketByAddress(tokenB.Hex(), tokenS.Hex()); err == nil {
+		h.dirtyMarkets[mkt] = true
+	}
+}
+
+// Depth 订阅某个市场的深度，深度发生变化时推送与loopring_getDepth相同的结果
+func (j *JsonrpcServiceImpl) Depth(ctx context.Context, query DepthQuery) (*rpc.Subscription, error) {
+	query.Market = strings.ToUpper(query.Market)
+	if _, err := j.GetDepth(query); err != nil {
+		return &rpc.Subscription{}, err
+	}
+	return j.subscriptions.subscribe(ctx, SubscribeTopicDepth, &subscriber{depth: query})
+}
+
+// Ticker 订阅所有市场的ticker，有新成交时推送与loopring_getTicker相同的结果
+func (j *JsonrpcServiceImpl) Ticker(ctx context.Context, contractVersion string) (*rpc.Subscription, error) {
+	if util.ContractVersionConfig[contractVersion] == "" {
+		return &rpc.Subscription{}, invalidParamsError("contractVersion", "correct contract version must be applied")
+	}
+	return j.subscriptions.subscribe(ctx, SubscribeTopicTicker, &subscriber{version: contractVersion})
+}
+
+// Fills 订阅新成交，可以按market、owner以及合约版本过滤
+func (j *JsonrpcServiceImpl) Fills(ctx context.Context, query FillQuery) (*rpc.Subscription, error) {
+	return j.subscriptions.subscribe(ctx, SubscribeTopicFills, &subscriber{fill: query})
+}
+
+// Orders 订阅某个地址的订单状态变化
+func (j *JsonrpcServiceImpl) Orders(ctx context.Context, owner string) (*rpc.Subscription, error) {
+	if !common.IsHexAddress(owner) {
+		return &rpc.Subscription{}, invalidParamsError("owner", "owner must be a hex address")
+	}
+	return j.subscriptions.subscribe(ctx, SubscribeTopicOrders, &subscriber{owner: common.HexToAddress(owner)})
+}
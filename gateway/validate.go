@@ -0,0 +1,184 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Loopring/relay/types"
+	"math/big"
+	"time"
+)
+
+const (
+	CheckStatusPassed  = "PASSED"
+	CheckStatusFailed  = "FAILED"
+	CheckStatusSkipped = "SKIPPED"
+
+	checkNamePrice             = "price"
+	checkNameTime              = "time"
+	checkNameBalance           = "balance"
+	checkNameAllowance         = "allowance"
+	checkNameCancelledOrFilled = "cancelledOrFilled"
+)
+
+type OrderCheckResult struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status"`
+	Error  *SubmitOrderError `json:"error,omitempty"`
+}
+
+type ValidateOrderResult struct {
+	OrderHash         string             `json:"orderHash"`
+	Known             bool               `json:"known"`      // 订单已经保存在relay中
+	Acceptable        bool               `json:"acceptable"` // 通过了gateway的所有filter，提交时会被接收
+	Matchable         bool               `json:"matchable"`  // 可以被撮合，会出现在depth中
+	Balance           string             `json:"balance"`
+	Allowance         string             `json:"allowance"`
+	CancelledOrFilled string             `json:"cancelledOrFilled"`
+	SpendableAmountS  string             `json:"spendableAmountS"` // 余额、授权以及订单剩余数量中的最小值
+	Checks            []OrderCheckResult `json:"checks"`
+}
+
+func (r *ValidateOrderResult) addCheck(name string, err error) bool {
+	check := OrderCheckResult{Name: name, Status: CheckStatusPassed}
+	if err != nil {
+		rpcErr := toRpcError(err)
+		check.Status = CheckStatusFailed
+		check.Error = &SubmitOrderError{Code: rpcErr.Code, Message: rpcErr.Message, Data: rpcErr.Data}
+	}
+	r.Checks = append(r.Checks, check)
+	return err == nil
+}
+
+func (r *ValidateOrderResult) skipCheck(name string) {
+	r.Checks = append(r.Checks, OrderCheckResult{Name: name, Status: CheckStatusSkipped})
+}
+
+// ValidateOrder 执行与提交订单相同的校验以及链上的余额、授权检查，但是不保存也不广播订单，
+// 用来排查订单为什么被拒绝或者没有出现在depth中
+func (j *JsonrpcServiceImpl) ValidateOrder(req *types.OrderJsonRequest) (res ValidateOrderResult, err error) {
+	order := types.ToOrder(req)
+	order.Hash = order.GenerateHash()
+	res.OrderHash = order.Hash.Hex()
+	res.Checks = make([]OrderCheckResult, 0)
+
+	if _, err = gateway.om.GetOrderByHash(order.Hash); err == nil {
+		res.Known = true
+	} else if !isRecordNotFound(err) {
+		return res, dbUnavailableError(err)
+	}
+	err = nil
+
+	res.Acceptable = validateByFilters(order, &res)
+	res.Matchable = j.validateSpendable(order, &res) && res.Acceptable
+	return res, nil
+}
+
+// validateByFilters 依次执行generatePrice以及gateway的所有filter，
+// 与handleOrder不同，某一项失败后仍然执行其余的检查
+func validateByFilters(order *types.Order, res *ValidateOrderResult) bool {
+	priceValid := res.addCheck(checkNamePrice, generatePrice(order))
+	passed := res.addCheck(checkNameTime, checkOrderTime(order, time.Now().Unix())) && priceValid
+
+	for _, f := range gateway.filters {
+		// 价格无效时base filter无法执行
+		if !priceValid && f.name == "base" {
+			res.skipCheck(f.name)
+			continue
+		}
+		if valid, err := f.filter(order); !valid {
+			if err == nil {
+				err = NewRpcError(ErrCodeOrderInvalid, ErrorData{OrderHash: order.Hash.Hex(), Reason: "rejected by filter " + f.name})
+			}
+			res.addCheck(f.name, err)
+			passed = false
+		} else {
+			res.addCheck(f.name, nil)
+		}
+	}
+	return passed
+}
+
+// validateSpendable 检查owner的余额、授权以及订单在链上已经成交或者取消的数量
+func (j *JsonrpcServiceImpl) validateSpendable(order *types.Order, res *ValidateOrderResult) bool {
+	orderHash := order.Hash.Hex()
+
+	balance, allowance, err := j.accountManager.GetBalanceByTokenAddress(order.Owner, order.TokenS)
+	if err == nil && (balance == nil || allowance == nil) {
+		err = errors.New("can't get balance or allowance of owner " + order.Owner.Hex())
+	}
+	if err != nil {
+		res.addCheck(checkNameBalance, chainNodeUnavailableError(err))
+		res.skipCheck(checkNameAllowance)
+	} else {
+		res.Balance = types.BigintToHex(balance)
+		res.Allowance = types.BigintToHex(allowance)
+		if balance.Sign() <= 0 {
+			res.addCheck(checkNameBalance, NewRpcError(ErrCodeInsufficientBalance, ErrorData{OrderHash: orderHash, Field: "tokenS", Reason: fmt.Sprintf("balance of %s is zero", order.TokenS.Hex())}))
+		} else {
+			res.addCheck(checkNameBalance, nil)
+		}
+		if allowance.Sign() <= 0 {
+			res.addCheck(checkNameAllowance, NewRpcError(ErrCodeInsufficientAllowance, ErrorData{OrderHash: orderHash, Field: "tokenS", Reason: fmt.Sprintf("allowance of %s is zero", order.TokenS.Hex())}))
+		} else {
+			res.addCheck(checkNameAllowance, nil)
+		}
+	}
+
+	if order.AmountS == nil || order.AmountB == nil || order.AmountB.Sign() <= 0 {
+		res.skipCheck(checkNameCancelledOrFilled)
+		return false
+	}
+
+	cancelledOrFilled, cErr := j.ethForwarder.Accessor.GetCancelledOrFilled(order.Protocol, order.Hash, "latest")
+	if cErr != nil {
+		res.addCheck(checkNameCancelledOrFilled, chainNodeUnavailableError(cErr))
+		return false
+	}
+	res.CancelledOrFilled = types.BigintToHex(cancelledOrFilled)
+
+	// buyNoMoreThanAmountB的订单，合约中记录的是已经买入的数量
+	var remainAmountS *big.Int
+	if order.BuyNoMoreThanAmountB {
+		remainAmountB := new(big.Int).Sub(order.AmountB, cancelledOrFilled)
+		remainAmountS = new(big.Int).Div(new(big.Int).Mul(remainAmountB, order.AmountS), order.AmountB)
+	} else {
+		remainAmountS = new(big.Int).Sub(order.AmountS, cancelledOrFilled)
+	}
+	if remainAmountS.Sign() <= 0 {
+		res.addCheck(checkNameCancelledOrFilled, NewRpcError(ErrCodeOrderFinished, ErrorData{OrderHash: orderHash, Reason: "order has been fully cancelled or filled"}))
+		return false
+	}
+	res.addCheck(checkNameCancelledOrFilled, nil)
+
+	if err != nil {
+		return false
+	}
+
+	spendable := remainAmountS
+	if balance.Cmp(spendable) < 0 {
+		spendable = balance
+	}
+	if allowance.Cmp(spendable) < 0 {
+		spendable = allowance
+	}
+	res.SpendableAmountS = types.BigintToHex(spendable)
+	return spendable.Sign() > 0
+}
@@ -140,6 +140,21 @@ func (a *AccountManager) GetBalanceByTokenAddress(address common.Address, token
 	return
 }
 
+// GetCachedBalanceByTokenAddress 只读取缓存中的余额以及授权，缓存中没有该地址时exists为false，不会访问以太坊节点
+func (a *AccountManager) GetCachedBalanceByTokenAddress(address common.Address, token common.Address) (balance, allowance *big.Int, exists bool) {
+	tokenAlias := util.AddressToAlias(token.Hex())
+	if tokenAlias == "" {
+		return
+	}
+
+	accountInCache, ok := a.c.Get(strings.ToLower(address.Hex()))
+	if !ok {
+		return
+	}
+	account := accountInCache.(Account)
+	return account.Balances[tokenAlias].Balance, account.Allowances[tokenAlias].allowance, true
+}
+
 func (a *AccountManager) GetCutoff(contract, address string) (int, error) {
 	cutoffTime, err := a.accessor.GetCutoff(common.StringToAddress(contract), common.StringToAddress(address), "latest")
 	return int(cutoffTime.Int64()), err
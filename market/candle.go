@@ -0,0 +1,362 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package market
+
+import (
+	"errors"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"sync"
+	"time"
+)
+
+const (
+	Interval1Min  = "1m"
+	Interval5Min  = "5m"
+	Interval15Min = "15m"
+	Interval1Hour = "1h"
+	Interval4Hour = "4h"
+	Interval1Day  = "1d"
+	Interval1Week = "1w"
+
+	// unix时间0为周四，1w的周期从周一开始
+	weekOffset = 4 * 24 * 60 * 60
+
+	// 延迟处理fill，等待ordermanager将fill保存或者在分叉时删除
+	candleFlushInterval = 10 * time.Second
+
+	// 分叉区块的时间无法获取时重新计算的时间范围
+	defaultForkRollbackRange = 60 * 60
+
+	defaultCandleCount = 100
+	maxCandleCount     = 1000
+)
+
+type candleInterval struct {
+	name     string
+	duration int64
+	source   string // 由该周期的k线聚合，为空时由fill计算
+}
+
+// 按照周期从小到大排列，每个周期都是source周期的整数倍
+var candleIntervals = []candleInterval{
+	{name: Interval1Min, duration: 60},
+	{name: Interval5Min, duration: 5 * 60, source: Interval1Min},
+	{name: Interval15Min, duration: 15 * 60, source: Interval5Min},
+	{name: Interval1Hour, duration: 60 * 60, source: Interval15Min},
+	{name: Interval4Hour, duration: 4 * 60 * 60, source: Interval1Hour},
+	{name: Interval1Day, duration: 24 * 60 * 60, source: Interval4Hour},
+	{name: Interval1Week, duration: 7 * 24 * 60 * 60, source: Interval1Day},
+}
+
+var (
+	ErrUnsupportedInterval = errors.New("unsupported candle interval")
+	ErrInvalidCandleRange  = errors.New("start must be earlier than end and the range can't exceed 1000 candles")
+)
+
+func getCandleInterval(name string) (candleInterval, error) {
+	for _, interval := range candleIntervals {
+		if interval.name == name {
+			return interval, nil
+		}
+	}
+	return candleInterval{}, ErrUnsupportedInterval
+}
+
+func IsCandleInterval(name string) bool {
+	_, err := getCandleInterval(name)
+	return err == nil
+}
+
+// bucketStart t所在周期的开始时间
+func (i candleInterval) bucketStart(t int64) int64 {
+	var offset int64
+	if i.name == Interval1Week {
+		offset = weekOffset
+	}
+	v := t - offset
+	start := v - v%i.duration
+	if v%i.duration < 0 {
+		start -= i.duration
+	}
+	return start + offset
+}
+
+func (i candleInterval) bucketEnd(start int64) int64 {
+	return start + i.duration - 1
+}
+
+// candleBuilder 记录有新成交或者被回滚的1m周期，定时重新计算这些周期以及包含它们的更大周期，
+// 每个周期都从数据库中重新读取fill或者下一级的k线，所以迟到的fill以及分叉都可以正确的更新已经结束的周期
+type candleBuilder struct {
+	rds      dao.RdsService
+	mtx      sync.Mutex
+	dirty    map[string]map[int64]bool // market -> 1m周期的开始时间
+	stopChan chan bool
+}
+
+func newCandleBuilder(rds dao.RdsService) *candleBuilder {
+	b := &candleBuilder{}
+	b.rds = rds
+	b.dirty = make(map[string]map[int64]bool)
+	b.stopChan = make(chan bool)
+	return b
+}
+
+func (b *candleBuilder) start() {
+	go func() {
+		ticker := time.NewTicker(candleFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.flush()
+			case <-b.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (b *candleBuilder) stop() {
+	close(b.stopChan)
+}
+
+// markDirty 标记[from, to]时间内的所有1m周期
+func (b *candleBuilder) markDirty(market string, from, to int64) {
+	interval := candleIntervals[0]
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	starts, exists := b.dirty[market]
+	if !exists {
+		starts = make(map[int64]bool)
+		b.dirty[market] = starts
+	}
+	for start := interval.bucketStart(from); start <= to; start += interval.duration {
+		starts[start] = true
+	}
+}
+
+func (b *candleBuilder) flush() {
+	b.mtx.Lock()
+	dirty := b.dirty
+	b.dirty = make(map[string]map[int64]bool)
+	b.mtx.Unlock()
+
+	for market, starts := range dirty {
+		if err := b.rebuild(market, starts); err != nil {
+			log.Errorf("market,rebuild candles of %s error:%s", market, err.Error())
+			// 失败的周期在下一次重新计算
+			for start := range starts {
+				b.markDirty(market, start, start)
+			}
+		}
+	}
+}
+
+// rebuild 从1m开始逐级重新计算starts所在的周期
+func (b *candleBuilder) rebuild(market string, starts map[int64]bool) error {
+	trendWriteMtx.Lock()
+	defer trendWriteMtx.Unlock()
+
+	for idx, interval := range candleIntervals {
+		if idx > 0 {
+			parents := make(map[int64]bool)
+			for start := range starts {
+				parents[interval.bucketStart(start)] = true
+			}
+			starts = parents
+		}
+		for start := range starts {
+			if err := b.rebuildBucket(market, interval, start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *candleBuilder) rebuildBucket(market string, interval candleInterval, start int64) error {
+	end := interval.bucketEnd(start)
+
+	var (
+		candle Trend
+		ok     bool
+	)
+	if interval.source == "" {
+		fills, err := b.rds.GetFillsByTime(market, start, end)
+		if err != nil {
+			return err
+		}
+		candle, ok = candleFromFills(market, fills)
+	} else {
+		sources, err := b.rds.TrendsByRange(interval.source, market, start, end)
+		if err != nil {
+			return err
+		}
+		candle, ok = candleFromCandles(market, sources)
+	}
+
+	// 成交全部被回滚时删除该周期
+	if !ok {
+		return b.rds.DelTrend(interval.name, market, start)
+	}
+	return b.saveCandle(market, interval, start, candle)
+}
+
+func (b *candleBuilder) saveCandle(market string, interval candleInterval, start int64, candle Trend) error {
+	candle.Market = market
+	candle.Intervals = interval.name
+	candle.Start = start
+	candle.End = interval.bucketEnd(start)
+	candle.CreateTime = time.Now().Unix()
+	model := &dao.Trend{}
+	candle.convertDown(model)
+	return b.rds.SaveTrend(model)
+}
+
+// rebuildRange 重新计算[from, to]内的所有周期，每一级只读取一次fill或者下一级的k线，
+// 用于停机之后补齐以及命令行重建，重复执行的结果相同
+func (b *candleBuilder) rebuildRange(market string, from, to int64) error {
+	trendWriteMtx.Lock()
+	defer trendWriteMtx.Unlock()
+
+	for _, interval := range candleIntervals {
+		start := interval.bucketStart(from)
+		end := interval.bucketEnd(interval.bucketStart(to))
+
+		existed, err := b.rds.TrendsByRange(interval.name, market, start, end)
+		if err != nil {
+			return err
+		}
+		candles := make(map[int64]Trend)
+		if interval.source == "" {
+			fills, err := b.rds.GetFillsByTime(market, start, end)
+			if err != nil {
+				return err
+			}
+			groups := make(map[int64][]dao.FillEvent)
+			for _, fill := range fills {
+				bucket := interval.bucketStart(fill.CreateTime)
+				groups[bucket] = append(groups[bucket], fill)
+			}
+			for bucket, group := range groups {
+				if candle, ok := candleFromFills(market, group); ok {
+					candles[bucket] = candle
+				}
+			}
+		} else {
+			sources, err := b.rds.TrendsByRange(interval.source, market, start, end)
+			if err != nil {
+				return err
+			}
+			groups := make(map[int64][]dao.Trend)
+			for _, source := range sources {
+				bucket := interval.bucketStart(source.Start)
+				groups[bucket] = append(groups[bucket], source)
+			}
+			for bucket, group := range groups {
+				if candle, ok := candleFromCandles(market, group); ok {
+					candles[bucket] = candle
+				}
+			}
+		}
+
+		for _, trend := range existed {
+			if _, ok := candles[trend.Start]; !ok {
+				if err := b.rds.DelTrend(interval.name, market, trend.Start); err != nil {
+					return err
+				}
+			}
+		}
+		for bucket, candle := range candles {
+			if err := b.saveCandle(market, interval, bucket, candle); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// candleFromFills 只统计卖出market中第一个token的fill
+func candleFromFills(market string, fills []dao.FillEvent) (candle Trend, ok bool) {
+	candle.Market = market
+
+	stats := newOhlcv()
+	for i := range fills {
+		if trade, valid := baseSideFillTrade(market, &fills[i]); valid {
+			stats.addTrade(trade)
+		}
+	}
+	stats.fillTrend(&candle)
+	return candle, !stats.empty()
+}
+
+func candleFromCandles(market string, sources []dao.Trend) (candle Trend, ok bool) {
+	candle.Market = market
+
+	stats := newOhlcv()
+	for _, source := range sources {
+		stats.addTrend(ConvertUp(source))
+	}
+	stats.fillTrend(&candle)
+	return candle, !stats.empty()
+}
+
+// candles 开始时间在[start, end]之间的k线，没有成交的周期不返回
+func (b *candleBuilder) candles(market, name string, start, end int64) ([]Trend, error) {
+	interval, err := getCandleInterval(name)
+	if err != nil {
+		return nil, err
+	}
+	if end <= 0 {
+		end = time.Now().Unix()
+	}
+	if start <= 0 {
+		start = end - interval.duration*defaultCandleCount
+	}
+	if start > end || (end-start)/interval.duration >= maxCandleCount {
+		return nil, ErrInvalidCandleRange
+	}
+
+	trends, err := b.rds.TrendsByRange(interval.name, market, interval.bucketStart(start), end)
+	if err != nil {
+		return nil, err
+	}
+	candles := make([]Trend, 0, len(trends))
+	for _, trend := range trends {
+		candles = append(candles, ConvertUp(trend))
+	}
+	return candles, nil
+}
+
+func (t *Trend) convertDown(dst *dao.Trend) {
+	dst.Intervals = t.Intervals
+	dst.Market = t.Market
+	dst.Vol = t.Vol
+	dst.Amount = t.Amount
+	dst.CreateTime = t.CreateTime
+	dst.Open = t.Open
+	dst.Close = t.Close
+	dst.High = t.High
+	dst.Low = t.Low
+	dst.Start = t.Start
+	dst.End = t.End
+}
@@ -0,0 +1,159 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package market
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/market/util"
+	"math/big"
+	"strings"
+)
+
+// 价格保留的小数位数，数量按照token的decimals计算，不超过该位数时没有精度损失
+const decimalDigits = 18
+
+// fillTrade 按照token的decimals转换后的成交，amount为market中第一个token的数量，vol为第二个token的数量
+type fillTrade struct {
+	amount *big.Rat
+	vol    *big.Rat
+	price  *big.Rat // vol/amount
+}
+
+// newFillTrade token不支持或者成交数量为0时返回false
+func newFillTrade(fill *dao.FillEvent) (trade fillTrade, ok bool) {
+	base, _ := util.UnWrap(fill.Market)
+	symbolS := util.AddressToAlias(fill.TokenS)
+	symbolB := util.AddressToAlias(fill.TokenB)
+
+	amountS := tokenAmount(symbolS, fill.AmountS)
+	amountB := tokenAmount(symbolB, fill.AmountB)
+	if nil == amountS || nil == amountB || amountS.Sign() <= 0 || amountB.Sign() <= 0 {
+		return
+	}
+
+	if symbolS == base {
+		trade.amount, trade.vol = amountS, amountB
+	} else {
+		trade.amount, trade.vol = amountB, amountS
+	}
+	trade.price = new(big.Rat).Quo(trade.vol, trade.amount)
+	return trade, true
+}
+
+// baseSideFillTrade 每次撮合中买卖双方各有一条fill，只统计卖出market中第一个token的fill，避免成交量重复计算
+func baseSideFillTrade(market string, fill *dao.FillEvent) (trade fillTrade, ok bool) {
+	base, _ := util.UnWrap(market)
+	if util.AddressToAlias(fill.TokenS) != base {
+		return
+	}
+	return newFillTrade(fill)
+}
+
+func tokenAmount(symbol, amount string) *big.Rat {
+	token, exists := util.AllTokens[symbol]
+	if !exists || nil == token.Decimals || token.Decimals.Sign() <= 0 {
+		return nil
+	}
+	value, ok := new(big.Int).SetString(amount, 0)
+	if !ok {
+		return nil
+	}
+	return new(big.Rat).SetFrac(value, token.Decimals)
+}
+
+// formatDecimal 保留decimalDigits位小数并去掉末尾的0
+func formatDecimal(v *big.Rat) string {
+	if nil == v {
+		return "0"
+	}
+	s := v.FloatString(decimalDigits)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || s == "-" || s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// parseDecimal 空字符串或者无法解析时为0
+func parseDecimal(s string) *big.Rat {
+	v, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return new(big.Rat)
+	}
+	return v
+}
+
+// ohlcv 聚合成交或者更小周期的趋势，open为nil时没有任何成交
+type ohlcv struct {
+	open   *big.Rat
+	close  *big.Rat
+	high   *big.Rat
+	low    *big.Rat
+	vol    *big.Rat
+	amount *big.Rat
+}
+
+func newOhlcv() *ohlcv {
+	return &ohlcv{vol: new(big.Rat), amount: new(big.Rat)}
+}
+
+func (o *ohlcv) empty() bool {
+	return nil == o.open
+}
+
+func (o *ohlcv) addTrade(trade fillTrade) {
+	o.addPrices(trade.price, trade.price, trade.price, trade.price)
+	o.vol.Add(o.vol, trade.vol)
+	o.amount.Add(o.amount, trade.amount)
+}
+
+// addTrend 价格为0的趋势没有任何成交，只累计数量
+func (o *ohlcv) addTrend(trend Trend) {
+	if open := parseDecimal(trend.Open); open.Sign() > 0 {
+		o.addPrices(open, parseDecimal(trend.High), parseDecimal(trend.Low), parseDecimal(trend.Close))
+	}
+	o.vol.Add(o.vol, parseDecimal(trend.Vol))
+	o.amount.Add(o.amount, parseDecimal(trend.Amount))
+}
+
+func (o *ohlcv) addPrices(open, high, low, close *big.Rat) {
+	if o.empty() {
+		o.open = new(big.Rat).Set(open)
+		o.high = new(big.Rat).Set(high)
+		o.low = new(big.Rat).Set(low)
+	}
+	if high.Cmp(o.high) > 0 {
+		o.high.Set(high)
+	}
+	if low.Sign() > 0 && low.Cmp(o.low) < 0 {
+		o.low.Set(low)
+	}
+	o.close = new(big.Rat).Set(close)
+}
+
+// fillTrend 没有成交时价格为0
+func (o *ohlcv) fillTrend(trend *Trend) {
+	trend.Open = formatDecimal(o.open)
+	trend.Close = formatDecimal(o.close)
+	trend.High = formatDecimal(o.high)
+	trend.Low = formatDecimal(o.low)
+	trend.Vol = formatDecimal(o.vol)
+	trend.Amount = formatDecimal(o.amount)
+}
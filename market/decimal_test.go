@@ -0,0 +1,178 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package market
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"testing"
+)
+
+var (
+	testLrcAddress  = common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	testWethAddress = common.HexToAddress("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2")
+	testUsdtAddress = common.HexToAddress("0xdac17f958d2ee523a2206206994597c13d831ec7")
+)
+
+func setTestTokens() {
+	util.AllTokens = map[string]types.Token{
+		"LRC":  {Protocol: testLrcAddress, Symbol: "LRC", Decimals: big.NewInt(1e18)},
+		"WETH": {Protocol: testWethAddress, Symbol: "WETH", Decimals: big.NewInt(1e18)},
+		"USDT": {Protocol: testUsdtAddress, Symbol: "USDT", Decimals: big.NewInt(1e6)},
+	}
+}
+
+func testFill(market string, tokenS, tokenB common.Address, amountS, amountB string) *dao.FillEvent {
+	return &dao.FillEvent{Market: market, TokenS: tokenS.Hex(), TokenB: tokenB.Hex(), AmountS: amountS, AmountB: amountB}
+}
+
+func rat(s string) *big.Rat {
+	v, _ := new(big.Rat).SetString(s)
+	return v
+}
+
+func TestFormatDecimal(t *testing.T) {
+	cases := []struct {
+		value *big.Rat
+		want  string
+	}{
+		{nil, "0"},
+		{new(big.Rat), "0"},
+		{rat("1"), "1"},
+		{rat("1.2500"), "1.25"},
+		{rat("-0.5"), "-0.5"},
+		{rat("1/3"), "0.333333333333333333"},
+		{rat("1/1000000000000000000"), "0.000000000000000001"},
+		{rat("1/10000000000000000000"), "0"},
+		{rat("-1/10000000000000000000"), "0"},
+		{rat("123456789012345678901234567890"), "123456789012345678901234567890"},
+	}
+	for _, c := range cases {
+		if got := formatDecimal(c.value); got != c.want {
+			t.Errorf("formatDecimal(%v) got %s, want %s", c.value, got, c.want)
+		}
+	}
+}
+
+func TestNewFillTrade(t *testing.T) {
+	setTestTokens()
+
+	// 卖出1.5 LRC，买入0.003 WETH
+	sell := testFill("LRC-WETH", testLrcAddress, testWethAddress, "1500000000000000000", "3000000000000000")
+	trade, ok := newFillTrade(sell)
+	if !ok {
+		t.Fatalf("sell fill should be valid")
+	}
+	if trade.amount.Cmp(rat("1.5")) != 0 || trade.vol.Cmp(rat("0.003")) != 0 || trade.price.Cmp(rat("0.002")) != 0 {
+		t.Errorf("sell trade got amount:%s vol:%s price:%s", trade.amount.String(), trade.vol.String(), trade.price.String())
+	}
+
+	// 买单的amount以及vol与卖单相同
+	buy := testFill("LRC-WETH", testWethAddress, testLrcAddress, "3000000000000000", "1500000000000000000")
+	trade, ok = newFillTrade(buy)
+	if !ok {
+		t.Fatalf("buy fill should be valid")
+	}
+	if trade.amount.Cmp(rat("1.5")) != 0 || trade.vol.Cmp(rat("0.003")) != 0 || trade.price.Cmp(rat("0.002")) != 0 {
+		t.Errorf("buy trade got amount:%s vol:%s price:%s", trade.amount.String(), trade.vol.String(), trade.price.String())
+	}
+
+	// 不同decimals的token
+	usdt := testFill("WETH-USDT", testWethAddress, testUsdtAddress, "2000000000000000000", "900500000")
+	trade, ok = newFillTrade(usdt)
+	if !ok {
+		t.Fatalf("usdt fill should be valid")
+	}
+	if trade.price.Cmp(rat("450.25")) != 0 {
+		t.Errorf("usdt trade got price:%s, want 450.25", trade.price.String())
+	}
+
+	invalid := []*dao.FillEvent{
+		testFill("LRC-WETH", testLrcAddress, testWethAddress, "0", "3000000000000000"),
+		testFill("LRC-WETH", testLrcAddress, testWethAddress, "1500000000000000000", "-1"),
+		testFill("LRC-WETH", testLrcAddress, testWethAddress, "abc", "3000000000000000"),
+		testFill("LRC-WETH", common.HexToAddress("0x01"), testWethAddress, "1500000000000000000", "3000000000000000"),
+	}
+	for i, fill := range invalid {
+		if _, ok := newFillTrade(fill); ok {
+			t.Errorf("fill %d should be invalid", i)
+		}
+	}
+}
+
+func TestBaseSideFillTrade(t *testing.T) {
+	setTestTokens()
+
+	sell := testFill("LRC-WETH", testLrcAddress, testWethAddress, "1500000000000000000", "3000000000000000")
+	buy := testFill("LRC-WETH", testWethAddress, testLrcAddress, "3000000000000000", "1500000000000000000")
+	if _, ok := baseSideFillTrade("LRC-WETH", sell); !ok {
+		t.Errorf("fill selling LRC should be counted")
+	}
+	if _, ok := baseSideFillTrade("LRC-WETH", buy); ok {
+		t.Errorf("fill selling WETH should not be counted")
+	}
+
+	// 同一次撮合的两条fill只统计一次
+	trend := hourTrendFromFills("LRC-WETH", []dao.FillEvent{*sell, *buy}, "")
+	if trend.Amount != "1.5" || trend.Vol != "0.003" {
+		t.Errorf("hour trend got amount:%s vol:%s, want 1.5 and 0.003", trend.Amount, trend.Vol)
+	}
+}
+
+func TestOhlcv(t *testing.T) {
+	stats := newOhlcv()
+	if !stats.empty() {
+		t.Fatalf("new ohlcv should be empty")
+	}
+
+	var trend Trend
+	stats.fillTrend(&trend)
+	if trend.Open != "0" || trend.Close != "0" || trend.High != "0" || trend.Low != "0" || trend.Vol != "0" || trend.Amount != "0" {
+		t.Errorf("empty ohlcv got %+v", trend)
+	}
+
+	trades := []fillTrade{
+		{amount: rat("10"), vol: rat("0.02"), price: rat("0.002")},
+		{amount: rat("5"), vol: rat("0.0125"), price: rat("0.0025")},
+		{amount: rat("2"), vol: rat("0.003"), price: rat("0.0015")},
+		{amount: rat("1"), vol: rat("0.0022"), price: rat("0.0022")},
+	}
+	for _, trade := range trades {
+		stats.addTrade(trade)
+	}
+
+	// 价格为0的趋势只累计数量，有价格的趋势参与计算最高以及最低价
+	stats.addTrend(Trend{Open: "0", High: "0", Low: "0", Close: "0", Vol: "1", Amount: "100"})
+	stats.addTrend(Trend{Open: "0.0021", High: "0.003", Low: "0.001", Close: "0.0024", Vol: "0.5", Amount: "200"})
+
+	trend = Trend{}
+	stats.fillTrend(&trend)
+	want := Trend{Open: "0.002", Close: "0.0024", High: "0.003", Low: "0.001", Vol: "1.5377", Amount: "318"}
+	if trend != want {
+		t.Errorf("ohlcv got %+v, want %+v", trend, want)
+	}
+
+	// addTrade不能修改传入的价格
+	if trades[0].price.Cmp(rat("0.002")) != 0 {
+		t.Errorf("trade price changed to %s", trades[0].price.String())
+	}
+}
@@ -0,0 +1,171 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package market
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"sync"
+	"time"
+)
+
+const (
+	// 没有历史记录时启动补齐的时间范围
+	defaultCatchUpRange = 24 * 60 * 60
+
+	// 启动时最多补齐的时间范围，更早的数据使用relay trends rebuild重建
+	maxCatchUpRange = 30 * 24 * 60 * 60
+)
+
+// trendWriteMtx 串行化1Hr趋势以及k线的写入，SaveTrend先查询再插入，
+// 启动补齐、定时任务、k线的定时计算以及分叉之后的重建同时写入同一个周期时会产生重复的记录
+// 该锁只在一个进程内有效，运行relay trends rebuild之前需要先停止relay
+var trendWriteMtx sync.Mutex
+
+// RebuildTrends 重新计算market在[from, to]之间的1Hr趋势以及所有周期的k线，
+// 已经存在的记录被覆盖，没有成交的k线被删除，可以重复执行
+// 与relay进程中的写入之间没有锁，不能在relay运行时调用
+func RebuildTrends(rds dao.RdsService, market string, from, to int64) error {
+	if err := rebuildHourTrends(rds, market, from, to); err != nil {
+		return err
+	}
+	return newCandleBuilder(rds).rebuildRange(market, from, to)
+}
+
+// firstSecondOfHour 1Hr趋势的周期为(整点, 下一个整点]，返回t所在周期的开始时间
+func firstSecondOfHour(t int64) int64 {
+	tm := time.Unix(t-1, 0)
+	return time.Date(tm.Year(), tm.Month(), tm.Day(), tm.Hour(), 0, 1, 0, tm.Location()).Unix()
+}
+
+// rebuildHourTrends 逐小时重新计算已经结束的1Hr趋势，没有成交的小时沿用上一个小时的收盘价
+func rebuildHourTrends(rds dao.RdsService, market string, from, to int64) error {
+	trendWriteMtx.Lock()
+	defer trendWriteMtx.Unlock()
+
+	now := time.Now().Unix()
+	start := firstSecondOfHour(from)
+
+	lastClose := "0"
+	lastTrends, err := rds.TrendQueryByTime(OneHour, market, start-60*60, start-1)
+	if err != nil {
+		return err
+	}
+	if len(lastTrends) > 0 {
+		lastClose = lastTrends[0].Close
+	}
+
+	for ; start <= to; start += 60 * 60 {
+		end := start + 60*60 - 1
+		if end >= now {
+			break
+		}
+
+		fills, err := rds.GetFillsByTime(market, start, end)
+		if err != nil {
+			return err
+		}
+		trend := hourTrendFromFills(market, fills, lastClose)
+		trend.Start = start
+		trend.End = end
+		trend.CreateTime = now
+		model := &dao.Trend{}
+		trend.convertDown(model)
+		if err := rds.SaveTrend(model); err != nil {
+			return err
+		}
+		lastClose = trend.Close
+	}
+	return nil
+}
+
+// hourTrendFromFills 与ticker的统计方式一致，fills需要按照成交时间排序
+func hourTrendFromFills(market string, fills []dao.FillEvent, lastClose string) Trend {
+	trend := Trend{Intervals: OneHour, Market: market}
+
+	stats := newOhlcv()
+	for i := range fills {
+		if trade, ok := baseSideFillTrade(market, &fills[i]); ok {
+			stats.addTrade(trade)
+		}
+	}
+	stats.fillTrend(&trend)
+	if stats.empty() {
+		trend.Open = lastClose
+		trend.Close = lastClose
+		trend.High = lastClose
+		trend.Low = lastClose
+	}
+	return trend
+}
+
+// catchUp 从最后一条记录开始补齐停机期间的1Hr趋势以及k线
+func (t *TrendManager) catchUp() {
+	now := time.Now().Unix()
+	for _, mkt := range util.AllMarkets {
+		hourFrom, err := t.catchUpStart(dao.Trend{Market: mkt, Intervals: OneHour}, now)
+		if err != nil {
+			log.Errorf("market,catch up trends of %s error:%s", mkt, err.Error())
+			continue
+		}
+		if err := rebuildHourTrends(t.rds, mkt, hourFrom, now); err != nil {
+			log.Errorf("market,catch up trends of %s error:%s", mkt, err.Error())
+		}
+
+		candleFrom, err := t.catchUpStart(dao.Trend{Market: mkt, Intervals: Interval1Min}, now)
+		if err != nil {
+			log.Errorf("market,catch up candles of %s error:%s", mkt, err.Error())
+			continue
+		}
+		if err := t.candles.rebuildRange(mkt, candleFrom, now); err != nil {
+			log.Errorf("market,catch up candles of %s error:%s", mkt, err.Error())
+		}
+	}
+}
+
+// catchUpStart 最后一条记录可能在停机前还没有统计完整，从它开始重新计算
+func (t *TrendManager) catchUpStart(query dao.Trend, now int64) (int64, error) {
+	res, err := t.rds.TrendPageQuery(query, 1, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Data) == 0 {
+		return now - defaultCatchUpRange, nil
+	}
+
+	from := res.Data[0].(dao.Trend).Start
+	if now-from > maxCatchUpRange {
+		log.Warnf("market,%s %s trends stopped at %d, only catch up the latest %d seconds", query.Market, query.Intervals, from, maxCatchUpRange)
+		from = now - maxCatchUpRange
+	}
+	return from, nil
+}
+
+// rebuildAfterFork 重新计算分叉之后的所有周期，在ordermanager删除分叉区块之后的fill之后调用
+func (t *TrendManager) rebuildAfterFork(from int64) {
+	go func() {
+		for _, mkt := range util.AllMarkets {
+			if err := RebuildTrends(t.rds, mkt, from, time.Now().Unix()); err != nil {
+				log.Errorf("market,rebuild trends of %s after fork error:%s", mkt, err.Error())
+			}
+		}
+		t.refreshCache()
+	}()
+}
@@ -0,0 +1,174 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package market
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/market/util"
+	"math/big"
+)
+
+const (
+	TradeSideBuy  = "buy"
+	TradeSideSell = "sell"
+
+	// 每个market缓存的fill数量，与QueryRecentFills的上限一致
+	recentFillsSize = 100
+
+	defaultTradesLimit = 20
+	maxTradesLimit     = 50
+)
+
+// Trade 一个环路在market中的成交，side为taker的方向，price与size按照token decimals换算
+type Trade struct {
+	Market    string `json:"market"`
+	RingHash  string `json:"ringHash"`
+	TxHash    string `json:"txHash"`
+	Side      string `json:"side"`
+	Price     string `json:"price"`
+	Size      string `json:"size"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// recentFill orderTime为订单提交到relay的时间，环路中最后提交的订单为taker
+type recentFill struct {
+	fill      dao.FillEvent
+	orderTime int64
+}
+
+// loadRecentFills 按照成交时间从早到晚返回market最近的fill
+func loadRecentFills(rds dao.RdsService, market string) ([]recentFill, error) {
+	fills, err := rds.QueryRecentFills(market, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(fills))
+	for _, fill := range fills {
+		hashes = append(hashes, fill.OrderHash)
+	}
+	orders := make(map[string]dao.Order)
+	if len(hashes) > 0 {
+		if orders, err = rds.GetOrdersByHash(hashes); err != nil {
+			return nil, err
+		}
+	}
+
+	list := make([]recentFill, 0, len(fills))
+	for i := len(fills) - 1; i >= 0; i-- {
+		list = append(list, recentFill{fill: fills[i], orderTime: orders[fills[i].OrderHash].CreateTime})
+	}
+	return list, nil
+}
+
+func appendRecentFill(list []recentFill, fill recentFill) []recentFill {
+	list = append(list, fill)
+	if len(list) > recentFillsSize {
+		list = list[len(list)-recentFillsSize:]
+	}
+	return list
+}
+
+// collapseTrades 将同一个环路中的fill合并为一笔成交，返回的成交按照时间从早到晚排列
+func collapseTrades(market string, fills []recentFill) []Trade {
+	var ringHashes []string
+	rings := make(map[string][]recentFill)
+	for _, v := range fills {
+		if _, exists := rings[v.fill.RingHash]; !exists {
+			ringHashes = append(ringHashes, v.fill.RingHash)
+		}
+		rings[v.fill.RingHash] = append(rings[v.fill.RingHash], v)
+	}
+
+	trades := make([]Trade, 0, len(ringHashes))
+	for _, ringHash := range ringHashes {
+		if trade, ok := newTrade(market, rings[ringHash]); ok {
+			trades = append(trades, trade)
+		}
+	}
+	return trades
+}
+
+// newTrade 成交数量为卖出market中第一个token的订单卖出的数量，没有卖单时为买单买入的数量，
+// 价格为taker订单的成交价格
+func newTrade(market string, fills []recentFill) (trade Trade, ok bool) {
+	base, _ := util.UnWrap(market)
+
+	var (
+		taker     *recentFill
+		takerDeal fillTrade
+	)
+	sold := new(big.Rat)
+	bought := new(big.Rat)
+	for i := range fills {
+		v := &fills[i]
+		deal, valid := newFillTrade(&v.fill)
+		if !valid {
+			continue
+		}
+		if util.AddressToAlias(v.fill.TokenS) == base {
+			sold.Add(sold, deal.amount)
+		} else {
+			bought.Add(bought, deal.amount)
+		}
+		if nil == taker || v.orderTime > taker.orderTime || (v.orderTime == taker.orderTime && v.fill.FillIndex > taker.fill.FillIndex) {
+			taker = v
+			takerDeal = deal
+		}
+	}
+	if nil == taker {
+		return
+	}
+
+	trade.Market = market
+	trade.RingHash = taker.fill.RingHash
+	trade.TxHash = taker.fill.TxHash
+	trade.Timestamp = taker.fill.CreateTime
+	trade.Price = formatDecimal(takerDeal.price)
+	if util.AddressToAlias(taker.fill.TokenS) == base {
+		trade.Side = TradeSideSell
+	} else {
+		trade.Side = TradeSideBuy
+	}
+	if sold.Sign() > 0 {
+		trade.Size = formatDecimal(sold)
+	} else {
+		trade.Size = formatDecimal(bought)
+	}
+	return trade, true
+}
+
+// latestTrades 按照时间从晚到早返回since之后的最多limit笔成交
+func latestTrades(trades []Trade, limit int, since int64) []Trade {
+	if limit <= 0 {
+		limit = defaultTradesLimit
+	}
+	if limit > maxTradesLimit {
+		limit = maxTradesLimit
+	}
+
+	list := make([]Trade, 0, limit)
+	for i := len(trades) - 1; i >= 0 && len(list) < limit; i-- {
+		if trades[i].Timestamp <= since {
+			continue
+		}
+		list = append(list, trades[i])
+	}
+	return list
+}
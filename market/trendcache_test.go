@@ -0,0 +1,90 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package market
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/market/util"
+	"github.com/patrickmn/go-cache"
+	"testing"
+	"time"
+)
+
+// testTrendRds 只实现refreshCache用到的方法，与gorm的Where相同，查询条件中的空字段不做过滤
+type testTrendRds struct {
+	dao.RdsService
+	trends []dao.Trend
+}
+
+func (r *testTrendRds) TrendPageQuery(query dao.Trend, pageIndex, pageSize int) (res dao.PageResult, err error) {
+	for _, trend := range r.trends {
+		if query.Market != "" && query.Market != trend.Market {
+			continue
+		}
+		if query.Intervals != "" && query.Intervals != trend.Intervals {
+			continue
+		}
+		res.Data = append(res.Data, trend)
+	}
+	return res, nil
+}
+
+func (r *testTrendRds) QueryRecentFills(mkt, owner string, start int64, end int64) ([]dao.FillEvent, error) {
+	return []dao.FillEvent{}, nil
+}
+
+func testTicker(t *testing.T, trends []dao.Trend) Ticker {
+	manager := &TrendManager{rds: &testTrendRds{trends: trends}, c: cache.New(cache.NoExpiration, cache.NoExpiration)}
+	manager.refreshCache()
+	tickers, err := manager.GetTicker()
+	if err != nil || len(tickers) != 1 {
+		t.Fatalf("get ticker got %d tickers, error:%v", len(tickers), err)
+	}
+	return tickers[0]
+}
+
+func TestRefreshCacheUsesHourTrends(t *testing.T) {
+	setTestTokens()
+	util.AllMarkets = []string{"LRC-WETH"}
+
+	now := time.Now().Unix()
+	hourStart := now - now%3600
+	trend := func(interval string, start int64, open, close, vol, amount string) dao.Trend {
+		return dao.Trend{Market: "LRC-WETH", Intervals: interval, Start: start, Open: open, Close: close, High: close, Low: open, Vol: vol, Amount: amount}
+	}
+	hourTrends := []dao.Trend{
+		trend(OneHour, hourStart-2*3600, "1", "2", "10", "15"),
+		trend(OneHour, hourStart-3600, "2", "3", "20", "50"),
+	}
+	expected := testTicker(t, hourTrends)
+	if expected.Vol != "30" || expected.Amount != "65" || expected.Open != "1" || expected.Close != "3" {
+		t.Fatalf("ticker of hour trends got %+v", expected)
+	}
+
+	// 1m、1h以及1d的candle覆盖相同的fill，不能重复计算
+	trends := append([]dao.Trend{}, hourTrends...)
+	trends = append(trends,
+		trend(Interval1Min, hourStart-3600, "2", "3", "20", "50"),
+		trend(Interval1Hour, hourStart-3600, "2", "3", "20", "50"),
+		trend(Interval1Day, now-now%86400, "1", "3", "30", "65"),
+	)
+	if ticker := testTicker(t, trends); ticker != expected {
+		t.Errorf("ticker with candles got %+v, want %+v", ticker, expected)
+	}
+}
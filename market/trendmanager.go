@@ -20,16 +20,16 @@ package market
 
 import (
 	"errors"
-	"fmt"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/market/util"
 	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/patrickmn/go-cache"
 	"github.com/robfig/cron"
 	"log"
+	"math/big"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -41,38 +41,42 @@ const (
 	//OneDay = "1Day"
 )
 
+// Ticker 价格以及数量都是按照token decimals换算后的十进制字符串
 type Ticker struct {
-	Market    string  `json:"market"`
-	Intervals string  `json:"interval"`
-	Amount    float64 `json:"amount"`
-	Vol       float64 `json:"vol"`
-	Open      float64 `json:"open"`
-	Close     float64 `json:"close"`
-	High      float64 `json:"high"`
-	Low       float64 `json:"low"`
-	Last      float64 `json:"last"`
-	Buy       string  `json:"buy"`
-	Sell      string  `json:"sell"`
-	Change    string  `json:"change"`
+	Market    string `json:"market"`
+	Intervals string `json:"interval"`
+	Amount    string `json:"amount"`
+	Vol       string `json:"vol"`
+	Open      string `json:"open"`
+	Close     string `json:"close"`
+	High      string `json:"high"`
+	Low       string `json:"low"`
+	Last      string `json:"last"`
+	Buy       string `json:"buy"`
+	Sell      string `json:"sell"`
+	Change    string `json:"change"`
 }
 
 type Cache struct {
 	Trends []Trend
 	Fills  []dao.FillEvent
+
+	recentFills []recentFill // 最近的fill，不限于当前小时
 }
 
+// Trend 与Ticker相同，价格以及数量为十进制字符串
 type Trend struct {
-	Intervals  string
-	Market     string
-	Vol        float64
-	Amount     float64
-	CreateTime int64
-	Open       float64
-	Close      float64
-	High       float64
-	Low        float64
-	Start      int64
-	End        int64
+	Intervals  string `json:"intervals"`
+	Market     string `json:"market"`
+	Vol        string `json:"vol"`
+	Amount     string `json:"amount"`
+	CreateTime int64  `json:"createTime"`
+	Open       string `json:"open"`
+	Close      string `json:"close"`
+	High       string `json:"high"`
+	Low        string `json:"low"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
 }
 
 type TrendManager struct {
@@ -80,6 +84,7 @@ type TrendManager struct {
 	cacheReady bool
 	rds        dao.RdsService
 	cron       *cron.Cron
+	candles    *candleBuilder
 }
 
 var once sync.Once
@@ -93,10 +98,18 @@ func NewTrendManager(dao dao.RdsService) TrendManager {
 	once.Do(func() {
 		trendManager = TrendManager{rds: dao, cron: cron.New()}
 		trendManager.c = cache.New(cache.NoExpiration, cache.NoExpiration)
+		trendManager.candles = newCandleBuilder(dao)
+		trendManager.candles.start()
 		trendManager.refreshCache()
+		go func() {
+			trendManager.catchUp()
+			trendManager.refreshCache()
+		}()
 		trendManager.startScheduleUpdate()
 		fillOrderWatcher := &eventemitter.Watcher{Concurrent: false, Handle: trendManager.handleOrderFilled}
 		eventemitter.On(eventemitter.OrderManagerExtractorFill, fillOrderWatcher)
+		forkWatcher := &eventemitter.Watcher{Concurrent: false, Handle: trendManager.handleFork}
+		eventemitter.On(eventemitter.OrderManagerFork, forkWatcher)
 		//trendManager.startScheduleUpdate()
 	})
 
@@ -123,7 +136,8 @@ func (t *TrendManager) refreshCache() {
 		mktCache.Fills = make([]dao.FillEvent, 0)
 
 		// default 100 records load first time
-		trends, err := t.rds.TrendPageQuery(dao.Trend{Market: mkt}, 1, 100)
+		// trends表中同时保存了各个周期的candle，ticker以及GetTrends只使用1Hr的记录
+		trends, err := t.rds.TrendPageQuery(dao.Trend{Market: mkt, Intervals: OneHour}, 1, 100)
 
 		if err != nil {
 			log.Println(err)
@@ -146,6 +160,11 @@ func (t *TrendManager) refreshCache() {
 			mktCache.Fills = append(mktCache.Fills, f)
 		}
 
+		if mktCache.recentFills, err = loadRecentFills(t.rds, mkt); err != nil {
+			log.Println(err)
+			return
+		}
+
 		trendMap[mkt] = mktCache
 
 		ticker := calculateTicker(mkt, fills, mktCache.Trends, firstSecondThisHour)
@@ -162,87 +181,43 @@ func calculateTicker(market string, fills []dao.FillEvent, trends []Trend, now t
 
 	var result = Ticker{Market: market}
 
-	if len(fills) == 0 && len(trends) == 0 {
-		return result
-	}
-
 	before24Hour := now.Unix() - 24*60*60
 
-	var (
-		high   float64
-		low    float64
-		vol    float64
-		amount float64
-	)
-
 	sort.Slice(trends, func(i, j int) bool {
 		return trends[i].Start < trends[j].Start
 	})
 
+	stats := newOhlcv()
 	for _, data := range trends {
-
 		if data.Start < before24Hour {
 			continue
 		}
-
-		vol += data.Vol
-		amount += data.Amount
-
-		if result.Open == 0 && data.Open != 0 {
-			result.Open = data.Open
-		}
-
-		if high == 0 || high < data.High {
-			high = data.High
-		}
-		if low == 0 || (low > data.Low && data.Low != 0) {
-			low = data.Low
-		}
-
-		if data.Close != 0 {
-			result.Last = data.Close
-			result.Close = data.Close
-		}
+		stats.addTrend(data)
 	}
 
-	for _, data := range fills {
-
-		if util.IsBuy(data.TokenS) {
-			vol += util.StringToFloat(data.AmountB)
-			amount += util.StringToFloat(data.AmountS)
-		} else {
-			vol += util.StringToFloat(data.AmountS)
-			amount += util.StringToFloat(data.AmountB)
-		}
-
-		price := util.CalculatePrice(data.AmountS, data.AmountB, data.TokenS, data.TokenB)
-
-		if result.Open == 0 && price != 0 {
-			result.Open = price
-		}
-
-		if price != 0 {
-			result.Last = price
-			result.Close = price
-		}
-
-		if high == 0 || high < price {
-			high = price
-		}
-		if low == 0 || (low > price && price != 0) {
-			low = price
+	for i := range fills {
+		if trade, ok := baseSideFillTrade(market, &fills[i]); ok {
+			stats.addTrade(trade)
 		}
 	}
 
-	result.High = high
-	result.Low = low
-
-	if result.Open > 0 && result.Last > 0 {
-		result.Change = fmt.Sprintf("%.2f%%", 100*(result.Last-result.Open)/result.Open)
+	trend := Trend{}
+	stats.fillTrend(&trend)
+	result.Open = trend.Open
+	result.Close = trend.Close
+	result.Last = trend.Close
+	result.High = trend.High
+	result.Low = trend.Low
+	result.Vol = trend.Vol
+	result.Amount = trend.Amount
+
+	if !stats.empty() && stats.open.Sign() > 0 {
+		change := new(big.Rat).Sub(stats.close, stats.open)
+		change.Mul(change, big.NewRat(100, 1))
+		change.Quo(change, stats.open)
+		result.Change = change.FloatString(2) + "%"
 	}
 
-	result.Vol = vol
-	result.Amount = amount
 	return result
 }
 
@@ -251,119 +226,16 @@ func (t *TrendManager) startScheduleUpdate() {
 	t.cron.Start()
 }
 
+// insertTrend 重新计算最近24小时的1Hr趋势，迟到或者回滚的fill也会更新已经存在的记录
 func (t *TrendManager) insertTrend() {
-	// get latest 24 hour trend if not exist generate
-
-	fmt.Println("start insert trend cron job")
-
-	var wg sync.WaitGroup
+	log.Println("start insert trend cron job")
 
+	now := time.Now().Unix()
 	for _, mkt := range util.AllMarkets {
-		now := time.Now()
-		firstSecondThisHour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 1, 0, now.Location())
-
-		wg.Add(1)
-		go func(tmpMkt string) {
-			for i := 24; i >= 1; i-- {
-
-				start := firstSecondThisHour.Unix() - int64(i*60*60)
-				end := firstSecondThisHour.Unix() - int64((i-1)*60*60) - 1
-
-				trends, _ := t.rds.TrendQueryByTime(OneHour, tmpMkt, start, end)
-				if len(trends) > 0 {
-					log.Println("current interval trend exsit")
-					wg.Done()
-					return
-				}
-
-				lastTrends, _ := t.rds.TrendQueryByTime(OneHour, tmpMkt, start-int64(60*60), end-int64(60*60))
-				if len(lastTrends) > 1 {
-					log.Println("found more than one last trend!")
-					wg.Done()
-					return
-				} else if len(lastTrends) == 0 {
-					log.Println("not found last trend!")
-				}
-
-				if trends == nil || len(trends) == 0 {
-					fills, fillsErr := t.rds.QueryRecentFills(tmpMkt, "", start, end)
-
-					if fillsErr != nil {
-						continue
-					}
-
-					toInsert := &dao.Trend{
-						Intervals:  OneHour,
-						Market:     tmpMkt,
-						CreateTime: time.Now().Unix(),
-						Start:      start,
-						End:        end}
-
-					var (
-						vol    float64
-						amount float64
-						open   float64
-						low    float64
-					)
-
-					if len(lastTrends) == 0 {
-						toInsert.Open = 0
-						toInsert.Close = 0
-						toInsert.High = 0
-						toInsert.Low = 0
-					} else {
-						toInsert.Open = lastTrends[0].Close
-						toInsert.Close = lastTrends[0].Close
-						toInsert.High = lastTrends[0].Close
-						toInsert.Low = lastTrends[0].Close
-					}
-
-					sort.Slice(fills, func(i, j int) bool {
-						return fills[i].CreateTime < fills[j].CreateTime
-					})
-
-					for _, data := range fills {
-
-						if util.IsBuy(data.TokenS) {
-							vol += util.StringToFloat(data.AmountB)
-							amount += util.StringToFloat(data.AmountS)
-						} else {
-							vol += util.StringToFloat(data.AmountS)
-							amount += util.StringToFloat(data.AmountB)
-						}
-
-						price := util.CalculatePrice(data.AmountS, data.AmountB, data.TokenS, data.TokenB)
-
-						if open == 0 && price != 0 {
-							open = price
-						}
-
-						if toInsert.High == 0 || toInsert.High < price {
-							toInsert.High = price
-						}
-						if low == 0 || low > price {
-							low = price
-						}
-						toInsert.Close = price
-					}
-
-					if toInsert.Open != 0 && open != 0 {
-						toInsert.Open = open
-					}
-
-					toInsert.Low = low
-					toInsert.Vol = vol
-					toInsert.Amount = amount
-
-					if err := t.rds.Add(toInsert); err != nil {
-						fmt.Println(err)
-					}
-				}
-			}
-			wg.Done()
-		}(mkt)
+		if err := rebuildHourTrends(t.rds, mkt, now-24*60*60, now); err != nil {
+			log.Println(err)
+		}
 	}
-	wg.Wait()
 	t.refreshCache()
 }
 
@@ -388,62 +260,21 @@ func (t *TrendManager) aggregate(fills []dao.FillEvent, trends []Trend) (trend T
 			End:        lastSecondThisHour,
 			High:       lastTrend.High,
 			Low:        lastTrend.Low,
-			Vol:        0,
-			Amount:     0,
+			Vol:        "0",
+			Amount:     "0",
 			Open:       lastTrend.Open,
 			Close:      lastTrend.Close,
 		}, nil
 	}
 
-	trend = Trend{
-		Intervals:  OneHour,
-		Market:     fills[0].Market,
-		CreateTime: time.Now().Unix(),
-		Start:      firstSecondThisHour.Unix(),
-		End:        lastSecondThisHour,
-	}
-
-	var (
-		high   float64
-		low    float64
-		vol    float64
-		amount float64
-	)
-
 	sort.Slice(fills, func(i, j int) bool {
 		return fills[i].CreateTime < fills[j].CreateTime
 	})
 
-	for _, data := range fills {
-
-		if util.IsBuy(data.TokenS) {
-			vol += util.StringToFloat(data.AmountB)
-			amount += util.StringToFloat(data.AmountS)
-		} else {
-			vol += util.StringToFloat(data.AmountS)
-			amount += util.StringToFloat(data.AmountB)
-		}
-
-		price := util.CalculatePrice(data.AmountS, data.AmountB, data.TokenS, data.TokenB)
-
-		if high == 0 || high < price {
-			high = price
-		}
-		if low == 0 || low > price {
-			low = price
-		}
-	}
-
-	trend.High = high
-	trend.Low = low
-
-	openFill := fills[0]
-	trend.Open = util.CalculatePrice(openFill.AmountS, openFill.AmountB, openFill.TokenS, openFill.TokenB)
-	closeFill := fills[len(fills)-1]
-	trend.Close = util.CalculatePrice(closeFill.AmountS, closeFill.AmountB, closeFill.TokenS, closeFill.TokenB)
-
-	trend.Vol = vol
-	trend.Amount = amount
+	trend = hourTrendFromFills(fills[0].Market, fills, "0")
+	trend.CreateTime = time.Now().Unix()
+	trend.Start = firstSecondThisHour.Unix()
+	trend.End = lastSecondThisHour
 
 	return
 }
@@ -480,8 +311,8 @@ func (t *TrendManager) GetTicker() (tickers []Ticker, err error) {
 			tickerMap := tickerInCache.(map[string]Ticker)
 			tickers = make([]Ticker, 0)
 			for _, v := range tickerMap {
-				v.Buy = strconv.FormatFloat(v.Last, 'f', -1, 64)
-				v.Sell = strconv.FormatFloat(v.Last, 'f', -1, 64)
+				v.Buy = v.Last
+				v.Sell = v.Last
 				tickers = append(tickers, v)
 			}
 		} else {
@@ -495,33 +326,37 @@ func (t *TrendManager) GetTicker() (tickers []Ticker, err error) {
 
 func (t *TrendManager) handleOrderFilled(input eventemitter.EventData) (err error) {
 
-	if t.cacheReady {
+	event := input.(*types.OrderFilledEvent)
+	newFillModel := &dao.FillEvent{}
+	if err = newFillModel.ConvertDown(event); err != nil {
+		return
+	}
 
-		event := input.(*types.OrderFilledEvent)
-		newFillModel := &dao.FillEvent{}
-		if err = newFillModel.ConvertDown(event); err != nil {
-			return
-		}
+	market, wrapErr := util.WrapMarketByAddress(newFillModel.TokenS, newFillModel.TokenB)
 
-		market, wrapErr := util.WrapMarketByAddress(newFillModel.TokenS, newFillModel.TokenB)
+	if wrapErr != nil {
+		err = wrapErr
+		return
+	}
 
-		if wrapErr != nil {
-			err = wrapErr
-			return
-		}
+	// 迟到的fill同样需要更新已经结束的周期
+	t.candles.markDirty(market, newFillModel.CreateTime, newFillModel.CreateTime)
+
+	if t.cacheReady {
 
 		if tickerInCache, ok := t.c.Get(trendKey); ok {
 			trendMap := tickerInCache.(map[string]Cache)
 			tc := trendMap[market]
 			tc.Fills = append(tc.Fills, *newFillModel)
+			tc.recentFills = appendRecentFill(tc.recentFills, t.newRecentFill(newFillModel))
 			trendMap[market] = tc
 			t.c.Set(trendKey, trendMap, cache.NoExpiration)
 			t.reCalTicker(market)
 		} else {
 			fills := make([]dao.FillEvent, 0)
 			fills = append(fills, *newFillModel)
-			newCache := Cache{make([]Trend, 0), fills}
-			t.c.Set(trendKey, newCache, cache.NoExpiration)
+			newCache := Cache{Trends: make([]Trend, 0), Fills: fills, recentFills: []recentFill{t.newRecentFill(newFillModel)}}
+			t.c.Set(trendKey, map[string]Cache{market: newCache}, cache.NoExpiration)
 			t.reCalTicker(market)
 		}
 	} else {
@@ -531,15 +366,60 @@ func (t *TrendManager) handleOrderFilled(input eventemitter.EventData) (err erro
 	return
 }
 
+// handleFork ordermanager已经删除了分叉区块之后的fill，fill的时间不早于分叉区块的时间，
+// 重新计算从分叉区块开始的1Hr趋势以及k线
+func (t *TrendManager) handleFork(input eventemitter.EventData) error {
+	event := input.(*types.ForkedEvent)
+
+	now := time.Now().Unix()
+	from := now - defaultForkRollbackRange
+	if block, err := t.rds.FindBlockByHash(event.ForkHash); err == nil && block.CreateTime > 0 {
+		from = block.CreateTime
+	}
+
+	t.rebuildAfterFork(from)
+	return nil
+}
+
+// GetCandles 开始时间在[start, end]之间的k线，start和end为0时返回最近的100个周期
+func (t *TrendManager) GetCandles(market, interval string, start, end int64) ([]Trend, error) {
+	return t.candles.candles(strings.ToUpper(market), interval, start, end)
+}
+
+func (t *TrendManager) newRecentFill(fill *dao.FillEvent) recentFill {
+	v := recentFill{fill: *fill}
+	if order, err := t.rds.GetOrderByHash(common.HexToHash(fill.OrderHash)); err == nil {
+		v.orderTime = order.CreateTime
+	}
+	return v
+}
+
+// GetTrades 从缓存中返回market最近的成交，同一个环路的fill合并为一笔，since为0时不限制时间
+func (t *TrendManager) GetTrades(market string, limit int, since int64) (trades []Trade, err error) {
+	market = strings.ToUpper(market)
+
+	if !t.cacheReady {
+		return nil, errors.New("cache is not ready , please access later")
+	}
+	trendCache, ok := t.c.Get(trendKey)
+	if !ok {
+		return nil, errors.New("can't found trends by key : " + trendKey)
+	}
+	tc := trendCache.(map[string]Cache)[market]
+	return latestTrades(collapseTrades(market, tc.recentFills), limit, since), nil
+}
+
 func (t *TrendManager) reCalTicker(market string) {
 	trendInCache, _ := t.c.Get(trendKey)
 	mktCache := trendInCache.(map[string]Cache)[market]
 	now := time.Now()
 	firstSecondThisHour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 1, 0, now.Location())
 	ticker := calculateTicker(market, mktCache.Fills, mktCache.Trends, firstSecondThisHour)
-	tickerInCache, _ := t.c.Get(tickerKey)
-	tickerMap := tickerInCache.(map[string]Ticker)
-	tickerMap[market] = ticker
+	if tickerInCache, ok := t.c.Get(tickerKey); ok {
+		tickerInCache.(map[string]Ticker)[market] = ticker
+	} else {
+		t.c.Set(tickerKey, map[string]Ticker{market: ticker}, cache.NoExpiration)
+	}
 }
 
 func ConvertUp(src dao.Trend) Trend {
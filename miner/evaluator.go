@@ -21,7 +21,6 @@ package miner
 import (
 	"errors"
 	"github.com/Loopring/relay/log"
-	"math"
 	"math/big"
 
 	"github.com/Loopring/relay/ethaccessor"
@@ -30,6 +29,9 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
+//计算折价比例时保留的二进制小数位数
+const ratePrecision = 128
+
 type Evaluator struct {
 	marketCapProvider     marketcap.MarketCapProvider
 	rateRatioCVSThreshold int64
@@ -48,6 +50,31 @@ func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
 
 		productAmountS.Mul(productAmountS, amountS)
 		productAmountB.Mul(productAmountB, amountB)
+	}
+
+	//折价比例为productAmountB/productAmountS的n次方根，向下取整保证rateAmountS不超过amountS
+	productPrice := new(big.Rat)
+	productPrice.Quo(productAmountB, productAmountS)
+	ringState.ReducedRate = NthRoot(productPrice, len(ringState.Orders))
+	log.Debugf("Miner,productPrice:%s, len:%d, reducedRate:%s ", productPrice.FloatString(18), len(ringState.Orders), ringState.ReducedRate.FloatString(18))
+
+	rates := make([]*big.Rat, len(ringState.Orders))
+	for idx := range rates {
+		rates[idx] = ringState.ReducedRate
+	}
+	return e.ComputeRingWithRates(ringState, rates)
+}
+
+// ComputeRingWithRates 按指定的折价比例计算成交量及费用，rates[i]为第i个订单的折价比例，
+// 折价之后环路中所有订单价格的乘积应为1。ComputeRing中所有订单使用相同的比例
+func (e *Evaluator) ComputeRingWithRates(ringState *types.Ring, rates []*big.Rat) error {
+	if len(rates) != len(ringState.Orders) {
+		return errors.New("Miner,the length of rates must be equal to the length of orders")
+	}
+
+	for _, order := range ringState.Orders {
+		amountS := new(big.Rat).SetInt(order.OrderState.RawOrder.AmountS)
+		amountB := new(big.Rat).SetInt(order.OrderState.RawOrder.AmountB)
 
 		order.SPrice = new(big.Rat)
 		order.SPrice.Quo(amountS, amountB)
@@ -56,16 +83,6 @@ func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
 		order.BPrice.Quo(amountB, amountS)
 	}
 
-	productPrice := new(big.Rat)
-	productPrice.Quo(productAmountS, productAmountB)
-	//todo:change pow to big.Int
-	priceOfFloat, _ := productPrice.Float64()
-	rootOfRing := math.Pow(priceOfFloat, 1/float64(len(ringState.Orders)))
-	rate := new(big.Rat).SetFloat64(rootOfRing)
-	ringState.ReducedRate = new(big.Rat)
-	ringState.ReducedRate.Inv(rate)
-	log.Debugf("Miner,rate:%s, priceFloat:%f , len:%d, rootOfRing:%f, reducedRate:%s ", rate.String(), priceOfFloat, len(ringState.Orders), rootOfRing, ringState.ReducedRate.RatString())
-
 	//todo:get the fee for select the ring of mix income
 	//LRC等比例下降，首先需要计算fillAmountS
 	//分润的fee，首先需要计算fillAmountS，fillAmountS取决于整个环路上的完全匹配的订单
@@ -73,7 +90,7 @@ func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
 	minVolumeIdx := 0
 
 	for idx, filledOrder := range ringState.Orders {
-		filledOrder.SPrice.Mul(filledOrder.SPrice, ringState.ReducedRate)
+		filledOrder.SPrice.Mul(filledOrder.SPrice, rates[idx])
 
 		filledOrder.BPrice.Inv(filledOrder.SPrice)
 
@@ -83,16 +100,15 @@ func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
 		//根据用户设置，判断是以卖还是买为基准
 		//买入不超过amountB
 		filledOrder.RateAmountS = new(big.Rat).Set(amountS)
-		filledOrder.RateAmountS.Mul(amountS, ringState.ReducedRate)
+		filledOrder.RateAmountS.Mul(amountS, rates[idx])
 		//if BuyNoMoreThanAmountB , AvailableAmountS need to be reduced by the ratePrice
-		//if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
-		//	availbleAmountB := new(big.Rat).Set(filledOrder.AvailableAmountB)
-		//	availableAmountS := new(big.Rat).Mul(filledOrder.RateAmountS, availbleAmountB)
-		//	availableAmountS.Quo(availableAmountS, amountB)
-		//	if filledOrder.AvailableAmountB.Cmp(new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)) < 0 {
-		//		filledOrder.AvailableAmountS.Set(availableAmountS)
-		//	}
-		//}
+		if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
+			_, remainedAmountB := filledOrder.OrderState.RemainedAmount()
+			availableAmountS := new(big.Rat).Mul(remainedAmountB, filledOrder.SPrice)
+			if availableAmountS.Cmp(filledOrder.AvailableAmountS) < 0 {
+				filledOrder.AvailableAmountS = availableAmountS
+			}
+		}
 
 		//与上一订单的买入进行比较
 		var lastOrder *types.FilledOrder
@@ -183,15 +199,21 @@ func (e *Evaluator) computeFeeOfRingAndOrder(ringState *types.Ring) {
 			filledOrder.FeeS = savingAmount
 			legalAmountOfSaving = e.getLegalCurrency(filledOrder.OrderState.RawOrder.TokenS, filledOrder.FeeS)
 		} else {
+			reducedRate := new(big.Rat).Quo(filledOrder.RateAmountS, new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS))
 			savingAmount := new(big.Rat).Set(filledOrder.FillAmountB)
-			savingAmount.Mul(savingAmount, ringState.ReducedRate)
+			savingAmount.Mul(savingAmount, reducedRate)
 			savingAmount.Sub(filledOrder.FillAmountB, savingAmount)
 			filledOrder.FeeS = savingAmount
 			legalAmountOfSaving = e.getLegalCurrency(filledOrder.OrderState.RawOrder.TokenB, filledOrder.FeeS)
 		}
 
-		//compute lrcFee
-		rate := new(big.Rat).Quo(filledOrder.FillAmountS, new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS))
+		//compute lrcFee，与合约相同，BuyNoMoreThanAmountB时按照买入的比例计算
+		var rate *big.Rat
+		if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
+			rate = new(big.Rat).Quo(filledOrder.FillAmountB, new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB))
+		} else {
+			rate = new(big.Rat).Quo(filledOrder.FillAmountS, new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS))
+		}
 		filledOrder.LrcFee = new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.LrcFee)
 		filledOrder.LrcFee.Mul(filledOrder.LrcFee, rate)
 
@@ -203,7 +225,7 @@ func (e *Evaluator) computeFeeOfRingAndOrder(ringState *types.Ring) {
 		log.Debugf("raw.lrc:%s, AvailableLrcBalance:%s, legalAmountOfLrc:%s saving:%s", filledOrder.OrderState.RawOrder.LrcFee.String(), filledOrder.AvailableLrcBalance.FloatString(0), legalAmountOfLrc.String(), legalAmountOfSaving.String())
 		filledOrder.LegalLrcFee = legalAmountOfLrc
 
-		splitPer := new(big.Rat).SetInt64(int64(filledOrder.OrderState.RawOrder.MarginSplitPercentage))
+		splitPer := big.NewRat(int64(filledOrder.OrderState.RawOrder.MarginSplitPercentage), int64(100))
 		legalAmountOfSaving.Mul(legalAmountOfSaving, splitPer)
 		filledOrder.LegalFeeS = legalAmountOfSaving
 	}
@@ -212,11 +234,53 @@ func (e *Evaluator) computeFeeOfRingAndOrder(ringState *types.Ring) {
 
 //成环之后才可计算能否成交，否则不需计算，判断是否能够成交，不能使用除法计算
 func PriceValid(a2BOrder *types.OrderState, b2AOrder *types.OrderState) bool {
-	amountS := new(big.Int).Mul(a2BOrder.RawOrder.AmountS, b2AOrder.RawOrder.AmountS)
-	amountB := new(big.Int).Mul(a2BOrder.RawOrder.AmountB, b2AOrder.RawOrder.AmountB)
+	return PriceValidOfRing(a2BOrder, b2AOrder)
+}
+
+//多个订单成环时，所有订单amountS的乘积不小于amountB的乘积才能成交
+func PriceValidOfRing(orders ...*types.OrderState) bool {
+	amountS := big.NewInt(int64(1))
+	amountB := big.NewInt(int64(1))
+	for _, order := range orders {
+		amountS.Mul(amountS, order.RawOrder.AmountS)
+		amountB.Mul(amountB, order.RawOrder.AmountB)
+	}
 	return amountS.Cmp(amountB) >= 0
 }
 
+// NthRoot 计算x的n次方根，结果向下取整到ratePrecision位二进制小数，不会大于真实值
+func NthRoot(x *big.Rat, n int) *big.Rat {
+	if x.Sign() <= 0 {
+		return new(big.Rat)
+	}
+	if n <= 1 {
+		return new(big.Rat).Set(x)
+	}
+	scaled := new(big.Int).Lsh(x.Num(), uint(ratePrecision*n))
+	scaled.Quo(scaled, x.Denom())
+	root := nthRootOfInt(scaled, n)
+	return new(big.Rat).SetFrac(root, new(big.Int).Lsh(big.NewInt(int64(1)), ratePrecision))
+}
+
+// nthRootOfInt 牛顿迭代计算floor(a^(1/n))，初始值不小于真实值时迭代单调递减
+func nthRootOfInt(a *big.Int, n int) *big.Int {
+	if a.Sign() <= 0 {
+		return new(big.Int)
+	}
+	bigN := big.NewInt(int64(n))
+	bigN1 := big.NewInt(int64(n - 1))
+	x := new(big.Int).Lsh(big.NewInt(int64(1)), uint((a.BitLen()+n-1)/n))
+	for {
+		y := new(big.Int).Mul(bigN1, x)
+		y.Add(y, new(big.Int).Quo(a, new(big.Int).Exp(x, bigN1, nil)))
+		y.Quo(y, bigN)
+		if y.Cmp(x) >= 0 {
+			return x
+		}
+		x = y
+	}
+}
+
 func PriceRateCVSquare(ringState *types.Ring) (*big.Int, error) {
 	rateRatios := []*big.Int{}
 	scale, _ := new(big.Int).SetString("10000", 0)
@@ -237,6 +301,27 @@ func PriceRateCVSquare(ringState *types.Ring) (*big.Int, error) {
 	return CVSquare(rateRatios, scale), nil
 }
 
+// RatesCVSValid 计算成交量之前按照PriceRateCVSquare的方式检查折价比例，rates为RateAmountS/AmountS
+func (e *Evaluator) RatesCVSValid(rates []*big.Rat) bool {
+	if len(rates) < 2 {
+		return true
+	}
+	rateRatios := []*big.Int{}
+	scale, _ := new(big.Int).SetString("10000", 0)
+	for _, rate := range rates {
+		if rate.Cmp(big.NewRat(int64(1), int64(1))) > 0 {
+			return false
+		}
+		ratio := new(big.Rat).Mul(rate, new(big.Rat).SetInt(scale))
+		rateRatio := new(big.Int).Quo(ratio.Num(), ratio.Denom())
+		if rateRatio.Sign() <= 0 {
+			return false
+		}
+		rateRatios = append(rateRatios, rateRatio)
+	}
+	return CVSquare(rateRatios, scale).Cmp(big.NewInt(e.rateRatioCVSThreshold)) <= 0
+}
+
 func CVSquare(rateRatios []*big.Int, scale *big.Int) *big.Int {
 	avg := big.NewInt(0)
 	length := big.NewInt(int64(len(rateRatios)))
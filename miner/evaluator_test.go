@@ -0,0 +1,336 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+// 法币价格与token数量1:1，便于直接比较费用
+type fixedMarketCap struct{}
+
+func (mc *fixedMarketCap) Start() {}
+func (mc *fixedMarketCap) Stop()  {}
+func (mc *fixedMarketCap) LegalCurrencyValue(tokenAddress common.Address, amount *big.Rat) (*big.Rat, error) {
+	return new(big.Rat).Set(amount), nil
+}
+func (mc *fixedMarketCap) LegalCurrencyValueOfEth(amount *big.Rat) (*big.Rat, error) {
+	return new(big.Rat).Set(amount), nil
+}
+func (mc *fixedMarketCap) LegalCurrencyValueByCurrency(tokenAddress common.Address, amount *big.Rat, currencyStr string) (*big.Rat, error) {
+	return new(big.Rat).Set(amount), nil
+}
+func (mc *fixedMarketCap) GetMarketCap(tokenAddress common.Address) (*big.Rat, error) {
+	return big.NewRat(1, 1), nil
+}
+func (mc *fixedMarketCap) GetEthCap() (*big.Rat, error) {
+	return big.NewRat(1, 1), nil
+}
+func (mc *fixedMarketCap) GetMarketCapByCurrency(tokenAddress common.Address, currencyStr string) (*big.Rat, error) {
+	return big.NewRat(1, 1), nil
+}
+
+func newTestEvaluator() *miner.Evaluator {
+	return miner.NewEvaluator(&fixedMarketCap{}, int64(1000000000000000), &ethaccessor.EthNodeAccessor{})
+}
+
+// randomAmount 1e20 ~ 1e23，订单价格在1e-3 ~ 1e3之间，避免合约中的整数运算误差过大
+func randomAmount(r *rand.Rand) *big.Int {
+	amount := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(18+r.Intn(3))), nil)
+	return amount.Mul(amount, big.NewInt(r.Int63n(900)+100))
+}
+
+// generatedRing 随机生成的可以成交的环路，所有订单amountS的乘积不小于amountB的乘积
+type generatedRing struct {
+	orders         []*types.OrderState
+	tokenSBalances []*big.Int
+}
+
+func (generatedRing) Generate(r *rand.Rand, size int) reflect.Value {
+	ring := generatedRing{}
+	n := 2 + r.Intn(3)
+	productS := big.NewInt(1)
+	productB := big.NewInt(1)
+	for i := 0; i < n; i++ {
+		order := types.Order{}
+		order.Protocol = common.HexToAddress("0x1")
+		order.Owner = common.BigToAddress(big.NewInt(int64(100 + i)))
+		order.TokenS = common.BigToAddress(big.NewInt(int64(200 + i)))
+		order.TokenB = common.BigToAddress(big.NewInt(int64(200 + (i+1)%n)))
+		order.AmountS = randomAmount(r)
+		if i < n-1 {
+			order.AmountB = randomAmount(r)
+		} else {
+			//最后一个订单的价格使环路刚好可以成交或者有不超过5%的收益
+			order.AmountB = new(big.Int).Mul(order.AmountS, productS)
+			order.AmountB.Mul(order.AmountB, big.NewInt(int64(9500+r.Intn(501))))
+			order.AmountB.Quo(order.AmountB, new(big.Int).Mul(productB, big.NewInt(10000)))
+		}
+		productS.Mul(productS, order.AmountS)
+		productB.Mul(productB, order.AmountB)
+		order.LrcFee = randomAmount(r)
+		order.BuyNoMoreThanAmountB = r.Intn(2) == 0
+		order.MarginSplitPercentage = uint8(r.Intn(101))
+		order.Hash = common.BigToHash(big.NewInt(int64(300 + i)))
+
+		state := &types.OrderState{RawOrder: order}
+		state.DealtAmountS = big.NewInt(0)
+		state.DealtAmountB = big.NewInt(0)
+		state.SplitAmountS = big.NewInt(0)
+		state.SplitAmountB = big.NewInt(0)
+		state.CancelledAmountS = big.NewInt(0)
+		state.CancelledAmountB = big.NewInt(0)
+		ring.orders = append(ring.orders, state)
+
+		//余额为amountS的10% ~ 200%
+		balance := new(big.Int).Mul(order.AmountS, big.NewInt(int64(10+r.Intn(191))))
+		ring.tokenSBalances = append(ring.tokenSBalances, balance.Quo(balance, big.NewInt(100)))
+	}
+	return reflect.ValueOf(ring)
+}
+
+func (ring generatedRing) compute(t *testing.T) *types.Ring {
+	filledOrders := []*types.FilledOrder{}
+	for i, order := range ring.orders {
+		lrcBalance := new(big.Rat).SetInt(new(big.Int).Mul(order.RawOrder.LrcFee, big.NewInt(10)))
+		filledOrders = append(filledOrders, types.ConvertOrderStateToFilledOrder(*order, lrcBalance, new(big.Rat).SetInt(ring.tokenSBalances[i])))
+	}
+	ringState := &types.Ring{Orders: filledOrders}
+	if err := newTestEvaluator().ComputeRing(ringState); nil != err {
+		t.Errorf("valid ring rejected:%s", err.Error())
+		return nil
+	}
+	return ringState
+}
+
+// contractFills 按照合约calculateRingFillAmount的整数运算计算每个订单的fillAmountS、fillAmountB以及lrcFee
+func contractFills(ringState *types.Ring, balances []*big.Int) (fillS, fillB, lrcFee []*big.Int) {
+	n := len(ringState.Orders)
+	rateS := make([]*big.Int, n)
+	fillS = make([]*big.Int, n)
+	fillB = make([]*big.Int, n)
+	lrcFee = make([]*big.Int, n)
+	for i, filledOrder := range ringState.Orders {
+		rateS[i], _ = new(big.Int).SetString(filledOrder.RateAmountS.FloatString(0), 10)
+		fillS[i] = new(big.Int).Set(filledOrder.OrderState.RawOrder.AmountS)
+		if balances[i].Cmp(fillS[i]) < 0 {
+			fillS[i].Set(balances[i])
+		}
+	}
+
+	calculate := func(i, smallestIdx int) int {
+		order := ringState.Orders[i].OrderState.RawOrder
+		j := (i + 1) % n
+		fillB[i] = new(big.Int).Mul(fillS[i], order.AmountB)
+		fillB[i].Quo(fillB[i], rateS[i])
+		if order.BuyNoMoreThanAmountB {
+			if fillB[i].Cmp(order.AmountB) > 0 {
+				fillB[i].Set(order.AmountB)
+				fillS[i] = new(big.Int).Mul(fillB[i], rateS[i])
+				fillS[i].Quo(fillS[i], order.AmountB)
+				smallestIdx = i
+			}
+			lrcFee[i] = new(big.Int).Mul(order.LrcFee, fillB[i])
+			lrcFee[i].Quo(lrcFee[i], order.AmountB)
+		} else {
+			lrcFee[i] = new(big.Int).Mul(order.LrcFee, fillS[i])
+			lrcFee[i].Quo(lrcFee[i], order.AmountS)
+		}
+		if fillB[i].Cmp(fillS[j]) <= 0 {
+			fillS[j] = new(big.Int).Set(fillB[i])
+		} else {
+			smallestIdx = j
+		}
+		return smallestIdx
+	}
+
+	smallestIdx := 0
+	for i := 0; i < n; i++ {
+		smallestIdx = calculate(i, smallestIdx)
+	}
+	for i := 0; i < smallestIdx; i++ {
+		calculate(i, 0)
+	}
+	return fillS, fillB, lrcFee
+}
+
+// approxEqual 合约中的整数运算每一步都向下取整，允许与参与计算的数量scale相比很小的误差
+func approxEqual(expected *big.Int, actual *big.Rat, scale *big.Int) bool {
+	diff := new(big.Rat).Sub(new(big.Rat).SetInt(expected), actual)
+	diff.Abs(diff)
+	tolerance := new(big.Rat).Mul(new(big.Rat).SetInt(scale), big.NewRat(1, 1000000000))
+	tolerance.Add(tolerance, big.NewRat(10, 1))
+	return diff.Cmp(tolerance) <= 0
+}
+
+func TestNthRoot(t *testing.T) {
+	one := new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 128))
+	property := func(num, denom uint64, n uint8) bool {
+		if num == 0 || denom == 0 {
+			return true
+		}
+		x := new(big.Rat).SetFrac(new(big.Int).SetUint64(num), new(big.Int).SetUint64(denom))
+		root := miner.NthRoot(x, int(n%6)+1)
+		pow := func(r *big.Rat) *big.Rat {
+			res := big.NewRat(1, 1)
+			for i := 0; i < int(n%6)+1; i++ {
+				res.Mul(res, r)
+			}
+			return res
+		}
+		//root^n <= x < (root+2^-128)^n
+		return pow(root).Cmp(x) <= 0 && pow(new(big.Rat).Add(root, one)).Cmp(x) > 0
+	}
+	if err := quick.Check(property, nil); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestRatesCVSValid(t *testing.T) {
+	evaluator := miner.NewEvaluator(nil, 62500, nil)
+	cases := []struct {
+		rates []*big.Rat
+		valid bool
+	}{
+		{[]*big.Rat{big.NewRat(1, 1), big.NewRat(1, 1)}, true},
+		{[]*big.Rat{big.NewRat(1, 1), big.NewRat(99, 100)}, true},
+		{[]*big.Rat{big.NewRat(9, 10), big.NewRat(9, 10)}, true},
+		{[]*big.Rat{big.NewRat(1, 1), big.NewRat(1, 2)}, false},
+		{[]*big.Rat{big.NewRat(101, 100), big.NewRat(1, 1)}, false},
+		{[]*big.Rat{big.NewRat(1, 100000), big.NewRat(1, 1)}, false},
+		{[]*big.Rat{big.NewRat(1, 2)}, true},
+	}
+	for idx, c := range cases {
+		if valid := evaluator.RatesCVSValid(c.rates); valid != c.valid {
+			t.Errorf("case %d got %t, want %t", idx, valid, c.valid)
+		}
+	}
+}
+
+func TestComputeRingRateAmountS(t *testing.T) {
+	property := func(ring generatedRing) bool {
+		ringState := ring.compute(t)
+		if nil == ringState {
+			return false
+		}
+		//折价之后所有订单价格的乘积不超过1，并且只有极小的误差
+		product := big.NewRat(1, 1)
+		for _, filledOrder := range ringState.Orders {
+			rateAmountS, _ := new(big.Int).SetString(filledOrder.RateAmountS.FloatString(0), 10)
+			if rateAmountS.Cmp(filledOrder.OrderState.RawOrder.AmountS) > 0 {
+				t.Errorf("rateAmountS:%s is greater than amountS:%s", rateAmountS.String(), filledOrder.OrderState.RawOrder.AmountS.String())
+				return false
+			}
+			product.Mul(product, filledOrder.SPrice)
+		}
+		lower := big.NewRat(999999999999, 1000000000000)
+		if product.Cmp(big.NewRat(1, 1)) > 0 || product.Cmp(lower) < 0 {
+			t.Errorf("product of reduced prices:%s is not 1", product.FloatString(20))
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 200}); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestComputeRingFillsMatchContract(t *testing.T) {
+	property := func(ring generatedRing) bool {
+		ringState := ring.compute(t)
+		if nil == ringState {
+			return false
+		}
+		fillS, fillB, lrcFee := contractFills(ringState, ring.tokenSBalances)
+		for i, filledOrder := range ringState.Orders {
+			if !approxEqual(fillS[i], filledOrder.FillAmountS, fillS[i]) || !approxEqual(fillB[i], filledOrder.FillAmountB, fillB[i]) {
+				t.Errorf("order %d, contract fillAmountS:%s fillAmountB:%s, evaluator fillAmountS:%s fillAmountB:%s", i, fillS[i].String(), fillB[i].String(), filledOrder.FillAmountS.FloatString(0), filledOrder.FillAmountB.FloatString(0))
+				return false
+			}
+			if !approxEqual(lrcFee[i], filledOrder.LrcFee, lrcFee[i]) {
+				t.Errorf("order %d, contract lrcFee:%s, evaluator lrcFee:%s", i, lrcFee[i].String(), filledOrder.LrcFee.FloatString(0))
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 200}); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestComputeRingFeesMatchContract(t *testing.T) {
+	property := func(ring generatedRing) bool {
+		ringState := ring.compute(t)
+		if nil == ringState {
+			return false
+		}
+		fillS, _, _ := contractFills(ringState, ring.tokenSBalances)
+		n := len(ringState.Orders)
+		for i, filledOrder := range ringState.Orders {
+			order := filledOrder.OrderState.RawOrder
+			next := fillS[(i+1)%n]
+
+			//合约中的分润：BuyNoMoreThanAmountB时为节省的tokenS，否则为多得到的tokenB
+			var margin, scale *big.Int
+			if order.BuyNoMoreThanAmountB {
+				scale = fillS[i]
+				margin = new(big.Int).Mul(next, order.AmountS)
+				margin.Quo(margin, order.AmountB)
+				margin.Sub(margin, fillS[i])
+			} else {
+				scale = next
+				margin = new(big.Int).Mul(fillS[i], order.AmountB)
+				margin.Quo(margin, order.AmountS)
+				margin.Sub(next, margin)
+			}
+			if !approxEqual(margin, filledOrder.FeeS, scale) {
+				t.Errorf("order %d, contract margin:%s, evaluator feeS:%s", i, margin.String(), filledOrder.FeeS.FloatString(0))
+				return false
+			}
+
+			split := new(big.Int).Mul(margin, big.NewInt(int64(order.MarginSplitPercentage)))
+			split.Quo(split, big.NewInt(100))
+			if !approxEqual(split, filledOrder.LegalFeeS, scale) {
+				t.Errorf("order %d, contract split:%s, evaluator legalFeeS:%s", i, split.String(), filledOrder.LegalFeeS.FloatString(0))
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 200}); nil != err {
+		t.Error(err)
+	}
+}
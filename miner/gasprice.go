@@ -0,0 +1,218 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+)
+
+const (
+	GasPriceStrategyNode       = "node"
+	GasPriceStrategyFixed      = "fixed"
+	GasPriceStrategyPercentile = "percentile"
+
+	defaultGasPriceBlocks = 20
+)
+
+// GasPriceStrategy 根据环路的法币收益以及提交环路需要的gas计算gasPrice
+type GasPriceStrategy interface {
+	GasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error)
+}
+
+// NewGasPriceStrategy 没有配置时使用节点的gasPrice
+func NewGasPriceStrategy(options *config.GasPriceOptions, accessor *ethaccessor.EthNodeAccessor) (GasPriceStrategy, error) {
+	if nil == options || options.Strategy == "" || options.Strategy == GasPriceStrategyNode {
+		return &NodeGasPriceStrategy{accessor: accessor}, nil
+	}
+	switch options.Strategy {
+	case GasPriceStrategyFixed:
+		if options.FixedPrice <= 0 {
+			return nil, errors.New("fixedPrice must be setted when gas price strategy is fixed")
+		}
+		return &FixedGasPriceStrategy{price: big.NewInt(options.FixedPrice)}, nil
+	case GasPriceStrategyPercentile:
+		return NewPercentileGasPriceStrategy(accessor, options.Blocks, options.Percentile)
+	}
+	return nil, errors.New("unsupported gas price strategy:" + options.Strategy)
+}
+
+type NodeGasPriceStrategy struct {
+	accessor *ethaccessor.EthNodeAccessor
+}
+
+func (s *NodeGasPriceStrategy) GasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error) {
+	var gasPrice types.Big
+	if err := s.accessor.RetryCall(2, &gasPrice, "eth_gasPrice"); nil != err {
+		return nil, err
+	}
+	return gasPrice.BigInt(), nil
+}
+
+type FixedGasPriceStrategy struct {
+	price *big.Int
+}
+
+func (s *FixedGasPriceStrategy) GasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error) {
+	return new(big.Int).Set(s.price), nil
+}
+
+// PercentileGasPriceStrategy 最近blocks个区块中所有交易gasPrice的百分位数，
+// 只获取新的区块，最近的区块中没有交易时使用节点的gasPrice
+type PercentileGasPriceStrategy struct {
+	accessor   *ethaccessor.EthNodeAccessor
+	blocks     int64
+	percentile int
+
+	mtx    sync.Mutex
+	prices map[int64][]*big.Int // blockNumber -> 区块中交易的gasPrice
+}
+
+func NewPercentileGasPriceStrategy(accessor *ethaccessor.EthNodeAccessor, blocks, percentile int) (*PercentileGasPriceStrategy, error) {
+	if percentile <= 0 || percentile > 100 {
+		return nil, errors.New("percentile must be in (0, 100] when gas price strategy is percentile")
+	}
+	s := &PercentileGasPriceStrategy{}
+	s.accessor = accessor
+	s.blocks = int64(blocks)
+	if s.blocks <= 0 {
+		s.blocks = defaultGasPriceBlocks
+	}
+	s.percentile = percentile
+	s.prices = make(map[int64][]*big.Int)
+	return s, nil
+}
+
+func (s *PercentileGasPriceStrategy) GasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error) {
+	var blockNumber types.Big
+	if err := s.accessor.RetryCall(2, &blockNumber, "eth_blockNumber"); nil != err {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	latest := blockNumber.Int64()
+	for number := range s.prices {
+		if number <= latest-s.blocks || number > latest {
+			delete(s.prices, number)
+		}
+	}
+	for number := latest - s.blocks + 1; number <= latest; number++ {
+		if _, exists := s.prices[number]; exists || number < 0 {
+			continue
+		}
+		var block ethaccessor.BlockWithTxObject
+		if err := s.accessor.RetryCall(2, &block, "eth_getBlockByNumber", fmt.Sprintf("%#x", number), true); nil != err {
+			return nil, err
+		}
+		blockPrices := make([]*big.Int, 0, len(block.Transactions))
+		for _, tx := range block.Transactions {
+			blockPrices = append(blockPrices, tx.GasPrice.BigInt())
+		}
+		s.prices[number] = blockPrices
+	}
+
+	prices := []*big.Int{}
+	for _, blockPrices := range s.prices {
+		prices = append(prices, blockPrices...)
+	}
+	if len(prices) <= 0 {
+		return (&NodeGasPriceStrategy{accessor: s.accessor}).GasPrice(legalFee, gas)
+	}
+	return percentileOf(prices, s.percentile), nil
+}
+
+func percentileOf(prices []*big.Int, percentile int) *big.Int {
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].Cmp(prices[j]) < 0
+	})
+	idx := (len(prices) - 1) * percentile / 100
+	return new(big.Int).Set(prices[idx])
+}
+
+// FeePercentGasPriceStrategy 提交环路的gas费用最多为环路法币收益的feePercent%，
+// 使用base策略的gasPrice，超过feePercent%对应的gasPrice时使用后者
+type FeePercentGasPriceStrategy struct {
+	marketCapProvider marketcap.MarketCapProvider
+	feePercent        float64
+	base              GasPriceStrategy
+}
+
+func NewFeePercentGasPriceStrategy(marketCapProvider marketcap.MarketCapProvider, feePercent float64, base GasPriceStrategy) *FeePercentGasPriceStrategy {
+	return &FeePercentGasPriceStrategy{marketCapProvider: marketCapProvider, feePercent: feePercent, base: base}
+}
+
+func (s *FeePercentGasPriceStrategy) GasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error) {
+	maxGasPrice, err := s.maxGasPrice(legalFee, gas)
+	if nil != err {
+		return nil, err
+	}
+	if nil == s.base {
+		return maxGasPrice, nil
+	}
+	// base策略失败时仍然可以按照上限提交
+	gasPrice, err := s.base.GasPrice(legalFee, gas)
+	if nil != err {
+		log.Errorf("miner,compute gasPrice by base strategy err:%s, use the gasPrice of fee percent:%s", err.Error(), maxGasPrice.String())
+		return maxGasPrice, nil
+	}
+	if gasPrice.Cmp(maxGasPrice) > 0 {
+		return maxGasPrice, nil
+	}
+	return gasPrice, nil
+}
+
+// maxGasPrice gas费用恰好为法币收益的feePercent%时的gasPrice
+func (s *FeePercentGasPriceStrategy) maxGasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error) {
+	if nil == legalFee || legalFee.Sign() <= 0 || nil == gas || gas.Sign() <= 0 {
+		return nil, errors.New("legalFee and gas must be positive")
+	}
+	ethPrice, err := s.marketCapProvider.GetEthCap()
+	if nil != err {
+		return nil, err
+	}
+	if nil == ethPrice || ethPrice.Sign() <= 0 {
+		return nil, errors.New("price of eth must be positive")
+	}
+	percent := new(big.Rat)
+	percent.SetFloat64(s.feePercent / 100)
+
+	// 法币金额换算为wei之后平均到每个gas
+	cost := new(big.Rat).Mul(legalFee, percent)
+	cost.Quo(cost, ethPrice)
+	cost.Mul(cost, new(big.Rat).SetInt(util.AllTokens["WETH"].Decimals))
+	cost.Quo(cost, new(big.Rat).SetInt(gas))
+	gasPrice := new(big.Int).Quo(cost.Num(), cost.Denom())
+	if gasPrice.Sign() <= 0 {
+		return nil, errors.New("legal fee of ring is too little to pay for gas")
+	}
+	log.Debugf("miner,fee percent:%f of legalFee:%s, max gasPrice:%s", s.feePercent, legalFee.FloatString(2), gasPrice.String())
+	return gasPrice, nil
+}
@@ -0,0 +1,191 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+type testEthCapProvider struct {
+	marketcap.MarketCapProvider
+	ethPrice *big.Rat
+	err      error
+}
+
+func (p *testEthCapProvider) GetEthCap() (*big.Rat, error) {
+	return p.ethPrice, p.err
+}
+
+func TestPercentileOf(t *testing.T) {
+	cases := []struct {
+		percentile int
+		want       int64
+	}{
+		{1, 1},
+		{50, 5},
+		{60, 6},
+		{99, 9},
+		{100, 10},
+	}
+	for _, c := range cases {
+		prices := []*big.Int{}
+		for _, v := range []int64{7, 3, 10, 1, 5, 9, 2, 8, 4, 6} {
+			prices = append(prices, big.NewInt(v))
+		}
+		if got := percentileOf(prices, c.percentile); got.Int64() != c.want {
+			t.Errorf("percentile:%d got %s, want %d", c.percentile, got.String(), c.want)
+		}
+	}
+
+	single := []*big.Int{big.NewInt(42)}
+	if got := percentileOf(single, 60); got.Int64() != 42 {
+		t.Errorf("single price got %s, want 42", got.String())
+	}
+	got := percentileOf(single, 100)
+	got.SetInt64(0)
+	if single[0].Int64() != 42 {
+		t.Errorf("result of percentileOf should be a copy")
+	}
+}
+
+func TestNewPercentileGasPriceStrategy(t *testing.T) {
+	for _, percentile := range []int{-1, 0, 101} {
+		if _, err := NewPercentileGasPriceStrategy(nil, 0, percentile); nil == err {
+			t.Errorf("percentile:%d should be rejected", percentile)
+		}
+	}
+	s, err := NewPercentileGasPriceStrategy(nil, 0, 100)
+	if nil != err {
+		t.Fatalf("percentile:100 err:%s", err.Error())
+	}
+	if s.percentile != 100 || s.blocks != defaultGasPriceBlocks {
+		t.Errorf("got percentile:%d blocks:%d", s.percentile, s.blocks)
+	}
+}
+
+func TestFeePercentGasPrice(t *testing.T) {
+	util.AllTokens = map[string]types.Token{
+		"WETH": {Symbol: "WETH", Decimals: big.NewInt(1e18)},
+	}
+	provider := &testEthCapProvider{ethPrice: big.NewRat(500, 1)}
+	s := NewFeePercentGasPriceStrategy(provider, 10, nil)
+
+	// 10%的法币收益为10，可以支付0.02 eth，平均到200000 gas为100 gwei
+	gasPrice, err := s.GasPrice(big.NewRat(100, 1), big.NewInt(200000))
+	if nil != err {
+		t.Fatalf("compute gasPrice err:%s", err.Error())
+	}
+	if gasPrice.Cmp(big.NewInt(100000000000)) != 0 {
+		t.Errorf("gasPrice got %s, want 100000000000", gasPrice.String())
+	}
+
+	// 不足1 wei的部分舍去
+	gasPrice, err = s.GasPrice(big.NewRat(100, 1), big.NewInt(300000))
+	if nil != err {
+		t.Fatalf("compute gasPrice err:%s", err.Error())
+	}
+	if gasPrice.Cmp(big.NewInt(66666666666)) != 0 {
+		t.Errorf("gasPrice got %s, want 66666666666", gasPrice.String())
+	}
+
+	invalid := []struct {
+		legalFee *big.Rat
+		gas      *big.Int
+	}{
+		{nil, big.NewInt(200000)},
+		{new(big.Rat), big.NewInt(200000)},
+		{big.NewRat(100, 1), nil},
+		{big.NewRat(100, 1), new(big.Int)},
+		{big.NewRat(1, 1000000000000000), big.NewInt(200000)},
+	}
+	for i, c := range invalid {
+		if _, err := s.GasPrice(c.legalFee, c.gas); nil == err {
+			t.Errorf("case %d should return error", i)
+		}
+	}
+
+	provider.ethPrice = new(big.Rat)
+	if _, err := s.GasPrice(big.NewRat(100, 1), big.NewInt(200000)); nil == err {
+		t.Errorf("zero eth price should return error")
+	}
+	provider.ethPrice, provider.err = nil, errors.New("marketcap unavailable")
+	if _, err := s.GasPrice(big.NewRat(100, 1), big.NewInt(200000)); nil == err {
+		t.Errorf("marketcap error should be returned")
+	}
+}
+
+type testGasPriceStrategy struct {
+	price *big.Int
+	err   error
+}
+
+func (s *testGasPriceStrategy) GasPrice(legalFee *big.Rat, gas *big.Int) (*big.Int, error) {
+	return s.price, s.err
+}
+
+func TestFeePercentGasPriceCapsBase(t *testing.T) {
+	util.AllTokens = map[string]types.Token{
+		"WETH": {Symbol: "WETH", Decimals: big.NewInt(1e18)},
+	}
+	provider := &testEthCapProvider{ethPrice: big.NewRat(500, 1)}
+	base := &testGasPriceStrategy{}
+	s := NewFeePercentGasPriceStrategy(provider, 10, base)
+
+	// 上限为100 gwei
+	cases := []struct {
+		basePrice *big.Int
+		baseErr   error
+		want      int64
+	}{
+		{big.NewInt(20000000000), nil, 20000000000},
+		{big.NewInt(100000000000), nil, 100000000000},
+		{big.NewInt(300000000000), nil, 100000000000},
+		{nil, errors.New("node unavailable"), 100000000000},
+	}
+	for i, c := range cases {
+		base.price, base.err = c.basePrice, c.baseErr
+		gasPrice, err := s.GasPrice(big.NewRat(100, 1), big.NewInt(200000))
+		if nil != err {
+			t.Fatalf("case %d compute gasPrice err:%s", i, err.Error())
+		}
+		if gasPrice.Cmp(big.NewInt(c.want)) != 0 {
+			t.Errorf("case %d gasPrice got %s, want %d", i, gasPrice.String(), c.want)
+		}
+	}
+
+	// 无法计算上限时不使用base的gasPrice
+	base.price, base.err = big.NewInt(1), nil
+	provider.ethPrice, provider.err = nil, errors.New("marketcap unavailable")
+	if _, err := s.GasPrice(big.NewRat(100, 1), big.NewInt(200000)); nil == err {
+		t.Errorf("marketcap error should be returned")
+	}
+}
@@ -0,0 +1,457 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// 节点替换相同nonce的交易时要求gasPrice至少提高10%
+	defaultGasPriceBumpPercent = 10
+
+	// 没有配置MaxPendingTtl的地址，例如percent miner
+	defaultMaxPendingTtl = 40
+
+	cancelTxGas = 21000
+)
+
+// sentTx 已经发送但还没有被打包的交易，txHashes为使用该nonce发送过的所有交易，最后一个为最新的交易
+type sentTx struct {
+	nonce        *big.Int
+	to           common.Address
+	gas          *big.Int
+	gasPrice     *big.Int
+	data         []byte
+	ringhashes   []common.Hash
+	isRegistry   bool
+	txHashes     []common.Hash
+	cancelTxHash common.Hash // 环路失效后转账给自己的交易，不为空时不再重新发送环路
+	sentBlock    *big.Int
+}
+
+func (tx *sentTx) cancelled() bool {
+	return !types.IsZeroHash(tx.cancelTxHash)
+}
+
+type minerNonce struct {
+	mtx           sync.Mutex
+	address       common.Address
+	maxPendingTtl int64
+	gasPriceLimit *big.Int
+	nonce         *big.Int // 下一笔交易使用的nonce
+	pending       map[uint64]*sentTx
+}
+
+// nonceManager 为每个miner地址分配nonce并跟踪发送的交易，
+// 交易超过MaxPendingTtl个区块仍未打包时提高gasPrice使用相同的nonce重新发送，
+// 环路中的订单已经失效时使用相同的nonce转账给自己，取消该环路
+type nonceManager struct {
+	accessor    *ethaccessor.EthNodeAccessor
+	dbService   dao.RdsService
+	bumpPercent int64
+	failed      func(ringhashes []common.Hash, err error)
+
+	mtx    sync.RWMutex
+	miners map[common.Address]*minerNonce
+}
+
+func newNonceManager(accessor *ethaccessor.EthNodeAccessor, dbService dao.RdsService, bumpPercent int64, failed func(ringhashes []common.Hash, err error)) *nonceManager {
+	manager := &nonceManager{}
+	manager.accessor = accessor
+	manager.dbService = dbService
+	manager.bumpPercent = bumpPercent
+	if manager.bumpPercent < defaultGasPriceBumpPercent {
+		manager.bumpPercent = defaultGasPriceBumpPercent
+	}
+	manager.failed = failed
+	manager.miners = make(map[common.Address]*minerNonce)
+	return manager
+}
+
+func (manager *nonceManager) addMiner(address common.Address, maxPendingTtl int, gasPriceLimit *big.Int) {
+	miner := &minerNonce{}
+	miner.address = address
+	miner.maxPendingTtl = int64(maxPendingTtl)
+	if miner.maxPendingTtl <= 0 {
+		miner.maxPendingTtl = defaultMaxPendingTtl
+	}
+	miner.gasPriceLimit = gasPriceLimit
+	miner.pending = make(map[uint64]*sentTx)
+
+	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
+	manager.miners[address] = miner
+}
+
+func (manager *nonceManager) getMiner(address common.Address) *minerNonce {
+	manager.mtx.RLock()
+	miner, exists := manager.miners[address]
+	manager.mtx.RUnlock()
+	if !exists {
+		manager.addMiner(address, defaultMaxPendingTtl, nil)
+		manager.mtx.RLock()
+		miner = manager.miners[address]
+		manager.mtx.RUnlock()
+	}
+	return miner
+}
+
+func (manager *nonceManager) pendingCount(address common.Address) int64 {
+	miner := manager.getMiner(address)
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+	return int64(len(miner.pending))
+}
+
+// sendTransaction 发送失败时下一笔交易重新从节点获取nonce
+func (manager *nonceManager) sendTransaction(from, to common.Address, gas, gasPrice *big.Int, data []byte, ringhashes []common.Hash, isRegistry bool) (string, error) {
+	miner := manager.getMiner(from)
+	miner.mtx.Lock()
+	defer miner.mtx.Unlock()
+
+	nonce, err := manager.nextNonce(miner)
+	if nil != err {
+		return "", err
+	}
+	tx := &sentTx{}
+	tx.nonce = nonce
+	tx.to = to
+	tx.gas = new(big.Int).Set(gas)
+	tx.gasPrice = new(big.Int).Set(gasPrice)
+	tx.data = data
+	tx.ringhashes = ringhashes
+	tx.isRegistry = isRegistry
+
+	txHash, err := manager.accessor.ContractSendTransactionWithNonce(accounts.Account{Address: from}, to, gas, gasPrice, nil, nonce, data)
+	if nil != err {
+		miner.nonce = nil
+		return "", err
+	}
+	tx.txHashes = []common.Hash{common.HexToHash(txHash)}
+	miner.nonce = new(big.Int).Add(nonce, big.NewInt(1))
+	miner.pending[nonce.Uint64()] = tx
+	return txHash, nil
+}
+
+// nextNonce 其他程序使用该地址发送交易后，节点的pending nonce会大于本地记录的nonce
+func (manager *nonceManager) nextNonce(miner *minerNonce) (*big.Int, error) {
+	var pendingNonce types.Big
+	if err := manager.accessor.RetryCall(2, &pendingNonce, "eth_getTransactionCount", miner.address.Hex(), "pending"); nil != err {
+		return nil, err
+	}
+	if nil == miner.nonce || pendingNonce.BigInt().Cmp(miner.nonce) > 0 {
+		return pendingNonce.BigInt(), nil
+	}
+	return new(big.Int).Set(miner.nonce), nil
+}
+
+// restorePending 重启之后从已经发送但还没有被打包的环路恢复交易，节点已经丢弃的交易无法获取nonce，环路提交失败
+func (manager *nonceManager) restorePending() {
+	manager.mtx.RLock()
+	addresses := make([]string, 0, len(manager.miners))
+	for address := range manager.miners {
+		addresses = append(addresses, address.Hex())
+	}
+	manager.mtx.RUnlock()
+	if len(addresses) <= 0 {
+		return
+	}
+
+	infos, err := manager.dbService.GetUnminedRingSubmitInfos(addresses)
+	if nil != err {
+		log.Errorf("miner,get unmined rings err:%s", err.Error())
+		return
+	}
+
+	// 批量注册时多个环路使用同一笔交易
+	txHashes := []common.Hash{}
+	ringhashes := make(map[common.Hash][]common.Hash)
+	isRegistry := make(map[common.Hash]bool)
+	for _, info := range infos {
+		txHash, registry := common.HexToHash(info.ProtocolTxHash), false
+		if info.Status == uint8(types.RING_SUBMIT_PENDING) {
+			txHash, registry = common.HexToHash(info.RegistryTxHash), true
+		}
+		if _, exists := ringhashes[txHash]; !exists {
+			txHashes = append(txHashes, txHash)
+			isRegistry[txHash] = registry
+		}
+		ringhashes[txHash] = append(ringhashes[txHash], common.HexToHash(info.RingHash))
+	}
+
+	for _, txHash := range txHashes {
+		var transaction ethaccessor.Transaction
+		if err := manager.accessor.Call(&transaction, "eth_getTransactionByHash", txHash.Hex()); nil != err {
+			log.Errorf("miner,get tx:%s err:%s", txHash.Hex(), err.Error())
+			continue
+		}
+		if transaction.Hash == "" {
+			manager.failed(ringhashes[txHash], errors.New("tx:"+txHash.Hex()+" has been dropped"))
+			continue
+		}
+		if !types.IsZeroHash(common.HexToHash(transaction.BlockHash)) {
+			continue
+		}
+
+		tx := &sentTx{}
+		tx.nonce = new(big.Int).Set(transaction.Nonce.BigInt())
+		tx.to = common.HexToAddress(transaction.To)
+		tx.gas = new(big.Int).Set(transaction.Gas.BigInt())
+		tx.gasPrice = new(big.Int).Set(transaction.GasPrice.BigInt())
+		tx.data = common.FromHex(transaction.Input)
+		tx.ringhashes = ringhashes[txHash]
+		tx.isRegistry = isRegistry[txHash]
+		tx.txHashes = []common.Hash{txHash}
+
+		miner := manager.getMiner(common.HexToAddress(transaction.From))
+		miner.mtx.Lock()
+		miner.pending[tx.nonce.Uint64()] = tx
+		miner.mtx.Unlock()
+		log.Infof("miner,restore tx:%s with nonce:%d of %s", txHash.Hex(), tx.nonce.Uint64(), miner.address.Hex())
+	}
+}
+
+func (manager *nonceManager) checkPending(blockNumber *big.Int) {
+	manager.mtx.RLock()
+	miners := make([]*minerNonce, 0, len(manager.miners))
+	for _, miner := range manager.miners {
+		miners = append(miners, miner)
+	}
+	manager.mtx.RUnlock()
+
+	for _, miner := range miners {
+		manager.checkMinerPending(miner, blockNumber)
+	}
+}
+
+// checkMinerPending 查询节点时不持有miner.mtx，避免阻塞sendTransaction，
+// 已发送交易的字段只在这里修改，checkPending只在处理新区块的goroutine中调用
+func (manager *nonceManager) checkMinerPending(miner *minerNonce, blockNumber *big.Int) {
+	miner.mtx.Lock()
+	pending := make(map[uint64]*sentTx, len(miner.pending))
+	for nonce, tx := range miner.pending {
+		pending[nonce] = tx
+	}
+	miner.mtx.Unlock()
+
+	if len(pending) <= 0 {
+		return
+	}
+	var minedNonce types.Big
+	if err := manager.accessor.Call(&minedNonce, "eth_getTransactionCount", miner.address.Hex(), "latest"); nil != err {
+		log.Errorf("miner,get nonce of %s err:%s", miner.address.Hex(), err.Error())
+		return
+	}
+
+	for nonce, tx := range pending {
+		if nil == tx.sentBlock {
+			tx.sentBlock = new(big.Int).Set(blockNumber)
+		}
+		if nonce < minedNonce.Uint64() {
+			miner.mtx.Lock()
+			delete(miner.pending, nonce)
+			miner.mtx.Unlock()
+			manager.settle(tx)
+			continue
+		}
+		if !manager.isKnown(tx) {
+			log.Infof("miner,tx with nonce:%d of %s has been dropped, send it again", nonce, miner.address.Hex())
+			manager.resend(miner, tx, tx.gasPrice, blockNumber)
+			continue
+		}
+		if new(big.Int).Sub(blockNumber, tx.sentBlock).Int64() < miner.maxPendingTtl {
+			continue
+		}
+
+		gasPrice := manager.bumpGasPrice(miner, tx.gasPrice)
+		if nil == gasPrice {
+			log.Errorf("miner,tx with nonce:%d of %s is still pending, but gasPrice:%s can't be raised", nonce, miner.address.Hex(), tx.gasPrice.String())
+			tx.sentBlock.Set(blockNumber)
+			continue
+		}
+		if !tx.cancelled() && len(tx.ringhashes) > 0 && !manager.ringsValid(tx.ringhashes) {
+			manager.cancel(miner, tx, gasPrice, blockNumber)
+		} else {
+			manager.resend(miner, tx, gasPrice, blockNumber)
+		}
+	}
+}
+
+// settle nonce已经被使用，被打包的不是最新发送的交易时更新环路记录的txhash，
+// 被打包的是取消交易时环路提交失败，都没有被打包时该nonce被其他交易使用，环路同样提交失败
+func (manager *nonceManager) settle(tx *sentTx) {
+	for i := len(tx.txHashes) - 1; i >= 0; i-- {
+		if !manager.isMined(tx.txHashes[i]) {
+			continue
+		}
+		if i != len(tx.txHashes)-1 {
+			manager.updateTxHash(tx, tx.txHashes[i])
+		}
+		return
+	}
+	if len(tx.ringhashes) <= 0 {
+		return
+	}
+	if tx.cancelled() && manager.isMined(tx.cancelTxHash) {
+		manager.failed(tx.ringhashes, errors.New("orders of ring became invalid, cancelled by tx:"+tx.cancelTxHash.Hex()))
+	} else {
+		manager.failed(tx.ringhashes, errors.New("nonce has been used by another transaction"))
+	}
+}
+
+func (manager *nonceManager) isMined(txHash common.Hash) bool {
+	var receipt ethaccessor.TransactionReceipt
+	if err := manager.accessor.Call(&receipt, "eth_getTransactionReceipt", txHash.Hex()); nil != err {
+		log.Errorf("miner,get receipt of tx:%s err:%s", txHash.Hex(), err.Error())
+		return false
+	}
+	return receipt.BlockHash != ""
+}
+
+// isKnown 节点无法查询时认为交易仍然存在
+func (manager *nonceManager) isKnown(tx *sentTx) bool {
+	hashes := tx.txHashes
+	if tx.cancelled() {
+		hashes = append([]common.Hash{tx.cancelTxHash}, hashes...)
+	}
+	for _, txHash := range hashes {
+		var transaction ethaccessor.Transaction
+		if err := manager.accessor.Call(&transaction, "eth_getTransactionByHash", txHash.Hex()); nil != err || transaction.Hash != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// bumpGasPrice 不能超过GasPriceLimit，无法提高时返回nil
+func (manager *nonceManager) bumpGasPrice(miner *minerNonce, gasPrice *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(gasPrice, big.NewInt(100+manager.bumpPercent))
+	bumped.Div(bumped, big.NewInt(100))
+	if nil != miner.gasPriceLimit && miner.gasPriceLimit.Sign() > 0 && bumped.Cmp(miner.gasPriceLimit) > 0 {
+		bumped.Set(miner.gasPriceLimit)
+	}
+	if bumped.Cmp(gasPrice) <= 0 {
+		return nil
+	}
+	return bumped
+}
+
+func (manager *nonceManager) resend(miner *minerNonce, tx *sentTx, gasPrice *big.Int, blockNumber *big.Int) {
+	to, gas, data := tx.to, new(big.Int).Set(tx.gas), tx.data
+	if tx.cancelled() {
+		to, gas, data = miner.address, big.NewInt(cancelTxGas), nil
+	}
+	txHash, err := manager.accessor.ContractSendTransactionWithNonce(accounts.Account{Address: miner.address}, to, gas, gasPrice, nil, tx.nonce, data)
+	if nil != err {
+		log.Errorf("miner,resend tx with nonce:%d of %s err:%s", tx.nonce.Uint64(), miner.address.Hex(), err.Error())
+		return
+	}
+	log.Infof("miner,resend tx with nonce:%d of %s, txhash:%s, gasPrice:%s", tx.nonce.Uint64(), miner.address.Hex(), txHash, gasPrice.String())
+
+	tx.gasPrice = new(big.Int).Set(gasPrice)
+	tx.sentBlock = new(big.Int).Set(blockNumber)
+	if tx.cancelled() {
+		tx.cancelTxHash = common.HexToHash(txHash)
+	} else {
+		tx.txHashes = append(tx.txHashes, common.HexToHash(txHash))
+		manager.updateTxHash(tx, common.HexToHash(txHash))
+	}
+}
+
+// cancel 原来的环路交易在取消交易之前仍然可能被打包，所以这里不标记失败，
+// 等到nonce被使用之后在settle中根据被打包的交易处理
+func (manager *nonceManager) cancel(miner *minerNonce, tx *sentTx, gasPrice *big.Int, blockNumber *big.Int) {
+	txHash, err := manager.accessor.ContractSendTransactionWithNonce(accounts.Account{Address: miner.address}, miner.address, big.NewInt(cancelTxGas), gasPrice, nil, tx.nonce, nil)
+	if nil != err {
+		log.Errorf("miner,cancel tx with nonce:%d of %s err:%s", tx.nonce.Uint64(), miner.address.Hex(), err.Error())
+		return
+	}
+	log.Infof("miner,orders of rings in tx with nonce:%d of %s became invalid, cancelled by tx:%s", tx.nonce.Uint64(), miner.address.Hex(), txHash)
+
+	tx.gasPrice = new(big.Int).Set(gasPrice)
+	tx.sentBlock = new(big.Int).Set(blockNumber)
+	tx.cancelTxHash = common.HexToHash(txHash)
+}
+
+func (manager *nonceManager) updateTxHash(tx *sentTx, txHash common.Hash) {
+	var err error
+	if tx.isRegistry {
+		err = manager.dbService.UpdateRingSubmitInfoRegistryTxHash(tx.ringhashes, txHash.Hex())
+	} else {
+		for _, ringhash := range tx.ringhashes {
+			if err = manager.dbService.UpdateRingSubmitInfoProtocolTxHash(ringhash, txHash.Hex()); nil != err {
+				break
+			}
+		}
+	}
+	if nil != err {
+		log.Errorf("miner,update txhash of rings to %s err:%s", txHash.Hex(), err.Error())
+	}
+}
+
+// ringsValid 交易中所有环路都有订单已经完成、取消或者过期时返回false，查询失败时不取消
+func (manager *nonceManager) ringsValid(ringhashes []common.Hash) bool {
+	now := time.Now().Unix()
+	for _, ringhash := range ringhashes {
+		orderhashes, err := manager.dbService.GetOrderHashesByRingHash(ringhash)
+		if nil != err || len(orderhashes) <= 0 {
+			return true
+		}
+		hashes := []string{}
+		for _, orderhash := range orderhashes {
+			hashes = append(hashes, orderhash.Hex())
+		}
+		orders, err := manager.dbService.GetOrdersByHash(hashes)
+		if nil != err {
+			return true
+		}
+
+		valid := true
+		for _, orderhash := range hashes {
+			order, exists := orders[orderhash]
+			if !exists || !isOrderAvailable(order, now) {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return true
+		}
+	}
+	return false
+}
+
+func isOrderAvailable(order dao.Order, now int64) bool {
+	status := types.OrderStatus(order.Status)
+	if status != types.ORDER_NEW && status != types.ORDER_PARTIAL {
+		return false
+	}
+	return order.ValidTime+order.Ttl > now
+}
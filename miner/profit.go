@@ -0,0 +1,88 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/rcrowley/go-metrics"
+)
+
+var ErrRingNotProfitable = errors.New("received of ring is less than the profit threshold")
+
+// ProfitThreshold 环路的法币收益(已扣除gas成本)必须为正，不小于MinProfit，
+// 并且与LegalCost的比例不小于MinProfitRatio，否则不提交
+type ProfitThreshold struct {
+	MinProfit      *big.Rat
+	MinProfitRatio *big.Rat
+}
+
+func NewProfitThreshold(minProfit, minProfitRatio float64) *ProfitThreshold {
+	threshold := &ProfitThreshold{}
+	threshold.MinProfit = new(big.Rat).SetFloat64(minProfit)
+	threshold.MinProfitRatio = new(big.Rat).SetFloat64(minProfitRatio)
+	if nil == threshold.MinProfit || threshold.MinProfit.Sign() < 0 {
+		threshold.MinProfit = new(big.Rat)
+	}
+	if nil == threshold.MinProfitRatio || threshold.MinProfitRatio.Sign() < 0 {
+		threshold.MinProfitRatio = new(big.Rat)
+	}
+	return threshold
+}
+
+func (threshold *ProfitThreshold) Reached(received, legalCost *big.Rat) bool {
+	if nil == received || received.Sign() <= 0 || received.Cmp(threshold.MinProfit) < 0 {
+		return false
+	}
+	if nil != legalCost && legalCost.Sign() > 0 {
+		ratio := new(big.Rat).Quo(received, legalCost)
+		return ratio.Cmp(threshold.MinProfitRatio) >= 0
+	}
+	return true
+}
+
+// IsProfitable 判断候选环路的收益是否达到配置的要求。一轮撮合中同一个环路会在生成候选、
+// 其他环路成交后以及最终选择时多次判断，达到要求时不记录，被提交时由ringAccepted记录；
+// 未达到要求时每次判断都会计数，miner/profit/rejected_evaluations统计的是判断次数而不是环路数，
+// 候选环路被拒绝很常见，只输出Debug日志
+func (submitter *RingSubmitter) IsProfitable(ringhash common.Hash, received, legalCost *big.Rat) bool {
+	if submitter.profitThreshold.Reached(received, legalCost) {
+		return true
+	}
+	metrics.GetOrRegisterCounter("miner/profit/rejected_evaluations", nil).Inc(1)
+	log.Debugf("miner,ring:%s rejected for profit, received:%s, legalCost:%s, minProfit:%s, minProfitRatio:%s", ringhash.Hex(), ratString(received), ratString(legalCost), submitter.profitThreshold.MinProfit.FloatString(2), submitter.profitThreshold.MinProfitRatio.FloatString(2))
+	return false
+}
+
+// ringAccepted 环路被提交时记录一次
+func (submitter *RingSubmitter) ringAccepted(info *types.RingSubmitInfo) {
+	metrics.GetOrRegisterCounter("miner/profit/accepted", nil).Inc(1)
+	log.Infof("miner,ring:%s accepted, received:%s, legalCost:%s", info.Ringhash.Hex(), ratString(info.Received), ratString(info.LegalCost))
+}
+
+func ratString(r *big.Rat) string {
+	if nil == r {
+		return "nil"
+	}
+	return r.FloatString(2)
+}
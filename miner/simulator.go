@@ -0,0 +1,125 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// RingSimulation 模拟提交环路的结果，不保存环路也不发送交易
+type RingSimulation struct {
+	SubmitInfo  *types.RingSubmitInfo
+	Profitable  bool  //是否达到提交环路的收益要求
+	EstimateErr error //eth_estimateGas的错误，不为nil时gas按照maxGasLimit计算
+	Called      bool
+	CallErr     error //使用eth_call执行submitRing的错误
+}
+
+// WouldRevert 合约执行失败时eth_estimateGas以及eth_call都会返回错误，网络或者节点不可用时无法判断
+func (simulation *RingSimulation) WouldRevert() bool {
+	return isExecutionError(simulation.EstimateErr) || isExecutionError(simulation.CallErr)
+}
+
+// isExecutionError 节点返回的JSON-RPC错误中，除请求格式以及节点内部错误之外都是执行交易的错误，
+// 连接失败、超时等错误不是rpc.Error
+func isExecutionError(err error) bool {
+	rpcErr, ok := err.(rpc.Error)
+	if !ok {
+		return false
+	}
+	switch rpcErr.ErrorCode() {
+	case -32700, -32600, -32601, -32602, -32603:
+		return false
+	}
+	return true
+}
+
+// SimulateRing 按照订单的顺序组成环路，使用与撮合时相同的可用余额、ComputeRing以及费用选择，
+// call为true时再使用eth_call执行submitRing，用来排查撮合结果与合约不一致的问题
+func (minerInstance *Miner) SimulateRing(orders []*types.OrderState, call bool) (*RingSimulation, error) {
+	ringState, err := minerInstance.newRing(orders)
+	if nil != err {
+		return nil, err
+	}
+	if err = minerInstance.evaluator.ComputeRing(ringState); nil != err {
+		return nil, err
+	}
+	return minerInstance.submitter.simulateRing(ringState, call)
+}
+
+func (minerInstance *Miner) newRing(orders []*types.OrderState) (*types.Ring, error) {
+	if len(orders) < 2 {
+		return nil, errors.New("ring must contain at least two orders")
+	}
+	protocolAddress := orders[0].RawOrder.Protocol
+	implAddress, exists := minerInstance.accessor.ProtocolAddresses[protocolAddress]
+	if !exists {
+		return nil, errors.New("doesn't contain this version of protocol:" + protocolAddress.Hex())
+	}
+	return NewRingWithBalances(minerInstance.matcher, implAddress.LrcTokenAddress, orders...)
+}
+
+func (submitter *RingSubmitter) simulateRing(ringState *types.Ring, call bool) (*RingSimulation, error) {
+	ringSubmitInfo, err := submitter.packRingSubmitInfo(ringState)
+	if nil != err {
+		return nil, err
+	}
+
+	simulation := &RingSimulation{SubmitInfo: ringSubmitInfo}
+	if simulation.EstimateErr = submitter.estimateGas(ringSubmitInfo); nil != simulation.EstimateErr {
+		log.Debugf("miner,simulate ring:%s estimate gas err:%s", ringSubmitInfo.Ringhash.Hex(), simulation.EstimateErr.Error())
+		ringSubmitInfo.ProtocolGas = new(big.Int).Set(submitter.maxGasLimit)
+		if submitter.ifRegistryRingHash && nil == ringSubmitInfo.RegistryGas {
+			ringSubmitInfo.RegistryGas = new(big.Int).Set(submitter.maxGasLimit)
+		}
+		if ringSubmitInfo.ProtocolGasPrice, err = (&NodeGasPriceStrategy{accessor: submitter.Accessor}).GasPrice(nil, nil); nil != err {
+			return nil, err
+		}
+	}
+
+	if err = submitter.computeReceivedAndSelectMiner(ringSubmitInfo); nil != err {
+		return nil, err
+	}
+	simulation.Profitable = submitter.profitThreshold.Reached(ringSubmitInfo.Received, ringSubmitInfo.LegalCost)
+
+	if call {
+		simulation.Called = true
+		simulation.CallErr = submitter.callSubmitRing(ringSubmitInfo)
+	}
+	return simulation, nil
+}
+
+// 使用选中的miner地址执行submitRing，不会产生交易
+func (submitter *RingSubmitter) callSubmitRing(ringSubmitInfo *types.RingSubmitInfo) error {
+	callArg := &ethaccessor.CallArg{}
+	callArg.From = ringSubmitInfo.Miner
+	callArg.To = ringSubmitInfo.ProtocolAddress
+	callArg.Gas = *types.NewBigPtr(ringSubmitInfo.ProtocolGas)
+	callArg.GasPrice = *types.NewBigPtr(ringSubmitInfo.ProtocolGasPrice)
+	callArg.Data = common.ToHex(ringSubmitInfo.ProtocolData)
+	var res string
+	return submitter.Accessor.Call(&res, "eth_call", callArg, "pending")
+}
@@ -0,0 +1,141 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func init() {
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+}
+
+type testRPCError struct {
+	code int
+}
+
+func (e *testRPCError) Error() string  { return "rpc error" }
+func (e *testRPCError) ErrorCode() int { return e.code }
+
+func TestIsExecutionError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("dial tcp 127.0.0.1:8545: connection refused"), false},
+		{&testRPCError{-32700}, false},
+		{&testRPCError{-32601}, false},
+		{&testRPCError{-32602}, false},
+		{&testRPCError{-32000}, true},
+		{&testRPCError{-32015}, true},
+	}
+	for idx, c := range cases {
+		if got := isExecutionError(c.err); got != c.want {
+			t.Errorf("case %d got %t, want %t", idx, got, c.want)
+		}
+	}
+
+	simulation := &RingSimulation{EstimateErr: errors.New("timeout"), CallErr: errors.New("timeout")}
+	if simulation.WouldRevert() {
+		t.Errorf("transport errors should not be treated as revert")
+	}
+	simulation.CallErr = &testRPCError{-32000}
+	if !simulation.WouldRevert() {
+		t.Errorf("execution error of eth_call should be treated as revert")
+	}
+}
+
+// testMatcher 可用余额为balances中的数量，不存在时返回错误
+type testMatcher struct {
+	balances map[common.Address]*big.Rat
+}
+
+func (m *testMatcher) Start() {}
+func (m *testMatcher) Stop()  {}
+func (m *testMatcher) GetAccountAvailableAmount(address common.Address, tokenAddress common.Address) (*big.Rat, error) {
+	if balance, exists := m.balances[tokenAddress]; exists {
+		return balance, nil
+	}
+	return nil, errors.New("balance not found")
+}
+
+func testOrderState(protocol, tokenS, tokenB common.Address, amountS, amountB int64) *types.OrderState {
+	order := &types.OrderState{}
+	order.RawOrder.Protocol = protocol
+	order.RawOrder.TokenS = tokenS
+	order.RawOrder.TokenB = tokenB
+	order.RawOrder.AmountS = big.NewInt(amountS)
+	order.RawOrder.AmountB = big.NewInt(amountB)
+	order.DealtAmountS, order.DealtAmountB = new(big.Int), new(big.Int)
+	order.CancelledAmountS, order.CancelledAmountB = new(big.Int), new(big.Int)
+	order.SplitAmountS, order.SplitAmountB = new(big.Int), new(big.Int)
+	return order
+}
+
+func TestNewRingWithBalances(t *testing.T) {
+	protocol := common.HexToAddress("0x01")
+	lrc := common.HexToAddress("0x02")
+	tokenA := common.HexToAddress("0x03")
+	tokenB := common.HexToAddress("0x04")
+	matcher := &testMatcher{balances: map[common.Address]*big.Rat{
+		lrc:    big.NewRat(100, 1),
+		tokenA: big.NewRat(50, 1),
+		tokenB: big.NewRat(1000, 1),
+	}}
+
+	a2B := testOrderState(protocol, tokenA, tokenB, 100, 200)
+	b2A := testOrderState(protocol, tokenB, tokenA, 200, 100)
+	ring, err := NewRingWithBalances(matcher, lrc, a2B, b2A)
+	if nil != err {
+		t.Fatalf("new ring err:%s", err.Error())
+	}
+	if len(ring.Orders) != 2 || ring.Orders[0].AvailableAmountS.Cmp(big.NewRat(50, 1)) != 0 || ring.Orders[1].AvailableAmountS.Cmp(big.NewRat(200, 1)) != 0 {
+		t.Errorf("available amountS got %s and %s", ring.Orders[0].AvailableAmountS.String(), ring.Orders[1].AvailableAmountS.String())
+	}
+
+	if _, err := NewRingWithBalances(matcher, lrc, a2B); nil == err {
+		t.Errorf("ring with one order should be rejected")
+	}
+	if _, err := NewRingWithBalances(matcher, lrc, a2B, a2B); nil == err {
+		t.Errorf("orders with unmatched tokens should be rejected")
+	}
+	other := testOrderState(common.HexToAddress("0x05"), tokenB, tokenA, 200, 100)
+	if _, err := NewRingWithBalances(matcher, lrc, a2B, other); nil == err {
+		t.Errorf("orders of different protocols should be rejected")
+	}
+
+	// 余额不足或者无法获取余额时返回导致失败的订单
+	matcher.balances[tokenB] = new(big.Rat)
+	_, err = NewRingWithBalances(matcher, lrc, a2B, b2A)
+	if orderErr, ok := err.(*OrderError); !ok || orderErr.Order != b2A {
+		t.Errorf("zero balance should return OrderError of the second order, got %v", err)
+	}
+	delete(matcher.balances, lrc)
+	_, err = NewRingWithBalances(matcher, lrc, a2B, b2A)
+	if orderErr, ok := err.(*OrderError); !ok || orderErr.Order != a2B {
+		t.Errorf("balance error should return OrderError of the first order, got %v", err)
+	}
+}
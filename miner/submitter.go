@@ -27,7 +27,6 @@ import (
 	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
-	"github.com/Loopring/relay/market/util"
 	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/accounts"
@@ -52,6 +51,9 @@ type RingSubmitter struct {
 	dbService         dao.RdsService
 	marketCapProvider marketcap.MarketCapProvider
 	matcher           Matcher
+	nonceManager      *nonceManager
+	gasPriceStrategy  GasPriceStrategy
+	profitThreshold   *ProfitThreshold
 
 	stopFuncs []func()
 }
@@ -65,6 +67,13 @@ func NewSubmitter(options config.MinerOptions, accessor *ethaccessor.EthNodeAcce
 	submitter := &RingSubmitter{}
 	submitter.maxGasLimit = big.NewInt(options.MaxGasLimit)
 	submitter.minGasLimit = big.NewInt(options.MinGasLimit)
+	submitter.profitThreshold = NewProfitThreshold(options.MinProfit, options.MinProfitRatio)
+	submitter.nonceManager = newNonceManager(accessor, dbService, options.GasPriceBumpPercent, submitter.submitFailed)
+	if strategy, err := NewGasPriceStrategy(options.GasPrice, accessor); nil != err {
+		log.Fatalf("miner submitter,create gas price strategy err:%s", err.Error())
+	} else {
+		submitter.gasPriceStrategy = strategy
+	}
 	for _, addr := range options.NormalMiners {
 		//var nonce types.Big
 		//if err := accessor.Call(&nonce, "eth_getTransactionCount", addr.Address, "pending"); nil != err {
@@ -77,6 +86,7 @@ func NewSubmitter(options config.MinerOptions, accessor *ethaccessor.EthNodeAcce
 		miner.MaxPendingTtl = addr.MaxPendingTtl
 		//miner.Nonce = nonce.BigInt()
 		submitter.normalMinerAddresses = append(submitter.normalMinerAddresses, miner)
+		submitter.nonceManager.addMiner(miner.Address, miner.MaxPendingTtl, miner.GasPriceLimit)
 	}
 
 	for _, addr := range options.PercentMiners {
@@ -89,7 +99,10 @@ func NewSubmitter(options config.MinerOptions, accessor *ethaccessor.EthNodeAcce
 		miner.Address = common.HexToAddress(addr.Address)
 		miner.FeePercent = addr.FeePercent
 		miner.StartFee = addr.StartFee
+		miner.GasPriceLimit = big.NewInt(addr.GasPriceLimit)
+		miner.GasPriceStrategy = NewFeePercentGasPriceStrategy(marketCapProvider, addr.FeePercent, submitter.gasPriceStrategy)
 		submitter.percentMinerAddresses = append(submitter.percentMinerAddresses, miner)
+		submitter.nonceManager.addMiner(miner.Address, 0, miner.GasPriceLimit)
 	}
 
 	submitter.dbService = dbService
@@ -116,6 +129,7 @@ func (submitter *RingSubmitter) listenNewRings() {
 			case ringInfos := <-ringSubmitInfoChan:
 				if nil != ringInfos {
 					for _, info := range ringInfos {
+						submitter.ringAccepted(info)
 						daoInfo := &dao.RingSubmitInfo{}
 						daoInfo.ConvertDown(info)
 						if err := submitter.dbService.Add(daoInfo); nil != err {
@@ -203,7 +217,7 @@ func (submitter *RingSubmitter) batchRinghashRegistry(contractAddress common.Add
 		if gas, gasPrice, err := submitter.Accessor.EstimateGas(registryData, ringhashRegistryAddress); nil != err {
 			return err
 		} else {
-			if txHash, err := submitter.Accessor.ContractSendTransactionByData(accounts.Account{Address: miners[0]}, ringhashRegistryAddress, gas, gasPrice, nil, registryData); nil != err {
+			if txHash, err := submitter.nonceManager.sendTransaction(miners[0], ringhashRegistryAddress, gas, gasPrice, registryData, ringhashes, true); nil != err {
 				return err
 			} else {
 				submitter.dbService.UpdateRingSubmitInfoRegistryTxHash(ringhashes, txHash)
@@ -222,7 +236,7 @@ func (submitter *RingSubmitter) ringhashRegistry(ringSubmitInfo *types.RingSubmi
 		ringhashRegistryAddress = implAddress.RinghashRegistryAddress
 	}
 
-	if txHash, err := submitter.Accessor.ContractSendTransactionByData(accounts.Account{Address: ringSubmitInfo.Miner}, ringhashRegistryAddress, ringSubmitInfo.RegistryGas, ringSubmitInfo.RegistryGasPrice, nil, ringSubmitInfo.RegistryData); nil != err {
+	if txHash, err := submitter.nonceManager.sendTransaction(ringSubmitInfo.Miner, ringhashRegistryAddress, ringSubmitInfo.RegistryGas, ringSubmitInfo.RegistryGasPrice, ringSubmitInfo.RegistryData, []common.Hash{ringSubmitInfo.Ringhash}, true); nil != err {
 		return err
 	} else {
 		ringSubmitInfo.RegistryTxHash = common.HexToHash(txHash)
@@ -232,7 +246,7 @@ func (submitter *RingSubmitter) ringhashRegistry(ringSubmitInfo *types.RingSubmi
 }
 
 func (submitter *RingSubmitter) submitRing(ringSubmitInfo *types.RingSubmitInfo) error {
-	if txHash, err := submitter.Accessor.ContractSendTransactionByData(accounts.Account{Address: ringSubmitInfo.Miner}, ringSubmitInfo.ProtocolAddress, ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, nil, ringSubmitInfo.ProtocolData); nil != err {
+	if txHash, err := submitter.nonceManager.sendTransaction(ringSubmitInfo.Miner, ringSubmitInfo.ProtocolAddress, ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, ringSubmitInfo.ProtocolData, []common.Hash{ringSubmitInfo.Ringhash}, false); nil != err {
 		submitter.submitFailed([]common.Hash{ringSubmitInfo.Ringhash}, err)
 		return err
 	} else {
@@ -256,7 +270,9 @@ func (submitter *RingSubmitter) listenSubmitRingMethodEvent() {
 							submitter.submitFailed(ringhashes, errors.New("failed to execute ring"))
 						}
 					}
-					submitter.dbService.UpdateRingSubmitInfoRegistryUsedGas(event.TxHash.Hex(), event.UsedGas)
+					if err := submitter.dbService.UpdateRingSubmitInfoSubmitUsedGas(event.TxHash.Hex(), event.UsedGas); nil != err {
+						log.Errorf("miner submitter,update used gas of tx:%s err:%s", event.TxHash.Hex(), err.Error())
+					}
 				}
 			}
 		}
@@ -393,7 +409,12 @@ func (submitter *RingSubmitter) listenRegistryEvent() {
 					}
 
 					if nil == err {
+						if err = submitter.dbService.UpdateRingSubmitInfoRegistered(info.Ringhash); nil != err {
+							log.Errorf("miner submitter,update ring:%s registered err:%s", info.Ringhash.Hex(), err.Error())
+						}
 						submitter.submitRing(info)
+					} else if !types.IsZeroHash(info.Ringhash) {
+						submitter.submitFailed([]common.Hash{info.Ringhash}, err)
 					}
 				}
 			}
@@ -415,14 +436,89 @@ func (submitter *RingSubmitter) listenRegistryEvent() {
 	})
 }
 
+func (submitter *RingSubmitter) listenRingMinedEvent() {
+	ringMinedChan := make(chan *types.RingMinedEvent)
+	go func() {
+		for {
+			select {
+			case event := <-ringMinedChan:
+				if nil != event {
+					if err := submitter.dbService.UpdateRingSubmitInfoMined(event.Ringhash, event.Blocknumber.Int64()); nil != err {
+						log.Errorf("miner submitter,update ring:%s mined err:%s", event.Ringhash.Hex(), err.Error())
+					}
+				}
+			}
+		}
+	}()
+
+	watcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			e := eventData.(*types.RingMinedEvent)
+			ringMinedChan <- e
+			return nil
+		},
+	}
+	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, watcher)
+	submitter.stopFuncs = append(submitter.stopFuncs, func() {
+		close(ringMinedChan)
+		eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, watcher)
+	})
+}
+
+func (submitter *RingSubmitter) listenNewBlock() {
+	newBlockChan := make(chan *types.BlockEvent)
+	go func() {
+		for {
+			select {
+			case blockEvent := <-newBlockChan:
+				if nil != blockEvent {
+					submitter.nonceManager.checkPending(blockEvent.BlockNumber)
+				}
+			}
+		}
+	}()
+
+	watcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			e := eventData.(*types.BlockEvent)
+			newBlockChan <- e
+			return nil
+		},
+	}
+	eventemitter.On(eventemitter.Block_New, watcher)
+	submitter.stopFuncs = append(submitter.stopFuncs, func() {
+		close(newBlockChan)
+		eventemitter.Un(eventemitter.Block_New, watcher)
+	})
+}
+
 func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*types.RingSubmitInfo, error) {
+	ringSubmitInfo, err := submitter.packRingSubmitInfo(ringState)
+	if nil != err {
+		return nil, err
+	}
+	if err = submitter.estimateGas(ringSubmitInfo); nil != err {
+		return nil, err
+	}
+
+	if err = submitter.computeReceivedAndSelectMiner(ringSubmitInfo); nil != err {
+		return nil, err
+	}
+	log.Debugf("miner,submitter generate ring info, legal cost:%s, legalFee:%s, received:%s", ringSubmitInfo.LegalCost.FloatString(2), ringState.LegalFee.FloatString(2), ringSubmitInfo.Received.FloatString(2))
+
+	if !submitter.IsProfitable(ringSubmitInfo.Ringhash, ringSubmitInfo.Received, ringSubmitInfo.LegalCost) {
+		return nil, ErrRingNotProfitable
+	}
+	return ringSubmitInfo, nil
+}
+
+//生成环路的hash以及registry、submitRing的调用数据
+func (submitter *RingSubmitter) packRingSubmitInfo(ringState *types.Ring) (*types.RingSubmitInfo, error) {
 	protocolAddress := ringState.Orders[0].OrderState.RawOrder.Protocol
-	var (
-		implAddress *ethaccessor.ProtocolAddress
-		exists      bool
-		err         error
-	)
-	if implAddress, exists = submitter.Accessor.ProtocolAddresses[protocolAddress]; !exists {
+	var err error
+	if _, exists := submitter.Accessor.ProtocolAddresses[protocolAddress]; !exists {
 		return nil, errors.New("doesn't contain this version of protocol:" + protocolAddress.Hex())
 	}
 	protocolAbi := submitter.Accessor.ProtocolImplAbi
@@ -438,27 +534,12 @@ func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*
 
 	if submitter.ifRegistryRingHash {
 		ringhashRegistryAbi := submitter.Accessor.RinghashRegistryAbi
-		ringhashRegistryAddress := implAddress.RinghashRegistryAddress
 		ringSubmitInfo.RegistryData, err = ringhashRegistryAbi.Pack("submitRinghash",
 			submitter.minerAccountForSign,
 			ringSubmitInfo.Ringhash)
 		if nil != err {
 			return nil, err
 		}
-
-		log.Debugf("ringhashRegistryAddress", ringhashRegistryAddress.Hex())
-		ringSubmitInfo.RegistryGas, ringSubmitInfo.RegistryGasPrice, err = submitter.Accessor.EstimateGas(ringSubmitInfo.RegistryData, ringhashRegistryAddress)
-		if nil != err {
-			return nil, err
-		}
-		if submitter.maxGasLimit.Sign() > 0 && ringSubmitInfo.RegistryGas.Cmp(submitter.maxGasLimit) > 0 {
-			ringSubmitInfo.RegistryGas.Set(submitter.maxGasLimit)
-		}
-		if submitter.minGasLimit.Sign() > 0 && ringSubmitInfo.RegistryGas.Cmp(submitter.minGasLimit) < 0 {
-			ringSubmitInfo.RegistryGas.Set(submitter.minGasLimit)
-		}
-
-		ringSubmitInfo.RegistryGas.Add(ringSubmitInfo.RegistryGas, big.NewInt(1000))
 	}
 
 	ringSubmitArgs := ringState.GenerateSubmitArgs(submitter.minerAccountForSign.Address, submitter.feeReceipt)
@@ -476,9 +557,32 @@ func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*
 	if nil != err {
 		return nil, err
 	}
-	ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, err = submitter.Accessor.EstimateGas(ringSubmitInfo.ProtocolData, protocolAddress)
+	return ringSubmitInfo, nil
+}
+
+//估计registry以及submitRing的gas，合约执行失败时eth_estimateGas会返回错误
+func (submitter *RingSubmitter) estimateGas(ringSubmitInfo *types.RingSubmitInfo) error {
+	var err error
+	if submitter.ifRegistryRingHash {
+		ringhashRegistryAddress := submitter.Accessor.ProtocolAddresses[ringSubmitInfo.ProtocolAddress].RinghashRegistryAddress
+		log.Debugf("ringhashRegistryAddress", ringhashRegistryAddress.Hex())
+		ringSubmitInfo.RegistryGas, ringSubmitInfo.RegistryGasPrice, err = submitter.Accessor.EstimateGas(ringSubmitInfo.RegistryData, ringhashRegistryAddress)
+		if nil != err {
+			return err
+		}
+		if submitter.maxGasLimit.Sign() > 0 && ringSubmitInfo.RegistryGas.Cmp(submitter.maxGasLimit) > 0 {
+			ringSubmitInfo.RegistryGas.Set(submitter.maxGasLimit)
+		}
+		if submitter.minGasLimit.Sign() > 0 && ringSubmitInfo.RegistryGas.Cmp(submitter.minGasLimit) < 0 {
+			ringSubmitInfo.RegistryGas.Set(submitter.minGasLimit)
+		}
+
+		ringSubmitInfo.RegistryGas.Add(ringSubmitInfo.RegistryGas, big.NewInt(1000))
+	}
+
+	ringSubmitInfo.ProtocolGas, ringSubmitInfo.ProtocolGasPrice, err = submitter.Accessor.EstimateGas(ringSubmitInfo.ProtocolData, ringSubmitInfo.ProtocolAddress)
 	if nil != err {
-		return nil, err
+		return err
 	}
 	if submitter.maxGasLimit.Sign() > 0 && ringSubmitInfo.ProtocolGas.Cmp(submitter.maxGasLimit) > 0 {
 		ringSubmitInfo.ProtocolGas.Set(submitter.maxGasLimit)
@@ -488,15 +592,7 @@ func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*
 	}
 
 	ringSubmitInfo.ProtocolGas.Add(ringSubmitInfo.ProtocolGas, big.NewInt(1000))
-
-	submitter.computeReceivedAndSelectMiner(ringSubmitInfo)
-	log.Debugf("miner,submitter generate ring info, legal cost:%s, legalFee:%s, received:%s", ringSubmitInfo.LegalCost.FloatString(2), ringState.LegalFee.FloatString(2), ringSubmitInfo.Received.FloatString(2))
-
-	if ringSubmitInfo.Received.Sign() <= 0 {
-		// todo: warning
-		//return nil, errors.New("received can't be less than 0")
-	}
-	return ringSubmitInfo, nil
+	return nil
 }
 
 func (submitter *RingSubmitter) stop() {
@@ -506,23 +602,23 @@ func (submitter *RingSubmitter) stop() {
 }
 
 func (submitter *RingSubmitter) start() {
+	submitter.nonceManager.restorePending()
 	submitter.listenNewRings()
 	submitter.listenRegistryMethodEvent()
 	submitter.listenBatchSubmitRingMethodEvent()
 	submitter.listenSubmitRingMethodEvent()
 	submitter.listenRegistryEvent()
+	submitter.listenRingMinedEvent()
+	submitter.listenNewBlock()
 }
 
 func (submitter *RingSubmitter) availabeMinerAddress() []*NormalMinerAddress {
 	minerAddresses := []*NormalMinerAddress{}
+	if len(submitter.normalMinerAddresses) <= 0 {
+		return minerAddresses
+	}
 	for _, minerAddress := range submitter.normalMinerAddresses {
-		var blockedTxCount, txCount types.Big
-		submitter.Accessor.Call(&blockedTxCount, "eth_getTransactionCount", minerAddress.Address.Hex(), "latest")
-		submitter.Accessor.Call(&txCount, "eth_getTransactionCount", minerAddress.Address.Hex(), "pending")
-
-		pendingCount := big.NewInt(int64(0))
-		pendingCount.Sub(txCount.BigInt(), blockedTxCount.BigInt())
-		if pendingCount.Int64() <= minerAddress.MaxPendingCount {
+		if submitter.nonceManager.pendingCount(minerAddress.Address) <= minerAddress.MaxPendingCount {
 			minerAddresses = append(minerAddresses, minerAddress)
 		}
 	}
@@ -533,86 +629,106 @@ func (submitter *RingSubmitter) availabeMinerAddress() []*NormalMinerAddress {
 	return minerAddresses
 }
 
+//使用某个miner地址提交环路时每个订单的费用选择以及环路的法币收益
+type minerFee struct {
+	legalFee      *big.Rat
+	feeSelections []uint8
+	legalFees     []*big.Rat
+	lrcRewards    []*big.Rat
+}
+
+//miner的lrc余额足够并且分润的收益超过lrc费用的两倍时选择分润
+func (submitter *RingSubmitter) computeMinerFee(ringState *types.Ring, minerAddress, lrcAddress common.Address) *minerFee {
+	fee := &minerFee{legalFee: new(big.Rat)}
+	minerLrcBalance, err := submitter.matcher.GetAccountAvailableAmount(minerAddress, lrcAddress)
+	if nil != err || nil == minerLrcBalance {
+		minerLrcBalance = new(big.Rat)
+	}
+
+	for _, filledOrder := range ringState.Orders {
+		lrcFee := new(big.Rat).SetInt(big.NewInt(int64(2)))
+		lrcFee.Mul(lrcFee, filledOrder.LegalLrcFee)
+		if lrcFee.Cmp(filledOrder.LegalFeeS) < 0 && minerLrcBalance.Cmp(filledOrder.LrcFee) > 0 {
+			fee.feeSelections = append(fee.feeSelections, 1)
+			legalFee := new(big.Rat).Set(filledOrder.LegalFeeS)
+			legalFee.Sub(legalFee, filledOrder.LegalLrcFee)
+			fee.legalFees = append(fee.legalFees, legalFee)
+			fee.lrcRewards = append(fee.lrcRewards, filledOrder.LegalLrcFee)
+			fee.legalFee.Add(fee.legalFee, legalFee)
+
+			minerLrcBalance.Sub(minerLrcBalance, filledOrder.LrcFee)
+		} else {
+			fee.feeSelections = append(fee.feeSelections, 0)
+			fee.legalFees = append(fee.legalFees, filledOrder.LegalLrcFee)
+			fee.lrcRewards = append(fee.lrcRewards, new(big.Rat).SetInt(big.NewInt(int64(0))))
+			fee.legalFee.Add(fee.legalFee, filledOrder.LegalLrcFee)
+		}
+	}
+	return fee
+}
+
+//法币收益达到StartFee的环路由percent miner提交，gasPrice为配置的策略的gasPrice，但gas费用最多为法币收益的FeePercent%，
+//没有normal miner时总是使用percent miner，其他环路由normal miner按照配置的gasPrice策略提交
 func (submitter *RingSubmitter) computeReceivedAndSelectMiner(ringSubmitInfo *types.RingSubmitInfo) error {
 	ringState := ringSubmitInfo.RawRing
-	ringState.LegalFee = new(big.Rat).SetInt(big.NewInt(int64(0)))
-	ethPrice, _ := submitter.marketCapProvider.GetEthCap()
-	ethPrice = ethPrice.Quo(ethPrice, new(big.Rat).SetInt(util.AllTokens["WETH"].Decimals))
 	lrcAddress := submitter.Accessor.ProtocolAddresses[ringState.Orders[0].OrderState.RawOrder.Protocol].LrcTokenAddress
-	useSplit := false
-	//for _,splitMiner := range submitter.splitMinerAddresses {
-	//	//todo:optimize it
-	//	if lrcFee > splitMiner.StartFee || splitFee > splitMiner.StartFee || len(submitter.normalMinerAddresses) <= 0  {
-	//		useSplit = true
-	//		ringState.Miner = splitMiner.Address
-	//		minerLrcBalance, _ := submitter.matcher.GetAccountAvailableAmount(splitMiner.Address, lrcAddress)
-	//		//the lrcreward should be send to order.owner when miner selects MarginSplit as the selection of fee
-	//		//be careful！！！ miner will received nothing, if miner set FeeSelection=1 and he doesn't have enough lrc
-	//
-	//
-	//		if ringState.LrcLegalFee.Cmp(ringState.SplitLegalFee) < 0 && minerLrcBalance.Cmp(filledOrder.LrcFee) > 0 {
-	//			filledOrder.FeeSelection = 1
-	//			splitPer := new(big.Rat).SetInt64(int64(filledOrder.OrderState.RawOrder.MarginSplitPercentage))
-	//			legalAmountOfSaving.Mul(legalAmountOfSaving, splitPer)
-	//			filledOrder.LrcReward = legalAmountOfLrc
-	//			legalAmountOfSaving.Sub(legalAmountOfSaving, legalAmountOfLrc)
-	//			filledOrder.LegalFee = legalAmountOfSaving
-	//
-	//			minerLrcBalance.Sub(minerLrcBalance, filledOrder.LrcFee)
-	//			//log.Debugf("Miner,lrcReward:%s  legalFee:%s", lrcReward.FloatString(10), filledOrder.LegalFee.FloatString(10))
-	//		} else {
-	//			filledOrder.FeeSelection = 0
-	//			filledOrder.LegalFee = legalAmountOfLrc
-	//		}
-	//
-	//		ringState.LegalFee.Add(ringState.LegalFee, filledOrder.LegalFee)
-	//	}
-	//}
-	minerAddresses := submitter.availabeMinerAddress()
-	if !useSplit {
-		for _, normalMinerAddress := range minerAddresses {
-			minerLrcBalance, _ := submitter.matcher.GetAccountAvailableAmount(normalMinerAddress.Address, lrcAddress)
-
-			legalFee := new(big.Rat).SetInt(big.NewInt(int64(0)))
-			feeSelections := []uint8{}
-			legalFees := []*big.Rat{}
-			lrcRewards := []*big.Rat{}
-			for _, filledOrder := range ringState.Orders {
-				lrcFee := new(big.Rat).SetInt(big.NewInt(int64(2)))
-				lrcFee.Mul(lrcFee, filledOrder.LegalLrcFee)
-				if lrcFee.Cmp(filledOrder.LegalFeeS) < 0 && minerLrcBalance.Cmp(filledOrder.LrcFee) > 0 {
-					feeSelections = append(feeSelections, 1)
-					fee := new(big.Rat).Set(filledOrder.LegalFeeS)
-					fee.Sub(fee, filledOrder.LegalLrcFee)
-					legalFees = append(legalFees, fee)
-					lrcRewards = append(lrcRewards, filledOrder.LegalLrcFee)
-					legalFee.Add(legalFee, fee)
-
-					minerLrcBalance.Sub(minerLrcBalance, filledOrder.LrcFee)
-					//log.Debugf("Miner,lrcReward:%s  legalFee:%s", lrcReward.FloatString(10), filledOrder.LegalFee.FloatString(10))
-				} else {
-					feeSelections = append(feeSelections, 0)
-					legalFees = append(legalFees, filledOrder.LegalLrcFee)
-					lrcRewards = append(lrcRewards, new(big.Rat).SetInt(big.NewInt(int64(0))))
-					legalFee.Add(legalFee, filledOrder.LegalLrcFee)
-				}
-			}
 
-			if ringState.LegalFee.Sign() == 0 || ringState.LegalFee.Cmp(legalFee) < 0 {
-				ringState.LegalFee = legalFee
+	var (
+		selected         *minerFee
+		gasPriceStrategy GasPriceStrategy
+		gasPriceLimit    *big.Int
+	)
+	for _, splitMiner := range submitter.percentMinerAddresses {
+		fee := submitter.computeMinerFee(ringState, splitMiner.Address, lrcAddress)
+		legalFee, _ := fee.legalFee.Float64()
+		if len(submitter.normalMinerAddresses) > 0 && legalFee < splitMiner.StartFee {
+			continue
+		}
+		if nil == selected || selected.legalFee.Cmp(fee.legalFee) < 0 {
+			selected = fee
+			ringSubmitInfo.Miner = splitMiner.Address
+			gasPriceStrategy = splitMiner.GasPriceStrategy
+			gasPriceLimit = splitMiner.GasPriceLimit
+		}
+	}
+	if nil == selected {
+		for _, normalMinerAddress := range submitter.availabeMinerAddress() {
+			fee := submitter.computeMinerFee(ringState, normalMinerAddress.Address, lrcAddress)
+			if nil == selected || selected.legalFee.Cmp(fee.legalFee) < 0 {
+				selected = fee
 				ringSubmitInfo.Miner = normalMinerAddress.Address
-				for idx, filledOrder := range ringState.Orders {
-					filledOrder.FeeSelection = feeSelections[idx]
-					filledOrder.LegalFee = legalFees[idx]
-					filledOrder.LrcReward = lrcRewards[idx]
-				}
-
-				if nil == ringSubmitInfo.ProtocolGasPrice || ringSubmitInfo.ProtocolGasPrice.Cmp(normalMinerAddress.GasPriceLimit) > 0 {
-					ringSubmitInfo.ProtocolGasPrice = normalMinerAddress.GasPriceLimit
-				}
+				gasPriceStrategy = submitter.gasPriceStrategy
+				gasPriceLimit = normalMinerAddress.GasPriceLimit
 			}
 		}
 	}
+	if nil == selected {
+		return errors.New("there isn't any miner address")
+	}
+
+	ringState.LegalFee = selected.legalFee
+	for idx, filledOrder := range ringState.Orders {
+		filledOrder.FeeSelection = selected.feeSelections[idx]
+		filledOrder.LegalFee = selected.legalFees[idx]
+		filledOrder.LrcReward = selected.lrcRewards[idx]
+	}
+
+	gas := new(big.Int).Set(ringSubmitInfo.ProtocolGas)
+	if submitter.ifRegistryRingHash {
+		gas.Add(gas, ringSubmitInfo.RegistryGas)
+	}
+	if gasPrice, err := gasPriceStrategy.GasPrice(ringState.LegalFee, gas); nil != err {
+		// percent miner的gas费用不能超过法币收益的FeePercent，无法计算时不提交
+		if _, isFeePercent := gasPriceStrategy.(*FeePercentGasPriceStrategy); isFeePercent {
+			return errors.New("compute gasPrice by fee percent err:" + err.Error())
+		}
+		log.Errorf("miner submitter,compute gasPrice of ring:%s err:%s, use the gasPrice of node", ringSubmitInfo.Ringhash.Hex(), err.Error())
+	} else {
+		ringSubmitInfo.ProtocolGasPrice = gasPrice
+	}
+	if nil != gasPriceLimit && gasPriceLimit.Sign() > 0 && (nil == ringSubmitInfo.ProtocolGasPrice || ringSubmitInfo.ProtocolGasPrice.Cmp(gasPriceLimit) > 0) {
+		ringSubmitInfo.ProtocolGasPrice = gasPriceLimit
+	}
 
 	registryCost := big.NewInt(int64(0))
 	if submitter.ifRegistryRingHash {
@@ -0,0 +1,243 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	marketLib "github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+集合竞价：每一轮在每个市场中计算使成交量最大的统一价格，所有价格满足的订单都以该价格成交，
+不再按照矿工收益选择环路。统一价格只对单个市场有意义，因此不寻找多个订单的环路
+*/
+
+type BatchAuctionMatcher struct {
+	*TimingMatcher
+}
+
+func NewBatchAuctionMatcher(matcherOptions *config.TimingMatcher, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) *BatchAuctionMatcher {
+	matcher := &BatchAuctionMatcher{TimingMatcher: NewTimingMatcher(matcherOptions, 2, submitter, evaluator, om, accountManager)}
+	matcher.marketMatch = (*Market).auction
+	return matcher
+}
+
+// auctionOrder 价格均以每单位tokenA对应的tokenB数量表示
+type auctionOrder struct {
+	order      *types.OrderState
+	limitPrice *big.Rat //AtoB订单的最低卖价，BtoA订单的最高买价
+	remained   *big.Rat //剩余可以卖出的tokenS数量
+}
+
+func (market *Market) auction() {
+	market.getOrdersForMatching(market.protocolAddress)
+
+	asks := market.auctionOrders(market.AtoBOrders, true)
+	bids := market.auctionOrders(market.BtoAOrders, false)
+	price := clearingPrice(asks, bids)
+	if nil == price {
+		return
+	}
+	log.Debugf("batch auction round:%s, market: %s -> %s , clearing price:%s", market.matcher.lastBlockNumber, market.TokenA.Hex(), market.TokenB.Hex(), price.FloatString(10))
+
+	//价格最优的订单优先成交
+	sort.Slice(asks, func(i, j int) bool {
+		return asks[i].limitPrice.Cmp(asks[j].limitPrice) < 0
+	})
+	sort.Slice(bids, func(i, j int) bool {
+		return bids[i].limitPrice.Cmp(bids[j].limitPrice) > 0
+	})
+
+	ringSubmitInfos := []*types.RingSubmitInfo{}
+	matchAuctionOrders(asks, bids, price, func(ask, bid *auctionOrder) (askFinished, bidFinished bool, err error) {
+		for _, o := range []*auctionOrder{ask, bid} {
+			if !market.hasAvailableBalance(o.order) {
+				return false, false, &miner.OrderError{Order: o.order, Err: errors.New("balance or allowance of owner is zero")}
+			}
+		}
+
+		ringForSubmit, err := market.generateRingSubmitInfoAtPrice(price, ask.order, bid.order)
+		if nil != err {
+			return false, false, err
+		}
+
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			orderState := market.reduceAmountAfterFilled(filledOrder)
+			market.excludeNextRound(orderState)
+			market.matcher.rounds.appendFilledOrderToCurrent(filledOrder, ringForSubmit.RawRing.Hash)
+
+			//订单完成或者余额已经用完之后，继续与下一个订单撮合
+			finished := market.om.IsOrderFullFinished(orderState) || filledOrder.FillAmountS.Cmp(filledOrder.AvailableAmountS) >= 0
+			if orderState.RawOrder.TokenS == market.TokenA {
+				askFinished = finished
+			} else {
+				bidFinished = finished
+			}
+		}
+		ringSubmitInfos = append(ringSubmitInfos, ringForSubmit)
+		return askFinished, bidFinished, nil
+	})
+
+	if len(ringSubmitInfos) > 0 {
+		eventemitter.Emit(eventemitter.Miner_NewRing, ringSubmitInfos)
+	}
+}
+
+// matchAuctionOrders asks以及bids已经按照价格从优到劣排序，依次撮合价格满足的订单，
+// match返回订单是否已经完成，完成的一方继续与下一个订单撮合
+func matchAuctionOrders(asks, bids []*auctionOrder, price *big.Rat, match func(ask, bid *auctionOrder) (askFinished, bidFinished bool, err error)) {
+	i, j := 0, 0
+	for i < len(asks) && j < len(bids) && asks[i].limitPrice.Cmp(price) <= 0 && bids[j].limitPrice.Cmp(price) >= 0 {
+		askFinished, bidFinished, err := match(asks[i], bids[j])
+		if nil != err {
+			log.Debugf("batch auction, generate RingSubmitInfo err:%s", err.Error())
+			askFinished, bidFinished = skippedSide(asks[i], bids[j], price, err)
+		}
+		if askFinished || !bidFinished {
+			i++
+		}
+		if bidFinished || !askFinished {
+			j++
+		}
+	}
+}
+
+// skippedSide 由订单导致的错误只跳过该订单；其他错误例如收益不足时跳过剩余数量(tokenA)较小的订单，
+// 数量较大的订单继续与下一个订单撮合
+func skippedSide(ask, bid *auctionOrder, price *big.Rat, err error) (skipAsk, skipBid bool) {
+	if e, ok := err.(*miner.OrderError); ok {
+		return e.Order == ask.order, e.Order == bid.order
+	}
+	if ask.remained.Cmp(new(big.Rat).Quo(bid.remained, price)) <= 0 {
+		return true, false
+	}
+	return false, true
+}
+
+func (market *Market) auctionOrders(orders map[common.Hash]*types.OrderState, isAsk bool) []*auctionOrder {
+	res := []*auctionOrder{}
+	for _, order := range orders {
+		if order.RawOrder.AmountS.Sign() <= 0 || order.RawOrder.AmountB.Sign() <= 0 {
+			continue
+		}
+		o := &auctionOrder{order: order}
+		if isAsk {
+			o.limitPrice = new(big.Rat).SetFrac(order.RawOrder.AmountB, order.RawOrder.AmountS)
+		} else {
+			o.limitPrice = new(big.Rat).SetFrac(order.RawOrder.AmountS, order.RawOrder.AmountB)
+		}
+		o.remained, _ = order.RemainedAmount()
+		if o.remained.Sign() > 0 {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// clearingPrice 在所有订单的限价中选择成交量(tokenA)最大的价格，成交量相同时选择买卖数量更接近的价格
+func clearingPrice(asks, bids []*auctionOrder) *big.Rat {
+	var (
+		price     *big.Rat
+		volume    = new(big.Rat)
+		imbalance *big.Rat
+	)
+	candidates := []*big.Rat{}
+	for _, o := range asks {
+		candidates = append(candidates, o.limitPrice)
+	}
+	for _, o := range bids {
+		candidates = append(candidates, o.limitPrice)
+	}
+
+	for _, p := range candidates {
+		supply := new(big.Rat)
+		for _, ask := range asks {
+			if ask.limitPrice.Cmp(p) <= 0 {
+				supply.Add(supply, ask.remained)
+			}
+		}
+		demand := new(big.Rat)
+		for _, bid := range bids {
+			if bid.limitPrice.Cmp(p) >= 0 {
+				demand.Add(demand, new(big.Rat).Quo(bid.remained, p))
+			}
+		}
+
+		v := supply
+		if demand.Cmp(supply) < 0 {
+			v = demand
+		}
+		diff := new(big.Rat).Sub(supply, demand)
+		diff.Abs(diff)
+		if v.Sign() <= 0 {
+			continue
+		}
+		if c := v.Cmp(volume); c > 0 || (c == 0 && diff.Cmp(imbalance) < 0) {
+			price, volume, imbalance = p, v, diff
+		}
+	}
+	return price
+}
+
+// generateRingSubmitInfoAtPrice 两个订单都以price成交，而不是使用ComputeRing中相同的折价比例
+func (market *Market) generateRingSubmitInfoAtPrice(price *big.Rat, a2BOrder, b2AOrder *types.OrderState) (*types.RingSubmitInfo, error) {
+	ringTmp, err := miner.NewRingWithBalances(market.matcher, market.lrcAddress, a2BOrder, b2AOrder)
+	if nil != err {
+		return nil, err
+	}
+
+	//AtoB订单每个tokenB卖出1/price个tokenA，BtoA订单每个tokenA卖出price个tokenB
+	a2BRate := new(big.Rat).SetFrac(a2BOrder.RawOrder.AmountB, a2BOrder.RawOrder.AmountS)
+	a2BRate.Quo(a2BRate, price)
+	b2ARate := new(big.Rat).SetFrac(b2AOrder.RawOrder.AmountB, b2AOrder.RawOrder.AmountS)
+	b2ARate.Mul(b2ARate, price)
+
+	//统一价格可能使某个订单的折价远大于另一个订单，此时跳过折价较大的订单，后面的订单价格更接近成交价
+	if !market.matcher.evaluator.RatesCVSValid([]*big.Rat{a2BRate, b2ARate}) {
+		discounted := a2BOrder
+		if b2ARate.Cmp(a2BRate) < 0 {
+			discounted = b2AOrder
+		}
+		return nil, &miner.OrderError{Order: discounted, Err: errors.New("cvs of rates at clearing price exceeds RateRatioCVSThreshold")}
+	}
+
+	if err := market.matcher.evaluator.ComputeRingWithRates(ringTmp, []*big.Rat{a2BRate, b2ARate}); nil != err {
+		return nil, err
+	}
+	return market.matcher.submitter.GenerateRingSubmitInfo(ringTmp)
+}
+
+func (market *Market) hasAvailableBalance(order *types.OrderState) bool {
+	balance, err := market.matcher.GetAccountAvailableAmount(order.RawOrder.Owner, order.RawOrder.TokenS)
+	if nil != err {
+		log.Debugf("batch auction, get balance of owner:%s err:%s", order.RawOrder.Owner.Hex(), err.Error())
+		return false
+	}
+	return balance.Sign() > 0
+}
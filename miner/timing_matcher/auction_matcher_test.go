@@ -0,0 +1,189 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"go.uber.org/zap"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+// newAuctionOrder price为每单位tokenA对应的tokenB数量，ask的remained为tokenA数量，bid的remained为tokenB数量
+func newAuctionOrder(price, remained *big.Rat) *auctionOrder {
+	return &auctionOrder{order: &types.OrderState{}, limitPrice: price, remained: remained}
+}
+
+func TestClearingPrice(t *testing.T) {
+	cases := []struct {
+		name string
+		asks []*auctionOrder
+		bids []*auctionOrder
+		want *big.Rat
+	}{
+		{
+			name: "no bids",
+			asks: []*auctionOrder{newAuctionOrder(big.NewRat(1, 1), big.NewRat(10, 1))},
+			want: nil,
+		},
+		{
+			name: "prices not crossed",
+			asks: []*auctionOrder{newAuctionOrder(big.NewRat(2, 1), big.NewRat(10, 1))},
+			bids: []*auctionOrder{newAuctionOrder(big.NewRat(1, 1), big.NewRat(10, 1))},
+			want: nil,
+		},
+		{
+			// 价格为1时成交10个tokenA，价格为2时买单只能买入5个
+			name: "max volume",
+			asks: []*auctionOrder{newAuctionOrder(big.NewRat(1, 1), big.NewRat(10, 1))},
+			bids: []*auctionOrder{newAuctionOrder(big.NewRat(2, 1), big.NewRat(10, 1))},
+			want: big.NewRat(1, 1),
+		},
+		{
+			// 价格为1以及2时成交量都为10个tokenA，价格为1时卖出10买入20，价格为2时卖出15买入10
+			name: "same volume with less imbalance",
+			asks: []*auctionOrder{
+				newAuctionOrder(big.NewRat(1, 1), big.NewRat(10, 1)),
+				newAuctionOrder(big.NewRat(2, 1), big.NewRat(5, 1)),
+			},
+			bids: []*auctionOrder{newAuctionOrder(big.NewRat(2, 1), big.NewRat(20, 1))},
+			want: big.NewRat(2, 1),
+		},
+		{
+			name: "several orders",
+			asks: []*auctionOrder{
+				newAuctionOrder(big.NewRat(9, 10), big.NewRat(4, 1)),
+				newAuctionOrder(big.NewRat(1, 1), big.NewRat(4, 1)),
+				newAuctionOrder(big.NewRat(11, 10), big.NewRat(4, 1)),
+			},
+			bids: []*auctionOrder{
+				newAuctionOrder(big.NewRat(12, 10), big.NewRat(6, 1)),
+				newAuctionOrder(big.NewRat(1, 1), big.NewRat(3, 1)),
+				newAuctionOrder(big.NewRat(8, 10), big.NewRat(10, 1)),
+			},
+			want: big.NewRat(1, 1),
+		},
+	}
+	for _, c := range cases {
+		got := clearingPrice(c.asks, c.bids)
+		if (nil == got) != (nil == c.want) || (nil != got && got.Cmp(c.want) != 0) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+type auctionStep struct {
+	ask, bid int
+}
+
+// runAuction 记录每次撮合的ask、bid下标，result按照下标返回撮合结果
+func runAuction(asks, bids []*auctionOrder, price *big.Rat, result func(ask, bid int) (bool, bool, error)) []auctionStep {
+	index := func(orders []*auctionOrder, o *auctionOrder) int {
+		for idx := range orders {
+			if orders[idx] == o {
+				return idx
+			}
+		}
+		return -1
+	}
+	steps := []auctionStep{}
+	matchAuctionOrders(asks, bids, price, func(ask, bid *auctionOrder) (bool, bool, error) {
+		step := auctionStep{index(asks, ask), index(bids, bid)}
+		steps = append(steps, step)
+		return result(step.ask, step.bid)
+	})
+	return steps
+}
+
+func TestMatchAuctionOrders(t *testing.T) {
+	price := big.NewRat(1, 1)
+	asks := []*auctionOrder{
+		newAuctionOrder(big.NewRat(8, 10), big.NewRat(5, 1)),
+		newAuctionOrder(big.NewRat(9, 10), big.NewRat(20, 1)),
+		newAuctionOrder(big.NewRat(1, 1), big.NewRat(5, 1)),
+		newAuctionOrder(big.NewRat(11, 10), big.NewRat(5, 1)),
+	}
+	bids := []*auctionOrder{
+		newAuctionOrder(big.NewRat(12, 10), big.NewRat(10, 1)),
+		newAuctionOrder(big.NewRat(11, 10), big.NewRat(10, 1)),
+		newAuctionOrder(big.NewRat(1, 1), big.NewRat(10, 1)),
+		newAuctionOrder(big.NewRat(9, 10), big.NewRat(10, 1)),
+	}
+
+	cases := []struct {
+		name   string
+		result func(ask, bid int) (bool, bool, error)
+		want   []auctionStep
+	}{
+		{
+			// 数量较小的一方完成后与下一个订单撮合，价格不满足的订单不参与
+			name: "finished side advances",
+			result: func(ask, bid int) (bool, bool, error) {
+				switch {
+				case ask == 0:
+					return true, false, nil
+				case ask == 1 && bid < 2:
+					return false, true, nil
+				}
+				return true, true, nil
+			},
+			want: []auctionStep{{0, 0}, {1, 0}, {1, 1}, {1, 2}},
+		},
+		{
+			name: "order error skips the order",
+			result: func(ask, bid int) (bool, bool, error) {
+				if ask == 0 {
+					return false, false, &miner.OrderError{Order: asks[0].order, Err: errors.New("balance is zero")}
+				}
+				if bid == 0 {
+					return false, false, &miner.OrderError{Order: bids[0].order, Err: errors.New("balance is zero")}
+				}
+				return true, true, nil
+			},
+			want: []auctionStep{{0, 0}, {1, 0}, {1, 1}, {2, 2}},
+		},
+		{
+			// ask 0剩余5个tokenA少于bid 0的10个，ask 1剩余20个多于bid 1的10个
+			name: "other error skips the smaller order",
+			result: func(ask, bid int) (bool, bool, error) {
+				if ask < 2 {
+					return false, false, errors.New("ring is not profitable")
+				}
+				return true, true, nil
+			},
+			want: []auctionStep{{0, 0}, {1, 0}, {1, 1}, {1, 2}},
+		},
+	}
+	for _, c := range cases {
+		got := runAuction(asks, bids, price, c.result)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"math/big"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	marketLib "github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+在定时撮合的基础上，ordermanager保存gateway收到的新订单之后立即将其与所在市场中本轮的订单进行撮合，减少成交的延迟
+*/
+
+type EventMatcher struct {
+	*TimingMatcher
+}
+
+func NewEventMatcher(matcherOptions *config.TimingMatcher, ringMaxLength int, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) *EventMatcher {
+	return &EventMatcher{TimingMatcher: NewTimingMatcher(matcherOptions, ringMaxLength, submitter, evaluator, om, accountManager)}
+}
+
+func (matcher *EventMatcher) Start() {
+	matcher.TimingMatcher.Start()
+	matcher.listenNewOrder()
+}
+
+// 等待撮合的新订单数量上限，队列已满时新订单等到定时撮合时处理
+const newOrderQueueSize = 1024
+
+// listenNewOrder ordermanager保存新订单之后才会发出Miner_NewOrderState，
+// 事件处理只把订单放入队列，撮合在单独的goroutine中进行，不会阻塞gateway提交订单
+func (matcher *EventMatcher) listenNewOrder() {
+	newOrderChan := make(chan *types.OrderState, newOrderQueueSize)
+	stopChan := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stopChan:
+				return
+			case state := <-newOrderChan:
+				matcher.matchNewOrder(state)
+			}
+		}
+	}()
+
+	watcher := &eventemitter.Watcher{
+		Concurrent: false,
+		Handle: func(eventData eventemitter.EventData) error {
+			state := eventData.(*types.OrderState)
+			select {
+			case newOrderChan <- state:
+			default:
+				log.Debugf("event matcher, queue of new orders is full, order:%s will be matched in the next round", state.RawOrder.Hash.Hex())
+			}
+			return nil
+		},
+	}
+	eventemitter.On(eventemitter.Miner_NewOrderState, watcher)
+	matcher.stopFuncs = append(matcher.stopFuncs, func() {
+		eventemitter.Un(eventemitter.Miner_NewOrderState, watcher)
+		close(stopChan)
+	})
+}
+
+// matchNewOrder 新订单只与所在市场中反方向的订单撮合，第一轮撮合之前收到的订单等到定时撮合时处理
+func (matcher *EventMatcher) matchNewOrder(state *types.OrderState) {
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	if matcher.lastBlockNumber.Sign() <= 0 {
+		return
+	}
+
+	rawOrder := state.RawOrder
+	for _, market := range matcher.markets {
+		if market.protocolAddress != rawOrder.Protocol ||
+			!((market.TokenA == rawOrder.TokenS && market.TokenB == rawOrder.TokenB) ||
+				(market.TokenB == rawOrder.TokenS && market.TokenA == rawOrder.TokenB)) {
+			continue
+		}
+
+		order := market.addOrder(state)
+		if nil == order {
+			return
+		}
+		log.Debugf("event matcher, match new order:%s in market: %s -> %s", rawOrder.Hash.Hex(), market.TokenA.Hex(), market.TokenB.Hex())
+		newOrders := map[common.Hash]*types.OrderState{rawOrder.Hash: order}
+		if rawOrder.TokenS == market.TokenA {
+			market.matchOrders(newOrders, market.BtoAOrders)
+		} else {
+			market.matchOrders(market.AtoBOrders, newOrders)
+		}
+		return
+	}
+}
+
+// addOrder 将gateway中的新订单加入market，订单已经存在或者已经完成时返回nil
+func (market *Market) addOrder(state *types.OrderState) *types.OrderState {
+	orderhash := state.RawOrder.Hash
+	if _, exists := market.AtoBOrders[orderhash]; exists {
+		return nil
+	}
+	if _, exists := market.BtoAOrders[orderhash]; exists {
+		return nil
+	}
+
+	order := &types.OrderState{}
+	order.RawOrder = state.RawOrder
+	order.UpdatedBlock = new(big.Int).Set(market.matcher.lastBlockNumber)
+	order.DealtAmountS = big.NewInt(0)
+	order.DealtAmountB = big.NewInt(0)
+	order.SplitAmountS = big.NewInt(0)
+	order.SplitAmountB = big.NewInt(0)
+	order.CancelledAmountS = big.NewInt(0)
+	order.CancelledAmountB = big.NewInt(0)
+	order.Status = types.ORDER_NEW
+
+	market.reduceRemainedAmountBeforeMatch(order)
+	if market.om.IsOrderFullFinished(order) {
+		return nil
+	}
+	if order.RawOrder.TokenS == market.TokenA {
+		market.AtoBOrders[orderhash] = order
+	} else {
+		market.BtoAOrders[orderhash] = order
+	}
+	return order
+}
@@ -39,19 +39,7 @@ func (matcher *TimingMatcher) listenNewBlock() {
 					if nextBlockNumber.Cmp(blockEvent.BlockNumber) <= 0 {
 						// debug use only
 						// log.Debugf("miner starts a new match round")
-						matcher.lastBlockNumber = blockEvent.BlockNumber
-						matcher.rounds.appendNewRoundState(matcher.lastBlockNumber)
-						var wg sync.WaitGroup
-						for _, market := range matcher.markets {
-							wg.Add(1)
-							go func(m *Market) {
-								defer func() {
-									wg.Add(-1)
-								}()
-								m.match()
-							}(market)
-						}
-						wg.Wait()
+						matcher.matchRound(blockEvent.BlockNumber)
 					}
 				}
 			}
@@ -74,6 +62,26 @@ func (matcher *TimingMatcher) listenNewBlock() {
 
 }
 
+func (matcher *TimingMatcher) matchRound(blockNumber *big.Int) {
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	matcher.lastBlockNumber = blockNumber
+	matcher.rounds.appendNewRoundState(matcher.lastBlockNumber)
+	var wg sync.WaitGroup
+	for _, market := range matcher.markets {
+		wg.Add(1)
+		go func(m *Market) {
+			defer func() {
+				wg.Add(-1)
+			}()
+			matcher.marketMatch(m)
+		}(market)
+	}
+	wg.Wait()
+	matcher.matchMultiOrderRings()
+}
+
 func (matcher *TimingMatcher) listenSubmitEvent() {
 	submitEventChan := make(chan common.Hash)
 	go func() {
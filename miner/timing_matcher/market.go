@@ -19,7 +19,6 @@
 package timing_matcher
 
 import (
-	"fmt"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/miner"
@@ -47,30 +46,28 @@ type Market struct {
 
 func (market *Market) match() {
 	market.getOrdersForMatching(market.protocolAddress)
+	market.matchOrders(market.AtoBOrders, market.BtoAOrders)
+}
+
+// matchOrders 将atoBOrders与btoAOrders两两成环，两者都必须已经在market中
+func (market *Market) matchOrders(atoBOrders, btoAOrders map[common.Hash]*types.OrderState) {
 	matchedOrderHashes := make(map[common.Hash]bool) //true:fullfilled, false:partfilled
 	ringSubmitInfos := []*types.RingSubmitInfo{}
 	candidateRingList := CandidateRingList{}
 
 	//step 1: evaluate received
-	for _, a2BOrder := range market.AtoBOrders {
-		for _, b2AOrder := range market.BtoAOrders {
+	for _, a2BOrder := range atoBOrders {
+		for _, b2AOrder := range btoAOrders {
 			if miner.PriceValid(a2BOrder, b2AOrder) {
 				if ringForSubmit, err := market.generateRingSubmitInfo(a2BOrder, b2AOrder); nil != err {
-					log.Errorf("err:%s", err.Error())
+					//收益不足的环路已经由submitter记录
+					if err != miner.ErrRingNotProfitable {
+						log.Errorf("err:%s", err.Error())
+					}
 					continue
 				} else {
 					log.Debugf("ringForSubmit: %s , Received: %s , protocolGas: %s , protocolGasPrice: %s, LegalCost:%s", ringForSubmit.Ringhash.Hex(), ringForSubmit.Received.String(), ringForSubmit.ProtocolGas.String(), ringForSubmit.ProtocolGasPrice.String(), ringForSubmit.LegalCost.String())
-					//todo:for test, release this limit
-					//if ringForSubmit.Received.Sign() > 0 {
-					candidateRing := CandidateRing{cost: ringForSubmit.LegalCost, received: ringForSubmit.Received, filledOrders: make(map[common.Hash]*big.Rat)}
-					for _, filledOrder := range ringForSubmit.RawRing.Orders {
-						log.Debugf("match, filledOrder.FilledAmountS:%s", filledOrder.FillAmountS.FloatString(3))
-						candidateRing.filledOrders[filledOrder.OrderState.RawOrder.Hash] = filledOrder.FillAmountS
-					}
-					candidateRingList = append(candidateRingList, candidateRing)
-					//} else {
-					//	log.Debugf("timing_matchher, market ringForSubmit received not enough, received:%s, gas:%s, gasPrice:%s ", ringForSubmit.Received.FloatString(0), ringForSubmit.ProtocolGas.String(), ringForSubmit.ProtocolGasPrice.String())
-					//}
+					candidateRingList = append(candidateRingList, newCandidateRing(ringForSubmit))
 				}
 			}
 		}
@@ -88,7 +85,7 @@ func (market *Market) match() {
 		candidateRing := list[0]
 		list = list[1:]
 		orders := []*types.OrderState{}
-		for hash, _ := range candidateRing.filledOrders {
+		for _, hash := range candidateRing.orderHashes {
 			if o, exists := market.AtoBOrders[hash]; exists {
 				orders = append(orders, o)
 			} else {
@@ -99,8 +96,6 @@ func (market *Market) match() {
 			log.Debugf("generate RingSubmitInfo err:%s", err.Error())
 			continue
 		} else {
-			//todo:for test, release this limit
-			//if ringForSubmit.Received.Sign() > 0 {
 			for _, filledOrder := range ringForSubmit.RawRing.Orders {
 				orderState := market.reduceAmountAfterFilled(filledOrder)
 				isFullFilled := market.om.IsOrderFullFinished(orderState)
@@ -110,9 +105,6 @@ func (market *Market) match() {
 				list = market.reduceReceivedOfCandidateRing(list, filledOrder, isFullFilled)
 			}
 			ringSubmitInfos = append(ringSubmitInfos, ringForSubmit)
-			//} else {
-			//	log.Debugf("ring:%s will not be submitted,because of received:%s", ringForSubmit.RawRing.Hash.Hex(), ringForSubmit.Received.String())
-			//}
 		}
 	}
 
@@ -154,10 +146,10 @@ func (market *Market) reduceReceivedOfCandidateRing(list CandidateRingList, fill
 				rate.Quo(remainedAmountS, amountS)
 				remainedReceived := new(big.Rat).Add(ring.received, ring.cost)
 				remainedReceived.Mul(remainedReceived, rate).Sub(remainedReceived, ring.cost)
-				//todo:for test, release this limit
-				//if remainedReceived.Sign() <= 0 {
-				//	continue
-				//}
+				if !market.matcher.submitter.IsProfitable(ring.ringhash, remainedReceived, ring.cost) {
+					continue
+				}
+				ring.received = remainedReceived
 				for hash, amount := range ring.filledOrders {
 					ring.filledOrders[hash] = amount.Mul(amount, rate)
 				}
@@ -252,25 +244,19 @@ func (market *Market) reduceAmountAfterFilled(filledOrder *types.FilledOrder) *t
 	return orderState
 }
 
-func (market *Market) generateRingSubmitInfo(orders ...*types.OrderState) (*types.RingSubmitInfo, error) {
-	filledOrders := []*types.FilledOrder{}
-	//miner will received nothing, if miner set FeeSelection=1 and he doesn't have enough lrc
-	for _, order := range orders {
-		lrcTokenBalance, err := market.matcher.GetAccountAvailableAmount(order.RawOrder.Owner, market.lrcAddress)
-		if nil != err {
-			return nil, err
-		}
-		tokenSBalance, err := market.matcher.GetAccountAvailableAmount(order.RawOrder.Owner, order.RawOrder.TokenS)
-		if nil != err {
-			return nil, err
-		}
-		if tokenSBalance.Sign() <= 0 {
-			return nil, fmt.Errorf("owner:%s token:%s balance or allowance is zero", order.RawOrder.Owner.Hex(), order.RawOrder.TokenS.Hex())
-		}
-		filledOrders = append(filledOrders, types.ConvertOrderStateToFilledOrder(*order, lrcTokenBalance, tokenSBalance))
+func (market *Market) excludeNextRound(orderState *types.OrderState) {
+	if orderState.RawOrder.TokenS == market.TokenA {
+		market.AtoBOrderHashesExcludeNextRound = append(market.AtoBOrderHashesExcludeNextRound, orderState.RawOrder.Hash)
+	} else {
+		market.BtoAOrderHashesExcludeNextRound = append(market.BtoAOrderHashesExcludeNextRound, orderState.RawOrder.Hash)
 	}
+}
 
-	ringTmp := miner.NewRing(filledOrders)
+func (market *Market) generateRingSubmitInfo(orders ...*types.OrderState) (*types.RingSubmitInfo, error) {
+	ringTmp, err := miner.NewRingWithBalances(market.matcher, market.lrcAddress, orders...)
+	if nil != err {
+		return nil, err
+	}
 	if err := market.matcher.evaluator.ComputeRing(ringTmp); nil != err {
 		return nil, err
 	} else {
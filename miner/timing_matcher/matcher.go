@@ -23,6 +23,7 @@ import (
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"sync"
 
 	"github.com/Loopring/relay/config"
 	marketLib "github.com/Loopring/relay/market"
@@ -41,6 +42,10 @@ type TimingMatcher struct {
 	lastBlockNumber *big.Int
 	duration        *big.Int
 	roundOrderCount int
+	ringMaxLength   int
+	marketMatch     func(market *Market) //每轮中单个市场的撮合方式
+
+	mtx sync.Mutex //撮合轮次与新订单的撮合不能同时进行
 
 	maxCacheRoundsLength int
 	delayedNumber        int64
@@ -49,12 +54,14 @@ type TimingMatcher struct {
 	stopFuncs []func()
 }
 
-func NewTimingMatcher(matcherOptions *config.TimingMatcher, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) *TimingMatcher {
+func NewTimingMatcher(matcherOptions *config.TimingMatcher, ringMaxLength int, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) *TimingMatcher {
 	matcher := &TimingMatcher{}
 	matcher.submitter = submitter
 	matcher.evaluator = evaluator
 	matcher.accountManager = accountManager
 	matcher.roundOrderCount = matcherOptions.RoundOrdersCount
+	matcher.ringMaxLength = ringMaxLength
+	matcher.marketMatch = (*Market).match
 	matcher.rounds = NewRoundStates(matcherOptions.MaxCacheRoundsLength)
 
 	matcher.markets = []*Market{}
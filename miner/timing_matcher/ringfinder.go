@@ -0,0 +1,253 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+market只能找到两个订单的环路，ringFinder将同一协议下所有market中剩余的订单按tokenS->tokenB建图，
+寻找长度为3到ringMaxLength的环路，计算收益之后按照CandidateRingList的方式选择提交的环路
+*/
+
+const (
+	maxOrdersPerTokenEdge = 5  //每个tokenS->tokenB只取价格最高的几个订单参与组合
+	maxRingsPerTokenCycle = 10 //每个token环路最多生成的候选环路数
+)
+
+type orderEdge struct {
+	order *types.OrderState
+	price *big.Rat //amountS/amountB
+}
+
+type ringFinder struct {
+	matcher *TimingMatcher
+	market  *Market //同一协议下的任一market，用于生成RingSubmitInfo
+	markets map[common.Hash]*Market
+	edges   map[common.Address]map[common.Address][]*orderEdge
+}
+
+func (matcher *TimingMatcher) matchMultiOrderRings() {
+	if matcher.ringMaxLength <= 2 {
+		return
+	}
+
+	protocolMarkets := make(map[common.Address][]*Market)
+	for _, market := range matcher.markets {
+		protocolMarkets[market.protocolAddress] = append(protocolMarkets[market.protocolAddress], market)
+	}
+	for _, markets := range protocolMarkets {
+		newRingFinder(matcher, markets).match()
+	}
+}
+
+func newRingFinder(matcher *TimingMatcher, markets []*Market) *ringFinder {
+	finder := &ringFinder{}
+	finder.matcher = matcher
+	finder.markets = make(map[common.Hash]*Market)
+	finder.edges = make(map[common.Address]map[common.Address][]*orderEdge)
+
+	for _, market := range markets {
+		finder.market = market
+		finder.addOrders(market, market.AtoBOrders)
+		finder.addOrders(market, market.BtoAOrders)
+	}
+	finder.sortEdges()
+	return finder
+}
+
+// sortEdges 每条边上的订单按价格从高到低排列，只保留maxOrdersPerTokenEdge个
+func (finder *ringFinder) sortEdges() {
+	for _, nextEdges := range finder.edges {
+		for tokenB, orders := range nextEdges {
+			sort.Slice(orders, func(i, j int) bool {
+				return orders[i].price.Cmp(orders[j].price) > 0
+			})
+			if len(orders) > maxOrdersPerTokenEdge {
+				nextEdges[tokenB] = orders[:maxOrdersPerTokenEdge]
+			}
+		}
+	}
+}
+
+func (finder *ringFinder) addOrders(market *Market, orders map[common.Hash]*types.OrderState) {
+	for orderhash, order := range orders {
+		if market.om.IsOrderFullFinished(order) || order.RawOrder.AmountS.Sign() <= 0 || order.RawOrder.AmountB.Sign() <= 0 {
+			continue
+		}
+		tokenS := order.RawOrder.TokenS
+		tokenB := order.RawOrder.TokenB
+		if _, exists := finder.edges[tokenS]; !exists {
+			finder.edges[tokenS] = make(map[common.Address][]*orderEdge)
+		}
+		edge := &orderEdge{order: order, price: new(big.Rat).SetFrac(order.RawOrder.AmountS, order.RawOrder.AmountB)}
+		finder.edges[tokenS][tokenB] = append(finder.edges[tokenS][tokenB], edge)
+		finder.markets[orderhash] = market
+	}
+}
+
+func (finder *ringFinder) match() {
+	if nil == finder.market {
+		return
+	}
+
+	candidateRingList := CandidateRingList{}
+	for _, cycle := range finder.tokenCycles(finder.matcher.ringMaxLength) {
+		for _, orders := range finder.ordersOfCycle(cycle) {
+			if ringForSubmit, err := finder.market.generateRingSubmitInfo(orders...); nil != err {
+				log.Debugf("multi-order ring, generate RingSubmitInfo err:%s", err.Error())
+			} else {
+				candidateRingList = append(candidateRingList, newCandidateRing(ringForSubmit))
+			}
+		}
+	}
+
+	log.Debugf("match round:%s, protocol:%s, multi-order candidateRingList.length:%d", finder.matcher.lastBlockNumber, finder.market.protocolAddress.Hex(), len(candidateRingList))
+	ringSubmitInfos := []*types.RingSubmitInfo{}
+	list := candidateRingList
+	for len(list) > 0 {
+		sort.Sort(list)
+		candidateRing := list[0]
+		list = list[1:]
+		orders := []*types.OrderState{}
+		for _, orderhash := range candidateRing.orderHashes {
+			orders = append(orders, finder.orderState(orderhash))
+		}
+		if ringForSubmit, err := finder.market.generateRingSubmitInfo(orders...); nil != err {
+			log.Debugf("generate RingSubmitInfo err:%s", err.Error())
+			continue
+		} else {
+			for _, filledOrder := range ringForSubmit.RawRing.Orders {
+				market := finder.markets[filledOrder.OrderState.RawOrder.Hash]
+				orderState := market.reduceAmountAfterFilled(filledOrder)
+				isFullFilled := market.om.IsOrderFullFinished(orderState)
+				market.excludeNextRound(orderState)
+				finder.matcher.rounds.appendFilledOrderToCurrent(filledOrder, ringForSubmit.RawRing.Hash)
+
+				list = finder.market.reduceReceivedOfCandidateRing(list, filledOrder, isFullFilled)
+			}
+			ringSubmitInfos = append(ringSubmitInfos, ringForSubmit)
+		}
+	}
+
+	if len(ringSubmitInfos) > 0 {
+		eventemitter.Emit(eventemitter.Miner_NewRing, ringSubmitInfos)
+	}
+}
+
+func (finder *ringFinder) orderState(orderhash common.Hash) *types.OrderState {
+	market := finder.markets[orderhash]
+	if order, exists := market.AtoBOrders[orderhash]; exists {
+		return order
+	}
+	return market.BtoAOrders[orderhash]
+}
+
+// tokenCycles 找出长度为3到maxLength的token环路，环路从其中最小的token开始，避免同一环路重复出现
+func (finder *ringFinder) tokenCycles(maxLength int) [][]common.Address {
+	cycles := [][]common.Address{}
+
+	var walk func(path []common.Address)
+	walk = func(path []common.Address) {
+		start := path[0]
+		for next := range finder.edges[path[len(path)-1]] {
+			if next == start {
+				if len(path) >= 3 {
+					cycle := make([]common.Address, len(path))
+					copy(cycle, path)
+					cycles = append(cycles, cycle)
+				}
+				continue
+			}
+			if len(path) >= maxLength || bytes.Compare(next.Bytes(), start.Bytes()) <= 0 || containsToken(path, next) {
+				continue
+			}
+			walk(append(path, next))
+		}
+	}
+
+	for token := range finder.edges {
+		walk([]common.Address{token})
+	}
+	return cycles
+}
+
+// ordersOfCycle 在token环路的每条边上选择订单，与PriceValid相同，要求amountS的乘积不小于amountB的乘积。
+// 每条边上的订单按价格从高到低排列，后面的边都取最高价格仍不能成交时，不再继续尝试
+func (finder *ringFinder) ordersOfCycle(cycle []common.Address) [][]*types.OrderState {
+	edges := make([][]*orderEdge, len(cycle))
+	for idx, tokenS := range cycle {
+		edges[idx] = finder.edges[tokenS][cycle[(idx+1)%len(cycle)]]
+	}
+
+	//bestPrices[idx]为第idx条边及之后所有边最高价格的乘积
+	bestPrices := make([]*big.Rat, len(cycle)+1)
+	bestPrices[len(cycle)] = big.NewRat(int64(1), int64(1))
+	for idx := len(cycle) - 1; idx >= 0; idx-- {
+		bestPrices[idx] = new(big.Rat).Mul(bestPrices[idx+1], edges[idx][0].price)
+	}
+
+	one := big.NewRat(int64(1), int64(1))
+	rings := [][]*types.OrderState{}
+	orders := make([]*types.OrderState, len(cycle))
+
+	var choose func(idx int, price *big.Rat)
+	choose = func(idx int, price *big.Rat) {
+		if idx == len(cycle) {
+			if miner.PriceValidOfRing(orders...) {
+				ring := make([]*types.OrderState, len(orders))
+				copy(ring, orders)
+				rings = append(rings, ring)
+			}
+			return
+		}
+		for _, edge := range edges[idx] {
+			if len(rings) >= maxRingsPerTokenCycle {
+				return
+			}
+			nextPrice := new(big.Rat).Mul(price, edge.price)
+			if new(big.Rat).Mul(nextPrice, bestPrices[idx+1]).Cmp(one) < 0 {
+				break
+			}
+			orders[idx] = edge.order
+			choose(idx+1, nextPrice)
+		}
+	}
+	choose(0, one)
+
+	return rings
+}
+
+func containsToken(tokens []common.Address, token common.Address) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	tokenA = common.HexToAddress("0x01")
+	tokenB = common.HexToAddress("0x02")
+	tokenC = common.HexToAddress("0x03")
+	tokenD = common.HexToAddress("0x04")
+)
+
+var tokenNames = map[common.Address]string{tokenA: "A", tokenB: "B", tokenC: "C", tokenD: "D"}
+
+func newTestFinder() *ringFinder {
+	return &ringFinder{edges: make(map[common.Address]map[common.Address][]*orderEdge)}
+}
+
+// addTestOrder 与addOrders相同按tokenS->tokenB建边，不需要market
+func (finder *ringFinder) addTestOrder(tokenS, tokenB common.Address, amountS, amountB int64) *types.OrderState {
+	order := &types.OrderState{}
+	order.RawOrder.TokenS = tokenS
+	order.RawOrder.TokenB = tokenB
+	order.RawOrder.AmountS = big.NewInt(amountS)
+	order.RawOrder.AmountB = big.NewInt(amountB)
+	if _, exists := finder.edges[tokenS]; !exists {
+		finder.edges[tokenS] = make(map[common.Address][]*orderEdge)
+	}
+	edge := &orderEdge{order: order, price: big.NewRat(amountS, amountB)}
+	finder.edges[tokenS][tokenB] = append(finder.edges[tokenS][tokenB], edge)
+	return order
+}
+
+func cycleNames(cycles [][]common.Address) []string {
+	names := []string{}
+	for _, cycle := range cycles {
+		name := ""
+		for _, token := range cycle {
+			name += tokenNames[token]
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTokenCycles(t *testing.T) {
+	// A->B->C->A为3个token的环路，A<->B只有两个token，C->B->A与A->B->C方向相反
+	three := newTestFinder()
+	three.addTestOrder(tokenA, tokenB, 1, 1)
+	three.addTestOrder(tokenB, tokenA, 1, 1)
+	three.addTestOrder(tokenB, tokenC, 1, 1)
+	three.addTestOrder(tokenC, tokenA, 1, 1)
+	three.addTestOrder(tokenA, tokenC, 1, 1)
+
+	// 4个token的图中A->B->C->D->A、A->B->C->A以及A->B->D->A都是环路
+	four := newTestFinder()
+	four.addTestOrder(tokenA, tokenB, 1, 1)
+	four.addTestOrder(tokenB, tokenC, 1, 1)
+	four.addTestOrder(tokenC, tokenD, 1, 1)
+	four.addTestOrder(tokenD, tokenA, 1, 1)
+	four.addTestOrder(tokenC, tokenA, 1, 1)
+	four.addTestOrder(tokenB, tokenD, 1, 1)
+
+	cases := []struct {
+		name      string
+		finder    *ringFinder
+		maxLength int
+		want      []string
+	}{
+		{"three tokens", three, 3, []string{"ABC"}},
+		{"three tokens with max length 2", three, 2, []string{}},
+		{"four tokens with max length 3", four, 3, []string{"ABC", "ABD"}},
+		{"four tokens", four, 4, []string{"ABC", "ABCD", "ABD"}},
+		{"four tokens with max length 5", four, 5, []string{"ABC", "ABCD", "ABD"}},
+	}
+	for _, c := range cases {
+		got := cycleNames(c.finder.tokenCycles(c.maxLength))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %s, want %s", c.name, strings.Join(got, ","), strings.Join(c.want, ","))
+		}
+	}
+}
+
+func TestOrdersOfCycle(t *testing.T) {
+	three := newTestFinder()
+	ab1 := three.addTestOrder(tokenA, tokenB, 100, 100)
+	three.addTestOrder(tokenA, tokenB, 90, 100)
+	bc1 := three.addTestOrder(tokenB, tokenC, 100, 100)
+	three.addTestOrder(tokenC, tokenA, 100, 120)
+	ca1 := three.addTestOrder(tokenC, tokenA, 110, 100)
+	three.sortEdges()
+
+	// 4个token中乘积恰好为1的组合同样可以成交
+	four := newTestFinder()
+	ab := four.addTestOrder(tokenA, tokenB, 2, 1)
+	bc := four.addTestOrder(tokenB, tokenC, 1, 2)
+	four.addTestOrder(tokenB, tokenC, 1, 4)
+	cd := four.addTestOrder(tokenC, tokenD, 3, 2)
+	da1 := four.addTestOrder(tokenD, tokenA, 2, 3)
+	da2 := four.addTestOrder(tokenD, tokenA, 1, 1)
+	four.sortEdges()
+
+	// 没有任何组合可以成交
+	none := newTestFinder()
+	none.addTestOrder(tokenA, tokenB, 1, 2)
+	none.addTestOrder(tokenB, tokenC, 1, 1)
+	none.addTestOrder(tokenC, tokenA, 3, 2)
+	none.sortEdges()
+
+	cases := []struct {
+		name   string
+		finder *ringFinder
+		cycle  []common.Address
+		want   [][]*types.OrderState
+	}{
+		{"three tokens", three, []common.Address{tokenA, tokenB, tokenC}, [][]*types.OrderState{{ab1, bc1, ca1}}},
+		{"four tokens", four, []common.Address{tokenA, tokenB, tokenC, tokenD}, [][]*types.OrderState{{ab, bc, cd, da2}, {ab, bc, cd, da1}}},
+		{"unmatched", none, []common.Address{tokenA, tokenB, tokenC}, [][]*types.OrderState{}},
+	}
+	for _, c := range cases {
+		got := c.finder.ordersOfCycle(c.cycle)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %d rings, want %d", c.name, len(got), len(c.want))
+		}
+	}
+}
+
+func TestOrdersOfCycleLimit(t *testing.T) {
+	finder := newTestFinder()
+	for i := 0; i < maxOrdersPerTokenEdge+1; i++ {
+		finder.addTestOrder(tokenA, tokenB, 1, 1)
+		finder.addTestOrder(tokenB, tokenC, 1, 1)
+		finder.addTestOrder(tokenC, tokenA, 1, 1)
+	}
+	finder.sortEdges()
+
+	if count := len(finder.edges[tokenA][tokenB]); count != maxOrdersPerTokenEdge {
+		t.Errorf("orders of edge got %d, want %d", count, maxOrdersPerTokenEdge)
+	}
+	if count := len(finder.ordersOfCycle([]common.Address{tokenA, tokenB, tokenC})); count != maxRingsPerTokenCycle {
+		t.Errorf("rings of cycle got %d, want %d", count, maxRingsPerTokenCycle)
+	}
+}
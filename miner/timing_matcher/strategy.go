@@ -0,0 +1,74 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"errors"
+
+	"github.com/Loopring/relay/config"
+	marketLib "github.com/Loopring/relay/market"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/ordermanager"
+)
+
+const (
+	MatcherTiming       = "timing"        //每隔duration个区块撮合一次
+	MatcherEvent        = "event"         //收到新订单时立即在其所在市场撮合，同时保留定时撮合
+	MatcherBatchAuction = "batch_auction" //每轮在每个市场中以统一价格撮合所有可成交的订单
+)
+
+type matcherFactory func(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) (miner.Matcher, error)
+
+var matcherFactories = make(map[string]matcherFactory)
+
+// registerMatcher 注册撮合策略，名称即miner.matcher中配置的名称
+func registerMatcher(name string, factory matcherFactory) {
+	if _, exists := matcherFactories[name]; exists {
+		panic("miner,matcher " + name + " already registered")
+	}
+	matcherFactories[name] = factory
+}
+
+// NewMatcher 根据miner.matcher选择撮合策略，未配置时使用timing
+func NewMatcher(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) (miner.Matcher, error) {
+	name := options.Matcher
+	if name == "" {
+		name = MatcherTiming
+	}
+	factory, exists := matcherFactories[name]
+	if !exists {
+		return nil, errors.New("unknown matcher " + name)
+	}
+	if nil == options.TimingMatcher {
+		return nil, errors.New("miner.TimingMatcher must be setted")
+	}
+	return factory(options, submitter, evaluator, om, accountManager)
+}
+
+func init() {
+	registerMatcher(MatcherTiming, func(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) (miner.Matcher, error) {
+		return NewTimingMatcher(options.TimingMatcher, options.RingMaxLength, submitter, evaluator, om, accountManager), nil
+	})
+	registerMatcher(MatcherEvent, func(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) (miner.Matcher, error) {
+		return NewEventMatcher(options.TimingMatcher, options.RingMaxLength, submitter, evaluator, om, accountManager), nil
+	})
+	registerMatcher(MatcherBatchAuction, func(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, accountManager *marketLib.AccountManager) (miner.Matcher, error) {
+		return NewBatchAuctionMatcher(options.TimingMatcher, submitter, evaluator, om, accountManager), nil
+	})
+}
@@ -221,11 +221,23 @@ func (r *RoundStates) removeMinedRing(ringhash common.Hash) {
 }
 
 type CandidateRing struct {
+	ringhash     common.Hash
+	orderHashes  []common.Hash //环路中订单的顺序，多个订单成环时不能打乱
 	filledOrders map[common.Hash]*big.Rat
 	received     *big.Rat
 	cost         *big.Rat
 }
 
+func newCandidateRing(ringForSubmit *types.RingSubmitInfo) CandidateRing {
+	candidateRing := CandidateRing{ringhash: ringForSubmit.Ringhash, cost: ringForSubmit.LegalCost, received: ringForSubmit.Received, filledOrders: make(map[common.Hash]*big.Rat)}
+	for _, filledOrder := range ringForSubmit.RawRing.Orders {
+		log.Debugf("match, filledOrder.FilledAmountS:%s", filledOrder.FillAmountS.FloatString(3))
+		candidateRing.orderHashes = append(candidateRing.orderHashes, filledOrder.OrderState.RawOrder.Hash)
+		candidateRing.filledOrders[filledOrder.OrderState.RawOrder.Hash] = filledOrder.FillAmountS
+	}
+	return candidateRing
+}
+
 type CandidateRingList []CandidateRing
 
 func (ringList CandidateRingList) Len() int {
@@ -19,6 +19,8 @@
 package miner
 
 import (
+	"errors"
+	"fmt"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
@@ -34,11 +36,13 @@ type NormalMinerAddress struct {
 }
 
 type SplitMinerAddress struct {
-	Address    common.Address
-	FeePercent float64
-	StartFee   float64
+	Address       common.Address
+	FeePercent    float64
+	StartFee      float64
+	GasPriceLimit *big.Int
 
-	Nonce *big.Int
+	GasPriceStrategy GasPriceStrategy
+	Nonce            *big.Int
 }
 
 func NewRing(filledOrders []*types.FilledOrder) *types.Ring {
@@ -47,3 +51,47 @@ func NewRing(filledOrders []*types.FilledOrder) *types.Ring {
 	ring.Hash = ring.GenerateHash()
 	return ring
 }
+
+// OrderError 由某个订单导致无法组成环路，例如余额不足，撮合时可以只跳过该订单
+type OrderError struct {
+	Order *types.OrderState
+	Err   error
+}
+
+func (e *OrderError) Error() string {
+	return "order:" + e.Order.RawOrder.Hash.Hex() + " " + e.Err.Error()
+}
+
+// NewRingWithBalances 按照订单的顺序组成环路，可用余额以及LRC余额从matcher获取，撮合以及模拟环路使用相同的检查
+func NewRingWithBalances(matcher Matcher, lrcAddress common.Address, orders ...*types.OrderState) (*types.Ring, error) {
+	if len(orders) < 2 {
+		return nil, errors.New("ring must contain at least two orders")
+	}
+	protocolAddress := orders[0].RawOrder.Protocol
+
+	filledOrders := []*types.FilledOrder{}
+	for idx, order := range orders {
+		nextOrder := orders[(idx+1)%len(orders)]
+		if order.RawOrder.Protocol != protocolAddress {
+			return nil, fmt.Errorf("protocol of order:%s is different from the first order", order.RawOrder.Hash.Hex())
+		}
+		if order.RawOrder.TokenB != nextOrder.RawOrder.TokenS {
+			return nil, fmt.Errorf("tokenB of order:%s isn't the tokenS of order:%s", order.RawOrder.Hash.Hex(), nextOrder.RawOrder.Hash.Hex())
+		}
+
+		//miner will received nothing, if miner set FeeSelection=1 and he doesn't have enough lrc
+		lrcTokenBalance, err := matcher.GetAccountAvailableAmount(order.RawOrder.Owner, lrcAddress)
+		if nil != err {
+			return nil, &OrderError{Order: order, Err: err}
+		}
+		tokenSBalance, err := matcher.GetAccountAvailableAmount(order.RawOrder.Owner, order.RawOrder.TokenS)
+		if nil != err {
+			return nil, &OrderError{Order: order, Err: err}
+		}
+		if tokenSBalance.Sign() <= 0 {
+			return nil, &OrderError{Order: order, Err: fmt.Errorf("owner:%s token:%s balance or allowance is zero", order.RawOrder.Owner.Hex(), order.RawOrder.TokenS.Hex())}
+		}
+		filledOrders = append(filledOrders, types.ConvertOrderStateToFilledOrder(*order, lrcTokenBalance, tokenSBalance))
+	}
+	return NewRing(filledOrders), nil
+}
@@ -19,7 +19,6 @@
 package node
 
 import (
-	"strconv"
 	"sync"
 
 	"github.com/Loopring/relay/config"
@@ -63,16 +62,15 @@ type Node struct {
 
 type RelayNode struct {
 	trendManager   market.TrendManager
-	jsonRpcService gateway.JsonrpcServiceImpl
+	jsonRpcService *gateway.JsonrpcServiceImpl
 }
 
 func (n *RelayNode) Start() {
-	//gateway.NewJsonrpcService("8080").Start()
 	n.jsonRpcService.Start()
 }
 
 func (n *RelayNode) Stop() {
-	//
+	n.jsonRpcService.Stop()
 }
 
 type MineNode struct {
@@ -187,7 +185,12 @@ func (n *Node) Wait() {
 
 func (n *Node) Stop() {
 	n.lock.RLock()
-	n.mineNode.Stop()
+	if nil != n.relayNode {
+		n.relayNode.Stop()
+	}
+	if nil != n.mineNode {
+		n.mineNode.Stop()
+	}
 	//
 	//n.p2pListener.Stop()
 	//n.chainListener.Stop()
@@ -239,19 +242,25 @@ func (n *Node) registerAccountManager() {
 
 func (n *Node) registerJsonRpcService() {
 	ethForwarder := gateway.EthForwarder{Accessor: *n.accessor}
-	n.relayNode.jsonRpcService = *gateway.NewJsonrpcService(strconv.Itoa(n.globalConfig.Jsonrpc.Port), n.relayNode.trendManager, n.orderManager, n.accountManager, &ethForwarder, n.marketCapProvider)
+	n.relayNode.jsonRpcService = gateway.NewJsonrpcService(&n.globalConfig.Jsonrpc, n.relayNode.trendManager, n.orderManager, n.accountManager, &ethForwarder, n.marketCapProvider)
+	if nil != n.mineNode {
+		n.relayNode.jsonRpcService.SetMiner(n.mineNode.miner)
+	}
 }
 
 func (n *Node) registerMiner() {
 	submitter := miner.NewSubmitter(n.globalConfig.Miner, n.accessor, n.rdsService, n.marketCapProvider)
 	evaluator := miner.NewEvaluator(n.marketCapProvider, n.globalConfig.Miner.RateRatioCVSThreshold, n.accessor)
-	matcher := timing_matcher.NewTimingMatcher(n.globalConfig.Miner.TimingMatcher, submitter, evaluator, n.orderManager, &n.accountManager)
+	matcher, err := timing_matcher.NewMatcher(n.globalConfig.Miner, submitter, evaluator, n.orderManager, &n.accountManager)
+	if nil != err {
+		log.Fatalf("miner,init matcher error:%s", err.Error())
+	}
 	submitter.SetMatcher(matcher)
 	n.mineNode.miner = miner.NewMiner(submitter, matcher, evaluator, n.accessor, n.marketCapProvider)
 }
 
 func (n *Node) registerGateway() {
-	gateway.Initialize(&n.globalConfig.GatewayFilters, &n.globalConfig.Gateway, &n.globalConfig.Ipfs, n.orderManager)
+	gateway.Initialize(&n.globalConfig.GatewayFilters, &n.globalConfig.Gateway, &n.globalConfig.Ipfs, n.orderManager, n.marketCapProvider)
 }
 
 func (n *Node) registerUserManager() {
@@ -26,6 +26,7 @@ import (
 	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/types"
 	"math/big"
+	"time"
 )
 
 var dustOrderValue int64
@@ -76,6 +77,13 @@ func settleOrderStatus(state *types.OrderState, mc marketcap.MarketCapProvider)
 	}
 }
 
+// settleExpiredStatus 过期订单在成交或者取消后，如果未完全成交仍然保持ORDER_EXPIRED
+func settleExpiredStatus(state *types.OrderState) {
+	if state.Status != types.ORDER_FINISHED && state.RawOrder.IsExpired(time.Now().Unix()) {
+		state.Status = types.ORDER_EXPIRED
+	}
+}
+
 func isOrderFullFinished(state *types.OrderState, mc marketcap.MarketCapProvider) bool {
 	var valueOfRemainAmount *big.Rat
 
@@ -51,6 +51,9 @@ func (p *forkProcessor) fork(event *types.ForkedEvent) error {
 	if err := p.dao.RollBackRingMined(from, to); err != nil {
 		log.Errorf("order manager fork error:%s", err.Error())
 	}
+	if err := p.dao.RollBackRingSubmitInfoMined(from, to); err != nil {
+		log.Errorf("order manager fork error:%s", err.Error())
+	}
 	if err := p.dao.RollBackFill(from, to); err != nil {
 		log.Errorf("order manager fork error:%s", err.Error())
 	}
@@ -0,0 +1,319 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"errors"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+type orderBookKey struct {
+	protocol common.Address
+	tokenS   common.Address
+	tokenB   common.Address
+}
+
+type orderBookEntry struct {
+	model dao.Order
+	state *types.OrderState
+	price *big.Rat // amountS/amountB，值越大对撮合方越有利
+}
+
+func (e *orderBookEntry) key() orderBookKey {
+	return orderBookKey{protocol: e.state.RawOrder.Protocol, tokenS: e.state.RawOrder.TokenS, tokenB: e.state.RawOrder.TokenB}
+}
+
+// valid 与数据库查询的条件一致，valid_time < now < valid_time + ttl
+func (e *orderBookEntry) valid(now int64) bool {
+	return e.model.ValidTime < now && e.model.ValidTime+e.model.Ttl > now
+}
+
+func (e *orderBookEntry) expired(now int64) bool {
+	return e.model.ValidTime+e.model.Ttl <= now
+}
+
+// before 价格从优到差，价格相同时按照id排序
+func (e *orderBookEntry) before(other *orderBookEntry) bool {
+	if c := e.price.Cmp(other.price); c != 0 {
+		return c > 0
+	}
+	return e.model.ID < other.model.ID
+}
+
+func newOrderBookEntry(model *dao.Order) (*orderBookEntry, error) {
+	state := &types.OrderState{}
+	if err := model.ConvertUp(state); err != nil {
+		return nil, err
+	}
+	if state.RawOrder.AmountS == nil || state.RawOrder.AmountB == nil || state.RawOrder.AmountS.Sign() <= 0 || state.RawOrder.AmountB.Sign() <= 0 {
+		return nil, errors.New("order manager,order " + model.OrderHash + " amount is invalid")
+	}
+
+	entry := &orderBookEntry{model: *model, state: state}
+	entry.price = new(big.Rat).SetFrac(state.RawOrder.AmountS, state.RawOrder.AmountB)
+	return entry, nil
+}
+
+func isOpenStatus(status types.OrderStatus) bool {
+	return status == types.ORDER_NEW || status == types.ORDER_PARTIAL
+}
+
+// orderBook 在内存中按照protocol以及交易对保存可以撮合的订单，
+// 订单事件先写入数据库再更新orderBook，version在每次修改后递增
+type orderBook struct {
+	mtx     sync.RWMutex
+	sides   map[orderBookKey][]*orderBookEntry
+	entries map[common.Hash]*orderBookEntry
+	version uint64
+}
+
+func newOrderBook() *orderBook {
+	b := &orderBook{}
+	b.sides = make(map[orderBookKey][]*orderBookEntry)
+	b.entries = make(map[common.Hash]*orderBookEntry)
+	return b
+}
+
+func (b *orderBook) currentVersion() uint64 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.version
+}
+
+// load 使用数据库中的订单替换orderBook的全部内容
+func (b *orderBook) load(models []dao.Order) {
+	sides, entries := buildOrderBook(models)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.sides, b.entries = sides, entries
+	b.version++
+}
+
+// reload 读取数据库之后没有新的事件时才替换，否则等待下一次检查
+func (b *orderBook) reload(models []dao.Order, version uint64) bool {
+	sides, entries := buildOrderBook(models)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.version != version {
+		return false
+	}
+	b.sides, b.entries = sides, entries
+	b.version++
+	return true
+}
+
+func buildOrderBook(models []dao.Order) (map[orderBookKey][]*orderBookEntry, map[common.Hash]*orderBookEntry) {
+	sides := make(map[orderBookKey][]*orderBookEntry)
+	entries := make(map[common.Hash]*orderBookEntry)
+	for i := range models {
+		if !isOpenStatus(types.OrderStatus(models[i].Status)) {
+			continue
+		}
+		entry, err := newOrderBookEntry(&models[i])
+		if err != nil {
+			log.Errorf("order manager,load order %s to orderbook error:%s", models[i].OrderHash, err.Error())
+			continue
+		}
+		key := entry.key()
+		sides[key] = append(sides[key], entry)
+		entries[entry.state.RawOrder.Hash] = entry
+	}
+	for _, side := range sides {
+		sort.Slice(side, func(i, j int) bool { return side[i].before(side[j]) })
+	}
+	return sides, entries
+}
+
+// update 订单未完成时更新或者加入orderBook，否则删除
+func (b *orderBook) update(model *dao.Order) {
+	var entry *orderBookEntry
+	if isOpenStatus(types.OrderStatus(model.Status)) {
+		var err error
+		if entry, err = newOrderBookEntry(model); err != nil {
+			log.Errorf("order manager,update orderbook error:%s", err.Error())
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.removeLocked(common.HexToHash(model.OrderHash))
+	if nil != entry {
+		b.insertLocked(entry)
+	}
+	b.version++
+}
+
+// removeCutoff 与dao.SetCutOff一致，owner在cutoff之前的订单都不再可以撮合
+func (b *orderBook) removeCutoff(owner common.Address, cutoff int64) {
+	b.removeIf(func(entry *orderBookEntry) bool {
+		return entry.state.RawOrder.Owner == owner && entry.model.ValidTime < cutoff
+	})
+}
+
+func (b *orderBook) removeExpired(now int64) {
+	b.removeIf(func(entry *orderBookEntry) bool {
+		return entry.expired(now)
+	})
+}
+
+func (b *orderBook) removeIf(match func(entry *orderBookEntry) bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for hash, entry := range b.entries {
+		if match(entry) {
+			b.removeLocked(hash)
+		}
+	}
+	b.version++
+}
+
+func (b *orderBook) markMiner(hashes []common.Hash, blockNumber int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, hash := range hashes {
+		if entry, exists := b.entries[hash]; exists {
+			entry.model.MinerBlockMark = blockNumber
+		}
+	}
+	b.version++
+}
+
+func (b *orderBook) removeLocked(hash common.Hash) {
+	entry, exists := b.entries[hash]
+	if !exists {
+		return
+	}
+	delete(b.entries, hash)
+
+	key := entry.key()
+	side := b.sides[key]
+	for i, v := range side {
+		if v == entry {
+			side = append(side[:i], side[i+1:]...)
+			break
+		}
+	}
+	if len(side) == 0 {
+		delete(b.sides, key)
+	} else {
+		b.sides[key] = side
+	}
+}
+
+func (b *orderBook) insertLocked(entry *orderBookEntry) {
+	key := entry.key()
+	side := b.sides[key]
+	i := sort.Search(len(side), func(i int) bool { return entry.before(side[i]) })
+	side = append(side, nil)
+	copy(side[i+1:], side[i:])
+	side[i] = entry
+	b.sides[key] = side
+	b.entries[entry.state.RawOrder.Hash] = entry
+}
+
+// orders 按照价格从优到差返回当前有效的订单，跳过前offset个，filter为nil时不过滤
+func (b *orderBook) orders(key orderBookKey, offset, length int, filter func(entry *orderBookEntry) bool) []*types.OrderState {
+	var list []*types.OrderState
+	now := time.Now().Unix()
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for _, entry := range b.sides[key] {
+		if len(list) >= length {
+			break
+		}
+		if !entry.valid(now) || (nil != filter && !filter(entry)) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		list = append(list, cloneOrderState(entry.state))
+	}
+	return list
+}
+
+// diff 与数据库中未完成的订单比较，返回不一致的订单数量，内存中已经过期的订单不计算在内
+func (b *orderBook) diff(models []dao.Order) int {
+	now := time.Now().Unix()
+	count := 0
+	hashes := make(map[common.Hash]bool)
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for i := range models {
+		model := &models[i]
+		if !isOpenStatus(types.OrderStatus(model.Status)) {
+			continue
+		}
+		hash := common.HexToHash(model.OrderHash)
+		hashes[hash] = true
+		entry, exists := b.entries[hash]
+		if !exists || !sameOrderState(&entry.model, model) {
+			count++
+		}
+	}
+	for hash, entry := range b.entries {
+		if !hashes[hash] && !entry.expired(now) {
+			count++
+		}
+	}
+	return count
+}
+
+func sameOrderState(a, b *dao.Order) bool {
+	return a.Status == b.Status &&
+		a.DealtAmountS == b.DealtAmountS &&
+		a.DealtAmountB == b.DealtAmountB &&
+		a.SplitAmountS == b.SplitAmountS &&
+		a.SplitAmountB == b.SplitAmountB &&
+		a.CancelledAmountS == b.CancelledAmountS &&
+		a.CancelledAmountB == b.CancelledAmountB &&
+		a.MinerBlockMark == b.MinerBlockMark
+}
+
+// cloneOrderState miner会直接修改返回的成交数量，不能共享内存中的big.Int
+func cloneOrderState(src *types.OrderState) *types.OrderState {
+	dst := *src
+	dst.DealtAmountS = cloneBigInt(src.DealtAmountS)
+	dst.DealtAmountB = cloneBigInt(src.DealtAmountB)
+	dst.SplitAmountS = cloneBigInt(src.SplitAmountS)
+	dst.SplitAmountB = cloneBigInt(src.SplitAmountB)
+	dst.CancelledAmountS = cloneBigInt(src.CancelledAmountS)
+	dst.CancelledAmountB = cloneBigInt(src.CancelledAmountB)
+	dst.UpdatedBlock = cloneBigInt(src.UpdatedBlock)
+	return &dst
+}
+
+func cloneBigInt(v *big.Int) *big.Int {
+	if nil == v {
+		return nil
+	}
+	return new(big.Int).Set(v)
+}
@@ -0,0 +1,259 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var (
+	testProtocol = common.HexToAddress("0x03e0f73a93993e5101362656af1162eb8d2d00d9")
+	testTokenS   = common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	testTokenB   = common.HexToAddress("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2")
+	testOwnerA   = common.HexToAddress("0x8888f1f195afa192cfee860698584c030f4c9db1")
+	testOwnerB   = common.HexToAddress("0x750ad4351bb728cec7d639a9511f9d6488f1e259")
+	testBookKey  = orderBookKey{protocol: testProtocol, tokenS: testTokenS, tokenB: testTokenB}
+)
+
+func init() {
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+}
+
+// testOrderModel 当前有效的订单，价格为amountS/amountB
+func testOrderModel(id int, owner common.Address, amountS, amountB int64) dao.Order {
+	order := types.Order{}
+	order.Protocol = testProtocol
+	order.Owner = owner
+	order.TokenS = testTokenS
+	order.TokenB = testTokenB
+	order.AmountS = big.NewInt(amountS)
+	order.AmountB = big.NewInt(amountB)
+	order.Timestamp = big.NewInt(time.Now().Unix() - 60)
+	order.Ttl = big.NewInt(3600)
+	order.Salt = big.NewInt(int64(id))
+	order.LrcFee = big.NewInt(0)
+	order.Price = new(big.Rat).SetFrac(order.AmountB, order.AmountS)
+	order.Hash = order.GenerateHash()
+
+	state := types.OrderState{RawOrder: order, Status: types.ORDER_NEW}
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.SplitAmountS = big.NewInt(0)
+	state.SplitAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+
+	model := dao.Order{}
+	if err := model.ConvertDown(&state); err != nil {
+		panic(err)
+	}
+	model.ID = id
+	return model
+}
+
+// withValidTime 修改有效期之后需要重新计算hash
+func withValidTime(model dao.Order, validTime, ttl int64) dao.Order {
+	state := &types.OrderState{}
+	if err := model.ConvertUp(state); err != nil {
+		panic(err)
+	}
+	state.RawOrder.Timestamp = big.NewInt(validTime)
+	state.RawOrder.Ttl = big.NewInt(ttl)
+	state.RawOrder.Hash = state.RawOrder.GenerateHash()
+
+	res := model
+	res.ValidTime = validTime
+	res.Ttl = ttl
+	res.OrderHash = state.RawOrder.Hash.Hex()
+	return res
+}
+
+func bookIDs(b *orderBook, key orderBookKey) []int {
+	var ids []int
+	for _, entry := range b.sides[key] {
+		ids = append(ids, entry.model.ID)
+	}
+	return ids
+}
+
+func stateIDs(book *orderBook, states []*types.OrderState) []int {
+	var ids []int
+	for _, state := range states {
+		ids = append(ids, book.entries[state.RawOrder.Hash].model.ID)
+	}
+	return ids
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOrderBookInsertRemove(t *testing.T) {
+	book := newOrderBook()
+	models := []dao.Order{
+		testOrderModel(1, testOwnerA, 100, 10),
+		testOrderModel(2, testOwnerA, 300, 10),
+		testOrderModel(3, testOwnerB, 100, 10),
+		testOrderModel(4, testOwnerB, 200, 10),
+		testOrderModel(5, testOwnerA, 50, 10),
+	}
+	for i := range models {
+		entry, err := newOrderBookEntry(&models[i])
+		if err != nil {
+			t.Fatalf("new entry error:%s", err.Error())
+		}
+		book.insertLocked(entry)
+	}
+
+	// 价格从高到低，价格相同时id小的在前
+	if ids := bookIDs(book, testBookKey); !sameIDs(ids, []int{2, 4, 1, 3, 5}) {
+		t.Fatalf("orderbook side %v after insert", ids)
+	}
+	if len(book.entries) != 5 {
+		t.Fatalf("orderbook has %d entries, expect 5", len(book.entries))
+	}
+
+	book.removeLocked(common.HexToHash(models[0].OrderHash))
+	book.removeLocked(common.HexToHash(models[0].OrderHash))
+	book.removeLocked(common.HexToHash("0x1234"))
+	if ids := bookIDs(book, testBookKey); !sameIDs(ids, []int{2, 4, 3, 5}) {
+		t.Errorf("orderbook side %v after remove", ids)
+	}
+	if _, exists := book.entries[common.HexToHash(models[0].OrderHash)]; exists || len(book.entries) != 4 {
+		t.Errorf("removed order is still in entries")
+	}
+
+	for _, model := range models[1:] {
+		book.removeLocked(common.HexToHash(model.OrderHash))
+	}
+	if _, exists := book.sides[testBookKey]; exists || len(book.entries) != 0 {
+		t.Errorf("empty side should be deleted")
+	}
+}
+
+func TestOrderBookOrders(t *testing.T) {
+	now := time.Now().Unix()
+	book := newOrderBook()
+	book.load([]dao.Order{
+		testOrderModel(1, testOwnerA, 500, 10),
+		withValidTime(testOrderModel(2, testOwnerA, 400, 10), now-7200, 3600), // 已经过期
+		testOrderModel(3, testOwnerB, 300, 10),
+		withValidTime(testOrderModel(4, testOwnerB, 250, 10), now+600, 3600), // 还未生效
+		testOrderModel(5, testOwnerA, 200, 10),
+		testOrderModel(6, testOwnerB, 100, 10),
+	})
+
+	tests := []struct {
+		offset, length int
+		filter         func(entry *orderBookEntry) bool
+		expect         []int
+	}{
+		{offset: 0, length: 10, expect: []int{1, 3, 5, 6}},
+		{offset: 0, length: 2, expect: []int{1, 3}},
+		{offset: 1, length: 2, expect: []int{3, 5}},
+		{offset: 3, length: 2, expect: []int{6}},
+		{offset: 4, length: 2, expect: nil},
+		{
+			offset: 1, length: 10,
+			filter: func(entry *orderBookEntry) bool { return entry.state.RawOrder.Owner == testOwnerB },
+			expect: []int{6},
+		},
+		{
+			offset: 0, length: 1,
+			filter: func(entry *orderBookEntry) bool { return entry.state.RawOrder.Owner == testOwnerA },
+			expect: []int{1},
+		},
+	}
+
+	for i, test := range tests {
+		states := book.orders(testBookKey, test.offset, test.length, test.filter)
+		if ids := stateIDs(book, states); !sameIDs(ids, test.expect) {
+			t.Errorf("case %d: orders %v, expect %v", i, ids, test.expect)
+		}
+	}
+
+	// 返回的订单不能与orderbook共享成交数量
+	states := book.orders(testBookKey, 0, 1, nil)
+	states[0].DealtAmountS.SetInt64(100)
+	if book.entries[states[0].RawOrder.Hash].state.DealtAmountS.Sign() != 0 {
+		t.Errorf("orders should return copies of the order state")
+	}
+}
+
+func TestOrderBookDiff(t *testing.T) {
+	now := time.Now().Unix()
+	models := []dao.Order{
+		testOrderModel(1, testOwnerA, 500, 10),
+		testOrderModel(2, testOwnerB, 400, 10),
+		testOrderModel(3, testOwnerA, 300, 10),
+	}
+	book := newOrderBook()
+	book.load(models)
+
+	if count := book.diff(models); count != 0 {
+		t.Errorf("diff of the same orders is %d", count)
+	}
+
+	// 数据库中的成交数量变化
+	changed := append([]dao.Order{}, models...)
+	changed[0].DealtAmountS = "100"
+	if count := book.diff(changed); count != 1 {
+		t.Errorf("diff with changed dealt amount is %d, expect 1", count)
+	}
+
+	// 数据库中已经完成的订单不计算在内，内存中的订单在数据库中不存在
+	finished := append([]dao.Order{}, models...)
+	finished[1].Status = uint8(types.ORDER_FINISHED)
+	if count := book.diff(finished); count != 1 {
+		t.Errorf("diff with finished order is %d, expect 1", count)
+	}
+
+	// 数据库中多出的订单
+	added := append(append([]dao.Order{}, models...), testOrderModel(4, testOwnerB, 200, 10))
+	if count := book.diff(added); count != 1 {
+		t.Errorf("diff with added order is %d, expect 1", count)
+	}
+
+	// 内存中已经过期的订单不在数据库中时不算作不一致
+	expired := withValidTime(testOrderModel(5, testOwnerB, 100, 10), now-7200, 3600)
+	book.load(append(append([]dao.Order{}, models...), expired))
+	if count := book.diff(models); count != 0 {
+		t.Errorf("diff with expired order in memory is %d, expect 0", count)
+	}
+
+	// markMiner之后与数据库中的miner_block_mark不一致
+	book.markMiner([]common.Hash{common.HexToHash(models[2].OrderHash)}, 100)
+	if count := book.diff(models); count != 1 {
+		t.Errorf("diff after markMiner is %d, expect 1", count)
+	}
+}
@@ -30,22 +30,28 @@ import (
 	"github.com/Loopring/relay/usermanager"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
+	"time"
 )
 
 type OrderManager interface {
 	Start()
 	Stop()
 	MinerOrders(protocol, tokenS, tokenB common.Address, length int, startBlockNumber, endBlockNumber int64, filterOrderHashLists ...*types.OrderDelayList) []*types.OrderState
-	GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]types.OrderState, error)
-	GetOrders(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
+	GetOrderBook(protocol, tokenS, tokenB common.Address, offset, length int) ([]types.OrderState, error)
+	GetOrders(query map[string]interface{}, options *dao.OrderQueryOptions, pageIndex, pageSize int) (dao.PageResult, error)
 	GetOrderByHash(hash common.Hash) (*types.OrderState, error)
+	GetOrdersByHashes(hashes []common.Hash) (map[common.Hash]*types.OrderState, error)
 	UpdateBroadcastTimeByHash(hash common.Hash, bt int) error
 	FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
+	GetTradeHistory(query TradeHistoryQuery, pageIndex, pageSize int) (dao.PageResult, error)
 	RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
+	RingSubmitInfoPageQuery(query map[string]interface{}, statusSet []types.RingSubmitStatus, start, end int64, pageIndex, pageSize int) (dao.PageResult, error)
+	RingSubmitInfosWithUsedGas(protocol string, start, end int64) ([]dao.RingSubmitInfo, error)
 	IsOrderCutoff(protocol, owner common.Address, createTime *big.Int) bool
 	IsOrderFullFinished(state *types.OrderState) bool
 	GetFrozenAmount(owner common.Address, token common.Address, statusSet []types.OrderStatus) (*big.Int, error)
 	GetFrozenLRCFee(owner common.Address, statusSet []types.OrderStatus) (*big.Int, error)
+	GetOpenOrderCount(owner common.Address) (int, error)
 }
 
 type OrderManagerImpl struct {
@@ -63,6 +69,8 @@ type OrderManagerImpl struct {
 	cutoffOrderWatcher *eventemitter.Watcher
 	forkWatcher        *eventemitter.Watcher
 	forkComplete       bool
+	book               *orderBook
+	stopChan           chan bool
 }
 
 func NewOrderManager(
@@ -82,6 +90,8 @@ func NewOrderManager(
 	om.cutoffCache = NewCutoffCache(rds, options.CutoffCacheExpireTime, options.CutoffCacheCleanTime)
 	om.accessor = accessor
 	om.forkComplete = true
+	om.book = newOrderBook()
+	om.stopChan = make(chan bool)
 
 	dustOrderValue = om.options.DustOrderValue
 
@@ -90,6 +100,8 @@ func NewOrderManager(
 
 // Start start orderbook as a service
 func (om *OrderManagerImpl) Start() {
+	om.loadOrderBook()
+
 	om.newOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleGatewayOrder}
 	om.ringMinedWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleRingMined}
 	om.fillOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleOrderFilled}
@@ -103,6 +115,9 @@ func (om *OrderManagerImpl) Start() {
 	eventemitter.On(eventemitter.OrderManagerExtractorCancel, om.cancelOrderWatcher)
 	eventemitter.On(eventemitter.OrderManagerExtractorCutoff, om.cutoffOrderWatcher)
 	eventemitter.On(eventemitter.ChainForkProcess, om.forkWatcher)
+
+	go om.sweepExpiredOrders()
+	go om.checkOrderBook()
 }
 
 func (om *OrderManagerImpl) Stop() {
@@ -112,15 +127,94 @@ func (om *OrderManagerImpl) Stop() {
 	eventemitter.Un(eventemitter.OrderManagerExtractorCancel, om.cancelOrderWatcher)
 	eventemitter.Un(eventemitter.OrderManagerExtractorCutoff, om.cutoffOrderWatcher)
 	eventemitter.Un(eventemitter.ChainForkProcess, om.forkWatcher)
+
+	close(om.stopChan)
+}
+
+// sweepExpiredOrders 定时将过期订单的状态更新为ORDER_EXPIRED，
+// 订单的查询虽然已经按照有效期过滤，但是状态仍然是ORDER_NEW或ORDER_PARTIAL
+func (om *OrderManagerImpl) sweepExpiredOrders() {
+	interval := om.options.ExpireSweepInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// 分叉处理过程中订单的状态会被回滚，等待处理完成后再更新
+			if !om.forkComplete {
+				continue
+			}
+			now := time.Now().Unix()
+			if count, err := om.rds.SetExpired(now); err != nil {
+				log.Errorf("order manager,sweep expired orders error:%s", err.Error())
+			} else if count > 0 {
+				log.Debugf("order manager,sweep expired orders,count:%d", count)
+			}
+			om.book.removeExpired(now)
+		case <-om.stopChan:
+			return
+		}
+	}
+}
+
+func (om *OrderManagerImpl) loadOrderBook() {
+	models, err := om.rds.GetOpenOrders(time.Now().Unix())
+	if err != nil {
+		log.Errorf("order manager,load orderbook error:%s", err.Error())
+		return
+	}
+	om.book.load(models)
+	log.Infof("order manager,load orderbook,order count:%d", len(models))
+}
+
+// checkOrderBook 定时与数据库比较，不一致时使用数据库中的订单重建orderbook
+func (om *OrderManagerImpl) checkOrderBook() {
+	interval := om.options.BookCheckInterval
+	if interval <= 0 {
+		interval = 300
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !om.forkComplete {
+				continue
+			}
+			version := om.book.currentVersion()
+			models, err := om.rds.GetOpenOrders(time.Now().Unix())
+			if err != nil {
+				log.Errorf("order manager,check orderbook error:%s", err.Error())
+				continue
+			}
+			if count := om.book.diff(models); count > 0 {
+				reloaded := om.book.reload(models, version)
+				log.Warnf("order manager,orderbook is inconsistent with database,count:%d reloaded:%t", count, reloaded)
+			}
+		case <-om.stopChan:
+			return
+		}
+	}
 }
 
 func (om *OrderManagerImpl) handleFork(input eventemitter.EventData) error {
+	event := input.(*types.ForkedEvent)
 	om.forkComplete = false
-	if err := om.processor.fork(input.(*types.ForkedEvent)); err != nil {
+	if err := om.processor.fork(event); err != nil {
 		log.Errorf("order manager,handle fork error:%s", err.Error())
 	}
+	// 分叉会回滚多个订单的成交以及取消，直接重新加载
+	om.loadOrderBook()
 
 	om.forkComplete = true
+
+	// 分叉区块之后的fill已经删除，依赖fill的统计可以重新计算
+	eventemitter.Emit(eventemitter.OrderManagerFork, event)
 	return nil
 }
 
@@ -134,7 +228,14 @@ func (om *OrderManagerImpl) handleGatewayOrder(input eventemitter.EventData) err
 		return err
 	}
 
-	return om.rds.Add(model)
+	if err := om.rds.Add(model); err != nil {
+		return err
+	}
+	om.book.update(model)
+
+	// 订单已经保存，通知miner撮合
+	eventemitter.Emit(eventemitter.Miner_NewOrderState, state)
+	return nil
 }
 
 func (om *OrderManagerImpl) handleRingMined(input eventemitter.EventData) error {
@@ -175,6 +276,12 @@ func (om *OrderManagerImpl) handleOrderFilled(input eventemitter.EventData) erro
 		log.Debugf("order manager,handle order filled event error:order %s convert down failed", event.OrderHash.Hex())
 		return err
 	}
+	// 记录成交时的法币价值，用于之后的对账
+	if legalValue, err := om.mc.LegalCurrencyValue(event.TokenS, new(big.Rat).SetInt(event.AmountS)); err != nil {
+		log.Debugf("order manager,handle order filled event,order %s get legal value error:%s", event.OrderHash.Hex(), err.Error())
+	} else {
+		newFillModel.LegalValue = legalValue.FloatString(8)
+	}
 	if err := om.rds.Add(newFillModel); err != nil {
 		log.Debugf("order manager,handle order filled event error:order %s insert faild", event.OrderHash.Hex())
 		return err
@@ -207,6 +314,7 @@ func (om *OrderManagerImpl) handleOrderFilled(input eventemitter.EventData) erro
 
 	// update order status
 	settleOrderStatus(state, om.mc)
+	settleExpiredStatus(state)
 
 	// update rds.Order
 	if err := model.ConvertDown(state); err != nil {
@@ -216,6 +324,7 @@ func (om *OrderManagerImpl) handleOrderFilled(input eventemitter.EventData) erro
 	if err := om.rds.UpdateOrderWhileFill(state.RawOrder.Hash, state.Status, state.DealtAmountS, state.DealtAmountB, state.SplitAmountS, state.SplitAmountB, state.UpdatedBlock); err != nil {
 		return err
 	}
+	om.book.update(model)
 
 	return nil
 }
@@ -258,6 +367,7 @@ func (om *OrderManagerImpl) handleOrderCancelled(input eventemitter.EventData) e
 
 	// update order status
 	settleOrderStatus(state, om.mc)
+	settleExpiredStatus(state)
 	state.UpdatedBlock = event.Blocknumber
 
 	// update rds.Order
@@ -267,6 +377,7 @@ func (om *OrderManagerImpl) handleOrderCancelled(input eventemitter.EventData) e
 	if err := om.rds.UpdateOrderWhileCancel(state.RawOrder.Hash, state.Status, state.CancelledAmountS, state.CancelledAmountB, state.UpdatedBlock); err != nil {
 		return err
 	}
+	om.book.update(model)
 
 	return nil
 }
@@ -293,7 +404,14 @@ func (om *OrderManagerImpl) handleOrderCutoff(input eventemitter.EventData) erro
 		return fmt.Errorf("order manager,handle cutoff error: cutoffCache add or del failed")
 	}
 
-	om.rds.SetCutOff(owner, currentCutoff)
+	orderHashes, err := om.rds.SetCutOff(owner, currentCutoff)
+	if err != nil {
+		return fmt.Errorf("order manager,handle cutoff error:%s", err.Error())
+	}
+	om.book.removeCutoff(owner, currentCutoff.Int64())
+	if len(orderHashes) > 0 {
+		eventemitter.Emit(eventemitter.OrderManagerOrdersCutoff, &types.OrdersCutoffEvent{Owner: owner, Cutoff: currentCutoff, OrderHashes: orderHashes})
+	}
 	log.Debugf("order manager,handle cutoff event, owner:%s, cutoffTimestamp:%s", event.Owner.Hex(), event.Cutoff.String())
 	return nil
 }
@@ -303,12 +421,7 @@ func (om *OrderManagerImpl) IsOrderFullFinished(state *types.OrderState) bool {
 }
 
 func (om *OrderManagerImpl) MinerOrders(protocol, tokenS, tokenB common.Address, length int, startBlockNumber, endBlockNumber int64, filterOrderHashLists ...*types.OrderDelayList) []*types.OrderState {
-	var (
-		list         []*types.OrderState
-		modelList    []*dao.Order
-		err          error
-		filterStatus = []types.OrderStatus{types.ORDER_FINISHED, types.ORDER_CUTOFF, types.ORDER_CANCEL}
-	)
+	var list []*types.OrderState
 
 	// 如果正在分叉，则不提供任何订单
 	if om.forkComplete == false {
@@ -321,20 +434,21 @@ func (om *OrderManagerImpl) MinerOrders(protocol, tokenS, tokenB common.Address,
 			orderHashes = append(orderHashes, hash.Hex())
 		}
 		if len(orderHashes) > 0 && orderDelay.DelayedCount != 0 {
-			if err = om.rds.MarkMinerOrders(orderHashes, orderDelay.DelayedCount); err != nil {
+			if err := om.rds.MarkMinerOrders(orderHashes, orderDelay.DelayedCount); err != nil {
 				log.Debugf("order manager,provide orders for miner error:%s", err.Error())
+			} else {
+				om.book.markMiner(orderDelay.OrderHash, orderDelay.DelayedCount)
 			}
 		}
 	}
 
-	// 从数据库获取订单
-	if modelList, err = om.rds.GetOrdersForMiner(protocol.Hex(), tokenS.Hex(), tokenB.Hex(), length, filterStatus, startBlockNumber, endBlockNumber); err != nil {
-		return list
-	}
+	// 从内存中的orderbook获取订单，与数据库中miner_block_mark的过滤条件一致
+	key := orderBookKey{protocol: protocol, tokenS: tokenS, tokenB: tokenB}
+	states := om.book.orders(key, 0, length, func(entry *orderBookEntry) bool {
+		return entry.model.MinerBlockMark >= startBlockNumber && entry.model.MinerBlockMark <= endBlockNumber
+	})
 
-	for _, v := range modelList {
-		state := &types.OrderState{}
-		v.ConvertUp(state)
+	for _, state := range states {
 		if om.um.InWhiteList(state.RawOrder.Owner) {
 			list = append(list, state)
 		} else {
@@ -345,29 +459,23 @@ func (om *OrderManagerImpl) MinerOrders(protocol, tokenS, tokenB common.Address,
 	return list
 }
 
-func (om *OrderManagerImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]types.OrderState, error) {
+// GetOrderBook 从内存中的orderbook按照价格从优到差分页获取订单
+func (om *OrderManagerImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, offset, length int) ([]types.OrderState, error) {
 	var list []types.OrderState
-	models, err := om.rds.GetOrderBook(protocol, tokenS, tokenB, length)
-	if err != nil {
-		return list, err
-	}
 
-	for _, v := range models {
-		var state types.OrderState
-		if err := v.ConvertUp(&state); err != nil {
-			continue
-		}
-		list = append(list, state)
+	key := orderBookKey{protocol: protocol, tokenS: tokenS, tokenB: tokenB}
+	for _, state := range om.book.orders(key, offset, length, nil) {
+		list = append(list, *state)
 	}
 
 	return list, nil
 }
 
-func (om *OrderManagerImpl) GetOrders(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error) {
+func (om *OrderManagerImpl) GetOrders(query map[string]interface{}, options *dao.OrderQueryOptions, pageIndex, pageSize int) (dao.PageResult, error) {
 	var (
 		pageRes dao.PageResult
 	)
-	tmp, err := om.rds.OrderPageQuery(query, pageIndex, pageSize)
+	tmp, err := om.rds.OrderPageQuery(query, options, pageIndex, pageSize)
 
 	if err != nil {
 		return pageRes, err
@@ -375,6 +483,7 @@ func (om *OrderManagerImpl) GetOrders(query map[string]interface{}, pageIndex, p
 	pageRes.PageIndex = tmp.PageIndex
 	pageRes.PageSize = tmp.PageSize
 	pageRes.Total = tmp.Total
+	pageRes.NextCursor = tmp.NextCursor
 
 	for _, v := range tmp.Data {
 		var state types.OrderState
@@ -402,6 +511,29 @@ func (om *OrderManagerImpl) GetOrderByHash(hash common.Hash) (orderState *types.
 	return &result, nil
 }
 
+func (om *OrderManagerImpl) GetOrdersByHashes(hashes []common.Hash) (map[common.Hash]*types.OrderState, error) {
+	orderhashs := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		orderhashs = append(orderhashs, hash.Hex())
+	}
+
+	ret := make(map[common.Hash]*types.OrderState)
+	orders, err := om.rds.GetOrdersByHash(orderhashs)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, order := range orders {
+		state := &types.OrderState{}
+		if err := order.ConvertUp(state); err != nil {
+			return ret, err
+		}
+		ret[state.RawOrder.Hash] = state
+	}
+
+	return ret, nil
+}
+
 func (om *OrderManagerImpl) UpdateBroadcastTimeByHash(hash common.Hash, bt int) error {
 	return om.rds.UpdateBroadcastTimeByHash(hash.Hex(), bt)
 }
@@ -410,10 +542,22 @@ func (om *OrderManagerImpl) FillsPageQuery(query map[string]interface{}, pageInd
 	return om.rds.FillsPageQuery(query, pageIndex, pageSize)
 }
 
+func (om *OrderManagerImpl) GetTradeHistory(query TradeHistoryQuery, pageIndex, pageSize int) (dao.PageResult, error) {
+	return QueryTradeHistory(om.rds, query, pageIndex, pageSize)
+}
+
 func (om *OrderManagerImpl) RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (result dao.PageResult, err error) {
 	return om.rds.RingMinedPageQuery(query, pageIndex, pageSize)
 }
 
+func (om *OrderManagerImpl) RingSubmitInfoPageQuery(query map[string]interface{}, statusSet []types.RingSubmitStatus, start, end int64, pageIndex, pageSize int) (dao.PageResult, error) {
+	return om.rds.RingSubmitInfoPageQuery(query, statusSet, start, end, pageIndex, pageSize)
+}
+
+func (om *OrderManagerImpl) RingSubmitInfosWithUsedGas(protocol string, start, end int64) ([]dao.RingSubmitInfo, error) {
+	return om.rds.RingSubmitInfosWithUsedGas(protocol, start, end)
+}
+
 func (om *OrderManagerImpl) IsOrderCutoff(protocol, owner common.Address, createTime *big.Int) bool {
 	return om.cutoffCache.IsOrderCutoff(protocol, owner, createTime)
 }
@@ -461,3 +605,9 @@ func (om *OrderManagerImpl) GetFrozenLRCFee(owner common.Address, statusSet []ty
 
 	return totalAmount, nil
 }
+
+// GetOpenOrderCount 返回owner未过期并且未完全成交的订单数量
+func (om *OrderManagerImpl) GetOpenOrderCount(owner common.Address) (int, error) {
+	statusSet := []types.OrderStatus{types.ORDER_NEW, types.ORDER_PARTIAL}
+	return om.rds.CountOrdersByOwner(owner, statusSet)
+}
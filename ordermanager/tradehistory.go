@@ -0,0 +1,277 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"strings"
+)
+
+const (
+	TradeSideBuy  = "buy"
+	TradeSideSell = "sell"
+
+	// 成交价格保留的小数位数
+	tradePricePrecision = 10
+)
+
+type TradeHistoryQuery struct {
+	Owner  string
+	Market string
+	Start  int64 // fill的create_time，为0时不限制
+	End    int64
+}
+
+// Trade 一次fill以及对应订单的信息，数量都已经按照token的decimals转换
+type Trade struct {
+	RingHash    string `json:"ringHash"`
+	RingIndex   int64  `json:"ringIndex"`
+	TxHash      string `json:"txHash"`
+	BlockNumber int64  `json:"blockNumber"`
+	CreateTime  int64  `json:"createTime"`
+	OrderHash   string `json:"orderHash"`
+	Owner       string `json:"owner"`
+	Market      string `json:"market"`
+	Side        string `json:"side"` // 相对于market中的第一个token
+	TokenS      string `json:"tokenS"`
+	TokenB      string `json:"tokenB"`
+	AmountS     string `json:"amountS"`
+	AmountB     string `json:"amountB"`
+	Price       string `json:"price"`      // 成交价格，单位与market一致，token未知时为空
+	OrderPrice  string `json:"orderPrice"` // 订单的限价，订单不存在时为空
+	FeeToken    string `json:"feeToken"`   // 支付lrcFee时为LRC，分润时为tokenS或tokenB
+	Fee         string `json:"fee"`
+	LrcFee      string `json:"lrcFee"`
+	SplitS      string `json:"splitS"`
+	SplitB      string `json:"splitB"`
+	LrcReward   string `json:"lrcReward"`
+	LegalValue  string `json:"legalValue"` // 成交时的法币价值，币种与market_cap中的currency一致
+}
+
+// QueryTradeHistory 分页查询fill并关联订单，relay的jsonrpc以及导出命令共用
+func QueryTradeHistory(rds dao.RdsService, query TradeHistoryQuery, pageIndex, pageSize int) (dao.PageResult, error) {
+	if pageIndex <= 0 {
+		pageIndex = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+
+	res, err := rds.FillsPageQueryByTime(query.fillQuery(), query.Start, query.End, pageIndex, pageSize)
+	if err != nil {
+		return res, err
+	}
+
+	fills := make([]dao.FillEvent, 0, len(res.Data))
+	for _, v := range res.Data {
+		fills = append(fills, v.(dao.FillEvent))
+	}
+	trades, err := NewTrades(rds, fills)
+	if err != nil {
+		return res, err
+	}
+
+	data := make([]interface{}, 0, len(trades))
+	for _, trade := range trades {
+		data = append(data, trade)
+	}
+	res.Data = data
+
+	return res, nil
+}
+
+// ExportTradeHistory 按照fill的id升序遍历所有满足条件的成交，只包含开始时已经存在的fill，
+// 使用上一批最后的id作为条件，导出期间新增的fill不会导致重复或者遗漏
+func ExportTradeHistory(rds dao.RdsService, query TradeHistoryQuery, batchSize int, handle func(trades []Trade) error) error {
+	maxID, err := rds.MaxFillID()
+	if err != nil {
+		return err
+	}
+
+	fillQuery := query.fillQuery()
+	lastID := 0
+	for {
+		fills, err := rds.FillsAfterID(fillQuery, query.Start, query.End, lastID, maxID, batchSize)
+		if err != nil || len(fills) == 0 {
+			return err
+		}
+		trades, err := NewTrades(rds, fills)
+		if err != nil {
+			return err
+		}
+		if err = handle(trades); err != nil {
+			return err
+		}
+		if len(fills) < batchSize {
+			return nil
+		}
+		lastID = fills[len(fills)-1].ID
+	}
+}
+
+func (query TradeHistoryQuery) fillQuery() map[string]interface{} {
+	fillQuery := make(map[string]interface{})
+	if query.Owner != "" {
+		fillQuery["owner"] = common.HexToAddress(query.Owner).Hex()
+	}
+	if query.Market != "" {
+		fillQuery["market"] = strings.ToUpper(query.Market)
+	}
+	return fillQuery
+}
+
+// NewTrades 关联fill对应的订单，按照fill的顺序返回，只有查询订单失败时返回错误
+func NewTrades(rds dao.RdsService, fills []dao.FillEvent) ([]Trade, error) {
+	var orderHashes []string
+	for _, fill := range fills {
+		orderHashes = append(orderHashes, fill.OrderHash)
+	}
+	orders := make(map[string]dao.Order)
+	if len(orderHashes) > 0 {
+		var err error
+		if orders, err = rds.GetOrdersByHash(orderHashes); err != nil {
+			return nil, err
+		}
+	}
+
+	trades := make([]Trade, 0, len(fills))
+	for i := range fills {
+		var order *dao.Order
+		if o, ok := orders[fills[i].OrderHash]; ok {
+			order = &o
+		}
+		trades = append(trades, *NewTrade(&fills[i], order))
+	}
+	return trades, nil
+}
+
+// NewTrade token不在AllTokens中或者decimals未知时，symbol为token地址，数量为未转换的原始数量，价格为空
+func NewTrade(fill *dao.FillEvent, order *dao.Order) *Trade {
+	tokenS, knownS := tradeToken(fill.TokenS)
+	tokenB, knownB := tradeToken(fill.TokenB)
+
+	trade := &Trade{}
+	trade.RingHash = fill.RingHash
+	trade.RingIndex = fill.RingIndex
+	trade.TxHash = fill.TxHash
+	trade.BlockNumber = fill.BlockNumber
+	trade.CreateTime = fill.CreateTime
+	trade.OrderHash = fill.OrderHash
+	trade.Owner = fill.Owner
+	trade.Market = fill.Market
+	trade.TokenS = tokenS.Symbol
+	trade.TokenB = tokenB.Symbol
+	trade.LegalValue = fill.LegalValue
+
+	amountS := tokenAmount(fill.AmountS, tokenS)
+	amountB := tokenAmount(fill.AmountB, tokenB)
+	trade.AmountS = formatTokenAmount(amountS, tokenS)
+	trade.AmountB = formatTokenAmount(amountB, tokenB)
+	trade.SplitS = formatTokenAmount(tokenAmount(fill.SplitS, tokenS), tokenS)
+	trade.SplitB = formatTokenAmount(tokenAmount(fill.SplitB, tokenB), tokenB)
+
+	lrc, lrcErr := util.AddressToToken(util.AliasToAddress("LRC"))
+	if lrcErr == nil && lrc.Decimals != nil {
+		trade.LrcFee = formatTokenAmount(tokenAmount(fill.LrcFee, lrc), lrc)
+		trade.LrcReward = formatTokenAmount(tokenAmount(fill.LrcReward, lrc), lrc)
+	}
+
+	// 卖单卖出market中的第一个token，价格为每个该token成交的另一个token的数量，
+	// tokenS未知时根据tokenB判断方向
+	base, _ := util.UnWrap(fill.Market)
+	var price *big.Rat
+	if tokenS.Symbol == base || (knownB && tokenB.Symbol != base) {
+		trade.Side = TradeSideSell
+		if amountS.Sign() > 0 {
+			price = new(big.Rat).Quo(amountB, amountS)
+		}
+	} else {
+		trade.Side = TradeSideBuy
+		if amountB.Sign() > 0 {
+			price = new(big.Rat).Quo(amountS, amountB)
+		}
+	}
+	// 原始数量计算的价格没有意义
+	if !knownS || !knownB {
+		price = nil
+	}
+	if price != nil {
+		trade.Price = price.FloatString(tradePricePrecision)
+	}
+
+	if order != nil && knownS && knownB {
+		orderAmountS := tokenAmount(order.AmountS, tokenS)
+		orderAmountB := tokenAmount(order.AmountB, tokenB)
+		if trade.Side == TradeSideSell && orderAmountS.Sign() > 0 {
+			trade.OrderPrice = new(big.Rat).Quo(orderAmountB, orderAmountS).FloatString(tradePricePrecision)
+		} else if trade.Side == TradeSideBuy && orderAmountB.Sign() > 0 {
+			trade.OrderPrice = new(big.Rat).Quo(orderAmountS, orderAmountB).FloatString(tradePricePrecision)
+		}
+	}
+
+	// 每次撮合订单要么支付lrcFee，要么按照marginSplitPercentage分润
+	switch {
+	case isPositive(fill.LrcFee):
+		trade.FeeToken = "LRC"
+		trade.Fee = trade.LrcFee
+	case isPositive(fill.SplitS):
+		trade.FeeToken = tokenS.Symbol
+		trade.Fee = trade.SplitS
+	case isPositive(fill.SplitB):
+		trade.FeeToken = tokenB.Symbol
+		trade.Fee = trade.SplitB
+	default:
+		trade.Fee = "0"
+	}
+
+	return trade
+}
+
+// tradeToken 未知的token使用地址作为symbol，decimals为1，数量不做转换
+func tradeToken(address string) (*types.Token, bool) {
+	token, err := util.AddressToToken(common.HexToAddress(address))
+	if err != nil || token.Decimals == nil || token.Decimals.Sign() <= 0 {
+		log.Debugf("order manager,trade of unknown token %s", address)
+		return &types.Token{Protocol: common.HexToAddress(address), Symbol: common.HexToAddress(address).Hex(), Decimals: big.NewInt(1)}, false
+	}
+	return token, true
+}
+
+func tokenAmount(amount string, token *types.Token) *big.Rat {
+	value, ok := new(big.Int).SetString(amount, 0)
+	if !ok {
+		return new(big.Rat)
+	}
+	return new(big.Rat).SetFrac(value, token.Decimals)
+}
+
+// formatTokenAmount 保留token decimals对应的全部小数位，不损失精度
+func formatTokenAmount(amount *big.Rat, token *types.Token) string {
+	return amount.FloatString(len(token.Decimals.String()) - 1)
+}
+
+func isPositive(amount string) bool {
+	value, ok := new(big.Int).SetString(amount, 0)
+	return ok && value.Sign() > 0
+}
@@ -0,0 +1,78 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+	"math/big"
+	"testing"
+)
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+func setTradeTestTokens() {
+	util.AllTokens = map[string]types.Token{
+		"LRC":  {Protocol: testTokenS, Symbol: "LRC", Decimals: big.NewInt(1e18)},
+		"WETH": {Protocol: testTokenB, Symbol: "WETH", Decimals: big.NewInt(1e18)},
+	}
+}
+
+func TestNewTrade(t *testing.T) {
+	setTradeTestTokens()
+
+	fill := &dao.FillEvent{Market: "LRC-WETH", TokenS: testTokenS.Hex(), TokenB: testTokenB.Hex(), AmountS: "2000000000000000000", AmountB: "1000000000000000", LrcFee: "0", SplitS: "0", SplitB: "0"}
+	trade := NewTrade(fill, nil)
+	if trade.Side != TradeSideSell || trade.TokenS != "LRC" || trade.TokenB != "WETH" {
+		t.Errorf("got side %s tokenS %s tokenB %s", trade.Side, trade.TokenS, trade.TokenB)
+	}
+	if trade.AmountS != "2.000000000000000000" || trade.Price != "0.0005000000" || trade.Fee != "0" {
+		t.Errorf("got amountS %s price %s fee %s", trade.AmountS, trade.Price, trade.Fee)
+	}
+}
+
+func TestNewTradeUnknownToken(t *testing.T) {
+	setTradeTestTokens()
+
+	unknown := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	fill := &dao.FillEvent{Market: "FOO-WETH", TokenS: unknown.Hex(), TokenB: testTokenB.Hex(), AmountS: "123", AmountB: "1000000000000000000", LrcFee: "0", SplitS: "5", SplitB: "0"}
+	order := &dao.Order{AmountS: "246", AmountB: "2000000000000000000"}
+	trade := NewTrade(fill, order)
+	if trade.TokenS != unknown.Hex() || trade.AmountS != "123" || trade.AmountB != "1.000000000000000000" {
+		t.Errorf("got tokenS %s amountS %s amountB %s", trade.TokenS, trade.AmountS, trade.AmountB)
+	}
+	if trade.Side != TradeSideSell || trade.Price != "" || trade.OrderPrice != "" {
+		t.Errorf("got side %s price %s orderPrice %s", trade.Side, trade.Price, trade.OrderPrice)
+	}
+	if trade.FeeToken != unknown.Hex() || trade.Fee != "5" {
+		t.Errorf("got fee %s %s", trade.Fee, trade.FeeToken)
+	}
+
+	fill = &dao.FillEvent{Market: "FOO-WETH", TokenS: testTokenB.Hex(), TokenB: unknown.Hex(), AmountS: "1000000000000000000", AmountB: "123", LrcFee: "0", SplitS: "0", SplitB: "0"}
+	if trade = NewTrade(fill, nil); trade.Side != TradeSideBuy || trade.Price != "" {
+		t.Errorf("got side %s price %s", trade.Side, trade.Price)
+	}
+}
@@ -145,6 +145,13 @@ type CutoffEvent struct {
 	Cutoff          *big.Int
 }
 
+// OrdersCutoffEvent ordermanager处理CutoffEvent时更新为ORDER_CUTOFF的订单
+type OrdersCutoffEvent struct {
+	Owner       common.Address
+	Cutoff      *big.Int
+	OrderHashes []common.Hash
+}
+
 type RingMinedEvent struct {
 	RingIndex          *big.Int
 	Time               *big.Int
@@ -34,6 +34,7 @@ const (
 	ORDER_FINISHED
 	ORDER_CANCEL
 	ORDER_CUTOFF
+	ORDER_EXPIRED
 )
 
 //订单原始信息
@@ -256,6 +257,11 @@ type OrderDelayList struct {
 	DelayedCount int64
 }
 
+// IsExpired 订单的有效期为[timestamp, timestamp+ttl)
+func (o *Order) IsExpired(now int64) bool {
+	return new(big.Int).Add(o.Timestamp, o.Ttl).Cmp(big.NewInt(now)) <= 0
+}
+
 // 根据是否完全成交确定订单状态
 func (ord *OrderState) SettleFinishedStatus(isFullFinished bool) {
 	if isFullFinished {
@@ -32,3 +32,16 @@ func TestOrder_GeneratePrice(t *testing.T) {
 
 	t.Log(ord.Price.String())
 }
+
+func TestOrder_IsExpired(t *testing.T) {
+	ord := types.Order{}
+	ord.Timestamp = big.NewInt(1000)
+	ord.Ttl = big.NewInt(100)
+
+	if ord.IsExpired(1099) {
+		t.Errorf("order should be valid before timestamp+ttl")
+	}
+	if !ord.IsExpired(1100) {
+		t.Errorf("order should be expired at timestamp+ttl")
+	}
+}
@@ -140,6 +140,18 @@ func (ring *Ring) GenerateSubmitArgs(miner common.Address, feeReceipt common.Add
 //	FeeMode        int      `json:"feeMode"`     //收费方式，0 lrc 1 share
 //}
 
+type RingSubmitStatus uint8
+
+// 环路提交的状态，pending为已经保存还未注册或者提交，registered为ringhash已经注册成功
+const (
+	RING_SUBMIT_UNKNOWN RingSubmitStatus = iota
+	RING_SUBMIT_PENDING
+	RING_SUBMIT_REGISTERED
+	RING_SUBMIT_SUBMITTED
+	RING_SUBMIT_MINED
+	RING_SUBMIT_FAILED
+)
+
 type RingSubmitInfo struct {
 	RawRing *Ring
 